@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const accountFile = "account.json"
+
+// Account is what Apple Music reports about the account the
+// media-user-token belongs to. Subscription is "active", "inactive" or
+// "unknown" when Apple Music didn't say; it tells nothing of the plan.
+type Account struct {
+	Storefront   string    `json:"storefront"`
+	Subscription string    `json:"subscription"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// AccountReport is returned by GET /admin/account
+type AccountReport struct {
+	Account
+	ConfiguredStorefront string   `json:"configured_storefront,omitempty"`
+	DefaultStorefront    string   `json:"default_storefront"`
+	Warnings             []string `json:"warnings"`
+}
+
+// AccountStore keeps the account last detected from the credentials,
+// persisted in the state directory
+type AccountStore struct {
+	mu      sync.Mutex
+	account *Account
+}
+
+var accountStore = &AccountStore{}
+
+func (s *AccountStore) load() error {
+	var account *Account
+	if err := loadState(accountFile, &account); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.account = account
+	return nil
+}
+
+func (s *AccountStore) get() *Account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.account
+}
+
+func (s *AccountStore) set(account *Account) {
+	s.mu.Lock()
+	changed := s.account == nil || s.account.Storefront != account.Storefront || s.account.Subscription != account.Subscription
+	s.account = account
+	s.mu.Unlock()
+
+	if changed {
+		slog.Info("Apple Music account", "storefront", account.Storefront, "subscription", account.Subscription)
+	}
+	if err := saveState(accountFile, account); err != nil {
+		slog.Error("Failed to save account", "error", err)
+	}
+}
+
+// fetchAccount asks Apple Music about the account of userToken. The status
+// is that of Apple Music's response, for telling rejected tokens apart.
+func fetchAccount(ctx context.Context, developerToken, userToken string) (int, *Account, error) {
+	status, body, err := appleMusicStatus(ctx, "/me/account?meta=subscription", developerToken, userToken)
+	if err != nil || status != http.StatusOK {
+		return status, nil, err
+	}
+	var result struct {
+		Meta struct {
+			Subscription *struct {
+				Active     bool   `json:"active"`
+				Storefront string `json:"storefront"`
+			} `json:"subscription"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return status, nil, fmt.Errorf("failed to parse account: %w", err)
+	}
+
+	account := &Account{Subscription: "unknown", CheckedAt: time.Now()}
+	if sub := result.Meta.Subscription; sub != nil {
+		account.Storefront = sub.Storefront
+		account.Subscription = "inactive"
+		if sub.Active {
+			account.Subscription = "active"
+		}
+	}
+	if account.Storefront == "" {
+		status, body, err := appleMusicStatus(ctx, "/me/storefront", developerToken, userToken)
+		if err != nil || status != http.StatusOK {
+			return status, nil, err
+		}
+		var storefronts struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(body, &storefronts) == nil && len(storefronts.Data) > 0 {
+			account.Storefront = storefronts.Data[0].ID
+		}
+	}
+	return status, account, nil
+}
+
+// detectAccount looks up the account of the configured credentials and
+// remembers it
+func detectAccount(ctx context.Context) (*Account, error) {
+	creds, err := configuredCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.MediaUserToken == "" {
+		return nil, errors.New("no media-user-token is configured")
+	}
+	developerToken := creds.AuthorizationToken
+	if developerToken == "" {
+		if developerToken, err = appleMusic.developerToken(false); err != nil {
+			return nil, err
+		}
+	}
+
+	status, account, err := fetchAccount(ctx, developerToken, creds.MediaUserToken)
+	switch {
+	case err != nil:
+		return nil, err
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return nil, errors.New("Apple Music rejected the media-user-token")
+	case account == nil:
+		return nil, fmt.Errorf("Apple Music returned %d", status)
+	}
+	accountStore.set(account)
+	return account, nil
+}
+
+// storefrontWarning describes why a link is likely to fail for the account,
+// or returns "" when the account is unknown or the link is in its
+// storefront
+func storefrontWarning(rawURL string) string {
+	account := accountStore.get()
+	if account == nil || account.Storefront == "" {
+		return ""
+	}
+	link, err := parseAppleMusicURL(rawURL)
+	if err != nil || link.Storefront == account.Storefront {
+		return ""
+	}
+	return fmt.Sprintf("The link is from the %s storefront, but the account is in %s; content outside the account's storefront usually fails to download", link.Storefront, account.Storefront)
+}
+
+// handleAccount serves GET /admin/account, the account the credentials
+// belong to. It's looked up with Apple Music when unknown or with
+// ?refresh=true, and otherwise as detected when credentials were last
+// checked or uploaded.
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := accountStore.get()
+	if account == nil || r.URL.Query().Get("refresh") == "true" {
+		ctx, cancel := context.WithTimeout(r.Context(), integrationTestTimeout)
+		defer cancel()
+		var err error
+		if account, err = detectAccount(ctx); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to look up the Apple Music account", "error", err)
+			http.Error(w, fmt.Sprintf("Account lookup failed: %v", err), http.StatusBadGateway)
+			return
+		}
+	}
+
+	report := AccountReport{Account: *account, DefaultStorefront: cfg.Storefront, Warnings: []string{}}
+	if creds, err := configuredCredentials(); err == nil {
+		report.ConfiguredStorefront = creds.Storefront
+	}
+	if report.ConfiguredStorefront != "" && report.ConfiguredStorefront != account.Storefront {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("The downloader config sets storefront %s, but the account is in %s", report.ConfiguredStorefront, account.Storefront))
+	}
+	if cfg.Storefront != account.Storefront {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("STOREFRONT is %s, so links without a storefront are downloaded from it, but the account is in %s", cfg.Storefront, account.Storefront))
+	}
+	if account.Subscription == "inactive" {
+		report.Warnings = append(report.Warnings, "The account has no active Apple Music subscription; downloads will fail")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const appleMusicAPI = "https://amp-api.music.apple.com/v1"
+
+var errCatalogNotFound = errors.New("not found in catalog")
+
+// AppleMusicURL is a parsed music.apple.com link
+type AppleMusicURL struct {
+	Storefront string `json:"storefront"`
+	Type       string `json:"type"` // album, song, playlist, artist or music-video
+	ID         string `json:"id"`
+	SongID     string `json:"song_id,omitempty"` // set for album links to a single track (?i=)
+}
+
+// appleMusicLinkPattern finds Apple Music links in free text
+var appleMusicLinkPattern = regexp.MustCompile(`https://music\.apple\.com/[^\s"'<>()\[\]]+`)
+
+// findAppleMusicLinks returns the distinct Apple Music links in text, without
+// trailing punctuation
+func findAppleMusicLinks(text string) []string {
+	var links []string
+	for _, link := range appleMusicLinkPattern.FindAllString(text, -1) {
+		link = strings.TrimRight(link, ".,;:!?")
+		if !slices.Contains(links, link) {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// parseAppleMusicURL extracts the storefront, content type and ID from links
+// like https://music.apple.com/us/album/name/1443732441?i=1443732453
+func parseAppleMusicURL(raw string) (AppleMusicURL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return AppleMusicURL{}, err
+	}
+	if u.Host != "music.apple.com" {
+		return AppleMusicURL{}, fmt.Errorf("not a music.apple.com link")
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 3 {
+		return AppleMusicURL{}, fmt.Errorf("unrecognized Apple Music link")
+	}
+
+	parsed := AppleMusicURL{
+		Storefront: parts[0],
+		Type:       parts[1],
+		ID:         parts[len(parts)-1],
+		SongID:     u.Query().Get("i"),
+	}
+	return parsed, nil
+}
+
+// Content types the downloader can fetch
+var downloadableTypes = []string{"album", "song", "playlist", "artist", "music-video"}
+
+// Hosts of links to music.apple.com pages: share links, embeds and old
+// iTunes links
+var appleMusicHosts = []string{"music.apple.com", "beta.music.apple.com", "geo.music.apple.com", "embed.music.apple.com", "itunes.apple.com"}
+
+var (
+	storefrontPattern = regexp.MustCompile(`^[a-zA-Z]{2}$`)
+	iTunesIDPattern   = regexp.MustCompile(`^id[0-9]+$`)
+)
+
+// LinkError is why a download URL can't be downloaded
+type LinkError struct {
+	Reason string
+}
+
+func (e *LinkError) Error() string { return e.Reason }
+
+// ContentType is what the link points at, counting album links to a single
+// track as songs
+func (link AppleMusicURL) ContentType() string {
+	if link.Type == "album" && link.SongID != "" {
+		return "song"
+	}
+	return link.Type
+}
+
+// normalizeAppleMusicURL checks that raw is a link to downloadable Apple
+// Music content and rewrites it to its canonical form: https, the
+// music.apple.com host, a lowercase storefront (STOREFRONT when the link has
+// none), IDs without the "id" prefix of iTunes links and no query
+// parameters but ?i=, dropping the page language (?l=) and share tracking
+func normalizeAppleMusicURL(raw string) (string, AppleMusicURL, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", AppleMusicURL{}, &LinkError{"URL must be a music.apple.com link"}
+	}
+	if !slices.Contains(appleMusicHosts, strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")) {
+		return "", AppleMusicURL{}, &LinkError{"URL must be a music.apple.com link"}
+	}
+
+	var parts []string
+	for part := range strings.SplitSeq(u.Path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 0 && !storefrontPattern.MatchString(parts[0]) {
+		parts = append([]string{cfg.Storefront}, parts...)
+	}
+	if len(parts) < 3 {
+		return "", AppleMusicURL{}, &LinkError{"URL doesn't link to an album, song, playlist or artist"}
+	}
+	parts[0] = strings.ToLower(parts[0])
+	if last := parts[len(parts)-1]; iTunesIDPattern.MatchString(last) {
+		parts[len(parts)-1] = last[len("id"):]
+	}
+	if !slices.Contains(downloadableTypes, parts[1]) {
+		return "", AppleMusicURL{}, &LinkError{fmt.Sprintf("Unsupported content type %q; must be album, song, playlist, artist or music-video", parts[1])}
+	}
+
+	normalized := url.URL{Scheme: "https", Host: "music.apple.com", Path: "/" + strings.Join(parts, "/")}
+	if song := u.Query().Get("i"); song != "" {
+		normalized.RawQuery = url.Values{"i": {song}}.Encode()
+	}
+	link, err := parseAppleMusicURL(normalized.String())
+	if err != nil {
+		return "", AppleMusicURL{}, &LinkError{err.Error()}
+	}
+	return normalized.String(), link, nil
+}
+
+// catalogResource is the subset of Apple Music API resources the wrapper reads
+type catalogResource struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Name             string         `json:"name"`
+		ArtistName       string         `json:"artistName"`
+		CuratorName      string         `json:"curatorName"`
+		AlbumName        string         `json:"albumName"`
+		TrackCount       int            `json:"trackCount"`
+		TrackNumber      int            `json:"trackNumber"`
+		DiscNumber       int            `json:"discNumber"`
+		DurationInMillis int64          `json:"durationInMillis"`
+		ReleaseDate      string         `json:"releaseDate"`
+		ContentRating    string         `json:"contentRating"`
+		IsCompilation    bool           `json:"isCompilation"`
+		ComposerName     string         `json:"composerName"`
+		WorkName         string         `json:"workName"`
+		MovementName     string         `json:"movementName"`
+		MovementNumber   int            `json:"movementNumber"`
+		MovementCount    int            `json:"movementCount"`
+		AudioTraits      []string       `json:"audioTraits"`
+		URL              string         `json:"url"`
+		PlayParams       map[string]any `json:"playParams"`
+		Artwork          struct {
+			URL string `json:"url"` // template with {w} and {h}
+		} `json:"artwork"`
+	} `json:"attributes"`
+	Relationships struct {
+		Tracks struct {
+			Data []catalogResource `json:"data"`
+			Next string            `json:"next"`
+		} `json:"tracks"`
+	} `json:"relationships"`
+	Views map[string]struct {
+		Data []catalogResource `json:"data"`
+	} `json:"views"`
+}
+
+// AppleMusicClient reads the public catalog with a developer token, either
+// configured or scraped from the music.apple.com web player
+type AppleMusicClient struct {
+	mu    sync.Mutex
+	token string
+}
+
+var appleMusic = &AppleMusicClient{}
+
+var (
+	webPlayerScriptPattern = regexp.MustCompile(`/assets/index[~-][A-Za-z0-9_-]+\.js`)
+	developerTokenPattern  = regexp.MustCompile(`eyJh[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+)
+
+func (c *AppleMusicClient) developerToken(refresh bool) (string, error) {
+	if cfg.AppleMusicToken != "" {
+		return cfg.AppleMusicToken, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && !refresh {
+		return c.token, nil
+	}
+
+	page, err := fetchText("https://music.apple.com/us/browse")
+	if err != nil {
+		return "", fmt.Errorf("failed to load web player: %w", err)
+	}
+	script := webPlayerScriptPattern.FindString(page)
+	if script == "" {
+		return "", errors.New("web player script not found")
+	}
+	js, err := fetchText("https://music.apple.com" + script)
+	if err != nil {
+		return "", fmt.Errorf("failed to load web player script: %w", err)
+	}
+	token := developerTokenPattern.FindString(js)
+	if token == "" {
+		return "", errors.New("developer token not found in web player script")
+	}
+
+	c.token = token
+	return token, nil
+}
+
+// useToken makes the client use a developer token that was just verified,
+// unless APPLE_MUSIC_TOKEN pins one
+func (c *AppleMusicClient) useToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+func fetchText(url string) (string, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	return string(body), err
+}
+
+// get fetches a catalog path such as "/catalog/us/albums/123" and decodes
+// the response into v, refreshing a scraped token once if it was rejected
+func (c *AppleMusicClient) get(path string, params url.Values, v any) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		token, err := c.developerToken(attempt > 0)
+		if err != nil {
+			return err
+		}
+
+		endpoint := appleMusicAPI + path
+		if len(params) > 0 {
+			endpoint += "?" + params.Encode()
+		}
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Origin", "https://music.apple.com")
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			defer resp.Body.Close()
+			return json.NewDecoder(resp.Body).Decode(v)
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return errCatalogNotFound
+		case http.StatusUnauthorized:
+			resp.Body.Close()
+			if cfg.AppleMusicToken != "" {
+				return errors.New("apple music rejected the configured developer token")
+			}
+			continue
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("apple music api returned %s", resp.Status)
+		}
+	}
+	return errors.New("apple music rejected the developer token")
+}
+
+// Resource fetches an album, song, playlist or music video with its tracks.
+// Tracks of long playlists are followed across pages.
+func (c *AppleMusicClient) Resource(storefront, kind, id, language string) (*catalogResource, error) {
+	collection := map[string]string{
+		"album":       "albums",
+		"song":        "songs",
+		"playlist":    "playlists",
+		"music-video": "music-videos",
+		"artist":      "artists",
+	}[kind]
+	if collection == "" {
+		return nil, fmt.Errorf("unsupported content type %q", kind)
+	}
+
+	params := url.Values{}
+	if kind == "album" || kind == "playlist" {
+		params.Set("include", "tracks")
+	}
+	if language != "" {
+		params.Set("l", language)
+	}
+
+	var result struct {
+		Data []catalogResource `json:"data"`
+	}
+	if err := c.get(fmt.Sprintf("/catalog/%s/%s/%s", storefront, collection, id), params, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, errCatalogNotFound
+	}
+
+	resource := &result.Data[0]
+	for next := resource.Relationships.Tracks.Next; next != ""; {
+		var page struct {
+			Data []catalogResource `json:"data"`
+			Next string            `json:"next"`
+		}
+		path, query, _ := strings.Cut(strings.TrimPrefix(next, "/v1"), "?")
+		pageParams, _ := url.ParseQuery(query)
+		if language != "" {
+			pageParams.Set("l", language)
+		}
+		if err := c.get(path, pageParams, &page); err != nil {
+			return nil, err
+		}
+		resource.Relationships.Tracks.Data = append(resource.Relationships.Tracks.Data, page.Data...)
+		next = page.Next
+	}
+
+	return resource, nil
+}
+
+// OtherVersions returns the other editions of an album, e.g. its deluxe or
+// clean versions
+func (c *AppleMusicClient) OtherVersions(storefront, id string) ([]catalogResource, error) {
+	var result struct {
+		Data []catalogResource `json:"data"`
+	}
+	path := fmt.Sprintf("/catalog/%s/albums/%s", storefront, id)
+	if err := c.get(path, url.Values{"views": {"other-versions"}}, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, errCatalogNotFound
+	}
+	return result.Data[0].Views["other-versions"].Data, nil
+}
+
+// ArtistAlbums returns an artist's albums, singles and EPs, following pages
+func (c *AppleMusicClient) ArtistAlbums(storefront, id string) ([]catalogResource, error) {
+	var albums []catalogResource
+	path := fmt.Sprintf("/catalog/%s/artists/%s/albums", storefront, id)
+	params := url.Values{"limit": {"100"}}
+	for path != "" {
+		var page struct {
+			Data []catalogResource `json:"data"`
+			Next string            `json:"next"`
+		}
+		if err := c.get(path, params, &page); err != nil {
+			return nil, err
+		}
+		albums = append(albums, page.Data...)
+
+		var query string
+		path, query, _ = strings.Cut(strings.TrimPrefix(page.Next, "/v1"), "?")
+		params, _ = url.ParseQuery(query)
+	}
+	return albums, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Archiving hides finished jobs from GET /jobs without losing them: they
+// still count in statistics and can be fetched, listed with ?archived= and
+// unarchived, until DELETE /jobs purges them. This is unrelated to jobs
+// evicted from memory to the state directory or JOB_DB, which drop out of
+// GET /jobs whether archived or not, but can still be archived by ID.
+
+// archive marks a finished job archived or not, returning whether it
+// changed
+func (job *DownloadStatus) archive(archived bool, now time.Time) bool {
+	if job.Archived == archived {
+		return false
+	}
+	job.Archived = archived
+	event := JobEvent{Time: now, Type: "unarchived"}
+	job.ArchivedAt = nil
+	if archived {
+		event.Type = "archived"
+		job.ArchivedAt = &now
+	}
+	job.Events = append(job.Events, event)
+	return true
+}
+
+// setArchived archives or unarchives finished jobs, whether they're in
+// memory or were evicted from it, returning the IDs of those that changed.
+// Jobs that don't exist or haven't finished are skipped.
+func (jm *JobManager) setArchived(ids []string, archived bool) ([]string, error) {
+	now := time.Now()
+	change := "unarchived"
+	if archived {
+		change = "archived"
+	}
+	changed := []string{}
+	var evicted []string
+
+	jm.mu.Lock()
+	for _, id := range ids {
+		job, exists := jm.jobs[id]
+		if !exists {
+			evicted = append(evicted, id)
+			continue
+		}
+		if job.EndedAt != nil && job.archive(archived, now) {
+			jm.persist(job)
+			jobChanges.record(change, job)
+			changed = append(changed, id)
+		}
+	}
+	if len(changed) > 0 {
+		jm.version.Add(1)
+	}
+	jm.mu.Unlock()
+
+	for _, id := range evicted {
+		job, exists := loadArchivedJob(id)
+		if !exists || job.EndedAt == nil || !job.archive(archived, now) {
+			continue
+		}
+		if jobStore != nil {
+			storeWriter.saveJob(job)
+		} else if err := saveState(archivePath(id), job); err != nil {
+			return changed, fmt.Errorf("job %s: %w", id, err)
+		}
+		jobChanges.record(change, &job)
+		changed = append(changed, id)
+		// Evicted jobs aren't listed, but no cached list outlives a change
+		jm.version.Add(1)
+	}
+	return changed, nil
+}
+
+// handleArchiveJob serves POST /jobs/{id}/archive and /jobs/{id}/unarchive
+func handleArchiveJob(w http.ResponseWriter, r *http.Request, jobID string, archived bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if job.EndedAt == nil {
+		http.Error(w, fmt.Sprintf("Job is %s; only finished jobs can be archived", job.Status), http.StatusConflict)
+		return
+	}
+	if _, err := jobManager.setArchived([]string{jobID}, archived); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to archive job", "job_id", jobID, "error", err)
+		http.Error(w, "Failed to save job", http.StatusInternalServerError)
+		return
+	}
+
+	job, _ = jobManager.Snapshot(jobID)
+	job.Logs = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleArchiveJobs serves POST /jobs/archive, archiving the finished jobs
+// matching the same filters as DELETE /jobs
+func handleArchiveJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseFinishedJobFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids, err := filter.ids()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	archived, err := jobManager.setArchived(ids, true)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to archive jobs", "error", err)
+		http.Error(w, "Failed to save jobs", http.StatusInternalServerError)
+		return
+	}
+	if len(archived) > 0 {
+		slog.InfoContext(r.Context(), "Archived finished jobs by request", "jobs", len(archived))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"archived": len(archived),
+		"job_ids":  archived,
+	})
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const artistWatchesFile = "artist_watches.json"
+
+// Check intervals of artist watches: the default, and the shortest allowed
+// so the catalog isn't polled too often
+const (
+	defaultArtistWatchInterval = 24 * time.Hour
+	minArtistWatchInterval     = time.Hour
+)
+
+// Job IDs remembered per watch
+const maxArtistWatchJobs = 100
+
+// ArtistWatch follows an artist in the catalog and queues a download for
+// every release it hasn't seen. Releases out when the watch was created are
+// only marked as seen unless it was asked to download them too.
+type ArtistWatch struct {
+	ID         string          `json:"id"`
+	URL        string          `json:"url"`
+	Storefront string          `json:"storefront"`
+	ArtistID   string          `json:"artist_id"`
+	ArtistName string          `json:"artist_name,omitempty"`
+	Interval   string          `json:"interval"`
+	Options    DownloadRequest `json:"options"` // for each release's job; url is ignored
+	Owner      string          `json:"owner,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+
+	// Album IDs of the releases seen, and the jobs queued for new ones,
+	// newest last
+	Seen   []string `json:"seen"`
+	JobIDs []string `json:"job_ids"`
+
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+	NextCheckAt   time.Time  `json:"next_check_at"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// artistWatchInput is the body of POST /watch
+type artistWatchInput struct {
+	URL              string          `json:"url"`
+	Interval         string          `json:"interval,omitempty"` // e.g. "12h", 24h when unset
+	Options          DownloadRequest `json:"options"`
+	DownloadExisting bool            `json:"download_existing,omitempty"`
+}
+
+type ArtistWatchStore struct {
+	mu      sync.Mutex
+	watches map[string]*ArtistWatch
+
+	// Serializes checks, so a watch checked on request while the poller
+	// checks it doesn't queue a release twice
+	checkMu sync.Mutex
+}
+
+var artistWatches = &ArtistWatchStore{watches: map[string]*ArtistWatch{}}
+
+var (
+	errArtistWatchNotFound = errors.New("watch not found")
+	errCatalogUnavailable  = errors.New("Apple Music catalog unavailable")
+)
+
+func (s *ArtistWatchStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var saved []ArtistWatch
+	if err := loadState(artistWatchesFile, &saved); err != nil {
+		return err
+	}
+	for _, w := range saved {
+		s.watches[w.ID] = &w
+	}
+	return nil
+}
+
+// save persists the watches; callers hold s.mu
+func (s *ArtistWatchStore) save() error {
+	saved := []ArtistWatch{}
+	for _, w := range s.watches {
+		saved = append(saved, *w)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	return saveState(artistWatchesFile, saved)
+}
+
+func (s *ArtistWatchStore) List() []ArtistWatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []ArtistWatch{}
+	for _, w := range s.watches {
+		list = append(list, w.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (s *ArtistWatchStore) Get(id string) (ArtistWatch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, exists := s.watches[id]
+	if !exists {
+		return ArtistWatch{}, false
+	}
+	return w.clone(), true
+}
+
+func (s *ArtistWatchStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.watches[id]; !exists {
+		return errArtistWatchNotFound
+	}
+	delete(s.watches, id)
+	return s.save()
+}
+
+func (w *ArtistWatch) clone() ArtistWatch {
+	snapshot := *w
+	snapshot.Seen = slices.Clone(w.Seen)
+	snapshot.JobIDs = slices.Clone(w.JobIDs)
+	return snapshot
+}
+
+// Create looks the artist up, records the releases it has and, when asked
+// to, queues them
+func (s *ArtistWatchStore) Create(in artistWatchInput, owner string) (ArtistWatch, error) {
+	link, err := parseAppleMusicURL(in.URL)
+	if err != nil {
+		return ArtistWatch{}, err
+	}
+	if link.Type != "artist" {
+		return ArtistWatch{}, errors.New("url must be an artist link")
+	}
+	interval := defaultArtistWatchInterval
+	if in.Interval != "" {
+		interval, err = time.ParseDuration(in.Interval)
+		if err != nil || interval < minArtistWatchInterval {
+			return ArtistWatch{}, fmt.Errorf("interval must be a duration of at least %v", minArtistWatchInterval)
+		}
+	}
+	if err := in.Options.validateWatchOptions(); err != nil {
+		return ArtistWatch{}, err
+	}
+
+	artist, err := appleMusic.Resource(link.Storefront, "artist", link.ID, "")
+	if errors.Is(err, errCatalogNotFound) {
+		return ArtistWatch{}, errors.New("artist not found in the catalog")
+	}
+	if err != nil {
+		return ArtistWatch{}, fmt.Errorf("%w: artist lookup failed: %v", errCatalogUnavailable, err)
+	}
+
+	w := &ArtistWatch{
+		ID:         uuid.New().String(),
+		URL:        in.URL,
+		Storefront: link.Storefront,
+		ArtistID:   link.ID,
+		ArtistName: artist.Attributes.Name,
+		Interval:   interval.String(),
+		Options:    in.Options,
+		Owner:      owner,
+		CreatedAt:  time.Now(),
+		Seen:       []string{},
+		JobIDs:     []string{},
+	}
+
+	if !in.DownloadExisting {
+		albums, err := appleMusic.ArtistAlbums(link.Storefront, link.ID)
+		if err != nil {
+			return ArtistWatch{}, fmt.Errorf("%w: listing releases failed: %v", errCatalogUnavailable, err)
+		}
+		for _, album := range albums {
+			if released(album) {
+				w.Seen = append(w.Seen, album.ID)
+			}
+		}
+		now := time.Now()
+		w.LastCheckedAt = &now
+		w.NextCheckAt = now.Add(interval)
+	}
+
+	s.mu.Lock()
+	s.watches[w.ID] = w
+	err = s.save()
+	snapshot := w.clone()
+	s.mu.Unlock()
+	if err != nil {
+		return snapshot, err
+	}
+
+	if in.DownloadExisting {
+		return s.check(w.ID)
+	}
+	return snapshot, nil
+}
+
+// validateWatchOptions checks the download options of a watch, which apply
+// to every release rather than to one URL
+func (req *DownloadRequest) validateWatchOptions() error {
+	if req.URL != "" || len(req.URLs) > 0 {
+		return errors.New("options must not include url or urls")
+	}
+	if req.Edition == "ask" {
+		return errors.New("options.edition can't be ask")
+	}
+	if req.scheduled() {
+		return errors.New("options must not include schedule_at or cron")
+	}
+	if err := req.validateOptions(); err != nil {
+		return fmt.Errorf("Invalid options: %w", err)
+	}
+	return nil
+}
+
+// released reports whether an album is out, rather than a pre-release that
+// can't be downloaded yet
+func released(album catalogResource) bool {
+	date, err := time.Parse(time.DateOnly, album.Attributes.ReleaseDate)
+	return err != nil || !date.After(time.Now())
+}
+
+// check lists the artist's releases and queues a job for each one the
+// watch hasn't seen
+func (s *ArtistWatchStore) check(id string) (ArtistWatch, error) {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+
+	w, exists := s.Get(id)
+	if !exists {
+		return ArtistWatch{}, errArtistWatchNotFound
+	}
+	interval, _ := time.ParseDuration(w.Interval)
+
+	albums, listErr := appleMusic.ArtistAlbums(w.Storefront, w.ArtistID)
+	var queued []string
+	var jobIDs []string
+	if listErr == nil {
+		for _, album := range albums {
+			if slices.Contains(w.Seen, album.ID) || !released(album) {
+				continue
+			}
+			jobID, err := w.queue(album)
+			if err != nil {
+				slog.Info("Not downloading release", "watch_id", w.ID, "album", album.Attributes.Name, "reason", err)
+			} else {
+				slog.Info("Queued new release", "watch_id", w.ID, "album", album.Attributes.Name, "artist", w.ArtistName, "job_id", jobID)
+				jobIDs = append(jobIDs, jobID)
+			}
+			queued = append(queued, album.ID)
+		}
+	} else {
+		slog.Error("Failed to list releases", "watch_id", w.ID, "artist", w.ArtistName, "error", listErr)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, exists := s.watches[id]
+	if !exists {
+		return ArtistWatch{}, errArtistWatchNotFound
+	}
+	now := time.Now()
+	stored.LastCheckedAt = &now
+	stored.NextCheckAt = now.Add(interval)
+	stored.LastError = ""
+	if listErr != nil {
+		stored.LastError = listErr.Error()
+	}
+	stored.Seen = append(stored.Seen, queued...)
+	stored.JobIDs = append(stored.JobIDs, jobIDs...)
+	if over := len(stored.JobIDs) - maxArtistWatchJobs; over > 0 {
+		stored.JobIDs = slices.Delete(stored.JobIDs, 0, over)
+	}
+	if err := s.save(); err != nil {
+		slog.Error("Failed to save artist watches", "watch_id", id, "error", err)
+	}
+	return stored.clone(), nil
+}
+
+// queue starts a job downloading album with the watch's options
+func (w *ArtistWatch) queue(album catalogResource) (string, error) {
+	req := w.Options
+	req.URL = album.Attributes.URL
+	if req.URL == "" {
+		req.URL = fmt.Sprintf("https://music.apple.com/%s/album/%s", w.Storefront, album.ID)
+	}
+	if req.Template != "" {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return "", err
+		}
+		if err := applyTemplate(&req, body); err != nil {
+			return "", err
+		}
+	}
+	req.Owner = w.Owner
+	req.Labels = maps.Clone(req.Labels)
+	if req.Labels == nil {
+		req.Labels = Labels{}
+	}
+	if _, set := req.Labels["artist_watch"]; !set {
+		req.Labels["artist_watch"] = w.ID
+	}
+	if err := prepareRequest(&req); err != nil {
+		return "", err
+	}
+	return startDownload(req).ID, nil
+}
+
+// run checks watches as they become due
+func (s *ArtistWatchStore) run() {
+	for {
+		now := time.Now()
+		for _, w := range s.List() {
+			if !w.NextCheckAt.After(now) {
+				s.check(w.ID)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+func writeArtistWatchError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errArtistWatchNotFound):
+		http.Error(w, "Watch not found", http.StatusNotFound)
+	case errors.Is(err, errCatalogUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// handleArtistWatches lists (GET) and creates (POST) artist watches
+func handleArtistWatches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		watches := artistWatches.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"watches": watches,
+			"count":   len(watches),
+		})
+
+	case http.MethodPost:
+		var in artistWatchInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		in.URL = strings.TrimSpace(in.URL)
+		if in.URL == "" {
+			http.Error(w, "URL is required", http.StatusBadRequest)
+			return
+		}
+		watch, err := artistWatches.Create(in, requestOwner(r, "anonymous"))
+		if err != nil {
+			writeArtistWatchError(w, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Watching artist", "watch_id", watch.ID, "artist", watch.ArtistName, "interval", watch.Interval)
+		auditLog.recordRequest(r, AuditEntry{Action: "watch.created", Actor: watch.Owner, URL: watch.URL, Detail: map[string]string{"watch_id": watch.ID}})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(watch)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleArtistWatch serves /watch/{id} (GET, DELETE) and /watch/{id}/check,
+// which checks for new releases right away
+func handleArtistWatch(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(r.URL.Path[len("/watch/"):], "/")
+	if id == "" {
+		http.Error(w, "Watch ID is required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case resource == "" && r.Method == http.MethodGet:
+		watch, exists := artistWatches.Get(id)
+		if !exists {
+			writeArtistWatchError(w, errArtistWatchNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(watch)
+
+	case resource == "" && r.Method == http.MethodDelete:
+		if err := artistWatches.Delete(id); err != nil {
+			writeArtistWatchError(w, err)
+			return
+		}
+		auditLog.recordRequest(r, AuditEntry{Action: "watch.deleted", Detail: map[string]string{"watch_id": id}})
+		w.WriteHeader(http.StatusNoContent)
+
+	case resource == "check" && r.Method == http.MethodPost:
+		watch, err := artistWatches.check(id)
+		if err != nil {
+			writeArtistWatchError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(watch)
+
+	case resource == "" || resource == "check":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ArtworkOptions control the cover art saved with a download
+type ArtworkOptions struct {
+	// Maximum width and height in pixels
+	MaxSize int `json:"max_size,omitempty"`
+
+	// "jpg" or "png"
+	Format string `json:"format,omitempty"`
+
+	// "embed" in the audio files, separate "file" (cover.jpg) or "both"
+	Mode string `json:"mode,omitempty"`
+
+	// Also save the album's motion artwork (video loop) where available
+	Motion bool `json:"motion,omitempty"`
+
+	// With "embed", delete the separate cover files the downloader saves
+	// all the same
+	RemoveCoverFiles bool `json:"remove_cover_files,omitempty"`
+}
+
+var (
+	artworkFormats = []string{"", "jpg", "png"}
+	artworkModes   = []string{"", "embed", "file", "both"}
+)
+
+func (a ArtworkOptions) validate() error {
+	if a.MaxSize < 0 {
+		return fmt.Errorf("max_size must be positive")
+	}
+	if !slices.Contains(artworkFormats, a.Format) {
+		return fmt.Errorf("format must be jpg or png")
+	}
+	if !slices.Contains(artworkModes, a.Mode) {
+		return fmt.Errorf("mode must be embed, file or both")
+	}
+	return nil
+}
+
+// merge returns a with the fields set in override replacing its own
+func (a ArtworkOptions) merge(override *ArtworkOptions) ArtworkOptions {
+	if override == nil {
+		return a
+	}
+	if override.MaxSize != 0 {
+		a.MaxSize = override.MaxSize
+	}
+	if override.Format != "" {
+		a.Format = override.Format
+	}
+	if override.Mode != "" {
+		a.Mode = override.Mode
+	}
+	if override.Motion {
+		a.Motion = true
+	}
+	if override.RemoveCoverFiles {
+		a.RemoveCoverFiles = true
+	}
+	return a
+}
+
+// apply adds the matching downloader settings to overrides
+func (a ArtworkOptions) apply(overrides map[string]any) {
+	if a.MaxSize > 0 {
+		overrides["cover-size"] = fmt.Sprintf("%dx%d", a.MaxSize, a.MaxSize)
+	}
+	if a.Format != "" {
+		overrides["cover-format"] = a.Format
+	}
+	if a.Mode != "" {
+		overrides["embed-cover"] = a.Mode != "file"
+	}
+	if a.Motion {
+		overrides["save-animated-artwork"] = true
+	}
+}
+
+// isMotionArtwork reports whether path is an animated cover saved by the
+// downloader, e.g. "square_animated_artwork.mp4"
+func isMotionArtwork(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	return artifactKinds[filepath.Ext(name)] == "video" && (strings.Contains(name, "animated") || strings.Contains(name, "motion"))
+}
+
+// removeCoverFiles deletes the separate cover images among a job's files
+// and returns the remaining files
+func removeCoverFiles(files []string) []string {
+	var kept []string
+	for _, path := range files {
+		name := strings.ToLower(filepath.Base(path))
+		if artifactKind(path) == "artwork" && strings.HasPrefix(name, "cover.") {
+			if err := os.Remove(path); err == nil {
+				continue
+			}
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
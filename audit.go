@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entries exported per chunk by default, and at most
+const (
+	defaultAuditChunk = 1000
+	maxAuditChunk     = 10000
+)
+
+// AuditEntry is one line of the audit log: who did what to which job.
+// Hash is the SHA-256 of the entry's canonical JSON without hash, which
+// includes the previous entry's hash, so changing or removing an entry
+// breaks the chain from there on.
+type AuditEntry struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Action    string            `json:"action"`
+	Actor     string            `json:"actor"`
+	APIKey    string            `json:"api_key,omitempty"`
+	JobID     string            `json:"job_id,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Detail    map[string]string `json:"detail,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash,omitempty"`
+}
+
+// AuditChunk is the trailer line of an export. Signature is the Ed25519
+// signature of the trailer's canonical JSON without signature, made with
+// AUDIT_SIGNING_KEY; both key fields are left out without one.
+type AuditChunk struct {
+	Type       string    `json:"type"`
+	FirstSeq   uint64    `json:"first_seq"`
+	LastSeq    uint64    `json:"last_seq"`
+	Count      int       `json:"count"`
+	PrevHash   string    `json:"prev_hash"`
+	LastHash   string    `json:"last_hash"`
+	HasMore    bool      `json:"has_more"`
+	ExportedAt time.Time `json:"exported_at"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	Signature  string    `json:"signature,omitempty"`
+}
+
+// AuditLog appends entries to AUDIT_LOG, one JSON object per line
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seq  uint64
+	hash string
+	key  ed25519.PrivateKey
+}
+
+// auditLog is nil unless AUDIT_LOG is set
+var auditLog *AuditLog
+
+// canonicalJSON encodes v with sorted keys, no insignificant whitespace and
+// no HTML escaping, so anyone can reproduce the bytes that are hashed and
+// signed
+func canonicalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// computeHash returns the hash the entry should have
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := canonicalJSON(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadSigningKey reads an Ed25519 private key from a PKCS #8 PEM file, such
+// as one made by openssl genpkey -algorithm ed25519
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an Ed25519 key", key)
+	}
+	return ed, nil
+}
+
+// openAuditLog opens AUDIT_LOG for appending, continuing the chain of the
+// entries already in it. A broken chain is logged rather than refused, so
+// auditing carries on; exports still show where it broke.
+func openAuditLog() (*AuditLog, error) {
+	a := &AuditLog{path: cfg.AuditLog}
+	if cfg.AuditSigningKey != "" {
+		key, err := loadSigningKey(cfg.AuditSigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("signing key: %w", err)
+		}
+		a.key = key
+	}
+
+	err := scanAuditLog(a.path, func(e AuditEntry) error {
+		if e.PrevHash != a.hash {
+			slog.Error("Audit log chain broken: prev_hash doesn't match the entry before it", "seq", e.Seq)
+		} else if hash, err := e.computeHash(); err != nil || hash != e.Hash {
+			slog.Error("Audit log chain broken: hash doesn't match the entry", "seq", e.Seq)
+		}
+		a.seq, a.hash = e.Seq, e.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	a.file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// scanAuditLog calls fn with every entry in the file, in order
+func scanAuditLog(path string, fn func(AuditEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// record appends an entry, chained to the one before it. Failures are
+// logged, as they shouldn't fail what is being audited.
+func (a *AuditLog) record(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.Seq, e.Time, e.PrevHash = a.seq+1, time.Now().UTC(), a.hash
+	hash, err := e.computeHash()
+	if err != nil {
+		slog.Error("Failed to hash audit entry", "error", err)
+		return
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Failed to encode audit entry", "error", err)
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write audit entry", "error", err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		slog.Error("Failed to sync audit log", "error", err)
+	}
+	a.seq, a.hash = e.Seq, e.Hash
+}
+
+// recordRequest appends an entry for something done through r
+func (a *AuditLog) recordRequest(r *http.Request, e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Actor == "" {
+		e.Actor = requestOwner(r, "anonymous")
+	}
+	e.APIKey = apiKeyName(r)
+	if e.RequestID == "" {
+		e.RequestID = r.Header.Get("X-Request-ID")
+	}
+	a.record(e)
+}
+
+// export returns up to limit entries after seq sinceSeq and the trailer
+// describing them
+func (a *AuditLog) export(sinceSeq uint64, limit int) ([]AuditEntry, AuditChunk, error) {
+	// Entries are written under the lock, so holding it keeps a half-written
+	// line out of the export
+	a.mu.Lock()
+	lastSeq := a.seq
+	entries := []AuditEntry{}
+	chunk := AuditChunk{Type: "chunk", ExportedAt: time.Now().UTC()}
+	errLimit := errors.New("limit reached")
+	err := scanAuditLog(a.path, func(e AuditEntry) error {
+		if e.Seq <= sinceSeq {
+			chunk.PrevHash = e.Hash
+			return nil
+		}
+		if len(entries) == limit {
+			return errLimit
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	a.mu.Unlock()
+	if err != nil && !errors.Is(err, errLimit) {
+		return nil, chunk, err
+	}
+
+	chunk.Count = len(entries)
+	chunk.LastHash = chunk.PrevHash
+	if len(entries) > 0 {
+		first, last := entries[0], entries[len(entries)-1]
+		chunk.FirstSeq, chunk.LastSeq, chunk.LastHash = first.Seq, last.Seq, last.Hash
+		chunk.HasMore = last.Seq < lastSeq
+	}
+	if a.key != nil {
+		chunk.PublicKey = base64.StdEncoding.EncodeToString(a.key.Public().(ed25519.PublicKey))
+		data, err := canonicalJSON(chunk)
+		if err != nil {
+			return nil, chunk, err
+		}
+		chunk.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, data))
+	}
+	return entries, chunk, nil
+}
+
+// handleAuditExport serves GET /audit/export, a chunk of the audit log as
+// JSONL: the entries after ?since_seq=, at most ?limit=, followed by a
+// signed trailer
+func handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if auditLog == nil {
+		http.Error(w, "Audit log is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	var sinceSeq uint64
+	if s := query.Get("since_seq"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since_seq", http.StatusBadRequest)
+			return
+		}
+		sinceSeq = n
+	}
+	limit := defaultAuditChunk
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAuditChunk {
+			http.Error(w, fmt.Sprintf("Invalid limit; must be between 1 and %d", maxAuditChunk), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, chunk, err := auditLog.export(sinceSeq, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to export audit log", "error", err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%d-%d.jsonl"`, chunk.FirstSeq, chunk.LastSeq))
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+	enc.Encode(chunk)
+}
+
+// runAuditVerify checks exported chunks, or the audit log itself: that
+// every entry matches its hash and follows the one before it, and that
+// every trailer covers the entries before it and is correctly signed
+func runAuditVerify(args []string) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	publicKey := fs.String("public-key", "", "base64 Ed25519 public key trailers must be signed with")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: audit-verify [-public-key KEY] FILE...")
+		return 2
+	}
+
+	v := &auditVerifier{publicKey: *publicKey}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		err = v.verify(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+	}
+	fmt.Printf("ok: %d entries, %d signed chunk(s)\n", v.entries, v.signed)
+	return 0
+}
+
+// auditVerifier follows the chain across the files given to audit-verify
+type auditVerifier struct {
+	publicKey string
+
+	started   bool
+	prevHash  string // hash of the last entry seen
+	chunkPrev string // prev_hash of the first entry since the last trailer
+	pending   int    // entries since the last trailer
+
+	entries, signed int
+}
+
+func (v *auditVerifier) verify(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		var kind struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &kind); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		var err error
+		if kind.Type == "chunk" {
+			err = v.chunk(data)
+		} else {
+			err = v.entry(data)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (v *auditVerifier) entry(data []byte) error {
+	var e AuditEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	// The first entry may follow entries that weren't exported
+	if v.started && e.PrevHash != v.prevHash {
+		return fmt.Errorf("seq %d doesn't follow the entry before it", e.Seq)
+	}
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	if hash != e.Hash {
+		return fmt.Errorf("seq %d doesn't match its hash", e.Seq)
+	}
+	if v.pending == 0 {
+		v.chunkPrev = e.PrevHash
+	}
+	v.started, v.prevHash = true, e.Hash
+	v.pending++
+	v.entries++
+	return nil
+}
+
+func (v *auditVerifier) chunk(data []byte) error {
+	var chunk AuditChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return err
+	}
+	switch {
+	case chunk.Count != v.pending:
+		return fmt.Errorf("trailer counts %d entries, found %d", chunk.Count, v.pending)
+	case v.pending > 0 && (chunk.PrevHash != v.chunkPrev || chunk.LastHash != v.prevHash):
+		return errors.New("trailer doesn't match the entries before it")
+	case v.pending == 0 && v.started && chunk.LastHash != v.prevHash:
+		return errors.New("trailer doesn't follow the entries before it")
+	}
+	v.started, v.prevHash, v.pending = true, chunk.LastHash, 0
+
+	if chunk.Signature == "" {
+		if v.publicKey != "" {
+			return errors.New("trailer isn't signed")
+		}
+		return nil
+	}
+	if v.publicKey != "" && chunk.PublicKey != v.publicKey {
+		return errors.New("trailer is signed with a different key")
+	}
+	key, err := base64.StdEncoding.DecodeString(chunk.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(chunk.Signature)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	chunk.Signature = ""
+	signed, err := canonicalJSON(chunk)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), signed, sig) {
+		return errors.New("bad signature")
+	}
+	v.signed++
+	return nil
+}
+
+// jobAuditDetail notes where a job came from, besides its owner
+func jobAuditDetail(req DownloadRequest) map[string]string {
+	detail := map[string]string{}
+	if req.RetryOf != "" {
+		detail["retry_of"] = req.RetryOf
+	}
+	if req.BatchID != "" {
+		detail["batch_id"] = req.BatchID
+	}
+	if len(detail) == 0 {
+		return nil
+	}
+	return detail
+}
+
+func reasonDetail(reason string) map[string]string {
+	if reason = strings.TrimSpace(reason); reason == "" {
+		return nil
+	}
+	return map[string]string{"reason": reason}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// APIKey grants access to the API; read-only keys may only make GET and
+// HEAD requests
+type APIKey struct {
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+
+	name string
+}
+
+var apiKeys []APIKey
+
+// loadAPIKeys collects the keys from API_KEYS, API_READ_ONLY_KEYS and
+// API_KEYS_FILE, a JSON object of named keys
+func loadAPIKeys() error {
+	var keys []APIKey
+	for i, key := range cfg.APIKeys {
+		keys = append(keys, APIKey{Key: key, name: fmt.Sprintf("API_KEYS[%d]", i)})
+	}
+	for i, key := range cfg.APIReadOnlyKeys {
+		keys = append(keys, APIKey{Key: key, ReadOnly: true, name: fmt.Sprintf("API_READ_ONLY_KEYS[%d]", i)})
+	}
+
+	if cfg.APIKeysFile != "" {
+		data, err := os.ReadFile(cfg.APIKeysFile)
+		if err != nil {
+			return err
+		}
+		named := map[string]APIKey{}
+		if err := json.Unmarshal(data, &named); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", cfg.APIKeysFile, err)
+		}
+		for name, key := range named {
+			if key.Key == "" {
+				return fmt.Errorf("key %q: key is required", name)
+			}
+			key.name = name
+			keys = append(keys, key)
+		}
+	}
+
+	apiKeys = keys
+	if len(keys) == 0 {
+		slog.Warn("No API keys configured; the API is open to anyone who can reach it")
+	} else {
+		slog.Info("Loaded API keys", "keys", len(keys))
+	}
+	return nil
+}
+
+// Endpoints left open: health checks, and endpoints that authenticate
+// requests themselves
+var (
+	publicPaths        = []string{"/health", "/readyz", "/quick", "/ext/submit", "/discord/interactions", "/openapi.json", "/docs"}
+	publicPathPrefixes = []string{"/ingest/webhook/", "/exports/", "/auth-assist/"}
+)
+
+func isPublicPath(path string) bool {
+	for _, public := range publicPaths {
+		if path == public {
+			return true
+		}
+	}
+	for _, prefix := range publicPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// findAPIKey returns the configured key matching the request's X-API-Key
+// header, or its bearer token for clients that can only send those. Browsers
+// can't set headers on WebSocket requests, so those may pass the key as
+// ?access_token= instead.
+func findAPIKey(r *http.Request) (APIKey, bool) {
+	given := r.Header.Get("X-API-Key")
+	if given == "" {
+		given, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if given == "" && websocket.IsWebSocketUpgrade(r) {
+		given = r.URL.Query().Get("access_token")
+	}
+	if given == "" {
+		return APIKey{}, false
+	}
+
+	var found APIKey
+	matched := false
+	// Every key is compared so the time taken doesn't reveal which matched
+	for _, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key.Key)) == 1 && !matched {
+			found, matched = key, true
+		}
+	}
+	return found, matched
+}
+
+// requireAPIKey rejects requests without a valid API key once any keys are
+// configured
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 || isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := findAPIKey(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="apple-music-dl-http-wrapper"`)
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		if key.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "API key is read-only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyName returns the name of the API key r was made with, if any
+func apiKeyName(r *http.Request) string {
+	key, _ := findAPIKey(r)
+	return key.name
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an auth assist page can be used
+const authAssistTTL = 15 * time.Minute
+
+// authAssistSessions are the pages handed out by POST
+// /admin/credentials/assist, by token. Each can save credentials once.
+type authAssistSessions struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+var authAssist = &authAssistSessions{expires: map[string]time.Time{}}
+
+func (s *authAssistSessions) create() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for token, expires := range s.expires {
+		if now.After(expires) {
+			delete(s.expires, token)
+		}
+	}
+	token, expires := randomHex(24), now.Add(authAssistTTL)
+	s.expires[token] = expires
+	return token, expires
+}
+
+// valid returns when the session expires, if it exists and hasn't
+func (s *authAssistSessions) valid(token string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, exists := s.expires[token]
+	return expires, exists && time.Now().Before(expires)
+}
+
+func (s *authAssistSessions) end(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.expires, token)
+}
+
+var authAssistPage = template.Must(template.New("assist").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="referrer" content="no-referrer">
+<title>Apple Music credentials</title>
+</head>
+<body style="font-family: -apple-system, sans-serif; margin: 2em; max-width: 46em;">
+<h3>Apple Music credentials</h3>
+{{if .Report}}
+<p><strong>{{if .Report.Saved}}Saved. New downloads use these credentials; running ones keep theirs.{{else}}Not saved.{{end}}</strong></p>
+<ul>
+{{range .Report.Checks}}<li><code>{{.Name}}</code>: {{.Status}}{{if .Detail}} &mdash; {{.Detail}}{{end}}</li>
+{{end}}</ul>
+{{end}}
+{{if not .Done}}
+<ol>
+<li>Open <a href="https://music.apple.com" target="_blank" rel="noopener">music.apple.com</a> in a desktop browser and sign in.</li>
+<li>Open the developer tools (F12, or Option-Command-I in Safari) and find the cookies of <code>https://music.apple.com</code> (Application &rarr; Cookies in Chrome, Storage &rarr; Cookies in Firefox and Safari). Copy the value of <code>media-user-token</code>.</li>
+<li>Optionally, in the Network tab, play any song, select a request to <code>amp-api.music.apple.com</code> and copy its <code>Authorization</code> header after <code>Bearer</code>. Leave it empty to keep the current developer token.</li>
+<li>Paste them below. They're checked with Apple Music before they're saved.</li>
+</ol>
+<form method="post">
+<p><label>media-user-token<br><textarea name="media_user_token" rows="4" cols="70" autocomplete="off" required></textarea></label></p>
+<p><label>Developer token (optional)<br><textarea name="developer_token" rows="4" cols="70" autocomplete="off"></textarea></label></p>
+<p><button type="submit">Verify and save</button></p>
+</form>
+<p><small>This page works until {{.Expires.Format "15:04 MST"}}.</small></p>
+{{end}}
+</body>
+</html>
+`))
+
+// handleCredentialsAssist serves POST /admin/credentials/assist, which
+// hands out a short-lived page guiding someone through capturing the
+// Apple Music tokens from their browser
+func handleCredentialsAssist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, expires := authAssist.create()
+	u := url.URL{Scheme: requestScheme(r), Host: r.Host, Path: "/auth-assist/" + token}
+	slog.InfoContext(r.Context(), "Started an auth assist page", "expires", expires.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"url":        u.String(),
+		"expires_at": expires,
+	})
+}
+
+// handleAuthAssist serves /auth-assist/{token}: GET shows the instructions
+// and form, and POST verifies the pasted tokens and saves them, as a form
+// or as JSON with media_user_token and developer_token. The token in the
+// path stands in for an API key.
+func handleAuthAssist(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Path[len("/auth-assist/"):]
+	expires, ok := authAssist.valid(token)
+	if !ok {
+		http.Error(w, "Link expired", http.StatusGone)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	page := struct {
+		Expires time.Time
+		Report  *CredentialsReport
+		Done    bool
+	}{Expires: expires}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		authAssistPage.Execute(w, page)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pasted struct {
+		MediaUserToken string `json:"media_user_token"`
+		DeveloperToken string `json:"developer_token"`
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	asJSON := mediaType == "application/json"
+	r.Body = http.MaxBytesReader(w, r.Body, maxCredentialsUpload)
+	if asJSON {
+		if err := json.NewDecoder(r.Body).Decode(&pasted); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		pasted.MediaUserToken, pasted.DeveloperToken = r.PostForm.Get("media_user_token"), r.PostForm.Get("developer_token")
+	}
+	mediaUserToken := strings.TrimSpace(pasted.MediaUserToken)
+	developerToken := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(pasted.DeveloperToken), "Bearer "))
+	if mediaUserToken == "" {
+		http.Error(w, "media_user_token is required", http.StatusBadRequest)
+		return
+	}
+
+	current, err := configuredCredentials()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read credentials", "error", err)
+		http.Error(w, "Failed to read downloader config", http.StatusInternalServerError)
+		return
+	}
+	creds, values := current, map[string]string{mediaUserTokenKey: mediaUserToken}
+	creds.MediaUserToken = mediaUserToken
+	if developerToken != "" {
+		creds.AuthorizationToken = developerToken
+		values[authorizationTokenKey] = developerToken
+	}
+
+	// Unlike uploads, pasted tokens are only saved once Apple Music has
+	// accepted them
+	ctx, cancel := context.WithTimeout(r.Context(), integrationTestTimeout)
+	defer cancel()
+	checks, account := checkCredentials(ctx, creds)
+	report := credentialsReport(creds, checks)
+	accepted := !slices.ContainsFunc(report.Checks, func(check CredentialCheck) bool {
+		_, pastedNow := values[check.Name]
+		return pastedNow && check.Status != "ok"
+	})
+
+	status := http.StatusUnprocessableEntity
+	if accepted {
+		if err := saveCredentials(values); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save credentials", "error", err)
+			http.Error(w, "Failed to write downloader config", http.StatusInternalServerError)
+			return
+		}
+		if developerToken != "" {
+			appleMusic.useToken(developerToken)
+		}
+		if account != nil {
+			accountStore.set(account)
+		}
+		authAssist.end(token)
+		status = http.StatusOK
+		report.Saved, page.Done = true, true
+		for key := range values {
+			report.Updated = append(report.Updated, key)
+		}
+		slices.Sort(report.Updated)
+		slog.InfoContext(r.Context(), "Updated downloader credentials through auth assist", "updated", report.Updated)
+		auditLog.recordRequest(r, AuditEntry{Action: "credentials.updated", Actor: "auth-assist", Detail: map[string]string{"updated": strings.Join(report.Updated, ","), "valid": strconv.FormatBool(report.Valid)}})
+	}
+	page.Report = &report
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	authAssistPage.Execute(w, page)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DigestConfig enables aggregate progress callbacks for a batch. A digest is
+// posted every EveryN finished jobs and/or every EveryMinutes minutes while
+// there is new progress, plus a final digest once every job has finished.
+type DigestConfig struct {
+	URL          string `json:"url"`
+	EveryN       int    `json:"every_n,omitempty"`
+	EveryMinutes int    `json:"every_minutes,omitempty"`
+}
+
+// Batch groups jobs created together, e.g. by an importer
+type Batch struct {
+	ID        string        `json:"id"`
+	Source    string        `json:"source"`
+	JobIDs    []string      `json:"job_ids"`
+	CreatedAt time.Time     `json:"created_at"`
+	Digest    *DigestConfig `json:"digest,omitempty"`
+
+	// Sealed is set once the creator has added all of its jobs
+	Sealed bool `json:"sealed"`
+
+	// Waves is set when the batch is big enough to run in waves
+	Waves *BatchWaves `json:"waves,omitempty"`
+
+	// Position of every job in JobIDs, which decides its wave
+	positions map[string]int
+
+	finishedSinceDigest int
+	digestsSent         int
+	finalDigestSent     bool
+	completedPublished  bool
+
+	// Trace of the request that created the batch, forwarded with digests
+	trace TraceContext
+}
+
+// BatchWaves tracks a batch running in waves of Size jobs. The jobs of
+// wave Current may run; the next wave starts at NextAt, a pause after the
+// current one has finished.
+type BatchWaves struct {
+	Size    int        `json:"size"`
+	Total   int        `json:"total"`
+	Current int        `json:"current"`
+	NextAt  *time.Time `json:"next_at,omitempty"`
+}
+
+// BatchDigest is the payload posted to a batch's digest URL
+type BatchDigest struct {
+	BatchID   string         `json:"batch_id"`
+	Source    string         `json:"source"`
+	Total     int            `json:"total"`
+	Finished  int            `json:"finished"`
+	Counts    map[string]int `json:"counts"`
+	Final     bool           `json:"final"`
+	Sequence  int            `json:"sequence"`
+	Timestamp time.Time      `json:"timestamp"`
+
+	// Set for batch.wave_completed: the wave that finished, its jobs by
+	// status, and when the next one starts
+	Wave       int            `json:"wave,omitempty"`
+	Waves      int            `json:"waves,omitempty"`
+	WaveCounts map[string]int `json:"wave_counts,omitempty"`
+	NextWaveAt *time.Time     `json:"next_wave_at,omitempty"`
+}
+
+type BatchManager struct {
+	mu      sync.RWMutex
+	batches map[string]*Batch
+}
+
+func NewBatchManager() *BatchManager {
+	return &BatchManager{
+		batches: make(map[string]*Batch),
+	}
+}
+
+var batchManager = NewBatchManager()
+
+func (bm *BatchManager) CreateBatch(source string, digest *DigestConfig, trace TraceContext) *Batch {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if digest != nil && digest.URL == "" {
+		digest = nil
+	}
+
+	batch := &Batch{
+		ID:        uuid.New().String(),
+		Source:    source,
+		JobIDs:    []string{},
+		CreatedAt: time.Now(),
+		Digest:    digest,
+		positions: make(map[string]int),
+		trace:     trace,
+	}
+	bm.batches[batch.ID] = batch
+
+	if digest != nil && digest.EveryMinutes > 0 {
+		go bm.runDigestTicker(batch.ID, time.Duration(digest.EveryMinutes)*time.Minute)
+	}
+	return batch
+}
+
+func (bm *BatchManager) AddJob(batchID, jobID string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if batch, exists := bm.batches[batchID]; exists {
+		batch.positions[jobID] = len(batch.JobIDs)
+		batch.JobIDs = append(batch.JobIDs, jobID)
+	}
+}
+
+// Seal marks the batch as complete; no more jobs will be added to it. A
+// batch of more than BATCH_WAVE_THRESHOLD jobs is split into waves.
+func (bm *BatchManager) Seal(batchID string) {
+	bm.mu.Lock()
+	if batch, exists := bm.batches[batchID]; exists {
+		batch.Sealed = true
+		if cfg.BatchWaveThreshold > 0 && len(batch.JobIDs) > cfg.BatchWaveThreshold {
+			size := waveSize()
+			batch.Waves = &BatchWaves{
+				Size:    size,
+				Total:   (len(batch.JobIDs) + size - 1) / size,
+				Current: 1,
+			}
+			slog.Info("Running batch in waves", "batch_id", batchID, "jobs", len(batch.JobIDs), "waves", batch.Waves.Total, "wave_size", size)
+		}
+	}
+	bm.mu.Unlock()
+
+	// Jobs held while the batch was still growing may run now
+	scheduler.notify()
+
+	bm.maybeSendDigest(batchID, false)
+	bm.maybeFinishWave(batchID)
+	bm.maybePublishCompleted(batchID)
+}
+
+func waveSize() int {
+	return max(cfg.BatchWaveSize, 1)
+}
+
+// held reports whether a queued job of the batch waits for a later wave.
+// Until the batch is sealed its size isn't known, so only the first wave
+// may run.
+func (bm *BatchManager) held(batchID, jobID string) bool {
+	if batchID == "" || cfg.BatchWaveThreshold <= 0 {
+		return false
+	}
+
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	batch, exists := bm.batches[batchID]
+	if !exists {
+		return false
+	}
+	wave := batch.positions[jobID]/waveSize() + 1
+	switch {
+	case !batch.Sealed:
+		return wave > 1
+	case batch.Waves != nil:
+		return wave > batch.Waves.Current
+	default:
+		return false
+	}
+}
+
+// maybeFinishWave publishes batch.wave_completed once every job of the
+// current wave has finished, and starts the next wave after
+// BATCH_WAVE_PAUSE
+func (bm *BatchManager) maybeFinishWave(batchID string) {
+	bm.mu.RLock()
+	batch, exists := bm.batches[batchID]
+	if !exists || batch.Waves == nil || batch.Waves.NextAt != nil || batch.Waves.Current >= batch.Waves.Total {
+		bm.mu.RUnlock()
+		return
+	}
+	wave := batch.Waves.Current
+	jobIDs := slices.Clone(batch.JobIDs[(wave-1)*batch.Waves.Size : wave*batch.Waves.Size])
+	bm.mu.RUnlock()
+
+	counts := map[string]int{}
+	for _, jobID := range jobIDs {
+		job, exists := jobManager.Snapshot(jobID)
+		if !exists {
+			continue
+		}
+		if job.EndedAt == nil {
+			return
+		}
+		counts[job.Status]++
+	}
+
+	bm.mu.Lock()
+	live := bm.batches[batchID]
+	if live.Waves.Current != wave || live.Waves.NextAt != nil {
+		bm.mu.Unlock()
+		return
+	}
+	nextAt := time.Now().Add(cfg.BatchWavePause)
+	live.Waves.NextAt = &nextAt
+	bm.mu.Unlock()
+
+	snapshot, _ := bm.Snapshot(batchID)
+	progress := batchProgress(snapshot)
+	progress.Wave = wave
+	progress.Waves = snapshot.Waves.Total
+	progress.WaveCounts = counts
+	progress.NextWaveAt = &nextAt
+
+	slog.Info("Wave finished", "batch_id", batchID, "wave", wave, "waves", progress.Waves, "counts", formatCounts(counts), "pause", cfg.BatchWavePause.Seconds())
+	publishEvent(WebhookEvent{
+		Event: "batch.wave_completed",
+		Time:  time.Now(),
+		Batch: &progress,
+	}, snapshot.trace)
+
+	time.AfterFunc(cfg.BatchWavePause, func() { bm.startNextWave(batchID) })
+}
+
+// startNextWave lets the jobs of the batch's next wave run
+func (bm *BatchManager) startNextWave(batchID string) {
+	bm.mu.Lock()
+	batch := bm.batches[batchID]
+	batch.Waves.Current++
+	batch.Waves.NextAt = nil
+	wave := batch.Waves.Current
+	end := min(wave*batch.Waves.Size, len(batch.JobIDs))
+	jobIDs := slices.Clone(batch.JobIDs[(wave-1)*batch.Waves.Size : end])
+	total := batch.Waves.Total
+	bm.mu.Unlock()
+
+	slog.Info("Starting wave", "batch_id", batchID, "wave", wave, "waves", total, "jobs", len(jobIDs))
+	scheduler.release(jobIDs)
+
+	// The wave may consist of jobs that were all cancelled meanwhile
+	bm.maybeFinishWave(batchID)
+}
+
+// formatCounts renders job counts by status as "3 completed, 1 failed"
+func formatCounts(counts map[string]int) string {
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	parts := make([]string, len(statuses))
+	for i, status := range statuses {
+		parts[i] = fmt.Sprintf("%d %s", counts[status], status)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Snapshot returns a copy of the batch that is safe to read concurrently
+func (bm *BatchManager) Snapshot(batchID string) (Batch, bool) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	batch, exists := bm.batches[batchID]
+	if !exists {
+		return Batch{}, false
+	}
+	snapshot := *batch
+	snapshot.JobIDs = append([]string(nil), batch.JobIDs...)
+	if batch.Waves != nil {
+		waves := *batch.Waves
+		snapshot.Waves = &waves
+	}
+	return snapshot, true
+}
+
+// jobFinished is registered with the job manager to drive digests
+func (bm *BatchManager) jobFinished(job DownloadStatus) {
+	if job.BatchID == "" {
+		return
+	}
+
+	bm.mu.Lock()
+	batch, exists := bm.batches[job.BatchID]
+	if exists {
+		batch.finishedSinceDigest++
+	}
+	bm.mu.Unlock()
+
+	if exists {
+		bm.maybeSendDigest(job.BatchID, false)
+		bm.maybeFinishWave(job.BatchID)
+		bm.maybePublishCompleted(job.BatchID)
+	}
+}
+
+// maybePublishCompleted publishes batch.completed once a sealed batch has no
+// unfinished jobs left
+func (bm *BatchManager) maybePublishCompleted(batchID string) {
+	batch, exists := bm.Snapshot(batchID)
+	if !exists || !batch.Sealed || batch.completedPublished {
+		return
+	}
+
+	progress := batchProgress(batch)
+	if progress.Finished != progress.Total {
+		return
+	}
+	progress.Final = true
+
+	bm.mu.Lock()
+	live := bm.batches[batchID]
+	if live.completedPublished {
+		bm.mu.Unlock()
+		return
+	}
+	live.completedPublished = true
+	bm.mu.Unlock()
+
+	publishEvent(WebhookEvent{
+		Event: "batch.completed",
+		Time:  time.Now(),
+		Batch: &progress,
+	}, batch.trace)
+}
+
+func (bm *BatchManager) runDigestTicker(batchID string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !bm.maybeSendDigest(batchID, true) {
+			return
+		}
+	}
+}
+
+// maybeSendDigest posts a digest if one is due. With periodic set, any new
+// progress since the last digest is enough. It reports whether the batch
+// still expects further digests.
+func (bm *BatchManager) maybeSendDigest(batchID string, periodic bool) bool {
+	batch, exists := bm.Snapshot(batchID)
+	if !exists || batch.Digest == nil || batch.finalDigestSent {
+		return false
+	}
+
+	digest := batchProgress(batch)
+	digest.Final = batch.Sealed && digest.Finished == digest.Total
+
+	bm.mu.Lock()
+	live := bm.batches[batchID]
+	due := digest.Final ||
+		(batch.Digest.EveryN > 0 && live.finishedSinceDigest >= batch.Digest.EveryN) ||
+		(periodic && live.finishedSinceDigest > 0)
+	if !due || live.finalDigestSent {
+		bm.mu.Unlock()
+		return true
+	}
+	live.finishedSinceDigest = 0
+	live.digestsSent++
+	live.finalDigestSent = digest.Final
+	digest.Sequence = live.digestsSent
+	bm.mu.Unlock()
+
+	deliveryQueue.Enqueue(batch.Digest.URL, "", "batch.digest", "", digest, batch.trace)
+	return !digest.Final
+}
+
+// batchProgress aggregates job statuses for a batch
+func batchProgress(batch Batch) BatchDigest {
+	digest := BatchDigest{
+		BatchID:   batch.ID,
+		Source:    batch.Source,
+		Total:     len(batch.JobIDs),
+		Counts:    map[string]int{},
+		Timestamp: time.Now(),
+	}
+	for _, jobID := range batch.JobIDs {
+		job, exists := jobManager.Snapshot(jobID)
+		if !exists {
+			continue
+		}
+		digest.Counts[job.Status]++
+		if job.EndedAt != nil {
+			digest.Finished++
+		}
+	}
+	return digest
+}
+
+// URLs accepted in a single download request
+const maxBatchURLs = 500
+
+// BatchJob is a job created for one URL of a batch download
+type BatchJob struct {
+	URL   string `json:"url"`
+	JobID string `json:"job_id"`
+}
+
+// handleDownloadBatch serves POST /download with "urls", starting a job for
+// every URL with the request's other options. The URLs are validated and
+// their editions resolved before any job is started, so the request is
+// either accepted or rejected as a whole.
+func handleDownloadBatch(w http.ResponseWriter, r *http.Request, req DownloadRequest) {
+	if req.URL != "" {
+		http.Error(w, "Use either url or urls", http.StatusBadRequest)
+		return
+	}
+	if req.scheduled() {
+		http.Error(w, "schedule_at and cron aren't supported for batches", http.StatusBadRequest)
+		return
+	}
+	if len(req.URLs) > maxBatchURLs {
+		http.Error(w, fmt.Sprintf("At most %d urls are allowed", maxBatchURLs), http.StatusBadRequest)
+		return
+	}
+	if req.Digest != nil && !isHTTPURL(req.Digest.URL) {
+		http.Error(w, "digest.url must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+
+	var requests []DownloadRequest
+	seen := map[string]bool{}
+	for i, url := range req.URLs {
+		url = strings.TrimSpace(url)
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+
+		single := req
+		single.URL, single.URLs, single.Digest = url, nil, nil
+		if err := prepareRequest(&single); err != nil {
+			writeSubmitError(w, fmt.Errorf("urls[%d]: %w", i, err))
+			return
+		}
+		editions, err := resolveEdition(&single)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Edition lookup failed for urls[%d]: %v", i, err), http.StatusBadGateway)
+			return
+		}
+		if editions != nil {
+			writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Album has multiple editions: urls[%d]", i), map[string]any{
+				"url":      url,
+				"editions": editions,
+			})
+			return
+		}
+		// The batch is attached to the collection rather than each job
+		single.Collection = ""
+		requests = append(requests, single)
+	}
+
+	owner := requestOwner(r, "anonymous")
+	trace := traceFromRequest(r)
+	batch := batchManager.CreateBatch("api", req.Digest, trace)
+	if req.Collection != "" {
+		if _, err := collectionStore.Attach(req.Collection, collectionMembers{BatchIDs: []string{batch.ID}}); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to attach batch to collection", "batch_id", batch.ID, "collection_id", req.Collection, "error", err)
+		}
+	}
+	jobs := make([]BatchJob, 0, len(requests))
+	for _, single := range requests {
+		single.Owner = owner
+		single.Trace = trace
+		single.BatchID = batch.ID
+		job := startDownload(single)
+		jobs = append(jobs, BatchJob{URL: single.URL, JobID: job.ID})
+	}
+	batchManager.Seal(batch.ID)
+	slog.InfoContext(r.Context(), "Batch started", "batch_id", batch.ID, "jobs", len(jobs))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"batch_id": batch.ID,
+		"status":   "started",
+		"jobs":     jobs,
+	})
+}
+
+func handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	batchID := r.URL.Path[len("/batches/"):]
+	if batchID == "" {
+		http.Error(w, "Batch ID is required", http.StatusBadRequest)
+		return
+	}
+
+	batch, exists := batchManager.Snapshot(batchID)
+	if !exists {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+
+	progress := batchProgress(batch)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"batch":    batch,
+		"counts":   progress.Counts,
+		"total":    progress.Total,
+		"finished": progress.Finished,
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Frames per second of cue sheet times
+const cueFramesPerSecond = 75
+
+// chapterTrack is a track of a cue sheet or chapters file, starting at the
+// end of the one before it
+type chapterTrack struct {
+	title     string
+	performer string
+	start     float64 // seconds
+	end       float64
+}
+
+// writeChapters writes a cue sheet and an ffmpeg chapters file for each
+// directory of the job's tracks, as the extras options ask, so that
+// continuous mixes can be navigated once merged into one file named after
+// the album. They're added to the job's extras.
+func writeChapters(jobID string, req DownloadRequest) {
+	profile := resolveOutputProfile(req)
+	if !profile.Extras.CueSheet && !profile.Extras.Chapters {
+		return
+	}
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		return
+	}
+
+	var dirs []string
+	byDir := map[string][]Track{}
+	for _, track := range job.Tracks {
+		dir := path.Dir(track.Path)
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], track)
+	}
+
+	var written []Artifact
+	for _, dir := range dirs {
+		tracks := byDir[dir]
+		if len(tracks) < 2 {
+			continue
+		}
+		files, err := writeChapterFiles(dir, tracks, profile.Extras, profile.Sanitize)
+		if err != nil {
+			postProcessWarning(jobID, fmt.Errorf("chapters of %s: %w", dir, err))
+			continue
+		}
+		for _, file := range files {
+			jobManager.AppendLog(jobID, fmt.Sprintf("Wrote %s", file.Path))
+		}
+		written = append(written, files...)
+	}
+	if len(written) > 0 {
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.Extras = append(append([]Artifact{}, job.Extras...), written...)
+		})
+	}
+}
+
+// writeChapterFiles writes the cue sheet and chapters file of the tracks in
+// dir, relative to DOWNLOADS_DIR, titled from the tags of the first one
+func writeChapterFiles(dir string, tracks []Track, extras ExtrasOptions, sanitize string) ([]Artifact, error) {
+	album, err := readTags(filepath.Join(cfg.DownloadsDir, filepath.FromSlash(tracks[0].Path)))
+	if err != nil {
+		return nil, err
+	}
+	title := cmp.Or(album["album"], path.Base(dir))
+	performer := cmp.Or(album["album_artist"], album["artist"])
+
+	var chapters []chapterTrack
+	var position float64
+	for _, track := range tracks {
+		if track.Duration <= 0 {
+			return nil, fmt.Errorf("%s has no duration; durations are read with ffprobe", path.Base(track.Path))
+		}
+		chapter := chapterTrack{title: track.Title, start: position, end: position + track.Duration}
+		if tags, err := readTags(filepath.Join(cfg.DownloadsDir, filepath.FromSlash(track.Path))); err == nil {
+			chapter.performer = tags["artist"]
+		}
+		chapters = append(chapters, chapter)
+		position = chapter.end
+	}
+
+	// Named for the merged file the sheets describe
+	name := sanitizeName(title, cmp.Or(sanitize, "windows"))
+	contents := map[string]string{}
+	if extras.CueSheet {
+		contents[path.Join(dir, name+".cue")] = cueSheet(title, performer, album, name+".m4a", chapters)
+	}
+	if extras.Chapters {
+		contents[path.Join(dir, name+chaptersSuffix)] = ffmetadataChapters(title, performer, chapters)
+	}
+
+	var artifacts []Artifact
+	for _, rel := range slices.Sorted(maps.Keys(contents)) {
+		if err := os.WriteFile(filepath.Join(cfg.DownloadsDir, filepath.FromSlash(rel)), []byte(contents[rel]), 0o644); err != nil {
+			return artifacts, err
+		}
+		artifacts = append(artifacts, Artifact{Path: rel, Kind: artifactKind(rel), Size: int64(len(contents[rel]))})
+	}
+	return artifacts, nil
+}
+
+// Suffix of ffmpeg chapters files, which are plain text
+const chaptersSuffix = ".chapters.txt"
+
+func cueSheet(title, performer string, album map[string]string, file string, tracks []chapterTrack) string {
+	// Cue sheets have no escapes for quotes
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+	}
+
+	var sb strings.Builder
+	if genre := album["genre"]; genre != "" {
+		fmt.Fprintf(&sb, "REM GENRE %s\n", quote(genre))
+	}
+	// Release dates like 2019-05-03 are given as the year
+	if year, _, _ := strings.Cut(album["date"], "-"); year != "" {
+		fmt.Fprintf(&sb, "REM DATE %s\n", year)
+	}
+	if performer != "" {
+		fmt.Fprintf(&sb, "PERFORMER %s\n", quote(performer))
+	}
+	fmt.Fprintf(&sb, "TITLE %s\n", quote(title))
+	fmt.Fprintf(&sb, "FILE %s WAVE\n", quote(file))
+	for i, track := range tracks {
+		fmt.Fprintf(&sb, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&sb, "    TITLE %s\n", quote(track.title))
+		if track.performer != "" {
+			fmt.Fprintf(&sb, "    PERFORMER %s\n", quote(track.performer))
+		}
+		frames := int(math.Round(track.start * cueFramesPerSecond))
+		seconds := frames / cueFramesPerSecond
+		fmt.Fprintf(&sb, "    INDEX 01 %02d:%02d:%02d\n", seconds/60, seconds%60, frames%cueFramesPerSecond)
+	}
+	return sb.String()
+}
+
+// ffmetadataChapters renders the tracks in ffmpeg's metadata format, which
+// ffmpeg -i merged.m4a -i chapters.txt -map_metadata 1 -map_chapters 1
+// writes into a file
+func ffmetadataChapters(title, performer string, tracks []chapterTrack) string {
+	escape := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n").Replace
+
+	var sb strings.Builder
+	sb.WriteString(";FFMETADATA1\n")
+	fmt.Fprintf(&sb, "title=%s\n", escape(title))
+	if performer != "" {
+		fmt.Fprintf(&sb, "artist=%s\n", escape(performer))
+	}
+	for _, track := range tracks {
+		sb.WriteString("\n[CHAPTER]\nTIMEBASE=1/1000\n")
+		fmt.Fprintf(&sb, "START=%d\nEND=%d\n", int64(math.Round(track.start*1000)), int64(math.Round(track.end*1000)))
+		fmt.Fprintf(&sb, "title=%s\n", escape(track.title))
+	}
+	return sb.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Average bitrates in kbit/s used to estimate download sizes. Lossless
+// bitrates vary with the material, so these are rough figures.
+var estimatedBitrates = map[string]int64{
+	"alac":       1000, // 16-bit/44.1 kHz
+	"alac-hires": 3000, // 24-bit up to 192 kHz
+	"atmos":      768,
+	"aac":        256,
+}
+
+// Formats the catalog reports per track, in order of preference
+var catalogFormats = []string{"alac", "atmos", "aac"}
+
+// FormatAvailability describes how much of the content is offered in a format
+type FormatAvailability struct {
+	Available      bool  `json:"available"`
+	Tracks         int   `json:"tracks"`
+	EstimatedBytes int64 `json:"estimated_bytes"`
+}
+
+// CheckResult is the pre-flight report returned by GET /check
+type CheckResult struct {
+	URL        string                        `json:"url"`
+	Type       string                        `json:"type"`
+	ID         string                        `json:"id"`
+	Storefront string                        `json:"storefront"`
+	Available  bool                          `json:"available"`
+	Name       string                        `json:"name,omitempty"`
+	Artist     string                        `json:"artist,omitempty"`
+	TrackCount int                           `json:"track_count"`
+	DurationMS int64                         `json:"duration_ms"`
+	HiRes      bool                          `json:"hi_res"`
+	Formats    map[string]FormatAvailability `json:"formats"`
+
+	// Set when the link isn't in the account's storefront
+	Warning string `json:"warning,omitempty"`
+}
+
+// catalogTracks returns the playable items of a resource: its tracks for
+// albums and playlists, or the resource itself for songs and videos
+func catalogTracks(resource *catalogResource, songID string) []catalogResource {
+	tracks := resource.Relationships.Tracks.Data
+	if len(tracks) == 0 && resource.Type != "albums" && resource.Type != "playlists" {
+		return []catalogResource{*resource}
+	}
+	if songID != "" {
+		for _, track := range tracks {
+			if track.ID == songID {
+				return []catalogResource{track}
+			}
+		}
+		return nil
+	}
+	return tracks
+}
+
+// trackFormats returns the formats a track is offered in, none for tracks
+// that can't be streamed in the storefront and for videos
+func trackFormats(track catalogResource) []string {
+	formats := []string{}
+	if track.Attributes.PlayParams == nil || track.Type == "music-videos" {
+		return formats
+	}
+	traits := track.Attributes.AudioTraits
+	for _, format := range catalogFormats {
+		if format == "aac" || (format == "alac" && slices.Contains(traits, "lossless")) || (format == "atmos" && slices.Contains(traits, "atmos")) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+func checkAvailability(rawURL, storefront string) (*CheckResult, error) {
+	link, err := parseAppleMusicURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CheckResult{
+		URL:        rawURL,
+		Type:       link.Type,
+		ID:         link.ID,
+		Storefront: storefront,
+		Formats:    map[string]FormatAvailability{},
+		Warning:    storefrontWarning(rawURL),
+	}
+	if link.SongID != "" {
+		result.Type = "song"
+		result.ID = link.SongID
+	}
+	for _, format := range catalogFormats {
+		result.Formats[format] = FormatAvailability{}
+	}
+
+	resource, err := appleMusic.Resource(storefront, link.Type, link.ID, "")
+	if errors.Is(err, errCatalogNotFound) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Name = resource.Attributes.Name
+	result.Artist = resource.Attributes.ArtistName
+	if result.Artist == "" {
+		result.Artist = resource.Attributes.CuratorName
+	}
+
+	for _, track := range catalogTracks(resource, link.SongID) {
+		// Tracks without play parameters can't be streamed in this storefront
+		if track.Attributes.PlayParams == nil || track.Type == "music-videos" {
+			continue
+		}
+		result.TrackCount++
+		duration := track.Attributes.DurationInMillis
+		result.DurationMS += duration
+
+		hiRes := slices.Contains(track.Attributes.AudioTraits, "hi-res-lossless")
+		result.HiRes = result.HiRes || hiRes
+
+		for _, format := range trackFormats(track) {
+			bitrate := estimatedBitrates[format]
+			if format == "alac" && hiRes {
+				bitrate = estimatedBitrates["alac-hires"]
+			}
+			availability := result.Formats[format]
+			availability.Available = true
+			availability.Tracks++
+			availability.EstimatedBytes += duration * bitrate / 8
+			result.Formats[format] = availability
+		}
+	}
+	result.Available = result.TrackCount > 0
+
+	return result, nil
+}
+
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "URL is required", http.StatusBadRequest)
+		return
+	}
+
+	storefront := r.URL.Query().Get("storefront")
+	if storefront == "" {
+		storefront = cfg.Storefront
+	}
+
+	result, err := checkAvailability(url, storefront)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Check failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
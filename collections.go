@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const collectionsFile = "collections.json"
+
+// Collection groups the jobs and batches of one project, such as a playlist
+// put together over many submissions, so they can be followed as one unit
+type Collection struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	JobIDs      []string  `json:"job_ids"`
+	BatchIDs    []string  `json:"batch_ids"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// collectionInput is the body of POST /collections
+type collectionInput struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// collectionMembers is the body of POST /collections/{id}/attach and
+// /detach
+type collectionMembers struct {
+	JobIDs   []string `json:"job_ids"`
+	BatchIDs []string `json:"batch_ids"`
+}
+
+type CollectionStore struct {
+	mu          sync.RWMutex
+	collections map[string]*Collection
+}
+
+var collectionStore = &CollectionStore{collections: map[string]*Collection{}}
+
+var errCollectionNotFound = errors.New("collection not found")
+
+func (cs *CollectionStore) load() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var saved []Collection
+	if err := loadState(collectionsFile, &saved); err != nil {
+		return err
+	}
+	for _, c := range saved {
+		cs.collections[c.ID] = &c
+	}
+	return nil
+}
+
+// save persists the collections; callers hold cs.mu
+func (cs *CollectionStore) save() error {
+	saved := []Collection{}
+	for _, c := range cs.collections {
+		saved = append(saved, *c)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	return saveState(collectionsFile, saved)
+}
+
+func (cs *CollectionStore) List() []Collection {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	list := []Collection{}
+	for _, c := range cs.collections {
+		list = append(list, c.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (cs *CollectionStore) Get(id string) (Collection, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	c, exists := cs.collections[id]
+	if !exists {
+		return Collection{}, false
+	}
+	return c.clone(), true
+}
+
+func (cs *CollectionStore) Create(in collectionInput) (Collection, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := &Collection{
+		ID:          uuid.New().String(),
+		Name:        in.Name,
+		Description: in.Description,
+		JobIDs:      []string{},
+		BatchIDs:    []string{},
+		CreatedAt:   time.Now(),
+	}
+	cs.collections[c.ID] = c
+	return c.clone(), cs.save()
+}
+
+func (cs *CollectionStore) Delete(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, exists := cs.collections[id]; !exists {
+		return errCollectionNotFound
+	}
+	delete(cs.collections, id)
+	return cs.save()
+}
+
+// Attach adds jobs and batches to a collection, skipping those already in
+// it
+func (cs *CollectionStore) Attach(id string, members collectionMembers) (Collection, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, exists := cs.collections[id]
+	if !exists {
+		return Collection{}, errCollectionNotFound
+	}
+	for _, jobID := range members.JobIDs {
+		if !slices.Contains(c.JobIDs, jobID) {
+			c.JobIDs = append(c.JobIDs, jobID)
+		}
+	}
+	for _, batchID := range members.BatchIDs {
+		if !slices.Contains(c.BatchIDs, batchID) {
+			c.BatchIDs = append(c.BatchIDs, batchID)
+		}
+	}
+	return c.clone(), cs.save()
+}
+
+// Detach removes jobs and batches from a collection
+func (cs *CollectionStore) Detach(id string, members collectionMembers) (Collection, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, exists := cs.collections[id]
+	if !exists {
+		return Collection{}, errCollectionNotFound
+	}
+	c.JobIDs = slices.DeleteFunc(c.JobIDs, func(jobID string) bool { return slices.Contains(members.JobIDs, jobID) })
+	c.BatchIDs = slices.DeleteFunc(c.BatchIDs, func(batchID string) bool { return slices.Contains(members.BatchIDs, batchID) })
+	return c.clone(), cs.save()
+}
+
+func (c *Collection) clone() Collection {
+	snapshot := *c
+	snapshot.JobIDs = slices.Clone(c.JobIDs)
+	snapshot.BatchIDs = slices.Clone(c.BatchIDs)
+	return snapshot
+}
+
+// jobs returns the jobs attached to the collection and those of its
+// batches, each once. Batches are kept in memory only, so after a restart
+// their jobs are found by the batch_id they were created with.
+func (c Collection) jobs() []DownloadStatus {
+	ids := slices.Clone(c.JobIDs)
+	var all []DownloadStatus
+	for _, batchID := range c.BatchIDs {
+		if batch, exists := batchManager.Snapshot(batchID); exists {
+			ids = append(ids, batch.JobIDs...)
+			continue
+		}
+		if all == nil {
+			all = jobManager.SnapshotAll()
+			sort.Slice(all, func(i, j int) bool { return all[i].StartedAt.Before(all[j].StartedAt) })
+		}
+		for _, job := range all {
+			if job.BatchID == batchID {
+				ids = append(ids, job.ID)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	jobs := []DownloadStatus{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if job, exists := jobManager.Snapshot(id); exists {
+			job.Logs = nil
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// CollectionStatus aggregates the statuses of a collection's jobs. Status is
+// "empty", "in_progress" while any job hasn't finished, "completed" when
+// every job completed, and "finished_with_errors" otherwise.
+type CollectionStatus struct {
+	Collection
+	Status   string         `json:"status"`
+	Total    int            `json:"total"`
+	Finished int            `json:"finished"`
+	Counts   map[string]int `json:"counts"`
+}
+
+func collectionStatus(c Collection, jobs []DownloadStatus) CollectionStatus {
+	status := CollectionStatus{Collection: c, Total: len(jobs), Counts: map[string]int{}}
+	for _, job := range jobs {
+		status.Counts[job.Status]++
+		if job.EndedAt != nil {
+			status.Finished++
+		}
+	}
+	switch {
+	case status.Total == 0:
+		status.Status = "empty"
+	case status.Finished < status.Total:
+		status.Status = "in_progress"
+	case status.Counts["completed"] == status.Total:
+		status.Status = "completed"
+	default:
+		status.Status = "finished_with_errors"
+	}
+	return status
+}
+
+// CollectionFile is a file in a collection's manifest
+type CollectionFile struct {
+	JobID string `json:"job_id"`
+	Artifact
+}
+
+// handleCollections lists (GET) and creates (POST) collections
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		collections := collectionStore.List()
+		statuses := make([]CollectionStatus, len(collections))
+		for i, c := range collections {
+			statuses[i] = collectionStatus(c, c.jobs())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"collections": statuses,
+			"count":       len(statuses),
+		})
+
+	case http.MethodPost:
+		var in collectionInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		in.Name = strings.TrimSpace(in.Name)
+		if in.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		c, err := collectionStore.Create(in)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save collections", "error", err)
+			http.Error(w, "Failed to save collection", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCollection serves /collections/{id} (GET, DELETE) and its attach,
+// detach, manifest, playlist and export resources
+func handleCollection(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(r.URL.Path[len("/collections/"):], "/")
+	if id == "" {
+		http.Error(w, "Collection ID is required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case resource == "" && r.Method == http.MethodDelete:
+		if err := collectionStore.Delete(id); err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case resource == "attach" || resource == "detach":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var members collectionMembers
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		update := collectionStore.Attach
+		if resource == "detach" {
+			update = collectionStore.Detach
+		}
+		c, err := update(id, members)
+		if err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collectionStatus(c, c.jobs()))
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, exists := collectionStore.Get(id)
+	if !exists {
+		writeCollectionError(w, errCollectionNotFound)
+		return
+	}
+	jobs := c.jobs()
+
+	switch resource {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"collection": collectionStatus(c, jobs),
+			"jobs":       jobs,
+		})
+
+	case "manifest":
+		files := []CollectionFile{}
+		for _, job := range jobs {
+			for _, artifact := range append(job.Artifacts, job.Extras...) {
+				files = append(files, CollectionFile{JobID: job.ID, Artifact: artifact})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"collection_id": c.ID,
+			"name":          c.Name,
+			"files":         files,
+		})
+
+	case "playlist":
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sanitizeName(c.Name, "windows")+".m3u8"))
+		writePlaylist(w, jobs, nil)
+
+	case "export":
+		handleCollectionExport(w, r, c, jobs)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writePlaylist writes an extended M3U playlist of the audio files of jobs,
+// with paths relative to DOWNLOADS_DIR, so it works when saved there. A
+// file downloaded by several jobs is listed once. rename, when given, maps
+// the paths to those of exported files.
+func writePlaylist(w io.Writer, jobs []DownloadStatus, rename func(string) string) {
+	if rename == nil {
+		rename = func(name string) string { return name }
+	}
+	seen := map[string]bool{}
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, job := range jobs {
+		if len(job.Tracks) > 0 {
+			for _, track := range job.Tracks {
+				if seen[track.Path] {
+					continue
+				}
+				seen[track.Path] = true
+				seconds := -1
+				if track.Duration > 0 {
+					seconds = int(track.Duration + 0.5)
+				}
+				fmt.Fprintf(w, "#EXTINF:%d,%s\n%s\n", seconds, track.Title, rename(filepath.ToSlash(track.Path)))
+			}
+			continue
+		}
+		for _, artifact := range job.Artifacts {
+			if artifact.Kind == "audio" && !seen[artifact.Path] {
+				seen[artifact.Path] = true
+				fmt.Fprintln(w, rename(filepath.ToSlash(artifact.Path)))
+			}
+		}
+	}
+}
+
+func writeCollectionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCollectionNotFound) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	slog.Error("Failed to save collections", "error", err)
+	http.Error(w, "Failed to save collection", http.StatusInternalServerError)
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configFile = flag.String("config", "", "YAML file with configuration variables; also CONFIG_FILE")
+
+// configFlags are command-line shortcuts for common configuration
+// variables; -set KEY=VALUE sets any other
+var configFlags = map[string]string{
+	"listen":            "LISTEN_ADDR",
+	"downloader-path":   "DOWNLOADER_PATH",
+	"downloader-config": "DOWNLOADER_CONFIG",
+	"downloads-dir":     "DOWNLOADS_DIR",
+	"default-timeout":   "DEFAULT_TIMEOUT",
+	"job-log-lines":     "JOB_LOG_LINES",
+	"max-concurrent":    "MAX_CONCURRENT_DOWNLOADS",
+}
+
+// Configuration variables set by flags and the config file. Flags take
+// precedence over the environment, which takes precedence over the file.
+var (
+	flagConfig = map[string]string{}
+	fileConfig = map[string]string{}
+)
+
+type configFlag string
+
+func (f configFlag) String() string { return "" }
+
+func (f configFlag) Set(value string) error {
+	flagConfig[string(f)] = value
+	return nil
+}
+
+type setFlag struct{}
+
+func (setFlag) String() string { return "" }
+
+func (setFlag) Set(value string) error {
+	key, value, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected KEY=VALUE")
+	}
+	flagConfig[configKey(key)] = value
+	return nil
+}
+
+func init() {
+	for name, key := range configFlags {
+		flag.Var(configFlag(key), name, "sets "+key)
+	}
+	flag.Var(setFlag{}, "set", "sets a configuration variable, as `KEY=VALUE`; may be repeated")
+}
+
+// configKey normalizes a variable name from a flag or the config file, so
+// "listen_addr" and "listen-addr" both mean LISTEN_ADDR
+func configKey(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(name), "-", "_"))
+}
+
+// loadConfigFile reads a YAML mapping of configuration variables. Lists are
+// joined with commas, so
+//
+//	listen_addr: [":8080", "[::1]:8081"]
+//
+// is the same as LISTEN_ADDR=:8080,[::1]:8081. Lists of mappings, such as
+// routing_rules, are kept as JSON.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, value := range values {
+		var s string
+		switch v := value.(type) {
+		case nil:
+			continue
+		case []any:
+			if slices.ContainsFunc(v, isMapping) {
+				data, err := json.Marshal(v)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", path, name, err)
+				}
+				fileConfig[configKey(name)] = string(data)
+				continue
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			s = strings.Join(items, ",")
+		case map[string]any:
+			return fmt.Errorf("%s: %s must be a value or a list", path, name)
+		default:
+			s = fmt.Sprint(v)
+		}
+		fileConfig[configKey(name)] = s
+	}
+	return nil
+}
+
+func isMapping(value any) bool {
+	_, ok := value.(map[string]any)
+	return ok
+}
+
+// Config holds runtime settings read from flags, the environment and the
+// config file
+type Config struct {
+	// Addresses the API listens on, and an optional separate address for
+	// admin endpoints (/metrics) such as "127.0.0.1:9090"
+	ListenAddrs     []string
+	AdminListenAddr string
+
+	// Keys required in the X-API-Key header, with full or read-only
+	// access, and a JSON file of further named keys
+	APIKeys         []string
+	APIReadOnlyKeys []string
+	APIKeysFile     string
+
+	// Path to a JSON file describing /ingest/webhook/{source} mappings
+	IngestMappingsFile string
+
+	// Token required by GET /quick; the endpoint is disabled when empty
+	QuickToken string
+
+	// API key and allowed CORS origins for the browser extension endpoint
+	ExtAPIKey         string
+	ExtAllowedOrigins []string
+
+	// Whether /docs serves Swagger UI for /openapi.json, and where its
+	// scripts and styles are loaded from
+	DocsUI       bool
+	DocsUIAssets string
+
+	// Browser origins allowed to open /ws besides the API's own
+	WSAllowedOrigins []string
+
+	// Telegram bot token and the chat IDs allowed to issue commands
+	TelegramBotToken     string
+	TelegramAllowedChats []int64
+
+	// Discord application used for /amdl slash commands. DiscordGuilds maps
+	// each allowed guild ID to the role IDs permitted to use the commands;
+	// an empty role list allows every member of that guild.
+	DiscordApplicationID string
+	DiscordPublicKey     string
+	DiscordBotToken      string
+	DiscordGuilds        map[string][]string
+
+	// IMAP mailbox polled for links mailed in by EmailAllowedSenders
+	// (addresses or "@domain"), over TLS unless IMAPTLS is false
+	IMAPAddr            string
+	IMAPUsername        string
+	IMAPPassword        string
+	IMAPMailbox         string
+	IMAPPollInterval    time.Duration
+	IMAPTLS             bool
+	EmailAllowedSenders []string
+
+	// Mail from allowed senders is only taken when it's authenticated: by
+	// a DMARC, DKIM or SPF pass for the sender's domain in an
+	// Authentication-Results header added by EmailAuthservID, the receiving
+	// mail server, or by EmailSecret in the subject or as a "+secret" tag
+	// of a recipient address
+	EmailAuthservID string
+	EmailSecret     string
+
+	// SMTP server replies to mailed-in requests are sent through
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// Addresses, or "@domain", the notify option of requests may send mail
+	// to; routing rules aren't limited
+	NotifyEmailRecipients []string
+
+	// Directory polled for dropped .txt and .url files with links
+	WatchDir      string
+	WatchInterval time.Duration
+
+	// Storefront used for catalog searches, e.g. "us"
+	Storefront string
+
+	// Apple Music developer token for catalog lookups; scraped from the web
+	// player when empty
+	AppleMusicToken string
+
+	// Album editions to prefer, in order, when a URL has other versions,
+	// e.g. "deluxe,standard"; "ask" rejects ambiguous requests instead
+	EditionPreference []string
+
+	// API key for reading loved tracks from Last.fm
+	LastFMAPIKey string
+
+	// Default Spotify app credentials for playlist migrations
+	SpotifyClientID     string
+	SpotifyClientSecret string
+
+	// Default retry policy for failed download attempts
+	Retry RetryPolicy
+
+	// Number of apple-music-dl processes allowed to run at once
+	MaxConcurrentDownloads int
+
+	// Disk space the output of running jobs may take before queued jobs
+	// wait for them to finish, and how often it's measured; 0 disables it
+	StagingBudgetMB      int
+	StagingCheckInterval time.Duration
+
+	// Batches of more than BatchWaveThreshold jobs run in waves of
+	// BatchWaveSize jobs, with BatchWavePause between them; 0 disables it
+	BatchWaveThreshold int
+	BatchWaveSize      int
+	BatchWavePause     time.Duration
+
+	// Dependencies awaited before jobs are started, and for how long
+	StartupWait    []string
+	StartupTimeout time.Duration
+
+	// Jobs waiting in the queue longer than this are expired; 0 disables it
+	QueueTTL time.Duration
+
+	// Time running downloads get to finish when the wrapper is stopped
+	// before they're interrupted
+	ShutdownGracePeriod time.Duration
+
+	// Time a cancelled download gets to exit after SIGTERM before it's killed
+	CancelGracePeriod time.Duration
+
+	// Queue time after which a waiting job gains one priority level
+	PriorityAging time.Duration
+
+	// Relative share of download slots per job owner; unlisted owners get 1
+	FairShareWeights map[string]float64
+
+	// Header carrying the requesting user's name, e.g. set by a reverse proxy
+	UserHeader string
+
+	// apple-music-dl executable
+	DownloaderPath string
+
+	// Locale the downloader runs in, so its output can be parsed whatever
+	// the host's; "inherit" keeps the wrapper's own
+	DownloaderLocale string
+
+	// Language of API errors, chat replies and notifications when the
+	// client doesn't ask for one: en, ru or de
+	DefaultLanguage string
+
+	// Timeout for jobs that don't set one, and how long an attempt may go
+	// without output before it's stopped as stalled (0 disables it)
+	DefaultTimeout     time.Duration
+	DefaultIdleTimeout time.Duration
+
+	// Log lines kept per job, in memory and in the store
+	JobLogLines int
+
+	// Format of the wrapper's own log, "text" or "json", the lowest level
+	// logged, and whether every HTTP request is logged
+	LogFormat string
+	LogLevel  string
+	AccessLog bool
+
+	// JSON file replacing the patterns downloader output is parsed with,
+	// checked for changes every PatternsReloadInterval (0 disables reloads)
+	PatternsFile           string
+	PatternsReloadInterval time.Duration
+
+	// Directory the downloader's raw output is recorded to as fixtures for
+	// --replay; recording is off when empty
+	RecordOutputDir string
+
+	// apple-music-dl config file, copied with per-job overrides when a
+	// request changes downloader settings
+	DownloaderConfig string
+
+	// Directory the downloader saves to, scanned for the files each job
+	// produced
+	DownloadsDir string
+
+	// JSON file of named output profiles selected by output_profile
+	OutputProfilesFile string
+
+	// Tools used by post-processing steps
+	FFmpegPath  string
+	FFprobePath string
+
+	// Checks run on every job's files once they're downloaded, unless its
+	// output profile or request sets other levels; see VerifyPolicy
+	Verify VerifyPolicy
+
+	// Key signing the download links of collection exports, random for each
+	// run when unset, and how long the links stay valid
+	ExportURLSecret string
+	ExportURLTTL    time.Duration
+
+	// Finished jobs are deleted once they ended longer than JobRetention ago
+	// and beyond the newest JobRetentionMaxJobs, checked every sweep
+	// interval. 0 disables a limit.
+	JobRetention              time.Duration
+	JobRetentionMaxJobs       int
+	JobRetentionSweepInterval time.Duration
+
+	// Limits on finished jobs kept in memory; older ones are evicted, and
+	// archived when StateDir is set. 0 disables a limit.
+	JobCacheMaxJobs int
+	JobCacheMaxMB   int
+
+	// Job state changes kept for GET /jobs/changes
+	JobChangesRetain int
+
+	// URL receiving job.completed, job.failed, job.cancelled and job.expired
+	// events
+	WebhookURL string
+
+	// Secret for the X-Webhook-Signature header of per-job callbacks
+	CallbackSecret string
+
+	// Hosts and networks (CIDR) callbacks may be sent to although they're
+	// on loopback, link-local or private addresses
+	CallbackAllowedHosts []string
+
+	// JSON file of rules routing events to destinations by job labels, and
+	// further rules as JSON, e.g. from the config file
+	RoutingRulesFile string
+	RoutingRules     string
+
+	// JSON file of rules changing or rejecting requests on submission
+	PolicyRulesFile string
+
+	// JSON file of commands and HTTP calls run after successful downloads
+	HooksFile string
+
+	// Format of events posted to WebhookURL, json or cloudevents, and the
+	// CloudEvents source attribute
+	WebhookFormat     string
+	CloudEventsSource string
+
+	// NATS server events are published to, under NATSSubjectPrefix, with an
+	// optional JetStream stream created for them, credentials file and
+	// event format (json or cloudevents)
+	NATSURL           string
+	NATSSubjectPrefix string
+	NATSStream        string
+	NATSCredentials   string
+	NATSFormat        string
+
+	// Kafka brokers to bootstrap from, topic events are produced to, event
+	// format (json or cloudevents) and whether to connect over TLS
+	KafkaBrokers []string
+	KafkaTopic   string
+	KafkaFormat  string
+	KafkaTLS     bool
+
+	// PostgreSQL database the job and track tables are mirrored to, as a
+	// lib/pq connection string or URL
+	PostgresMirrorURL string
+
+	// Plex server and token, with the section to refresh when it can't be
+	// told from the path, and Jellyfin server and API key, whose libraries
+	// are refreshed once a job completes. Path maps translate paths of the
+	// wrapper into each server's as "from=to" pairs.
+	PlexURL         string
+	PlexToken       string
+	PlexSection     string
+	PlexPathMap     []string
+	JellyfinURL     string
+	JellyfinAPIKey  string
+	JellyfinPathMap []string
+
+	// Append-only JSONL file who requested what is recorded to, and the
+	// PEM file with the Ed25519 key exported chunks are signed with
+	AuditLog        string
+	AuditSigningKey string
+
+	// Backoff for failed webhook deliveries; deliveries still failing after
+	// MaxAttempts are dead-lettered
+	WebhookRetry RetryPolicy
+
+	// Proxy URL for outbound calls to webhooks, chat and music APIs, and
+	// PEM files with extra CA certificates to trust for them
+	OutboundProxy string
+	ExtraCACerts  []string
+
+	// SQLite database jobs are persisted to; jobs are kept in memory only
+	// when empty
+	JobDatabase string
+
+	// Directory for persisted state such as user preferences; state is kept
+	// in memory only when empty
+	StateDir string
+}
+
+// loadConfig reads the configuration once flags have been parsed
+func loadConfig() (*Config, error) {
+	configPath = *configFile
+	if configPath == "" {
+		configPath = os.Getenv("CONFIG_FILE")
+	}
+	if configPath != "" {
+		if err := loadConfigFile(configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	durationTolerance := envInt("VERIFY_DURATION_TOLERANCE", 2)
+	c := &Config{
+		ListenAddrs:     splitList(envOr("LISTEN_ADDR", ":8080")),
+		AdminListenAddr: getenv("ADMIN_LISTEN_ADDR"),
+
+		APIKeys:            splitList(getenv("API_KEYS")),
+		APIReadOnlyKeys:    splitList(getenv("API_READ_ONLY_KEYS")),
+		APIKeysFile:        getenv("API_KEYS_FILE"),
+		IngestMappingsFile: getenv("INGEST_MAPPINGS_FILE"),
+		QuickToken:         getenv("QUICK_TOKEN"),
+		ExtAPIKey:          getenv("EXT_API_KEY"),
+		ExtAllowedOrigins:  splitList(getenv("EXT_ALLOWED_ORIGINS")),
+		DocsUI:             getenv("DOCS_UI") == "true",
+		DocsUIAssets:       envOr("DOCS_UI_ASSETS", "https://unpkg.com/swagger-ui-dist@5"),
+		WSAllowedOrigins:   splitList(getenv("WS_ALLOWED_ORIGINS")),
+
+		TelegramBotToken:     getenv("TELEGRAM_BOT_TOKEN"),
+		TelegramAllowedChats: splitIntList("TELEGRAM_ALLOWED_CHATS"),
+
+		DiscordApplicationID: getenv("DISCORD_APPLICATION_ID"),
+		DiscordPublicKey:     getenv("DISCORD_PUBLIC_KEY"),
+		DiscordBotToken:      getenv("DISCORD_BOT_TOKEN"),
+		DiscordGuilds:        parseDiscordGuilds(getenv("DISCORD_GUILDS")),
+
+		IMAPAddr:            getenv("IMAP_ADDR"),
+		IMAPUsername:        getenv("IMAP_USERNAME"),
+		IMAPPassword:        getenv("IMAP_PASSWORD"),
+		IMAPMailbox:         envOr("IMAP_MAILBOX", "INBOX"),
+		IMAPPollInterval:    envDuration("IMAP_POLL_INTERVAL", time.Minute),
+		IMAPTLS:             getenv("IMAP_TLS") != "false",
+		EmailAllowedSenders: splitList(getenv("EMAIL_ALLOWED_SENDERS")),
+		EmailAuthservID:     getenv("EMAIL_AUTHSERV_ID"),
+		EmailSecret:         getenv("EMAIL_SECRET"),
+
+		SMTPAddr:     getenv("SMTP_ADDR"),
+		SMTPUsername: getenv("SMTP_USERNAME"),
+		SMTPPassword: getenv("SMTP_PASSWORD"),
+		SMTPFrom:     envOr("SMTP_FROM", getenv("IMAP_USERNAME")),
+
+		NotifyEmailRecipients: splitList(getenv("NOTIFY_EMAIL_RECIPIENTS")),
+
+		WatchDir:      getenv("WATCH_DIR"),
+		WatchInterval: envDuration("WATCH_INTERVAL", 5*time.Second),
+
+		Storefront:      envOr("STOREFRONT", "us"),
+		AppleMusicToken: getenv("APPLE_MUSIC_TOKEN"),
+		LastFMAPIKey:    getenv("LASTFM_API_KEY"),
+
+		EditionPreference: splitList(getenv("EDITION_PREFERENCE")),
+
+		SpotifyClientID:     getenv("SPOTIFY_CLIENT_ID"),
+		SpotifyClientSecret: getenv("SPOTIFY_CLIENT_SECRET"),
+
+		Retry: RetryPolicy{
+			MaxAttempts:    envInt("RETRY_MAX_ATTEMPTS", 1),
+			BaseDelay:      envInt("RETRY_BASE_DELAY", 30),
+			Multiplier:     envFloat("RETRY_MULTIPLIER", 2),
+			RetryableCodes: splitList(envOr("RETRY_CODES", "timeout,transient,stalled")),
+		},
+
+		MaxConcurrentDownloads: envInt("MAX_CONCURRENT_DOWNLOADS", 1),
+		StagingBudgetMB:        envInt("STAGING_BUDGET_MB", 0),
+		StagingCheckInterval:   envDuration("STAGING_CHECK_INTERVAL", 10*time.Second),
+		BatchWaveThreshold:     envInt("BATCH_WAVE_THRESHOLD", 0),
+		BatchWaveSize:          envInt("BATCH_WAVE_SIZE", 50),
+		BatchWavePause:         envDuration("BATCH_WAVE_PAUSE", 15*time.Minute),
+		StartupWait:            splitList(getenv("STARTUP_WAIT")),
+		StartupTimeout:         envDuration("STARTUP_TIMEOUT", 2*time.Minute),
+		QueueTTL:               envDuration("QUEUE_TTL", 0),
+		ShutdownGracePeriod:    envDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second),
+		CancelGracePeriod:      envDuration("CANCEL_GRACE_PERIOD", 10*time.Second),
+		PriorityAging:          envDuration("PRIORITY_AGING", 30*time.Minute),
+		FairShareWeights:       parseWeights(getenv("FAIR_SHARE_WEIGHTS")),
+		UserHeader:             envOr("USER_HEADER", "X-User"),
+
+		DownloaderPath:     envOr("DOWNLOADER_PATH", defaultDownloaderPath),
+		DownloaderLocale:   envOr("DOWNLOADER_LOCALE", "C.UTF-8"),
+		DefaultLanguage:    envOr("DEFAULT_LANGUAGE", "en"),
+		DefaultTimeout:     envDuration("DEFAULT_TIMEOUT", time.Hour),
+		DefaultIdleTimeout: envDuration("DEFAULT_IDLE_TIMEOUT", 0),
+		JobLogLines:        envInt("JOB_LOG_LINES", 100),
+		LogFormat:          envOr("LOG_FORMAT", "text"),
+		LogLevel:           envOr("LOG_LEVEL", "info"),
+		AccessLog:          envOr("ACCESS_LOG", "true") == "true",
+		RecordOutputDir:    getenv("RECORD_OUTPUT_DIR"),
+
+		PatternsFile:           getenv("PATTERNS_FILE"),
+		PatternsReloadInterval: envDuration("PATTERNS_RELOAD_INTERVAL", 30*time.Second),
+
+		DownloaderConfig:   envOr("DOWNLOADER_CONFIG", "/app/config.yaml"),
+		DownloadsDir:       envOr("DOWNLOADS_DIR", "/downloads"),
+		OutputProfilesFile: getenv("OUTPUT_PROFILES_FILE"),
+		FFmpegPath:         envOr("FFMPEG_PATH", "ffmpeg"),
+		FFprobePath:        envOr("FFPROBE_PATH", "ffprobe"),
+
+		Verify: VerifyPolicy{
+			Checksums:         getenv("VERIFY_CHECKSUMS"),
+			Decode:            getenv("VERIFY_DECODE"),
+			Tags:              getenv("VERIFY_TAGS"),
+			Artwork:           getenv("VERIFY_ARTWORK"),
+			Duration:          getenv("VERIFY_DURATION"),
+			DurationTolerance: &durationTolerance,
+		},
+		ExportURLSecret: getenv("EXPORT_URL_SECRET"),
+		ExportURLTTL:    envDuration("EXPORT_URL_TTL", 24*time.Hour),
+
+		JobRetention:              envDuration("JOB_RETENTION", 0),
+		JobRetentionMaxJobs:       envInt("JOB_RETENTION_MAX_JOBS", 0),
+		JobRetentionSweepInterval: envDuration("JOB_RETENTION_SWEEP_INTERVAL", 10*time.Minute),
+
+		JobCacheMaxJobs: envInt("JOB_CACHE_MAX_JOBS", 1000),
+		JobCacheMaxMB:   envInt("JOB_CACHE_MAX_MB", 64),
+
+		JobChangesRetain: envInt("JOB_CHANGES_RETAIN", 10000),
+
+		WebhookURL:           getenv("WEBHOOK_URL"),
+		WebhookFormat:        getenv("WEBHOOK_FORMAT"),
+		CallbackSecret:       getenv("CALLBACK_SECRET"),
+		CallbackAllowedHosts: splitList(strings.ToLower(getenv("CALLBACK_ALLOWED_HOSTS"))),
+		RoutingRulesFile:     getenv("ROUTING_RULES_FILE"),
+		RoutingRules:         getenv("ROUTING_RULES"),
+		PolicyRulesFile:      getenv("POLICY_RULES_FILE"),
+		HooksFile:            getenv("HOOKS_FILE"),
+		CloudEventsSource:    envOr("CLOUDEVENTS_SOURCE", "/apple-music-dl-http-wrapper"),
+		WebhookRetry: RetryPolicy{
+			MaxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 8),
+			BaseDelay:   envInt("WEBHOOK_RETRY_DELAY", 30),
+			Multiplier:  envFloat("WEBHOOK_RETRY_MULTIPLIER", 2),
+		},
+
+		NATSURL:           getenv("NATS_URL"),
+		NATSSubjectPrefix: envOr("NATS_SUBJECT_PREFIX", "amdl"),
+		NATSStream:        getenv("NATS_STREAM"),
+		NATSCredentials:   getenv("NATS_CREDS"),
+		NATSFormat:        getenv("NATS_FORMAT"),
+
+		KafkaBrokers: splitList(getenv("KAFKA_BROKERS")),
+		KafkaTopic:   envOr("KAFKA_TOPIC", "amdl-events"),
+		KafkaFormat:  getenv("KAFKA_FORMAT"),
+		KafkaTLS:     getenv("KAFKA_TLS") == "true",
+
+		PostgresMirrorURL: getenv("POSTGRES_MIRROR_URL"),
+
+		PlexURL:         getenv("PLEX_URL"),
+		PlexToken:       getenv("PLEX_TOKEN"),
+		PlexSection:     getenv("PLEX_SECTION"),
+		PlexPathMap:     splitList(getenv("PLEX_PATH_MAP")),
+		JellyfinURL:     getenv("JELLYFIN_URL"),
+		JellyfinAPIKey:  getenv("JELLYFIN_API_KEY"),
+		JellyfinPathMap: splitList(getenv("JELLYFIN_PATH_MAP")),
+
+		AuditLog:        getenv("AUDIT_LOG"),
+		AuditSigningKey: getenv("AUDIT_SIGNING_KEY"),
+
+		OutboundProxy: getenv("OUTBOUND_PROXY"),
+		ExtraCACerts:  splitList(getenv("EXTRA_CA_CERTS")),
+
+		JobDatabase: getenv("JOB_DB"),
+		StateDir:    getenv("STATE_DIR"),
+	}
+	return c, c.validate()
+}
+
+// validate rejects values the wrapper can't run with
+func (c *Config) validate() error {
+	if c.JobLogLines < 1 {
+		return fmt.Errorf("JOB_LOG_LINES must be at least 1, got %d", c.JobLogLines)
+	}
+	if c.JobChangesRetain < 1 {
+		return fmt.Errorf("JOB_CHANGES_RETAIN must be at least 1, got %d", c.JobChangesRetain)
+	}
+	if c.JobRetentionSweepInterval <= 0 {
+		return fmt.Errorf("JOB_RETENTION_SWEEP_INTERVAL must be above 0, got %s", c.JobRetentionSweepInterval)
+	}
+	if c.StagingCheckInterval <= 0 {
+		return fmt.Errorf("STAGING_CHECK_INTERVAL must be above 0, got %s", c.StagingCheckInterval)
+	}
+	if c.IMAPPollInterval <= 0 {
+		return fmt.Errorf("IMAP_POLL_INTERVAL must be above 0, got %s", c.IMAPPollInterval)
+	}
+	if c.WatchInterval <= 0 {
+		return fmt.Errorf("WATCH_INTERVAL must be above 0, got %s", c.WatchInterval)
+	}
+	return nil
+}
+
+var (
+	// configPath is the config file read, if any
+	configPath string
+
+	// configEnv holds the configuration variables that were set, so an
+	// installed service can be checked to run with the same settings
+	configEnv = map[string]string{}
+)
+
+// getenv looks a configuration variable up in the flags, the environment
+// and the config file, in that order
+func getenv(key string) string {
+	value, ok := flagConfig[key]
+	if !ok {
+		value = os.Getenv(key)
+	}
+	if value == "" {
+		value = fileConfig[key]
+	}
+	if value != "" {
+		configEnv[key] = value
+	}
+	return value
+}
+
+func envOr(key, fallback string) string {
+	if value := getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList parses a comma-separated environment value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitIntList parses a comma-separated list of integers from the environment
+func splitIntList(key string) []int64 {
+	var values []int64
+	for _, item := range splitList(getenv(key)) {
+		value, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			slog.Warn("Ignoring invalid entry", "variable", key, "entry", item, "error", err)
+			continue
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// parseDiscordGuilds parses entries of the form "guild_id" or
+// "guild_id:role_id|role_id"
+func parseDiscordGuilds(value string) map[string][]string {
+	guilds := map[string][]string{}
+	for _, entry := range splitList(value) {
+		guild, roles, _ := strings.Cut(entry, ":")
+		guilds[guild] = nil
+		for _, role := range strings.Split(roles, "|") {
+			if role = strings.TrimSpace(role); role != "" {
+				guilds[guild] = append(guilds[guild], role)
+			}
+		}
+	}
+	return guilds
+}
+
+func envInt(key string, fallback int) int {
+	value := getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Ignoring invalid value", "variable", key, "value", value, "error", err)
+		return fallback
+	}
+	return parsed
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value := getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Ignoring invalid value", "variable", key, "value", value, "error", err)
+		return fallback
+	}
+	return parsed
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Ignoring invalid value", "variable", key, "value", value, "error", err)
+		return fallback
+	}
+	return parsed
+}
+
+// parseWeights parses entries of the form "owner=weight"
+func parseWeights(value string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, entry := range splitList(value) {
+		owner, weight, _ := strings.Cut(entry, "=")
+		parsed, err := strconv.ParseFloat(weight, 64)
+		if err != nil || parsed <= 0 {
+			slog.Warn("Ignoring invalid fair share weight", "entry", entry)
+			continue
+		}
+		weights[strings.TrimSpace(owner)] = parsed
+	}
+	return weights
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidateIntervals(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			JobLogLines:               1,
+			JobChangesRetain:          1,
+			JobRetentionSweepInterval: time.Minute,
+			StagingCheckInterval:      time.Minute,
+			IMAPPollInterval:          time.Minute,
+			WatchInterval:             time.Second,
+		}
+	}
+	if err := valid().validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		set  func(c *Config, d time.Duration)
+	}{
+		{"JOB_RETENTION_SWEEP_INTERVAL", func(c *Config, d time.Duration) { c.JobRetentionSweepInterval = d }},
+		{"STAGING_CHECK_INTERVAL", func(c *Config, d time.Duration) { c.StagingCheckInterval = d }},
+		{"IMAP_POLL_INTERVAL", func(c *Config, d time.Duration) { c.IMAPPollInterval = d }},
+		{"WATCH_INTERVAL", func(c *Config, d time.Duration) { c.WatchInterval = d }},
+	}
+	for _, tt := range tests {
+		for _, d := range []time.Duration{0, -time.Second} {
+			c := valid()
+			tt.set(c, d)
+			err := c.validate()
+			if err == nil || !strings.HasPrefix(err.Error(), tt.name) {
+				t.Errorf("%s=%s: got error %v", tt.name, d, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Largest credentials upload accepted
+const maxCredentialsUpload = 1 << 20
+
+// Cookies music.apple.com sets for a signed-in user: the user token, and
+// the account's storefront
+const (
+	mediaUserTokenCookie = "media-user-token"
+	storefrontCookie     = "itua"
+)
+
+// Downloader config keys the credentials are written to
+const (
+	mediaUserTokenKey     = "media-user-token"
+	authorizationTokenKey = "authorization-token"
+	storefrontKey         = "storefront"
+)
+
+// Credentials are the Apple Music account credentials the downloader reads
+// from its config. Expires is when the media-user-token cookie expires, if
+// known.
+type Credentials struct {
+	MediaUserToken     string
+	AuthorizationToken string
+	Storefront         string
+	Expires            *time.Time
+}
+
+// CredentialCheck is the outcome of checking one credential: "ok",
+// "missing", "expired", "rejected", "unreachable", "mismatch" or "unknown"
+// when it couldn't be checked
+type CredentialCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CredentialsReport is the result of checking the downloader's credentials,
+// and of saving uploaded ones
+type CredentialsReport struct {
+	Valid   bool              `json:"valid"`
+	Saved   bool              `json:"saved"`
+	Updated []string          `json:"updated,omitempty"`
+	Expires *time.Time        `json:"expires,omitempty"`
+	Checks  []CredentialCheck `json:"checks"`
+}
+
+// credentialFailures are check statuses that make credentials unusable
+var credentialFailures = []string{"missing", "expired", "rejected", "unreachable"}
+
+// placeholderCredential reports whether value is unset or the placeholder of
+// the downloader's example config, such as "your-media-user-token"
+func placeholderCredential(value string) bool {
+	return value == "" || strings.HasPrefix(value, "your-")
+}
+
+// parseCredentials reads an upload: a Netscape cookies.txt exported from a
+// browser, a JSON array of cookies as exported by browser extensions, or a
+// JSON object with the tokens themselves
+func parseCredentials(data []byte) (Credentials, error) {
+	var creds Credentials
+	var err error
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		creds, err = parseTokenJSON(trimmed)
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		creds, err = parseCookieJSON(trimmed)
+	default:
+		creds, err = parseCookiesTxt(trimmed)
+	}
+	if err != nil {
+		return creds, err
+	}
+	if creds.MediaUserToken == "" && creds.AuthorizationToken == "" {
+		return creds, errors.New("no media-user-token cookie for music.apple.com found; sign in at music.apple.com and export its cookies again")
+	}
+	return creds, nil
+}
+
+func parseTokenJSON(data []byte) (Credentials, error) {
+	var tokens map[string]string
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return Credentials{}, fmt.Errorf("invalid token JSON: %w", err)
+	}
+	get := func(names ...string) string {
+		for _, name := range names {
+			if value := strings.TrimSpace(tokens[name]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	return Credentials{
+		MediaUserToken:     get("media_user_token", "media-user-token", "mediaUserToken"),
+		AuthorizationToken: strings.TrimPrefix(get("authorization_token", "authorization-token", "authorizationToken", "developer_token"), "Bearer "),
+		Storefront:         strings.ToLower(get("storefront")),
+	}, nil
+}
+
+// cookie is the subset of a browser cookie the credentials are read from
+type cookie struct {
+	Domain  string
+	Name    string
+	Value   string
+	Expires time.Time
+}
+
+// credentialsFromCookies picks the credentials out of music.apple.com's
+// cookies
+func credentialsFromCookies(cookies []cookie) Credentials {
+	var creds Credentials
+	for _, c := range cookies {
+		domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		if domain != "apple.com" && !strings.HasSuffix(domain, ".apple.com") {
+			continue
+		}
+		switch c.Name {
+		case mediaUserTokenCookie:
+			creds.MediaUserToken = c.Value
+			if !c.Expires.IsZero() {
+				expires := c.Expires
+				creds.Expires = &expires
+			}
+		case storefrontCookie:
+			creds.Storefront = strings.ToLower(c.Value)
+		}
+	}
+	return creds
+}
+
+// parseCookiesTxt reads the tab-separated Netscape format: domain, include
+// subdomains, path, secure, expiry as a Unix time, name and value
+func parseCookiesTxt(data []byte) (Credentials, error) {
+	var cookies []cookie
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxCredentialsUpload)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		text = strings.TrimPrefix(text, "#HttpOnly_")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return Credentials{}, fmt.Errorf("cookies.txt line %d: expected 7 tab-separated fields, got %d", line, len(fields))
+		}
+		c := cookie{Domain: fields[0], Name: fields[5], Value: fields[6]}
+		if expiry, err := strconv.ParseInt(fields[4], 10, 64); err == nil && expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, err
+	}
+	return credentialsFromCookies(cookies), nil
+}
+
+func parseCookieJSON(data []byte) (Credentials, error) {
+	var exported []struct {
+		Domain         string  `json:"domain"`
+		Name           string  `json:"name"`
+		Value          string  `json:"value"`
+		ExpirationDate float64 `json:"expirationDate"`
+	}
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return Credentials{}, fmt.Errorf("invalid cookie JSON: %w", err)
+	}
+	cookies := make([]cookie, 0, len(exported))
+	for _, e := range exported {
+		c := cookie{Domain: e.Domain, Name: e.Name, Value: e.Value}
+		if e.ExpirationDate > 0 {
+			c.Expires = time.Unix(int64(e.ExpirationDate), 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return credentialsFromCookies(cookies), nil
+}
+
+// configuredCredentials reads the credentials in the downloader config
+func configuredCredentials() (Credentials, error) {
+	data, err := os.ReadFile(cfg.DownloaderConfig)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to read downloader config: %w", err)
+	}
+	var config map[string]any
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse downloader config: %w", err)
+	}
+	get := func(key string) string {
+		value, _ := config[key].(string)
+		if placeholderCredential(value) {
+			return ""
+		}
+		return value
+	}
+	return Credentials{
+		MediaUserToken:     get(mediaUserTokenKey),
+		AuthorizationToken: get(authorizationTokenKey),
+		Storefront:         get(storefrontKey),
+	}, nil
+}
+
+// saveCredentials writes values into the downloader config, keeping its
+// other settings, comments and key order. The new config replaces the old
+// one at once, so downloads starting meanwhile read either; a single-file
+// bind mount can't be replaced, and is rewritten in place instead. Running
+// downloads keep the credentials they started with.
+func saveCredentials(values map[string]string) error {
+	data, err := os.ReadFile(cfg.DownloaderConfig)
+	if err != nil {
+		return fmt.Errorf("failed to read downloader config: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse downloader config: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	mapping := doc.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return errors.New("downloader config is not a YAML mapping")
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		found := false
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			if mapping.Content[i].Value == key {
+				// Updated in place to keep the value's comments
+				value := mapping.Content[i+1]
+				value.Kind, value.Tag, value.Value, value.Style = yaml.ScalarNode, "!!str", values[key], yaml.DoubleQuotedStyle
+				value.Content = nil
+				found = true
+				break
+			}
+		}
+		if !found {
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[key], Style: yaml.DoubleQuotedStyle})
+		}
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return replaceFile(cfg.DownloaderConfig, out.Bytes())
+}
+
+// replaceFile writes data to a temporary file next to path and renames it
+// over path, falling back to rewriting path when that isn't possible
+func replaceFile(path string, data []byte) error {
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), mode)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err == nil {
+			return nil
+		}
+		os.Remove(tmp.Name())
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+// appleMusicStatus calls the Apple Music API with the given tokens and
+// returns the response's status and body
+func appleMusicStatus(ctx context.Context, path, developerToken, userToken string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, appleMusicAPI+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+developerToken)
+	req.Header.Set("Origin", "https://music.apple.com")
+	if userToken != "" {
+		req.Header.Set("Media-User-Token", userToken)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, body, err
+}
+
+// checkCredentials checks each credential, with Apple Music where it can:
+// the authorization token against the catalog, the media-user-token against
+// the account, whose storefront should match the configured one, and that
+// the decryption wrapper, which holds the account's login, is reachable.
+// The account is returned when Apple Music accepted the media-user-token.
+func checkCredentials(ctx context.Context, creds Credentials) ([]CredentialCheck, *Account) {
+	var checks []CredentialCheck
+	var account *Account
+
+	developerToken := creds.AuthorizationToken
+	if developerToken != "" {
+		check := CredentialCheck{Name: authorizationTokenKey}
+		switch status, _, err := appleMusicStatus(ctx, "/storefronts/us", developerToken, ""); {
+		case err != nil:
+			check.Status, check.Detail = "unknown", err.Error()
+		case status == http.StatusOK:
+			check.Status = "ok"
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			check.Status, check.Detail = "rejected", "Apple Music rejected the authorization token; remove it to use one from the web player"
+		default:
+			check.Status, check.Detail = "unknown", fmt.Sprintf("Apple Music returned %d", status)
+		}
+		checks = append(checks, check)
+	} else {
+		token, err := appleMusic.developerToken(false)
+		if err != nil {
+			checks = append(checks, CredentialCheck{Name: authorizationTokenKey, Status: "unknown", Detail: "no token configured, and none could be read from the web player: " + err.Error()})
+		}
+		developerToken = token
+	}
+
+	check := CredentialCheck{Name: mediaUserTokenKey}
+	var storefront *CredentialCheck
+	switch {
+	case creds.MediaUserToken == "":
+		check.Status, check.Detail = "missing", "sign in at music.apple.com and upload its cookies; lyrics, AAC-LC and music videos need it"
+	case creds.Expires != nil && creds.Expires.Before(time.Now()):
+		check.Status, check.Detail = "expired", "the cookie expired on "+creds.Expires.Format(time.DateOnly)+"; sign in at music.apple.com again and upload fresh cookies"
+	case developerToken == "":
+		check.Status, check.Detail = "unknown", "no developer token to check it with"
+	default:
+		status, found, err := fetchAccount(ctx, developerToken, creds.MediaUserToken)
+		switch {
+		case err != nil:
+			check.Status, check.Detail = "unknown", err.Error()
+		case status == http.StatusOK:
+			check.Status, account = "ok", found
+			check.Detail = fmt.Sprintf("account storefront %s, subscription %s", account.Storefront, account.Subscription)
+			if creds.Storefront != "" && account.Storefront != "" && creds.Storefront != account.Storefront {
+				storefront = &CredentialCheck{Name: storefrontKey, Status: "mismatch",
+					Detail: fmt.Sprintf("the account's storefront is %s, but %s is configured", account.Storefront, creds.Storefront)}
+			}
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			check.Status, check.Detail = "rejected", "Apple Music rejected the media-user-token; it has expired or was signed out. Sign in at music.apple.com again and upload fresh cookies"
+		default:
+			check.Status, check.Detail = "unknown", fmt.Sprintf("Apple Music returned %d", status)
+		}
+		if creds.Expires != nil && check.Status == "ok" {
+			check.Detail = strings.TrimPrefix(check.Detail+"; expires "+creds.Expires.Format(time.DateOnly), "; ")
+		}
+	}
+	checks = append(checks, check)
+	if storefront != nil {
+		checks = append(checks, *storefront)
+	}
+
+	if addr, err := decryptionWrapperAddr(); err == nil {
+		check := CredentialCheck{Name: "decryption_wrapper", Status: "ok", Detail: addr}
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := tcpCheck(addr)(dialCtx); err != nil {
+			check.Status, check.Detail = "unreachable", fmt.Sprintf("%s: %v; it holds the account's login for ALAC and Atmos", addr, err)
+		}
+		cancel()
+		checks = append(checks, check)
+	}
+	return checks, account
+}
+
+func credentialsReport(creds Credentials, checks []CredentialCheck) CredentialsReport {
+	report := CredentialsReport{Valid: true, Expires: creds.Expires, Checks: checks}
+	for _, check := range checks {
+		if slices.Contains(credentialFailures, check.Status) {
+			report.Valid = false
+		}
+	}
+	return report
+}
+
+// readCredentialsUpload returns the uploaded file: the request body, or the
+// "file" field of a multipart form
+func readCredentialsUpload(r *http.Request) ([]byte, error) {
+	body := http.MaxBytesReader(nil, r.Body, maxCredentialsUpload)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		r.Body = body
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	return io.ReadAll(body)
+}
+
+// handleCredentials serves /admin/credentials: GET checks the credentials
+// in the downloader config, and POST uploads new ones, checks them and saves
+// them unless Apple Music rejects them
+func handleCredentials(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), integrationTestTimeout)
+	defer cancel()
+
+	current, err := configuredCredentials()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read credentials", "error", err)
+		http.Error(w, "Failed to read downloader config", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		checks, account := checkCredentials(ctx, current)
+		if account != nil {
+			accountStore.set(account)
+		}
+		report := credentialsReport(current, checks)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	case http.MethodPost:
+		data, err := readCredentialsUpload(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		uploaded, err := parseCredentials(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Credentials missing from the upload keep their configured values
+		creds, values := current, map[string]string{}
+		if uploaded.MediaUserToken != "" {
+			creds.MediaUserToken, creds.Expires = uploaded.MediaUserToken, uploaded.Expires
+			values[mediaUserTokenKey] = uploaded.MediaUserToken
+		}
+		if uploaded.AuthorizationToken != "" {
+			creds.AuthorizationToken = uploaded.AuthorizationToken
+			values[authorizationTokenKey] = uploaded.AuthorizationToken
+		}
+		if uploaded.Storefront != "" {
+			creds.Storefront = uploaded.Storefront
+			values[storefrontKey] = uploaded.Storefront
+		}
+
+		checks, account := checkCredentials(ctx, creds)
+		report := credentialsReport(creds, checks)
+		rejected := slices.ContainsFunc(report.Checks, func(check CredentialCheck) bool {
+			_, changed := values[check.Name]
+			return changed && (check.Status == "expired" || check.Status == "rejected")
+		})
+		if rejected && r.URL.Query().Get("force") != "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+
+		if err := saveCredentials(values); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save credentials", "error", err)
+			http.Error(w, "Failed to write downloader config", http.StatusInternalServerError)
+			return
+		}
+		if uploaded.AuthorizationToken != "" {
+			appleMusic.useToken(uploaded.AuthorizationToken)
+		}
+		if account != nil {
+			accountStore.set(account)
+		}
+		report.Saved = true
+		for key := range values {
+			report.Updated = append(report.Updated, key)
+		}
+		slices.Sort(report.Updated)
+		slog.InfoContext(r.Context(), "Updated downloader credentials", "updated", report.Updated)
+		auditLog.recordRequest(r, AuditEntry{Action: "credentials.updated", Detail: map[string]string{"updated": strings.Join(report.Updated, ","), "valid": strconv.FormatBool(report.Valid)}})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
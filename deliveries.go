@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const deliveriesFile = "webhook_deliveries.json"
+
+// Delivered webhooks kept for inspection; pending and dead ones are kept
+// until redelivered
+const keepDelivered = 500
+
+// Delivery is one outbound webhook call, retried with backoff until it
+// succeeds or runs out of attempts and is dead-lettered
+type Delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	WebhookID   string          `json:"webhook_id,omitempty"`
+	Event       string          `json:"event"`
+	Format      string          `json:"format,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Trace       TraceContext    `json:"trace"`
+	Status      string          `json:"status"` // pending, delivered or dead
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt,omitempty"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+
+	// Restricted deliveries go to URLs clients supplied, and are only sent
+	// to addresses callbacks may be sent to
+	Restricted bool `json:"restricted,omitempty"`
+
+	inFlight bool
+}
+
+type DeliveryQueue struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+	wake       chan struct{}
+}
+
+var deliveryQueue = &DeliveryQueue{
+	deliveries: map[string]*Delivery{},
+	wake:       make(chan struct{}, 1),
+}
+
+var errDeliveryNotFound = errors.New("delivery not found")
+
+func (q *DeliveryQueue) load() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var saved []*Delivery
+	if err := loadState(deliveriesFile, &saved); err != nil {
+		return err
+	}
+	for _, d := range saved {
+		q.deliveries[d.ID] = d
+	}
+	return nil
+}
+
+// save persists the queue; callers hold q.mu
+func (q *DeliveryQueue) save() {
+	var delivered, kept []*Delivery
+	for _, d := range q.deliveries {
+		if d.Status == "delivered" {
+			delivered = append(delivered, d)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	sort.Slice(delivered, func(i, j int) bool { return delivered[i].CreatedAt.After(delivered[j].CreatedAt) })
+	for i, d := range delivered {
+		if i >= keepDelivered {
+			delete(q.deliveries, d.ID)
+			continue
+		}
+		kept = append(kept, d)
+	}
+
+	if err := saveState(deliveriesFile, kept); err != nil {
+		slog.Error("Failed to save webhook deliveries", "error", err)
+	}
+}
+
+func (q *DeliveryQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue schedules payload, encoded in format, to be posted to url, signed
+// with the secret of webhookID when it's a registered webhook
+func (q *DeliveryQueue) Enqueue(url, webhookID, event, format string, payload any, trace TraceContext) {
+	q.enqueue(url, webhookID, event, format, payload, trace, false)
+}
+
+// EnqueueRestricted is Enqueue for a URL a client supplied, which mustn't
+// reach the wrapper's own network
+func (q *DeliveryQueue) EnqueueRestricted(url, webhookID, event, format string, payload any, trace TraceContext) {
+	q.enqueue(url, webhookID, event, format, payload, trace, true)
+}
+
+func (q *DeliveryQueue) enqueue(url, webhookID, event, format string, payload any, trace TraceContext, restricted bool) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode webhook", "event", event, "error", err)
+		return
+	}
+
+	now := time.Now()
+	q.mu.Lock()
+	d := &Delivery{
+		ID:          uuid.New().String(),
+		URL:         url,
+		WebhookID:   webhookID,
+		Event:       event,
+		Format:      format,
+		Payload:     body,
+		Trace:       trace,
+		Status:      "pending",
+		CreatedAt:   now,
+		NextAttempt: now,
+		Restricted:  restricted,
+	}
+	q.deliveries[d.ID] = d
+	q.save()
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+// Redeliver resets a delivery so it's attempted again right away
+func (q *DeliveryQueue) Redeliver(id string) (Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, exists := q.deliveries[id]
+	if !exists {
+		return Delivery{}, errDeliveryNotFound
+	}
+	if !d.inFlight {
+		d.Status = "pending"
+		d.Attempts = 0
+		d.NextAttempt = time.Now()
+		q.save()
+	}
+	q.notify()
+	return *d, nil
+}
+
+// List returns deliveries with the given status, or all when empty, newest
+// first
+func (q *DeliveryQueue) List(status string) []Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := []Delivery{}
+	for _, d := range q.deliveries {
+		if status == "" || d.Status == status {
+			list = append(list, *d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Settled reports whether every pending delivery has been attempted at
+// least once
+func (q *DeliveryQueue) Settled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, d := range q.deliveries {
+		if d.Status == "pending" && (d.inFlight || d.Attempts == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Failing counts pending deliveries whose last attempt failed
+func (q *DeliveryQueue) Failing() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	failing := 0
+	for _, d := range q.deliveries {
+		if d.Status == "pending" && d.Attempts > 0 {
+			failing++
+		}
+	}
+	return failing
+}
+
+func (q *DeliveryQueue) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		q.dispatch()
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch starts every due delivery
+func (q *DeliveryQueue) dispatch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range q.deliveries {
+		if d.Status == "pending" && !d.inFlight && !d.NextAttempt.After(now) {
+			d.inFlight = true
+			go q.attempt(*d)
+		}
+	}
+}
+
+// deliverySecret returns the secret a delivery is signed with, if any
+func deliverySecret(d Delivery) (string, error) {
+	switch d.WebhookID {
+	case "", ntfyWebhookID:
+		return "", nil
+	case callbackWebhookID:
+		return cfg.CallbackSecret, nil
+	}
+	wh, exists := webhookStore.Get(d.WebhookID)
+	if !exists {
+		return "", errWebhookNotFound
+	}
+	return wh.secret, nil
+}
+
+func (q *DeliveryQueue) attempt(d Delivery) {
+	header := http.Header{}
+	header.Set("X-Webhook-Event", d.Event)
+	header.Set("X-Webhook-Delivery", d.ID)
+	if d.Format == "cloudevents" {
+		header.Set("Content-Type", "application/cloudevents+json")
+	}
+
+	secret, err := deliverySecret(d)
+	if secret != "" {
+		header.Set("X-Webhook-Signature", signPayload(secret, d.Payload))
+	}
+	if err == nil {
+		client := httpClient
+		if u, err := url.Parse(d.URL); (d.WebhookID == callbackWebhookID || d.Restricted) && (err != nil || !callbackHostAllowed(u.Hostname())) {
+			client = callbackClient
+		}
+		err = postBodyWith(client, d.URL, d.Payload, header, d.Trace)
+	}
+	if d.WebhookID == ntfyWebhookID {
+		integrationHealth.record("ntfy", err)
+	} else {
+		integrationHealth.record("webhooks", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	live, exists := q.deliveries[d.ID]
+	if !exists {
+		return
+	}
+	live.inFlight = false
+	live.Attempts++
+
+	if err == nil {
+		now := time.Now()
+		live.Status = "delivered"
+		live.DeliveredAt = &now
+		live.LastError = ""
+		q.save()
+		return
+	}
+
+	live.LastError = err.Error()
+	if live.Attempts >= cfg.WebhookRetry.MaxAttempts || errors.Is(err, errWebhookNotFound) {
+		live.Status = "dead"
+		metrics.webhooksDead.Add(1)
+		slog.Error("Webhook dead-lettered", "event", live.Event, "url", live.URL, "attempts", live.Attempts, "error", err)
+	} else {
+		live.NextAttempt = time.Now().Add(cfg.WebhookRetry.delay(live.Attempts))
+		slog.Warn("Webhook failed, retrying", "event", live.Event, "url", live.URL, "attempts", live.Attempts, "next_attempt", live.NextAttempt.Format(time.RFC3339), "error", err)
+	}
+	q.save()
+}
+
+// jobFinishedWebhook publishes job.completed, job.failed, job.cancelled and
+// job.expired events
+func jobFinishedWebhook(job DownloadStatus) {
+	job.Logs = nil
+	publishEvent(WebhookEvent{
+		Event: "job." + job.Status,
+		Time:  time.Now(),
+		Job:   &job,
+	}, job.Trace)
+}
+
+// Webhook ID of per-job callbacks, which are signed with CALLBACK_SECRET
+const callbackWebhookID = "callback"
+
+// Client of per-job callbacks, which only connects to allowed addresses;
+// see configureHTTPClient
+var callbackClient = &http.Client{Timeout: 60 * time.Second}
+
+// Shared address space of carrier-grade NAT, not covered by IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// callbackAddrAllowed reports whether callbacks may be sent to addr: public
+// addresses, and others when CALLBACK_ALLOWED_HOSTS lists them or their
+// network. Callback URLs come from clients, which mustn't reach the
+// wrapper's own network through them.
+func callbackAddrAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, allowed := range cfg.CallbackAllowedHosts {
+		if prefix, err := netip.ParsePrefix(allowed); err == nil && prefix.Contains(addr) {
+			return true
+		}
+		if ip, err := netip.ParseAddr(allowed); err == nil && ip == addr {
+			return true
+		}
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// checkCallbackURL rejects callback URLs whose host resolves to an address
+// callbacks may not be sent to, unless CALLBACK_ALLOWED_HOSTS lists the
+// host name
+func checkCallbackURL(raw string) error {
+	return checkClientURL("callback_url", raw)
+}
+
+// checkClientURL applies the checks of callback URLs to another URL a
+// client supplied, named field in errors
+func checkClientURL(field, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	if callbackHostAllowed(host) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%s host %s could not be resolved", field, host)
+	}
+	for _, addr := range addrs {
+		if !callbackAddrAllowed(addr) {
+			return fmt.Errorf("%s must not point at a loopback, link-local or private address (%s); see CALLBACK_ALLOWED_HOSTS", field, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// callbackHostAllowed reports whether CALLBACK_ALLOWED_HOSTS lists the host
+// of a callback URL by name, which trusts wherever it resolves to
+func callbackHostAllowed(host string) bool {
+	return slices.Contains(cfg.CallbackAllowedHosts, strings.ToLower(host))
+}
+
+// callbackDialControl refuses connections to addresses callbacks may not be
+// sent to, which a host can resolve to after its URL was checked or a
+// redirect can lead to
+func callbackDialControl(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !callbackAddrAllowed(addrPort.Addr()) {
+		return fmt.Errorf("callback to %s refused: loopback, link-local or private address", addrPort.Addr().Unmap())
+	}
+	return nil
+}
+
+// Webhook ID of routed ntfy messages, which are tracked as their own
+// integration
+const ntfyWebhookID = "ntfy"
+
+// JobCallback is posted to a job's callback_url once it finishes
+type JobCallback struct {
+	Event          string     `json:"event"`
+	JobID          string     `json:"job_id"`
+	URL            string     `json:"url"`
+	Status         string     `json:"status"`
+	Duration       string     `json:"duration,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	ErrorCode      string     `json:"error_code,omitempty"`
+	EndedAt        *time.Time `json:"ended_at,omitempty"`
+	FormatObtained string     `json:"format_obtained,omitempty"`
+	Artifacts      []Artifact `json:"artifacts,omitempty"`
+	Tracks         []Track    `json:"tracks,omitempty"`
+
+	Verification *VerificationReport `json:"verification,omitempty"`
+}
+
+// jobFinishedCallback queues the result of a job for its callback_url
+func jobFinishedCallback(job DownloadStatus) {
+	if job.CallbackURL == "" {
+		return
+	}
+	callback := JobCallback{
+		Event:          "job." + job.Status,
+		JobID:          job.ID,
+		URL:            job.URL,
+		Status:         job.Status,
+		Duration:       job.Duration,
+		Error:          job.Error,
+		ErrorCode:      job.ErrorCode,
+		EndedAt:        job.EndedAt,
+		FormatObtained: job.FormatObtained,
+		Artifacts:      job.Artifacts,
+		Tracks:         job.Tracks,
+		Verification:   job.Verification,
+	}
+	if callback.Duration == "" && job.EndedAt != nil {
+		callback.Duration = job.EndedAt.Sub(job.StartedAt).String()
+	}
+	deliveryQueue.Enqueue(job.CallbackURL, callbackWebhookID, callback.Event, "", callback, job.Trace)
+}
+
+// handleWebhookDeliveries lists deliveries, optionally filtered with
+// ?status=pending|delivered|dead
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deliveries := deliveryQueue.List(r.URL.Query().Get("status"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// handleWebhookDelivery redelivers a delivery with
+// POST /admin/webhooks/deliveries/{id}/redeliver
+func handleWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Path[len("/admin/webhooks/deliveries/"):]
+	id, action, _ := strings.Cut(path, "/")
+	if action != "redeliver" || id == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	delivery, err := deliveryQueue.Redeliver(id)
+	if errors.Is(err, errDeliveryNotFound) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
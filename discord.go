@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const discordAPI = "https://discord.com/api/v10"
+
+// Interaction tokens expire after 15 minutes, after which the original
+// response can no longer be edited
+const discordEditWindow = 14 * time.Minute
+
+var discordPublicKey ed25519.PublicKey
+
+var discordCommands = []map[string]any{
+	{
+		"name":        "amdl",
+		"description": "Apple Music downloads",
+		"options": []map[string]any{
+			{
+				"type":        1, // SUB_COMMAND
+				"name":        "download",
+				"description": "Start a download",
+				"options": []map[string]any{
+					{"type": 3, "name": "url", "description": "Apple Music URL", "required": true},
+					{"type": 3, "name": "format", "description": "Audio format", "choices": []map[string]string{
+						{"name": "ALAC", "value": "alac"},
+						{"name": "Dolby Atmos", "value": "atmos"},
+						{"name": "AAC", "value": "aac"},
+					}},
+					{"type": 5, "name": "song", "description": "Single song download"},
+				},
+			},
+			{
+				"type":        1, // SUB_COMMAND
+				"name":        "status",
+				"description": "Show a job, or counts of jobs by status",
+				"options": []map[string]any{
+					{"type": 3, "name": "job_id", "description": "Job ID"},
+				},
+			},
+		},
+	},
+}
+
+type discordOption struct {
+	Name    string          `json:"name"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Options []discordOption `json:"options,omitempty"`
+}
+
+func (o discordOption) stringValue(name string) string {
+	for _, opt := range o.Options {
+		if opt.Name == name {
+			var s string
+			json.Unmarshal(opt.Value, &s)
+			return s
+		}
+	}
+	return ""
+}
+
+func (o discordOption) boolValue(name string) bool {
+	for _, opt := range o.Options {
+		if opt.Name == name {
+			var b bool
+			json.Unmarshal(opt.Value, &b)
+			return b
+		}
+	}
+	return false
+}
+
+type discordInteraction struct {
+	Type    int    `json:"type"`
+	Token   string `json:"token"`
+	GuildID string `json:"guild_id"`
+	Locale  string `json:"locale"` // the invoking user's language
+	Member  *struct {
+		Roles []string `json:"roles"`
+		User  struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"member"`
+	Data struct {
+		Name    string          `json:"name"`
+		Options []discordOption `json:"options"`
+	} `json:"data"`
+}
+
+func setupDiscord() error {
+	key, err := hex.DecodeString(cfg.DiscordPublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("DISCORD_PUBLIC_KEY must be a hex-encoded Ed25519 public key")
+	}
+	discordPublicKey = key
+
+	if cfg.DiscordApplicationID == "" {
+		return errors.New("DISCORD_APPLICATION_ID is required")
+	}
+
+	if cfg.DiscordBotToken == "" {
+		slog.Info("DISCORD_BOT_TOKEN not set, skipping slash command registration", "component", "discord")
+		return nil
+	}
+
+	for guildID := range cfg.DiscordGuilds {
+		if err := registerDiscordCommands(guildID); err != nil {
+			slog.Error("Failed to register commands", "component", "discord", "guild_id", guildID, "error", err)
+			continue
+		}
+		slog.Info("Registered slash commands", "component", "discord", "guild_id", guildID)
+	}
+	return nil
+}
+
+func registerDiscordCommands(guildID string) error {
+	url := fmt.Sprintf("%s/applications/%s/guilds/%s/commands", discordAPI, cfg.DiscordApplicationID, guildID)
+	return discordRequest(http.MethodPut, url, "Bot "+cfg.DiscordBotToken, discordCommands, TraceContext{})
+}
+
+func discordRequest(method, url, authorization string, payload any, trace TraceContext) (err error) {
+	defer func() { integrationHealth.record("discord", err) }()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	trace.apply(req.Header)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("discord returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// discordAllowed applies the per-guild role permissions
+func discordAllowed(interaction discordInteraction) bool {
+	roles, exists := cfg.DiscordGuilds[interaction.GuildID]
+	if !exists || interaction.Member == nil {
+		return false
+	}
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range interaction.Member.Roles {
+		if slices.Contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleDiscordInteraction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	if err != nil || !ed25519.Verify(discordPublicKey, append([]byte(timestamp), body...), signature) {
+		http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid interaction: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// PING
+	if interaction.Type == 1 {
+		json.NewEncoder(w).Encode(map[string]int{"type": 1})
+		return
+	}
+
+	lang := supportedLanguage(interaction.Locale)
+	if interaction.Type != 2 || interaction.Data.Name != "amdl" || len(interaction.Data.Options) == 0 {
+		json.NewEncoder(w).Encode(discordMessage(tr(lang, "Unknown command"), true))
+		return
+	}
+
+	if !discordAllowed(interaction) {
+		json.NewEncoder(w).Encode(discordMessage(tr(lang, "You are not allowed to use this command here."), true))
+		return
+	}
+
+	sub := interaction.Data.Options[0]
+	switch sub.Name {
+	case "download":
+		req := DownloadRequest{
+			URL:    sub.stringValue("url"),
+			Format: parseFormatList(sub.stringValue("format")),
+			Song:   sub.boolValue("song"),
+			Owner:  "discord:" + interaction.Member.User.ID,
+			Trace:  traceFromRequest(r),
+		}
+		if err := prepareRequest(&req); err != nil {
+			json.NewEncoder(w).Encode(discordMessage(err.Error(), true))
+			return
+		}
+		job := startDownload(req)
+		go followDiscordProgress(interaction.Token, job.ID, lang)
+		json.NewEncoder(w).Encode(discordMessage(tr(lang, "Started job `%s`\n%s", job.ID, job.URL), false))
+
+	case "status":
+		jobID := sub.stringValue("job_id")
+		if jobID == "" {
+			json.NewEncoder(w).Encode(discordMessage(jobCountsSummary(lang), true))
+			return
+		}
+		job, exists := jobManager.Snapshot(jobID)
+		if !exists {
+			json.NewEncoder(w).Encode(discordMessage(tr(lang, "Job not found"), true))
+			return
+		}
+		json.NewEncoder(w).Encode(discordMessage(jobSummary(lang, job), true))
+
+	default:
+		json.NewEncoder(w).Encode(discordMessage(tr(lang, "Unknown command"), true))
+	}
+}
+
+// discordMessage builds a CHANNEL_MESSAGE_WITH_SOURCE interaction response
+func discordMessage(content string, ephemeral bool) map[string]any {
+	data := map[string]any{"content": content}
+	if ephemeral {
+		data["flags"] = 64
+	}
+	return map[string]any{"type": 4, "data": data}
+}
+
+// followDiscordProgress edits the original interaction response as the job
+// progresses, until it finishes or the interaction token expires
+func followDiscordProgress(token, jobID, lang string) {
+	url := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", discordAPI, cfg.DiscordApplicationID, token)
+	deadline := time.Now().Add(discordEditWindow)
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	last := ""
+	for range ticker.C {
+		job, exists := jobManager.Snapshot(jobID)
+		if !exists {
+			return
+		}
+
+		content := jobSummary(lang, job)
+		if content != last {
+			if err := discordRequest(http.MethodPatch, url, "", map[string]string{"content": content}, job.Trace); err != nil {
+				slog.Error("Failed to update progress", "component", "discord", "job_id", jobID, "error", err)
+			}
+			last = content
+		}
+
+		if job.EndedAt != nil || time.Now().After(deadline) {
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"slices"
+)
+
+// Edition is one version of an album
+type Edition struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Edition       string `json:"edition"` // standard, deluxe or clean
+	ContentRating string `json:"content_rating,omitempty"`
+	TrackCount    int    `json:"track_count"`
+	ReleaseDate   string `json:"release_date,omitempty"`
+	URL           string `json:"url"`
+}
+
+var deluxePattern = regexp.MustCompile(`(?i)\b(deluxe|expanded|anniversary|bonus tracks?|special edition|complete edition|collector'?s edition)\b`)
+
+func editionOf(album catalogResource) string {
+	switch {
+	case album.Attributes.ContentRating == "clean":
+		return "clean"
+	case deluxePattern.MatchString(album.Attributes.Name):
+		return "deluxe"
+	default:
+		return "standard"
+	}
+}
+
+// albumEditions returns the album followed by its other versions
+func albumEditions(storefront, id string) ([]Edition, error) {
+	album, err := appleMusic.Resource(storefront, "album", id, "")
+	if err != nil {
+		return nil, err
+	}
+	others, err := appleMusic.OtherVersions(storefront, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var editions []Edition
+	for _, version := range append([]catalogResource{*album}, others...) {
+		editions = append(editions, Edition{
+			ID:            version.ID,
+			Name:          version.Attributes.Name,
+			Edition:       editionOf(version),
+			ContentRating: version.Attributes.ContentRating,
+			TrackCount:    version.Attributes.TrackCount,
+			ReleaseDate:   version.Attributes.ReleaseDate,
+			URL:           version.Attributes.URL,
+		})
+	}
+	return editions, nil
+}
+
+// resolveEdition applies the request's edition preference, falling back to
+// EDITION_PREFERENCE. When the album has other versions it either rewrites
+// req.URL to the preferred one or, for "ask" or when no version matches the
+// preference, returns the alternatives so the client can pick.
+func resolveEdition(req *DownloadRequest) ([]Edition, error) {
+	preference := cfg.EditionPreference
+	if req.Edition != "" {
+		preference = splitList(req.Edition)
+	}
+	if len(preference) == 0 || slices.Equal(preference, []string{"any"}) || req.Song {
+		return nil, nil
+	}
+
+	link, err := parseAppleMusicURL(req.URL)
+	if err != nil || link.Type != "album" || link.SongID != "" {
+		return nil, nil
+	}
+
+	editions, err := albumEditions(link.Storefront, link.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(editions) < 2 {
+		return nil, nil
+	}
+	if slices.Contains(preference, "ask") {
+		return editions, nil
+	}
+
+	for _, wanted := range preference {
+		// editions[0] is the requested album, so it wins ties
+		for _, edition := range editions {
+			if edition.Edition != wanted {
+				continue
+			}
+			if edition.ID != link.ID {
+				slog.Info("Picked album edition", "edition", wanted, "album_id", edition.ID, "name", edition.Name, "instead_of", link.ID)
+				req.URL = edition.URL
+			}
+			return nil, nil
+		}
+	}
+	return editions, nil
+}
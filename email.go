@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/google/uuid"
+)
+
+// emailRequest is a submission by email, answered once all of its jobs have
+// finished
+type emailRequest struct {
+	from      string
+	subject   string
+	messageID string
+	jobIDs    []string
+	remaining int
+
+	// Links that weren't queued, with the reason
+	rejected []string
+}
+
+// EmailWatcher polls an IMAP mailbox for unread mail from allowed senders,
+// starts a download for every Apple Music link in it and replies by SMTP
+// with the results
+type EmailWatcher struct {
+	mu      sync.Mutex
+	pending map[string]*emailRequest // by job ID
+}
+
+func newEmailWatcher() *EmailWatcher {
+	return &EmailWatcher{pending: map[string]*emailRequest{}}
+}
+
+func (ew *EmailWatcher) run() {
+	if len(cfg.EmailAllowedSenders) == 0 {
+		slog.Info("No allowed senders configured; all mail will be ignored", "component", "email")
+	}
+	if cfg.EmailAuthservID == "" && cfg.EmailSecret == "" {
+		slog.Warn("Neither EMAIL_AUTHSERV_ID nor EMAIL_SECRET is set; all mail will be ignored", "component", "email")
+	}
+	slog.Info("Watching mailbox", "component", "email", "mailbox", cfg.IMAPMailbox, "addr", cfg.IMAPAddr)
+
+	for {
+		if err := ew.poll(); err != nil {
+			slog.Error("Failed to check mailbox", "component", "email", "error", err)
+		}
+		time.Sleep(cfg.IMAPPollInterval)
+	}
+}
+
+// poll handles every unread message and marks it as read
+func (ew *EmailWatcher) poll() error {
+	var c *client.Client
+	var err error
+	if cfg.IMAPTLS {
+		c, err = client.DialTLS(cfg.IMAPAddr, outboundTLSConfig())
+	} else {
+		c, err = client.Dial(cfg.IMAPAddr)
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	if err := c.Login(cfg.IMAPUsername, cfg.IMAPPassword); err != nil {
+		return err
+	}
+	if _, err := c.Select(cfg.IMAPMailbox, false); err != nil {
+		return err
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, len(uids))
+	if err := c.UidFetch(seqset, []imap.FetchItem{imap.FetchEnvelope, section.FetchItem()}, messages); err != nil {
+		return err
+	}
+
+	for msg := range messages {
+		ew.handleMessage(msg, msg.GetBody(section))
+	}
+
+	return c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.SeenFlag}, nil)
+}
+
+func (ew *EmailWatcher) handleMessage(msg *imap.Message, body imap.Literal) {
+	if msg.Envelope == nil || len(msg.Envelope.From) == 0 || body == nil {
+		return
+	}
+	from := strings.ToLower(msg.Envelope.From[0].Address())
+	if !emailSenderAllowed(from) {
+		slog.Info("Ignored message", "component", "email", "from", from)
+		return
+	}
+
+	mr, err := mail.CreateReader(body)
+	if err != nil {
+		slog.Error("Failed to read message", "component", "email", "from", from, "error", err)
+		return
+	}
+	if !emailAuthenticated(from, msg.Envelope, mr.Header) {
+		slog.Warn("Ignored unauthenticated message", "component", "email", "from", from)
+		return
+	}
+
+	request := &emailRequest{
+		from:      from,
+		subject:   msg.Envelope.Subject,
+		messageID: msg.Envelope.MessageId,
+	}
+
+	links, err := emailLinks(mr)
+	if err != nil {
+		slog.Error("Failed to read message", "component", "email", "from", from, "error", err)
+		return
+	}
+	if len(links) == 0 {
+		ew.reply(request, tr(cfg.DefaultLanguage, "No Apple Music links were found in your message."))
+		return
+	}
+
+	// A format named in the subject applies to every link
+	var format FormatList
+	for _, word := range strings.Fields(strings.ToLower(request.subject)) {
+		if slices.Contains([]string{"alac", "atmos", "aac"}, word) {
+			format = FormatList{word}
+		}
+	}
+
+	trace := newTrace()
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	for _, link := range links {
+		req := DownloadRequest{
+			URL:    link,
+			Format: format,
+			Owner:  "email:" + from,
+			Trace:  trace,
+		}
+		if err := prepareRequest(&req); err != nil {
+			request.rejected = append(request.rejected, fmt.Sprintf("%s: %v", link, err))
+			continue
+		}
+		job := startDownload(req)
+		request.jobIDs = append(request.jobIDs, job.ID)
+		request.remaining++
+		ew.pending[job.ID] = request
+	}
+	slog.Info("Started jobs from message", "component", "email", "from", from, "jobs", len(request.jobIDs), "rejected", len(request.rejected))
+	if len(request.jobIDs) == 0 {
+		ew.reply(request, rejectedLinks(cfg.DefaultLanguage, request.rejected))
+	}
+}
+
+// rejectedLinks lists the links of a message that weren't downloaded
+func rejectedLinks(lang string, rejected []string) string {
+	return tr(lang, "These links were not downloaded:") + "\n" + strings.Join(rejected, "\n")
+}
+
+// jobFinished is registered with the job manager to send replies
+func (ew *EmailWatcher) jobFinished(job DownloadStatus) {
+	ew.mu.Lock()
+	request, exists := ew.pending[job.ID]
+	if !exists {
+		ew.mu.Unlock()
+		return
+	}
+	delete(ew.pending, job.ID)
+	request.remaining--
+	done := request.remaining == 0
+	ew.mu.Unlock()
+
+	if !done {
+		return
+	}
+
+	summaries := make([]string, 0, len(request.jobIDs))
+	for _, id := range request.jobIDs {
+		if job, exists := jobManager.Snapshot(id); exists {
+			summaries = append(summaries, jobSummary(cfg.DefaultLanguage, job))
+		}
+	}
+	text := tr(cfg.DefaultLanguage, "Your request has finished.") + "\n\n" + strings.Join(summaries, "\n\n")
+	if len(request.rejected) > 0 {
+		text += "\n\n" + rejectedLinks(cfg.DefaultLanguage, request.rejected)
+	}
+	ew.reply(request, text)
+}
+
+func (ew *EmailWatcher) reply(request *emailRequest, text string) {
+	subject := request.subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	if err := sendMail(request.from, subject, request.messageID, text); err != nil {
+		slog.Error("Failed to reply", "component", "email", "to", request.from, "error", err)
+	}
+}
+
+// emailSenderAllowed matches an address against EMAIL_ALLOWED_SENDERS
+func emailSenderAllowed(from string) bool {
+	return emailAddressListed(cfg.EmailAllowedSenders, from)
+}
+
+// emailAddressListed matches a lowercase address against a list of
+// addresses or whole domains as "@example.com"
+func emailAddressListed(list []string, address string) bool {
+	for _, allowed := range list {
+		allowed = strings.ToLower(allowed)
+		if address == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(address, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailAuthenticated reports whether a message from an allowed sender
+// really comes from them, as the From header alone can be forged: the
+// receiving server vouches for the sender's domain, or the message carries
+// EMAIL_SECRET
+func emailAuthenticated(from string, envelope *imap.Envelope, header mail.Header) bool {
+	if cfg.EmailSecret != "" {
+		if slices.Contains(strings.Fields(envelope.Subject), cfg.EmailSecret) {
+			return true
+		}
+		for _, to := range slices.Concat(envelope.To, envelope.Cc) {
+			if _, tag, ok := strings.Cut(to.MailboxName, "+"); ok && tag == cfg.EmailSecret {
+				return true
+			}
+		}
+	}
+	if cfg.EmailAuthservID == "" {
+		return false
+	}
+	_, domain, _ := strings.Cut(from, "@")
+	for _, results := range header.Values("Authentication-Results") {
+		if authResultsPass(results, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// authResultsPass reports whether an Authentication-Results header (RFC
+// 8601) added by EMAIL_AUTHSERV_ID has a DMARC, DKIM or SPF pass aligned
+// with domain. Headers added by other servers, which a sender can forge,
+// are ignored.
+func authResultsPass(results, domain string) bool {
+	results = authResultsComments.ReplaceAllString(results, "")
+	resinfos := strings.Split(results, ";")
+	if fields := strings.Fields(resinfos[0]); len(fields) == 0 || !strings.EqualFold(fields[0], cfg.EmailAuthservID) {
+		return false
+	}
+	for _, resinfo := range resinfos[1:] {
+		fields := strings.Fields(strings.ToLower(resinfo))
+		if len(fields) == 0 {
+			continue
+		}
+		method, result, _ := strings.Cut(fields[0], "=")
+		if result != "pass" {
+			continue
+		}
+		props := map[string]string{}
+		for _, field := range fields[1:] {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				props[key] = strings.Trim(value, `"`)
+			}
+		}
+		var authenticated string
+		switch method {
+		case "dmarc":
+			authenticated = props["header.from"]
+		case "dkim":
+			authenticated = props["header.d"]
+		case "spf":
+			authenticated = props["smtp.mailfrom"]
+			if _, d, ok := strings.Cut(authenticated, "@"); ok {
+				authenticated = d
+			}
+		}
+		// Relaxed alignment: the sender's domain or one of its parents
+		if authenticated != "" && (domain == authenticated || strings.HasSuffix(domain, "."+authenticated)) {
+			return true
+		}
+	}
+	return false
+}
+
+var authResultsComments = regexp.MustCompile(`\([^)]*\)`)
+
+// emailLinks extracts the distinct Apple Music links from the text parts of
+// a message
+func emailLinks(mr *mail.Reader) ([]string, error) {
+	var links []string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		header, ok := part.Header.(*mail.InlineHeader)
+		if !ok {
+			continue
+		}
+		contentType, _, _ := header.ContentType()
+		if !strings.HasPrefix(contentType, "text/") {
+			continue
+		}
+
+		text, err := io.ReadAll(io.LimitReader(part.Body, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range findAppleMusicLinks(html.UnescapeString(string(text))) {
+			if !slices.Contains(links, link) {
+				links = append(links, link)
+			}
+		}
+	}
+	return links, nil
+}
+
+// dialSMTP connects to SMTP_ADDR, upgrading to TLS when the server offers
+// STARTTLS, and logs in when SMTP_USERNAME is set
+func dialSMTP() (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.Dial(cfg.SMTPAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := outboundTLSConfig()
+		tlsConfig.ServerName = host
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// sendMail sends a plain-text message through SMTP_ADDR
+func sendMail(to, subject, inReplyTo, text string) (err error) {
+	defer func() { integrationHealth.record("email", err) }()
+
+	c, err := dialSMTP()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Mail(cfg.SMTPFrom); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, domain, _ := strings.Cut(cfg.SMTPFrom, "@")
+	headers := []string{
+		"From: " + cfg.SMTPFrom,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", stripLineBreaks(subject)),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%s@%s>", uuid.New().String(), domain),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+		"Auto-Submitted: auto-replied",
+	}
+	if inReplyTo != "" {
+		inReplyTo = stripLineBreaks(inReplyTo)
+		headers = append(headers, "In-Reply-To: "+inReplyTo, "References: "+inReplyTo)
+	}
+	message := strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.ReplaceAll(text, "\n", "\r\n") + "\r\n"
+	if _, err := io.WriteString(w, message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func stripLineBreaks(s string) string {
+	return strings.NewReplacer("\r", "", "\n", " ").Replace(s)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Formats events can be delivered in
+var eventFormats = []string{"", "json", "cloudevents"}
+
+// cloudEventTypePrefix namespaces CloudEvents types, e.g.
+// io.github.tikhonp.amdl.job.completed
+const cloudEventTypePrefix = "io.github.tikhonp.amdl."
+
+// WebhookEvent is the payload posted to webhooks
+type WebhookEvent struct {
+	Event string          `json:"event"`
+	Time  time.Time       `json:"time"`
+	Job   *DownloadStatus `json:"job,omitempty"`
+	Batch *BatchDigest    `json:"batch,omitempty"`
+}
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data"`
+
+	// Distributed tracing extension
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// cloudEvent converts the event; id is shared by every delivery of it so
+// receivers can deduplicate
+func (ev WebhookEvent) cloudEvent(id string, trace TraceContext) CloudEvent {
+	ce := CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              id,
+		Source:          cfg.CloudEventsSource,
+		Type:            cloudEventTypePrefix + ev.Event,
+		Subject:         ev.subject(),
+		Time:            ev.Time,
+		DataContentType: "application/json",
+		TraceParent:     trace.TraceParent,
+	}
+	if ev.Job != nil {
+		ce.Data = ev.Job
+	} else if ev.Batch != nil {
+		ce.Data = ev.Batch
+	}
+	return ce
+}
+
+// subject is the ID of the job or batch the event is about
+func (ev WebhookEvent) subject() string {
+	switch {
+	case ev.Job != nil:
+		return ev.Job.ID
+	case ev.Batch != nil:
+		return ev.Batch.BatchID
+	}
+	return ""
+}
+
+// publishEvent queues the event for WEBHOOK_URL and every registered webhook
+// subscribed to it, in each endpoint's format, and sends it to NATS and Kafka
+func publishEvent(ev WebhookEvent, trace TraceContext) {
+	id := uuid.New().String()
+	payload := func(format string) any {
+		if format == "cloudevents" {
+			return ev.cloudEvent(id, trace)
+		}
+		return ev
+	}
+
+	if eventStream != nil {
+		eventStream.publish(ev, id, trace)
+	}
+	if kafkaSink != nil {
+		kafkaSink.publish(ev, id, trace)
+	}
+	if cfg.WebhookURL != "" {
+		deliveryQueue.Enqueue(cfg.WebhookURL, "", ev.Event, cfg.WebhookFormat, payload(cfg.WebhookFormat), trace)
+	}
+	for _, wh := range webhookStore.List() {
+		if wh.subscribed(ev.Event) {
+			deliveryQueue.Enqueue(wh.URL, wh.ID, ev.Event, wh.Format, payload(wh.Format), trace)
+		}
+	}
+	routeEvent(ev, payload, trace)
+}
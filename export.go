@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportFormat is a portable format audio files can be transcoded to on
+// export
+type exportFormat struct {
+	ext         string
+	contentType string
+	args        []string // ffmpeg output options
+}
+
+var exportFormats = map[string]exportFormat{
+	"mp3":  {ext: ".mp3", contentType: "audio/mpeg", args: []string{"-c:a", "libmp3lame", "-q:a", "2", "-id3v2_version", "3", "-f", "mp3"}},
+	"flac": {ext: ".flac", contentType: "audio/flac", args: []string{"-c:a", "flac", "-f", "flac"}},
+}
+
+// exportKey signs export download links; without EXPORT_URL_SECRET a random
+// key is used, so links stop working when the wrapper restarts
+var exportKey = sync.OnceValue(func() []byte {
+	if cfg.ExportURLSecret != "" {
+		return []byte(cfg.ExportURLSecret)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// ExportFile is a file in a collection export, with its signed download
+// link in URL mode
+type ExportFile struct {
+	JobID string `json:"job_id"`
+	Path  string `json:"path"` // relative to DOWNLOADS_DIR, as exported
+	Kind  string `json:"kind"`
+	Size  int64  `json:"size,omitempty"` // left out for transcoded files
+	URL   string `json:"url,omitempty"`
+
+	source string
+}
+
+// exportFiles returns the files of the completed jobs, each listed once,
+// named as they are exported with transcode
+func exportFiles(jobs []DownloadStatus, transcode string) []ExportFile {
+	files := []ExportFile{}
+	seen := map[string]bool{}
+	for _, job := range jobs {
+		if job.Status != "completed" {
+			continue
+		}
+		for _, artifact := range slices.Concat(job.Artifacts, job.Extras) {
+			if seen[artifact.Path] {
+				continue
+			}
+			seen[artifact.Path] = true
+			file := ExportFile{JobID: job.ID, Path: artifact.Path, Kind: artifact.Kind, Size: artifact.Size, source: artifact.Path}
+			if transcode != "" && artifact.Kind == "audio" {
+				file.Path = exportName(artifact.Path, transcode)
+				file.Size = 0
+			}
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// exportName returns the name of an audio file transcoded to format
+func exportName(name, format string) string {
+	if f, ok := exportFormats[format]; ok {
+		return strings.TrimSuffix(name, path.Ext(name)) + f.ext
+	}
+	return name
+}
+
+// handleCollectionExport serves GET /collections/{id}/export: a ZIP archive
+// of the files of the collection's completed jobs, with a playlist of them,
+// or with ?mode=urls a manifest of signed links to each file that work
+// without an API key until they expire. ?transcode=mp3 or flac converts the
+// audio files on the way out.
+func handleCollectionExport(w http.ResponseWriter, r *http.Request, c Collection, jobs []DownloadStatus) {
+	query := r.URL.Query()
+	transcode := query.Get("transcode")
+	if _, ok := exportFormats[transcode]; transcode != "" && !ok {
+		http.Error(w, "transcode must be mp3 or flac", http.StatusBadRequest)
+		return
+	}
+	mode := query.Get("mode")
+	if mode != "" && mode != "zip" && mode != "urls" {
+		http.Error(w, "mode must be zip or urls", http.StatusBadRequest)
+		return
+	}
+
+	files := exportFiles(jobs, transcode)
+	if len(files) == 0 {
+		http.Error(w, "Collection has no completed downloads to export", http.StatusConflict)
+		return
+	}
+
+	if mode == "urls" {
+		expires := time.Now().Add(cfg.ExportURLTTL).Truncate(time.Second)
+		for i := range files {
+			files[i].URL = exportURL(r, files[i].source, transcode, expires)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"collection_id": c.ID,
+			"name":          c.Name,
+			"transcode":     transcode,
+			"expires_at":    expires,
+			"files":         files,
+		})
+		return
+	}
+
+	name := sanitizeName(c.Name, "windows")
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	if err := writeExportArchive(r.Context(), w, name, files, jobs, transcode); err != nil {
+		// The response has started, so the client can only learn about the
+		// failure from the connection being dropped
+		slog.ErrorContext(r.Context(), "Export failed", "collection_id", c.ID, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeExportArchive streams a ZIP archive of files under the root
+// directory, with a playlist of the audio files next to them. Audio and
+// artwork are already compressed, so files are stored as they are.
+func writeExportArchive(ctx context.Context, w io.Writer, root string, files []ExportFile, jobs []DownloadStatus, transcode string) error {
+	zw := zip.NewWriter(w)
+
+	for _, file := range files {
+		fullPath, err := resolveArtifactPath(file.source)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return err
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     root + "/" + file.Path,
+			Method:   zip.Store,
+			Modified: info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyExportFile(ctx, entry, fullPath, file.Kind, transcode); err != nil {
+			return err
+		}
+	}
+
+	var playlist bytes.Buffer
+	writePlaylist(&playlist, completedJobs(jobs), func(name string) string { return exportName(name, transcode) })
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: root + "/" + root + ".m3u8", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(playlist.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyExportFile writes a file to w, transcoded when it's audio and a
+// format is given
+func copyExportFile(ctx context.Context, w io.Writer, fullPath, kind, transcode string) error {
+	if transcode == "" || kind != "audio" {
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	args := append([]string{"-v", "error", "-i", fullPath, "-map", "0:a", "-map_metadata", "0"}, exportFormats[transcode].args...)
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath, append(args, "pipe:1")...)
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = w, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg %s: %v: %s", path.Base(fullPath), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func completedJobs(jobs []DownloadStatus) []DownloadStatus {
+	var completed []DownloadStatus
+	for _, job := range jobs {
+		if job.Status == "completed" {
+			completed = append(completed, job)
+		}
+	}
+	return completed
+}
+
+// exportSignature signs a download link of a file, transcoded to a format
+// or not, until it expires
+func exportSignature(name, transcode string, expires int64) string {
+	mac := hmac.New(sha256.New, exportKey())
+	fmt.Fprintf(mac, "%s\n%s\n%d", name, transcode, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportURL returns the signed /exports/ link of a file, on the host the
+// request was made to
+func exportURL(r *http.Request, name, transcode string, expires time.Time) string {
+	query := url.Values{}
+	if transcode != "" {
+		query.Set("transcode", transcode)
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", exportSignature(name, transcode, expires.Unix()))
+	u := url.URL{Scheme: requestScheme(r), Host: r.Host, Path: "/exports/" + name, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// requestScheme returns the scheme the client made r with, behind a TLS
+// terminating proxy too
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// handleExportFile serves /exports/{path}, the signed download links of
+// collection exports. The signature stands in for an API key.
+func handleExportFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Path[len("/exports/"):]
+	query := r.URL.Query()
+	transcode := query.Get("transcode")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(query.Get("sig")), []byte(exportSignature(name, transcode, expires))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Link expired", http.StatusGone)
+		return
+	}
+
+	fullPath, err := resolveArtifactPath(name)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	format, transcoded := exportFormats[transcode]
+	if !transcoded || artifactKind(name) != "audio" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(exportName(name, transcode))}))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := copyExportFile(r.Context(), w, fullPath, "audio", transcode); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to transcode", "file", name, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
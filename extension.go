@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+func extOriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	return slices.Contains(cfg.ExtAllowedOrigins, "*") || slices.Contains(cfg.ExtAllowedOrigins, origin)
+}
+
+func setExtCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if !extOriginAllowed(origin) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.Header().Add("Vary", "Origin")
+}
+
+// handleExtSubmit serves the companion browser extension. Submitting a URL
+// that already has an active or completed job returns that job instead of
+// starting a duplicate download.
+func handleExtSubmit(w http.ResponseWriter, r *http.Request) {
+	setExtCORSHeaders(w, r)
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cfg.ExtAPIKey == "" {
+		http.Error(w, "Extension submission is disabled", http.StatusForbidden)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(cfg.ExtAPIKey)) != 1 {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req DownloadRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Template != "" {
+		if err := applyTemplate(&req, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.URLs) > 0 {
+		http.Error(w, "Batches must be submitted with POST /download", http.StatusBadRequest)
+		return
+	}
+	if req.scheduled() {
+		http.Error(w, "Scheduled downloads must be submitted with POST /download", http.StatusBadRequest)
+		return
+	}
+
+	req.Owner = requestOwner(r, "extension")
+	req.Trace = traceFromRequest(r)
+	if err := prepareRequest(&req); err != nil {
+		writeSubmitError(w, err)
+		return
+	}
+
+	response := map[string]any{"duplicate": false}
+	if existing, duplicate := jobManager.FindByURL(req.URL); duplicate {
+		response["id"] = existing.ID
+		response["status"] = existing.Status
+		response["duplicate"] = true
+	} else {
+		job := startDownload(req)
+		response["id"] = job.ID
+		response["status"] = "started"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// ExtrasOptions toggle the additional content downloaded with an album
+type ExtrasOptions struct {
+	// Expect a digital booklet (PDF) with the album, which keeps it even
+	// with RemoveBooklets
+	Booklet bool `json:"booklet,omitempty"`
+
+	// Delete digital booklets saved with the album
+	RemoveBooklets bool `json:"remove_booklets,omitempty"`
+
+	// Download the bonus music videos listed on the album
+	Videos bool `json:"videos,omitempty"`
+
+	// Write a cue sheet and an ffmpeg chapters file of the album's tracks,
+	// for continuous mixes merged into one file
+	CueSheet bool `json:"cue_sheet,omitempty"`
+	Chapters bool `json:"chapters,omitempty"`
+}
+
+// merge returns e with the toggles enabled in override turned on
+func (e ExtrasOptions) merge(override *ExtrasOptions) ExtrasOptions {
+	if override == nil {
+		return e
+	}
+	e.Booklet = e.Booklet || override.Booklet
+	e.RemoveBooklets = e.RemoveBooklets || override.RemoveBooklets
+	e.Videos = e.Videos || override.Videos
+	e.CueSheet = e.CueSheet || override.CueSheet
+	e.Chapters = e.Chapters || override.Chapters
+	return e
+}
+
+// Artifact kinds listed under the job's extras rather than its artifacts
+var extraKinds = map[string]bool{"booklet": true, "video": true, "motion_artwork": true, "cue_sheet": true, "chapters": true}
+
+// downloadExtras downloads the bonus videos of an album. Failures are
+// reported as warnings since the album itself was downloaded.
+func downloadExtras(jobID string, req DownloadRequest, dir string) {
+	if !resolveOutputProfile(req).Extras.Videos || req.Song {
+		return
+	}
+
+	link, err := parseAppleMusicURL(req.URL)
+	if err != nil || link.Type != "album" {
+		return
+	}
+
+	album, err := appleMusic.Resource(link.Storefront, "album", link.ID, "")
+	if err != nil {
+		postProcessWarning(jobID, fmt.Errorf("failed to list album extras: %w", err))
+		return
+	}
+
+	var videos []catalogResource
+	for _, track := range album.Relationships.Tracks.Data {
+		if track.Type == "music-videos" && track.Attributes.URL != "" {
+			videos = append(videos, track)
+		}
+	}
+	if len(videos) == 0 {
+		jobManager.AddEvent(jobID, JobEvent{Type: "videos_unavailable", Message: "The album has no bonus videos"})
+		return
+	}
+
+	message := fmt.Sprintf("Downloading %d bonus video(s)", len(videos))
+	jobManager.AppendLog(jobID, message)
+	slog.Info("Downloading bonus videos", "job_id", jobID, "videos", len(videos))
+
+	policy := cfg.Retry.merge(req.Retry)
+	for _, video := range videos {
+		args := []string{video.Attributes.URL}
+		if req.Debug {
+			args = append([]string{"--debug"}, args...)
+		}
+		jobManager.AppendLog(jobID, fmt.Sprintf("Command: /usr/local/bin/apple-music-dl %v", args))
+		if _, err := runWithRetries(jobID, args, dir, req, policy); err != nil {
+			if jobCancelled(jobID) {
+				return
+			}
+			postProcessWarning(jobID, fmt.Errorf("video %q failed: %w", video.Attributes.Name, err))
+		}
+	}
+}
+
+// removeBooklets deletes the PDF booklets among a job's files and returns
+// the remaining files
+func removeBooklets(files []string) []string {
+	var kept []string
+	for _, path := range files {
+		if artifactKind(path) == "booklet" {
+			if err := os.Remove(path); err == nil {
+				continue
+			}
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+)
+
+// Lines of the downloader's stderr kept with a failed job
+const stderrTailLines = 20
+
+// DownloadError is a failed download attempt with the error code clients
+// can branch on and the end of what the downloader printed to stderr.
+//
+// Codes: "invalid_token", "region_mismatch", "not_found",
+// "wrapper_unreachable" and "disk_full" as recognised in the output,
+// "format_unavailable", "network" for other errors that tend to go away by
+// themselves, "timeout", "stalled", "start_failed" and "downloader_failed"
+// when the downloader exited with an error that wasn't recognised. Jobs that
+// failed before the downloader ran get "internal".
+type DownloadError struct {
+	Code       string
+	StderrTail []string
+	Err        error
+}
+
+func (e *DownloadError) Error() string { return e.Err.Error() }
+func (e *DownloadError) Unwrap() error { return e.Err }
+
+// failureOutput collects what an attempt printed about why it failed
+type failureOutput struct {
+	mu     sync.Mutex
+	code   string // of the last line that was classified
+	stderr []string
+}
+
+func (f *failureOutput) line(patterns *OutputPatterns, line string) {
+	if code := patterns.classify(line); code != "" {
+		f.mu.Lock()
+		f.code = code
+		f.mu.Unlock()
+	}
+}
+
+func (f *failureOutput) stderrLine(line string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stderr = append(f.stderr, line)
+	if len(f.stderr) > stderrTailLines {
+		f.stderr = f.stderr[len(f.stderr)-stderrTailLines:]
+	}
+}
+
+// error returns err with code and the stderr tail
+func (f *failureOutput) error(code string, err error) *DownloadError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &DownloadError{Code: code, StderrTail: append([]string(nil), f.stderr...), Err: err}
+}
+
+// classified returns err with the code of the last line of output that
+// explained it, or fallback
+func (f *failureOutput) classified(fallback string, err error) *DownloadError {
+	f.mu.Lock()
+	code := f.code
+	f.mu.Unlock()
+	if code == "" {
+		code = fallback
+	}
+	return f.error(code, err)
+}
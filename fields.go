@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Fields of a job kept by ?compact=true: what a poller needs to show
+// progress and the outcome, without logs, events, files or the request
+var compactJobFields = []string{
+	"id", "url", "status", "progress", "error", "error_code",
+	"started_at", "ended_at", "duration", "batch_id", "priority", "format_obtained", "content_type", "retry",
+}
+
+// jobFieldNames are the JSON names of DownloadStatus fields
+var jobFieldNames = sync.OnceValue(func() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeFor[DownloadStatus]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+})
+
+// jobView is the subset of a job's fields a response includes; the zero
+// value includes all of them
+type jobView struct {
+	fields []string
+}
+
+// parseJobView reads ?fields= (comma-separated JSON field names) and
+// ?compact=true. Fields take precedence when both are given.
+func parseJobView(query url.Values) (jobView, error) {
+	var v jobView
+	if fields := splitList(query.Get("fields")); len(fields) > 0 {
+		for _, field := range fields {
+			if !jobFieldNames()[field] {
+				return v, fmt.Errorf("unknown field %q", field)
+			}
+		}
+		v.fields = fields
+		return v, nil
+	}
+	switch query.Get("compact") {
+	case "", "false":
+	case "true":
+		v.fields = compactJobFields
+	default:
+		return v, errors.New("compact must be true or false")
+	}
+	return v, nil
+}
+
+func (v jobView) includes(field string) bool {
+	return v.fields == nil || slices.Contains(v.fields, field)
+}
+
+// key identifies the view for caching
+func (v jobView) key() string {
+	return strings.Join(v.fields, ",")
+}
+
+// project returns the job as it's encoded in the view
+func (v jobView) project(job *DownloadStatus) (any, error) {
+	if v.fields == nil {
+		return job, nil
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(v.fields))
+	for _, field := range v.fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
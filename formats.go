@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FormatList is an ordered list of preferred formats. In JSON it can be a
+// single string ("atmos") or a list (["atmos", "alac", "aac"]); later formats
+// are fallbacks used when the earlier ones aren't available.
+type FormatList []string
+
+func (f *FormatList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*f = nil
+		} else {
+			*f = FormatList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("format must be a string or a list of strings")
+	}
+	*f = list
+	return nil
+}
+
+// parseFormatList parses a comma-separated format list, e.g. "atmos,alac"
+func parseFormatList(value string) FormatList {
+	return FormatList(splitList(value))
+}
+
+func (f FormatList) validate() error {
+	for _, format := range f {
+		if format == "" || !slices.Contains(validFormats, format) {
+			return fmt.Errorf("format must be alac, atmos or aac")
+		}
+	}
+	return nil
+}
+
+func (f FormatList) String() string {
+	if len(f) == 0 {
+		return "alac"
+	}
+	return strings.Join(f, ",")
+}
+
+// formatFlags returns the apple-music-dl flags and a display name for format
+func formatFlags(format string) ([]string, string) {
+	switch format {
+	case "atmos":
+		return []string{"--atmos"}, "Dolby Atmos"
+	case "aac":
+		return []string{"--aac"}, "AAC"
+	default:
+		return nil, "ALAC (default)"
+	}
+}
+
+// Quality caps apple-music-dl accepts: the highest ALAC sample rate in Hz,
+// the highest Atmos bitrate in kbps, and the AAC variant
+var (
+	validAlacMax  = []int{44100, 48000, 88200, 96000, 176400, 192000}
+	validAtmosMax = []int{2448, 2768}
+	validAACTypes = []string{"aac-lc", "aac", "aac-binaural", "aac-downmix"}
+)
+
+// validateQuality checks the request's quality options against what the
+// downloader accepts
+func (req *DownloadRequest) validateQuality() error {
+	if req.AlacMax != 0 && !slices.Contains(validAlacMax, req.AlacMax) {
+		return fmt.Errorf("alac_max must be one of %s", joinInts(validAlacMax))
+	}
+	if req.AtmosMax != 0 && !slices.Contains(validAtmosMax, req.AtmosMax) {
+		return fmt.Errorf("atmos_max must be one of %s", joinInts(validAtmosMax))
+	}
+	if req.AACType != "" && !slices.Contains(validAACTypes, req.AACType) {
+		return fmt.Errorf("aac_type must be one of %s", strings.Join(validAACTypes, ", "))
+	}
+	return nil
+}
+
+// qualityFlags returns the apple-music-dl flags for the request's quality
+// options that apply to format, so a fallback format isn't given the caps
+// of another
+func qualityFlags(req DownloadRequest, format string) []string {
+	switch {
+	case format == "atmos" && req.AtmosMax != 0:
+		return []string{"--atmos-max", strconv.Itoa(req.AtmosMax)}
+	case format == "aac" && req.AACType != "":
+		return []string{"--aac-type", req.AACType}
+	case format == "alac" && req.AlacMax != 0:
+		return []string{"--alac-max", strconv.Itoa(req.AlacMax)}
+	}
+	return nil
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GaplessInfo is the gapless playback info of an AAC track: the samples the
+// encoder added before and after the audio, which players skip to join
+// tracks without gaps, as the iTunSMPB tag gives them. Status is "ok",
+// "missing", "inconsistent" or "repaired"; Problem says what's wrong with
+// missing or inconsistent info.
+type GaplessInfo struct {
+	Status       string `json:"status"`
+	EncoderDelay int64  `json:"encoder_delay,omitempty"`
+	Padding      int64  `json:"padding,omitempty"`
+	Samples      int64  `json:"samples,omitempty"`
+	Problem      string `json:"problem,omitempty"`
+}
+
+// gaplessTiming is where the audio of a track lies among its samples
+type gaplessTiming struct {
+	delay, padding, samples int64
+}
+
+func parseITunSMPB(value string) (gaplessTiming, bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 4 {
+		return gaplessTiming{}, false
+	}
+	var timing gaplessTiming
+	var err [3]error
+	timing.delay, err[0] = strconv.ParseInt(fields[1], 16, 64)
+	timing.padding, err[1] = strconv.ParseInt(fields[2], 16, 64)
+	timing.samples, err[2] = strconv.ParseInt(fields[3], 16, 64)
+	return timing, err == [3]error{} && timing.samples > 0
+}
+
+// String renders the timing as iTunes writes iTunSMPB
+func (t gaplessTiming) String() string {
+	return fmt.Sprintf(" 00000000 %08X %08X %016X", t.delay, t.padding, t.samples) + strings.Repeat(" 00000000", 8)
+}
+
+// mp4Gapless is what an MP4 file says about the gapless playback of its
+// audio track
+type mp4Gapless struct {
+	codec  string // of the sample entry, e.g. "mp4a"
+	smpb   string
+	total  int64 // samples of the track; 0 when unknown
+	edit   gaplessTiming
+	edited bool // whether the edit list trims the track
+
+	// Samples the edit list's length may be off by, as it's in the coarser
+	// timescale of the movie
+	editPrecision int64
+}
+
+func readGapless(file *mp4File) mp4Gapless {
+	g := mp4Gapless{smpb: file.iTunesItem("iTunSMPB")}
+	trak := file.audioTrack()
+	if trak == nil {
+		return g
+	}
+	// Version and flags and the entry count precede the first sample entry
+	if stsd := mp4Child(trak, "mdia", "minf", "stbl", "stsd"); len(stsd) >= 16 {
+		g.codec = string(stsd[12:16])
+	}
+
+	if stts := mp4Child(trak, "mdia", "minf", "stbl", "stts"); len(stts) >= 8 && !file.fragmented {
+		count := int(binary.BigEndian.Uint32(stts[4:]))
+		for i := 0; i < count && 16+i*8 <= len(stts); i++ {
+			entry := stts[8+i*8:]
+			g.total += int64(binary.BigEndian.Uint32(entry)) * int64(binary.BigEndian.Uint32(entry[4:]))
+		}
+	}
+
+	mediaScale := timescale(mp4Child(trak, "mdia", "mdhd"))
+	movieScale := timescale(mp4Child(file.moov, "mvhd"))
+	elst := mp4Child(trak, "edts", "elst")
+	if mediaScale == 0 || movieScale == 0 || len(elst) < 8 {
+		return g
+	}
+	version, count := elst[0], int(binary.BigEndian.Uint32(elst[4:]))
+	width := 12
+	if version == 1 {
+		width = 20
+	}
+	for i := 0; i < count && 8+(i+1)*width <= len(elst); i++ {
+		entry := elst[8+i*width:]
+		var duration, mediaTime int64
+		if version == 1 {
+			duration, mediaTime = int64(binary.BigEndian.Uint64(entry)), int64(binary.BigEndian.Uint64(entry[8:]))
+		} else {
+			duration, mediaTime = int64(binary.BigEndian.Uint32(entry)), int64(int32(binary.BigEndian.Uint32(entry[4:])))
+		}
+		// Empty edits delay the track rather than trim it
+		if mediaTime < 0 {
+			continue
+		}
+		g.edit.delay = mediaTime
+		g.edit.samples = (duration*mediaScale + movieScale/2) / movieScale
+		g.editPrecision = (mediaScale + movieScale - 1) / movieScale
+		g.edited = true
+		break
+	}
+	if g.edited && g.total > 0 {
+		g.edit.padding = g.total - g.edit.delay - g.edit.samples
+	}
+	return g
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// timescale reads the timescale of an mvhd or mdhd box
+func timescale(body []byte) int64 {
+	if len(body) < 24 {
+		return 0
+	}
+	if body[0] == 1 {
+		// 64-bit creation and modification times
+		return int64(binary.BigEndian.Uint32(body[20:]))
+	}
+	return int64(binary.BigEndian.Uint32(body[12:]))
+}
+
+// editTiming returns the timing of the edit list, when it trims the track
+// into something that can be written to iTunSMPB
+func (g mp4Gapless) editTiming() (gaplessTiming, bool) {
+	t := g.edit
+	return t, g.edited && g.total > 0 && t.samples > 0 && t.padding >= 0 && t.delay+t.samples <= g.total
+}
+
+// check compares the iTunSMPB tag with the length of the track and its
+// edit list
+func (g mp4Gapless) check() GaplessInfo {
+	timing, ok := parseITunSMPB(g.smpb)
+	switch {
+	case g.smpb == "":
+		info := GaplessInfo{Status: "missing", Problem: "no iTunSMPB tag"}
+		if _, ok := g.editTiming(); ok {
+			info.Problem += "; the edit list has the timing"
+		}
+		return info
+	case !ok:
+		return GaplessInfo{Status: "inconsistent", Problem: fmt.Sprintf("unreadable iTunSMPB %q", strings.TrimSpace(g.smpb))}
+	}
+
+	info := GaplessInfo{Status: "ok", EncoderDelay: timing.delay, Padding: timing.padding, Samples: timing.samples}
+	if length := timing.delay + timing.samples + timing.padding; g.total > 0 && length != g.total {
+		info.Status = "inconsistent"
+		info.Problem = fmt.Sprintf("iTunSMPB covers %d samples, the track has %d", length, g.total)
+	} else if edit, ok := g.editTiming(); ok && (edit.delay != timing.delay || abs(edit.samples-timing.samples) > g.editPrecision) {
+		info.Status = "inconsistent"
+		info.Problem = fmt.Sprintf("iTunSMPB has %d samples after a delay of %d, the edit list %d after %d", timing.samples, timing.delay, edit.samples, edit.delay)
+	}
+	return info
+}
+
+// checkGapless checks the gapless info of a job's AAC files, by path, and
+// with repair writes iTunSMPB tags that are missing or inconsistent from
+// the edit lists. Files without gapless info are reported in a
+// gapless_problem event. ALAC is sample-exact and Dolby Atmos isn't
+// checked, so neither gets an entry.
+func checkGapless(jobID string, files []string, repair bool) map[string]*GaplessInfo {
+	results := map[string]*GaplessInfo{}
+	var problems []string
+	for _, path := range files {
+		if artifactKind(path) != "audio" {
+			continue
+		}
+		file, err := readMP4(path)
+		if err != nil {
+			jobManager.AppendLog(jobID, fmt.Sprintf("Gapless: failed to read %s: %v", filepath.Base(path), err))
+			continue
+		}
+		g := readGapless(file)
+		if g.codec != "mp4a" {
+			continue
+		}
+
+		info := g.check()
+		if timing, ok := g.editTiming(); ok && repair && info.Status != "ok" {
+			if err := file.setITunesItem(path, "iTunSMPB", timing.String()); err != nil {
+				info.Problem += fmt.Sprintf("; repair failed: %v", err)
+			} else {
+				jobManager.AppendLog(jobID, fmt.Sprintf("Gapless: wrote iTunSMPB of %s from its edit list (%s)", filepath.Base(path), info.Problem))
+				info = GaplessInfo{Status: "repaired", EncoderDelay: timing.delay, Padding: timing.padding, Samples: timing.samples}
+			}
+		}
+		if info.Problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", filepath.Base(path), info.Problem))
+			jobManager.AppendLog(jobID, fmt.Sprintf("Gapless: %s: %s", filepath.Base(path), info.Problem))
+		}
+		results[path] = &info
+	}
+
+	if len(problems) > 0 {
+		message := fmt.Sprintf("%d of %d AAC track(s) without valid gapless info; %s", len(problems), len(results), problems[0])
+		jobManager.AddEvent(jobID, JobEvent{Type: "gapless_problem", Message: message})
+		slog.Warn("AAC tracks without valid gapless info", "job_id", jobID, "tracks", len(problems), "first", problems[0])
+	}
+	return results
+}
+
+// keepITunSMPB writes back the iTunSMPB tag path had before it was remuxed,
+// as ffmpeg drops it
+func keepITunSMPB(path, smpb string) error {
+	if smpb == "" {
+		return nil
+	}
+	file, err := readMP4(path)
+	if err != nil {
+		return err
+	}
+	if file.iTunesItem("iTunSMPB") != "" {
+		return nil
+	}
+	return file.setITunesItem(path, "iTunSMPB", smpb)
+}
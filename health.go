@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Status string `json:"status"` // ok, degraded or fail
+	Error  string `json:"error,omitempty"`
+}
+
+// Readiness is reported by /readyz. The wrapper is "unavailable" when a
+// check fails, e.g. downloads can't run at all, and "degraded" when it works
+// with reduced functionality such as failing notifications.
+type Readiness struct {
+	Status string                 `json:"status"` // ready, degraded or unavailable
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+func checkReadiness() Readiness {
+	checks := map[string]HealthCheck{
+		"startup":       startupCheck(),
+		"downloader":    checkDownloader(),
+		"downloads_dir": checkDownloadsDir(),
+	}
+	if eventStream != nil {
+		checks["nats"] = HealthCheck{Status: "ok"}
+		if !eventStream.js.Conn().IsConnected() {
+			checks["nats"] = HealthCheck{Status: "degraded", Error: "not connected"}
+		}
+	}
+	if postgresMirror != nil {
+		checks["postgres_mirror"] = postgresMirror.check()
+	}
+	if patternsLoader != nil {
+		checks["patterns"] = patternsLoader.check()
+	}
+	checks["webhooks"] = HealthCheck{Status: "ok"}
+	if failing := deliveryQueue.Failing(); failing > 0 {
+		checks["webhooks"] = HealthCheck{Status: "degraded", Error: fmt.Sprintf("failing deliveries: %d", failing)}
+	}
+
+	readiness := Readiness{Status: "ready", Checks: checks}
+	for _, check := range checks {
+		switch {
+		case check.Status == "fail":
+			readiness.Status = "unavailable"
+		case check.Status == "degraded" && readiness.Status == "ready":
+			readiness.Status = "degraded"
+		}
+	}
+	return readiness
+}
+
+func checkDownloader() HealthCheck {
+	if _, err := exec.LookPath(cfg.DownloaderPath); err != nil {
+		return HealthCheck{Status: "fail", Error: err.Error()}
+	}
+	return HealthCheck{Status: "ok"}
+}
+
+// checkDownloadsDir checks that DOWNLOADS_DIR is mounted and writable
+func checkDownloadsDir() HealthCheck {
+	if err := checkWritable(cfg.DownloadsDir); err != nil {
+		return HealthCheck{Status: "fail", Error: err.Error()}
+	}
+	return HealthCheck{Status: "ok"}
+}
+
+// handleReadyz reports whether the wrapper can take downloads, with 503
+// Service Unavailable when it can't
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := checkReadiness()
+	w.Header().Set("Content-Type", "application/json")
+	if readiness.Status == "unavailable" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
+
+// Exit codes of the healthcheck subcommand
+const (
+	healthcheckReady       = 0
+	healthcheckUnavailable = 1
+	healthcheckDegraded    = 3
+)
+
+// runHealthcheck queries /readyz of the server running on this host, for
+// container health checks in images without curl or wget
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	addr := fs.String("addr", "", "address of the API (default: the first LISTEN_ADDR on localhost)")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for a response")
+	allowDegraded := fs.Bool("allow-degraded", false, "exit with 0 instead of 3 when degraded")
+	fs.Parse(args)
+
+	if *addr == "" && len(cfg.ListenAddrs) > 0 {
+		*addr = localAddr(cfg.ListenAddrs[0])
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get("http://" + *addr + "/readyz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+		return healthcheckUnavailable
+	}
+	defer resp.Body.Close()
+
+	var readiness Readiness
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: invalid response (%s): %v\n", resp.Status, err)
+		return healthcheckUnavailable
+	}
+	for name, check := range readiness.Checks {
+		if check.Status != "ok" {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", name, check.Status, check.Error)
+		}
+	}
+	fmt.Println(readiness.Status)
+
+	switch readiness.Status {
+	case "ready":
+		return healthcheckReady
+	case "degraded":
+		if *allowDegraded {
+			return healthcheckReady
+		}
+		return healthcheckDegraded
+	default:
+		return healthcheckUnavailable
+	}
+}
+
+// localAddr turns a listen address such as ":8080" or "0.0.0.0:8080" into
+// one to connect to on this host
+func localAddr(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of hooks that don't set their own
+const defaultHookTimeout = 10 * time.Minute
+
+// Bytes of an HTTP hook's response copied into the job log
+const maxHookResponseLog = 4 << 10
+
+// Hook runs after a job completes successfully, once its files have been
+// post-processed: a command, run with the job's details in its environment
+// and arguments, or an HTTP call to URL. Hooks apply to the jobs having
+// every label in Match, like routing rules.
+type Hook struct {
+	Name    string            `json:"name,omitempty"`
+	Match   Labels            `json:"match,omitempty"`
+	Command []string          `json:"command,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Timeout string            `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+// HookPayload is the body of HTTP hooks sent with POST, PUT or PATCH, and
+// the standard input of command hooks
+type HookPayload struct {
+	Event      string          `json:"event"`
+	Hook       string          `json:"hook"`
+	Time       time.Time       `json:"time"`
+	OutputPath string          `json:"output_path"`
+	Files      []string        `json:"files"`
+	Job        *DownloadStatus `json:"job"`
+}
+
+var hookMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch}
+
+var hooks []Hook
+
+// loadHooks reads the JSON list of hooks at HOOKS_FILE
+func loadHooks(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var list []Hook
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for i := range list {
+		hook := &list[i]
+		if hook.Name == "" {
+			hook.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := hook.validate(); err != nil {
+			return fmt.Errorf("hook %s: %w", hook.Name, err)
+		}
+	}
+
+	hooks = list
+	slog.Info("Loaded hooks", "hooks", len(list), "path", path)
+	return nil
+}
+
+func (h *Hook) validate() error {
+	switch {
+	case len(h.Command) > 0 && h.URL != "":
+		return errors.New("command and url are mutually exclusive")
+	case len(h.Command) > 0:
+		if h.Method != "" || len(h.Headers) > 0 {
+			return errors.New("method and headers only apply to url hooks")
+		}
+	case h.URL != "":
+		if !isHTTPURL(h.URL) {
+			return errors.New("url must be an http or https URL")
+		}
+		h.Method = strings.ToUpper(h.Method)
+		if h.Method == "" {
+			h.Method = http.MethodPost
+		}
+		if !slices.Contains(hookMethods, h.Method) {
+			return fmt.Errorf("method must be one of %s", strings.Join(hookMethods, ", "))
+		}
+	default:
+		return errors.New("command or url is required")
+	}
+	if err := h.Match.validate(); err != nil {
+		return fmt.Errorf("match: %w", err)
+	}
+
+	h.timeout = defaultHookTimeout
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", h.Timeout)
+		}
+		h.timeout = timeout
+	}
+	return nil
+}
+
+func (h Hook) matches(job DownloadStatus) bool {
+	for key, want := range h.Match {
+		value, ok := job.Labels[key]
+		if !ok || (want != "*" && value != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// runHooks runs the hooks matching a job that has completed successfully
+// in format, one after another. Their output goes to the job's log; a
+// failing hook is reported in the job's events without failing the job or
+// skipping the hooks after it.
+func runHooks(jobID, format string) {
+	if len(hooks) == 0 {
+		return
+	}
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		return
+	}
+	job.Logs = nil
+	job.Status = "completed"
+	job.FormatObtained = format
+
+	payload := HookPayload{
+		Event:      "job.completed",
+		OutputPath: jobOutputPath(job),
+		Files:      []string{},
+		Job:        &job,
+	}
+	for _, artifact := range slices.Concat(job.Artifacts, job.Extras) {
+		payload.Files = append(payload.Files, filepath.Join(cfg.DownloadsDir, filepath.FromSlash(artifact.Path)))
+	}
+
+	for _, hook := range hooks {
+		if !hook.matches(job) {
+			continue
+		}
+		if jobCancelled(jobID) {
+			return
+		}
+		payload.Hook, payload.Time = hook.Name, time.Now()
+
+		start := time.Now()
+		jobManager.AppendLog(jobID, fmt.Sprintf("Running hook %s", hook.Name))
+		var err error
+		if len(hook.Command) > 0 {
+			err = hook.runCommand(jobID, payload)
+		} else {
+			err = hook.call(jobID, payload)
+			if !jobCancelled(jobID) {
+				integrationHealth.record("hooks", err)
+			}
+		}
+		if err != nil && !jobCancelled(jobID) {
+			jobManager.AddEvent(jobID, JobEvent{Type: "hook_failed", Message: fmt.Sprintf("Hook %s failed: %v", hook.Name, err)})
+			jobManager.AppendLog(jobID, fmt.Sprintf("Hook %s failed: %v", hook.Name, err))
+			slog.Warn("Hook failed", "job_id", jobID, "hook", hook.Name, "error", err)
+			continue
+		}
+		jobManager.AppendLog(jobID, fmt.Sprintf("Hook %s finished in %v", hook.Name, time.Since(start).Round(time.Millisecond)))
+	}
+}
+
+// expand fills in the placeholders of a hook's arguments and URL, each
+// value passed through escape
+func (p HookPayload) expand(s string, escape func(string) string) string {
+	return strings.NewReplacer(
+		"{job_id}", escape(p.Job.ID),
+		"{status}", escape(p.Job.Status),
+		"{url}", escape(p.Job.URL),
+		"{content_type}", escape(p.Job.ContentType),
+		"{format}", escape(p.Job.FormatObtained),
+		"{output_path}", escape(p.OutputPath),
+		"{downloads_dir}", escape(cfg.DownloadsDir),
+	).Replace(s)
+}
+
+func (p HookPayload) env() []string {
+	env := append(os.Environ(),
+		"AMDL_HOOK="+p.Hook,
+		"AMDL_EVENT="+p.Event,
+		"AMDL_JOB_ID="+p.Job.ID,
+		"AMDL_STATUS="+p.Job.Status,
+		"AMDL_URL="+p.Job.URL,
+		"AMDL_CONTENT_TYPE="+p.Job.ContentType,
+		"AMDL_FORMAT="+p.Job.FormatObtained,
+		"AMDL_OUTPUT_PATH="+p.OutputPath,
+		"AMDL_DOWNLOADS_DIR="+cfg.DownloadsDir,
+		"AMDL_FILES="+strings.Join(p.Files, "\n"),
+	)
+	return append(env, p.Job.Trace.env()...)
+}
+
+func (h Hook) runCommand(jobID string, payload HookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	args := make([]string, len(h.Command))
+	for i, arg := range h.Command {
+		args[i] = payload.expand(arg, func(s string) string { return s })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcess(cmd) }
+	cmd.Env = payload.env()
+	cmd.Stdin = bytes.NewReader(body)
+	output := &hookOutput{jobID: jobID, prefix: "[" + h.Name + "] "}
+	cmd.Stdout, cmd.Stderr = output, output
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := attachProcess(cmd); err != nil {
+		slog.Error("Failed to track child processes", "job_id", jobID, "error", err)
+	}
+	defer releaseProcess(cmd)
+
+	// Cancelling the job stops its hook like it stops the downloader
+	proc := jobManager.trackProcess(jobID, cmd)
+	if jobCancelled(jobID) {
+		jobManager.stopProcess(jobID)
+	}
+	err = cmd.Wait()
+	jobManager.untrackProcess(jobID, proc)
+	output.flush()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", h.timeout)
+	}
+	return err
+}
+
+// request builds the HTTP call of the hook with payload
+func (h Hook) request(ctx context.Context, payload HookPayload) (*http.Request, error) {
+	var body io.Reader
+	if h.Method != http.MethodGet {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, h.Method, payload.expand(h.URL, url.QueryEscape), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+	payload.Job.Trace.apply(req.Header)
+	return req, nil
+}
+
+func (h Hook) call(jobID string, payload HookPayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	req, err := h.request(ctx, payload)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	output := &hookOutput{jobID: jobID, prefix: "[" + h.Name + "] "}
+	fmt.Fprintf(output, "HTTP %s\n", resp.Status)
+	io.Copy(output, io.LimitReader(resp.Body, maxHookResponseLog))
+	output.flush()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// hookOutput copies a hook's output into the job's log line by line
+type hookOutput struct {
+	jobID  string
+	prefix string
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.appendLine(string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (o *hookOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.appendLine(string(o.partial))
+	o.partial = nil
+}
+
+func (o *hookOutput) appendLine(line string) {
+	if line = strings.TrimSpace(line); line != "" {
+		jobManager.AppendLog(o.jobID, o.prefix+line)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languages are those messages are translated to. Messages are written in
+// English, which is also what a message without a translation stays in.
+var languages = []string{"en", "ru", "de"}
+
+// translations maps an English message, or the format it's built from, to
+// its translations by language
+var translations = map[string]map[string]string{
+	// API errors
+	"404 page not found":                    {"ru": "404 страница не найдена", "de": "404 Seite nicht gefunden"},
+	"API key is read-only":                  {"ru": "Ключ API только для чтения", "de": "Der API-Schlüssel ist schreibgeschützt"},
+	"Album has multiple editions":           {"ru": "У альбома несколько изданий", "de": "Das Album hat mehrere Ausgaben"},
+	"Batch ID is required":                  {"ru": "Требуется ID пакета", "de": "Stapel-ID ist erforderlich"},
+	"Batch not found":                       {"ru": "Пакет не найден", "de": "Stapel nicht gefunden"},
+	"Check failed":                          {"ru": "Проверка не удалась", "de": "Prüfung fehlgeschlagen"},
+	"Collection ID is required":             {"ru": "Требуется ID коллекции", "de": "Sammlungs-ID ist erforderlich"},
+	"Collection not found":                  {"ru": "Коллекция не найдена", "de": "Sammlung nicht gefunden"},
+	"Delivery not found":                    {"ru": "Доставка не найдена", "de": "Zustellung nicht gefunden"},
+	"Edition lookup failed":                 {"ru": "Не удалось найти издания", "de": "Suche nach Ausgaben fehlgeschlagen"},
+	"Extension submission is disabled":      {"ru": "Отправка из расширения отключена", "de": "Übermittlung per Erweiterung ist deaktiviert"},
+	"Failed to delete jobs":                 {"ru": "Не удалось удалить задачи", "de": "Aufträge konnten nicht gelöscht werden"},
+	"Failed to list jobs":                   {"ru": "Не удалось получить список задач", "de": "Aufträge konnten nicht aufgelistet werden"},
+	"Failed to read request":                {"ru": "Не удалось прочитать запрос", "de": "Anfrage konnte nicht gelesen werden"},
+	"Failed to save collection":             {"ru": "Не удалось сохранить коллекцию", "de": "Sammlung konnte nicht gespeichert werden"},
+	"Failed to save job":                    {"ru": "Не удалось сохранить задачу", "de": "Auftrag konnte nicht gespeichert werden"},
+	"Failed to save jobs":                   {"ru": "Не удалось сохранить задачи", "de": "Aufträge konnten nicht gespeichert werden"},
+	"Failed to save preferences":            {"ru": "Не удалось сохранить настройки", "de": "Einstellungen konnten nicht gespeichert werden"},
+	"Failed to save template":               {"ru": "Не удалось сохранить шаблон", "de": "Vorlage konnte nicht gespeichert werden"},
+	"Failed to save webhook":                {"ru": "Не удалось сохранить вебхук", "de": "Webhook konnte nicht gespeichert werden"},
+	"File not found":                        {"ru": "Файл не найден", "de": "Datei nicht gefunden"},
+	"Format must be alac, atmos or aac":     {"ru": "Формат должен быть alac, atmos или aac", "de": "Das Format muss alac, atmos oder aac sein"},
+	"Import ID is required":                 {"ru": "Требуется ID импорта", "de": "Import-ID ist erforderlich"},
+	"Import not found":                      {"ru": "Импорт не найден", "de": "Import nicht gefunden"},
+	"Invalid API key":                       {"ru": "Неверный ключ API", "de": "Ungültiger API-Schlüssel"},
+	"Invalid ingest token":                  {"ru": "Неверный токен приёма", "de": "Ungültiges Ingest-Token"},
+	"Invalid or missing API key":            {"ru": "Ключ API неверен или отсутствует", "de": "API-Schlüssel ungültig oder fehlt"},
+	"Invalid payload":                       {"ru": "Некорректные данные", "de": "Ungültige Nutzdaten"},
+	"Invalid request":                       {"ru": "Некорректный запрос", "de": "Ungültige Anfrage"},
+	"Invalid request signature":             {"ru": "Неверная подпись запроса", "de": "Ungültige Anfragesignatur"},
+	"Invalid signature":                     {"ru": "Неверная подпись", "de": "Ungültige Signatur"},
+	"Invalid token":                         {"ru": "Неверный токен", "de": "Ungültiges Token"},
+	"Invalid webhook":                       {"ru": "Некорректный вебхук", "de": "Ungültiger Webhook"},
+	"Job ID is required":                    {"ru": "Требуется ID задачи", "de": "Auftrags-ID ist erforderlich"},
+	"Job is not running":                    {"ru": "Задача не выполняется", "de": "Der Auftrag läuft nicht"},
+	"Job not found":                         {"ru": "Задача не найдена", "de": "Auftrag nicht gefunden"},
+	"Link expired":                          {"ru": "Срок действия ссылки истёк", "de": "Link abgelaufen"},
+	"Method not allowed":                    {"ru": "Метод не поддерживается", "de": "Methode nicht erlaubt"},
+	"Migration ID is required":              {"ru": "Требуется ID миграции", "de": "Migrations-ID ist erforderlich"},
+	"Migration not found":                   {"ru": "Миграция не найдена", "de": "Migration nicht gefunden"},
+	"Not found":                             {"ru": "Не найдено", "de": "Nicht gefunden"},
+	"Priority must be high, normal or low":  {"ru": "Приоритет должен быть high, normal или low", "de": "Die Priorität muss high, normal oder low sein"},
+	"Quick submission is disabled":          {"ru": "Быстрая отправка отключена", "de": "Schnellübermittlung ist deaktiviert"},
+	"Source must be lastfm or listenbrainz": {"ru": "Источник должен быть lastfm или listenbrainz", "de": "Die Quelle muss lastfm oder listenbrainz sein"},
+	"Template already exists":               {"ru": "Шаблон уже существует", "de": "Vorlage existiert bereits"},
+	"Template name is required":             {"ru": "Требуется имя шаблона", "de": "Vorlagenname ist erforderlich"},
+	"Template not found":                    {"ru": "Шаблон не найден", "de": "Vorlage nicht gefunden"},
+	"URL is required":                       {"ru": "Требуется URL", "de": "URL ist erforderlich"},
+	"Unknown ingest source":                 {"ru": "Неизвестный источник приёма", "de": "Unbekannte Ingest-Quelle"},
+	"Use either url or urls":                {"ru": "Укажите либо url, либо urls", "de": "Entweder url oder urls angeben"},
+	"User is required":                      {"ru": "Требуется пользователь", "de": "Benutzer ist erforderlich"},
+	"Webhook not found":                     {"ru": "Вебхук не найден", "de": "Webhook nicht gefunden"},
+	"Collection has no completed downloads to export": {
+		"ru": "В коллекции нет завершённых загрузок для экспорта",
+		"de": "Die Sammlung hat keine abgeschlossenen Downloads zum Exportieren",
+	},
+
+	// Chat and email messages
+	"Job %s finished: %s":              {"ru": "Задача %s завершена: %s", "de": "Auftrag %s beendet: %s"},
+	"Started job `%s`\n%s":             {"ru": "Задача `%s` запущена\n%s", "de": "Auftrag `%s` gestartet\n%s"},
+	"Cancelled job %s":                 {"ru": "Задача %s отменена", "de": "Auftrag %s abgebrochen"},
+	"Queue is empty":                   {"ru": "Очередь пуста", "de": "Die Warteschlange ist leer"},
+	"No jobs yet":                      {"ru": "Задач пока нет", "de": "Noch keine Aufträge"},
+	"Usage: /dl <url> [format]":        {"ru": "Использование: /dl <url> [формат]", "de": "Verwendung: /dl <url> [Format]"},
+	"Usage: /cancel <job_id> [reason]": {"ru": "Использование: /cancel <job_id> [причина]", "de": "Verwendung: /cancel <job_id> [Grund]"},
+	"This chat (%d) is not allowed to use this bot.": {
+		"ru": "Этому чату (%d) нельзя пользоваться ботом.",
+		"de": "Dieser Chat (%d) darf diesen Bot nicht verwenden.",
+	},
+	"Unknown command": {"ru": "Неизвестная команда", "de": "Unbekannter Befehl"},
+	"You are not allowed to use this command here.": {
+		"ru": "Вам нельзя использовать эту команду здесь.",
+		"de": "Du darfst diesen Befehl hier nicht verwenden.",
+	},
+	"Job %s":       {"ru": "Задача %s", "de": "Auftrag %s"},
+	"Status: %s":   {"ru": "Статус: %s", "de": "Status: %s"},
+	"Progress: %s": {"ru": "Прогресс: %s", "de": "Fortschritt: %s"},
+	"Duration: %s": {"ru": "Длительность: %s", "de": "Dauer: %s"},
+	"Error: %s":    {"ru": "Ошибка: %s", "de": "Fehler: %s"},
+	"Tracks:":      {"ru": "Треки:", "de": "Titel:"},
+	"…and %d more": {"ru": "…и ещё %d", "de": "…und %d weitere"},
+	"Batch %s finished: %d of %d job(s)": {
+		"ru": "Пакет %s завершён: задач %d из %d",
+		"de": "Stapel %s abgeschlossen: %d von %d Aufträgen",
+	},
+	"Batch %s wave %d of %d finished: %s; %d of %d job(s) done, next wave at %s": {
+		"ru": "Пакет %s: волна %d из %d завершена: %s; готово задач %d из %d, следующая волна в %s",
+		"de": "Stapel %s: Welle %d von %d abgeschlossen: %s; %d von %d Aufträgen erledigt, nächste Welle um %s",
+	},
+	"Apple Music download: %s": {"ru": "Загрузка Apple Music: %s", "de": "Apple-Music-Download: %s"},
+	"No Apple Music links were found in your message.": {
+		"ru": "В вашем сообщении не найдено ссылок на Apple Music.",
+		"de": "In Ihrer Nachricht wurden keine Apple-Music-Links gefunden.",
+	},
+	"Your request has finished.": {"ru": "Ваш запрос выполнен.", "de": "Ihre Anfrage ist abgeschlossen."},
+	"These links were not downloaded:": {
+		"ru": "Эти ссылки не были загружены:",
+		"de": "Diese Links wurden nicht heruntergeladen:",
+	},
+	telegramHelp: {
+		"ru": `Отправьте ссылку на Apple Music, чтобы скачать её, или используйте команду:
+/dl <url> [формат] - начать загрузку (формат: alac, atmos, aac или список для отката, например atmos,alac)
+/status [job_id] - показать задачу или сводку по всем задачам
+/cancel <job_id> [причина] - отменить задачу в очереди или в работе
+/queue - показать задачи в очереди и в работе`,
+		"de": `Senden Sie einen Apple-Music-Link, um ihn herunterzuladen, oder verwenden Sie einen Befehl:
+/dl <url> [Format] - einen Download starten (Format: alac, atmos, aac oder eine Ausweichliste wie atmos,alac)
+/status [job_id] - einen Auftrag oder eine Übersicht aller Aufträge anzeigen
+/cancel <job_id> [Grund] - einen wartenden oder laufenden Auftrag abbrechen
+/queue - wartende und laufende Aufträge auflisten`,
+	},
+
+	// Quick submission page
+	"Download started": {"ru": "Загрузка начата", "de": "Download gestartet"},
+	"Job":              {"ru": "Задача", "de": "Auftrag"},
+	"Check status":     {"ru": "Проверить статус", "de": "Status prüfen"},
+}
+
+// tr translates a message to lang and formats it with args
+func tr(lang, format string, args ...any) string {
+	if translated, ok := translations[format][lang]; ok {
+		format = translated
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// translateError translates the message of an error response, including
+// those in the form "Invalid request: <details>" by their prefix. Details
+// such as validation errors stay as they are.
+func translateError(lang, message string) string {
+	if translated, ok := translations[message][lang]; ok {
+		return translated
+	}
+	if prefix, details, ok := strings.Cut(message, ": "); ok {
+		if translated, ok := translations[prefix][lang]; ok {
+			return translated + ": " + details
+		}
+	}
+	return message
+}
+
+// supportedLanguage returns the language of a tag such as "de" or "ru-RU"
+// when messages are translated to it, or DEFAULT_LANGUAGE
+func supportedLanguage(tag string) string {
+	language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	language, _, _ = strings.Cut(language, "_")
+	if slices.Contains(languages, language) {
+		return language
+	}
+	return cfg.DefaultLanguage
+}
+
+// requestLanguage picks the language of a response from the request's
+// Accept-Language header, falling back to DEFAULT_LANGUAGE
+func requestLanguage(r *http.Request) string {
+	type choice struct {
+		language string
+		q        float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if !slices.Contains(languages, language) {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{language, q})
+		}
+	}
+	if len(choices) == 0 {
+		return cfg.DefaultLanguage
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].language
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type LovedImportRequest struct {
+	Source     string     `json:"source"` // "lastfm" or "listenbrainz"
+	User       string     `json:"user"`
+	Limit      int        `json:"limit,omitempty"`
+	DryRun     bool       `json:"dry_run,omitempty"`
+	Format     FormatList `json:"format,omitempty"`
+	Storefront string     `json:"storefront,omitempty"`
+
+	Digest *DigestConfig `json:"digest,omitempty"`
+
+	Owner  string       `json:"-"`
+	APIKey string       `json:"-"`
+	Trace  TraceContext `json:"-"`
+}
+
+type lovedTrack struct {
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+}
+
+type ImportMatch struct {
+	lovedTrack
+	URL           string `json:"url"`
+	JobID         string `json:"job_id,omitempty"`
+	ExistingJobID string `json:"existing_job_id,omitempty"`
+	Error         string `json:"error,omitempty"` // why no job was started
+}
+
+type ImportMiss struct {
+	lovedTrack
+	Reason string `json:"reason"`
+}
+
+type ImportReport struct {
+	ID         string        `json:"id"`
+	Source     string        `json:"source"`
+	User       string        `json:"user"`
+	DryRun     bool          `json:"dry_run"`
+	Status     string        `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	BatchID    string        `json:"batch_id,omitempty"`
+	Total      int           `json:"total"`
+	Processed  int           `json:"processed"`
+	Matched    []ImportMatch `json:"matched"`
+	Missed     []ImportMiss  `json:"missed"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+var (
+	importsMu sync.RWMutex
+	imports   = map[string]*ImportReport{}
+)
+
+func updateImport(id string, updater func(*ImportReport)) {
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	if report, exists := imports[id]; exists {
+		updater(report)
+	}
+}
+
+func handleImportLoved(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LovedImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.User == "" {
+		http.Error(w, "User is required", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Source {
+	case "lastfm":
+		if cfg.LastFMAPIKey == "" {
+			http.Error(w, "LASTFM_API_KEY is not configured", http.StatusBadRequest)
+			return
+		}
+	case "listenbrainz":
+	default:
+		http.Error(w, "Source must be lastfm or listenbrainz", http.StatusBadRequest)
+		return
+	}
+
+	req.Owner = requestOwner(r, "import:"+req.Source)
+	req.APIKey = apiKeyName(r)
+	req.Trace = traceFromRequest(r)
+
+	if req.Limit <= 0 || req.Limit > 500 {
+		req.Limit = 50
+	}
+	if req.Storefront == "" {
+		req.Storefront = cfg.Storefront
+	}
+
+	report := &ImportReport{
+		ID:        uuid.New().String(),
+		Source:    req.Source,
+		User:      req.User,
+		DryRun:    req.DryRun,
+		Status:    "running",
+		Matched:   []ImportMatch{},
+		Missed:    []ImportMiss{},
+		StartedAt: time.Now(),
+	}
+	importsMu.Lock()
+	imports[report.ID] = report
+	importsMu.Unlock()
+
+	go runLovedImport(report.ID, req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"import_id": report.ID,
+		"status":    "started",
+	})
+}
+
+func handleImportStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	importID := r.URL.Path[len("/import/"):]
+	if importID == "" {
+		http.Error(w, "Import ID is required", http.StatusBadRequest)
+		return
+	}
+
+	importsMu.RLock()
+	defer importsMu.RUnlock()
+	report, exists := imports[importID]
+	if !exists {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func runLovedImport(importID string, req LovedImportRequest) {
+	var tracks []lovedTrack
+	var err error
+	switch req.Source {
+	case "lastfm":
+		tracks, err = fetchLastFMLoved(req.User, req.Limit)
+	case "listenbrainz":
+		tracks, err = fetchListenBrainzLoved(req.User, req.Limit)
+	}
+
+	if err != nil {
+		now := time.Now()
+		updateImport(importID, func(report *ImportReport) {
+			report.Status = "failed"
+			report.Error = err.Error()
+			report.FinishedAt = &now
+		})
+		slog.Error("Failed to fetch loved tracks", "import_id", importID, "error", err)
+		return
+	}
+
+	updateImport(importID, func(report *ImportReport) {
+		report.Total = len(tracks)
+	})
+	slog.Info("Matching loved tracks", "import_id", importID, "tracks", len(tracks), "source", req.Source)
+
+	var batchID string
+	if !req.DryRun {
+		batchID = batchManager.CreateBatch("import:"+req.Source, req.Digest, req.Trace).ID
+		updateImport(importID, func(report *ImportReport) {
+			report.BatchID = batchID
+		})
+	}
+
+	for _, track := range tracks {
+		matches, _, err := matchSong(track.Artist, track.Title, req.Storefront)
+
+		switch {
+		case err != nil:
+			updateImport(importID, func(report *ImportReport) {
+				report.Missed = append(report.Missed, ImportMiss{lovedTrack: track, Reason: err.Error()})
+			})
+		case len(matches) == 0:
+			updateImport(importID, func(report *ImportReport) {
+				report.Missed = append(report.Missed, ImportMiss{lovedTrack: track, Reason: "no match"})
+			})
+		default:
+			match := ImportMatch{lovedTrack: track, URL: matches[0].AppleMusicURL()}
+			if existing, exists := jobManager.FindByURL(match.URL); exists {
+				match.ExistingJobID = existing.ID
+			} else if !req.DryRun {
+				single := DownloadRequest{
+					URL:     match.URL,
+					Format:  req.Format,
+					Song:    true,
+					BatchID: batchID,
+					Owner:   req.Owner,
+					APIKey:  req.APIKey,
+					Trace:   req.Trace,
+				}
+				if err := prepareRequest(&single); err != nil {
+					match.Error = err.Error()
+				} else {
+					match.JobID = startDownload(single).ID
+				}
+			}
+			updateImport(importID, func(report *ImportReport) {
+				report.Matched = append(report.Matched, match)
+			})
+		}
+
+		updateImport(importID, func(report *ImportReport) {
+			report.Processed++
+		})
+	}
+
+	if batchID != "" {
+		batchManager.Seal(batchID)
+	}
+
+	now := time.Now()
+	updateImport(importID, func(report *ImportReport) {
+		report.Status = "completed"
+		report.FinishedAt = &now
+	})
+	slog.Info("Import finished", "import_id", importID)
+}
+
+func fetchLastFMLoved(user string, limit int) ([]lovedTrack, error) {
+	params := url.Values{
+		"method":  {"user.getlovedtracks"},
+		"user":    {user},
+		"api_key": {cfg.LastFMAPIKey},
+		"format":  {"json"},
+		"limit":   {fmt.Sprint(limit)},
+	}
+	resp, err := httpClient.Get("https://ws.audioscrobbler.com/2.0/?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error       int    `json:"error"`
+		Message     string `json:"message"`
+		LovedTracks struct {
+			Track []struct {
+				Name   string `json:"name"`
+				Artist struct {
+					Name string `json:"name"`
+				} `json:"artist"`
+			} `json:"track"`
+		} `json:"lovedtracks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode Last.fm response: %w", err)
+	}
+	if result.Error != 0 {
+		return nil, errors.New(result.Message)
+	}
+
+	tracks := make([]lovedTrack, 0, len(result.LovedTracks.Track))
+	for _, t := range result.LovedTracks.Track {
+		tracks = append(tracks, lovedTrack{Artist: t.Artist.Name, Title: t.Name})
+	}
+	return tracks, nil
+}
+
+func fetchListenBrainzLoved(user string, limit int) ([]lovedTrack, error) {
+	params := url.Values{
+		"score":    {"1"},
+		"count":    {fmt.Sprint(limit)},
+		"metadata": {"true"},
+	}
+	endpoint := fmt.Sprintf("https://api.listenbrainz.org/1/feedback/user/%s/get-feedback?%s", url.PathEscape(user), params.Encode())
+	resp, err := httpClient.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listenbrainz returned %s", resp.Status)
+	}
+
+	var result struct {
+		Feedback []struct {
+			TrackMetadata *struct {
+				ArtistName string `json:"artist_name"`
+				TrackName  string `json:"track_name"`
+			} `json:"track_metadata"`
+		} `json:"feedback"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode ListenBrainz response: %w", err)
+	}
+
+	tracks := make([]lovedTrack, 0, len(result.Feedback))
+	for _, f := range result.Feedback {
+		// Feedback for recordings without metadata can't be searched for
+		if f.TrackMetadata == nil {
+			continue
+		}
+		tracks = append(tracks, lovedTrack{Artist: f.TrackMetadata.ArtistName, Title: f.TrackMetadata.TrackName})
+	}
+	return tracks, nil
+}
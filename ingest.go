@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// IngestMapping describes how a payload from an external system is
+// transformed into one or more download requests. Field values are
+// dot-separated paths into the JSON payload, e.g. "track.links.apple".
+type IngestMapping struct {
+	Secret      string `json:"secret,omitempty"`
+	ItemsField  string `json:"items_field,omitempty"`
+	URLField    string `json:"url_field"`
+	FormatField string `json:"format_field,omitempty"`
+	SongField   string `json:"song_field,omitempty"`
+
+	// Static values used when the payload doesn't provide them
+	Format  string `json:"format,omitempty"`
+	Song    bool   `json:"song,omitempty"`
+	Debug   bool   `json:"debug,omitempty"`
+	Timeout int    `json:"timeout,omitempty"`
+}
+
+var ingestMappings = map[string]IngestMapping{}
+
+func loadIngestMappings(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	mappings := map[string]IngestMapping{}
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for source, m := range mappings {
+		if m.URLField == "" {
+			return fmt.Errorf("mapping %q: url_field is required", source)
+		}
+		if err := parseFormatList(m.Format).validate(); err != nil {
+			return fmt.Errorf("mapping %q: %w", source, err)
+		}
+	}
+
+	ingestMappings = mappings
+	slog.Info("Loaded ingest mappings", "mappings", len(mappings), "path", path)
+	return nil
+}
+
+// lookupField walks a decoded JSON value following a dot-separated path.
+// Numeric segments index into arrays.
+func lookupField(v any, path string) (any, bool) {
+	if path == "" {
+		return v, true
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func lookupString(v any, path string) string {
+	if path == "" {
+		return ""
+	}
+	value, ok := lookupField(v, path)
+	if !ok {
+		return ""
+	}
+	s, _ := value.(string)
+	return strings.TrimSpace(s)
+}
+
+func lookupBool(v any, path string, fallback bool) bool {
+	if path == "" {
+		return fallback
+	}
+	value, ok := lookupField(v, path)
+	if !ok {
+		return fallback
+	}
+	switch b := value.(type) {
+	case bool:
+		return b
+	case string:
+		if parsed, err := strconv.ParseBool(b); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// buildRequest maps a single payload item to a download request
+func (m IngestMapping) buildRequest(item any) (DownloadRequest, bool) {
+	req := DownloadRequest{
+		URL:     lookupString(item, m.URLField),
+		Format:  parseFormatList(m.Format),
+		Song:    lookupBool(item, m.SongField, m.Song),
+		Debug:   m.Debug,
+		Timeout: m.Timeout,
+	}
+	if format := lookupString(item, m.FormatField); format != "" {
+		req.Format = parseFormatList(format)
+	}
+	return req, req.URL != ""
+}
+
+func ingestSecretMatches(r *http.Request, secret string) bool {
+	if secret == "" {
+		return true
+	}
+	token := r.Header.Get("X-Ingest-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func handleIngestWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source := r.URL.Path[len("/ingest/webhook/"):]
+	mapping, exists := ingestMappings[source]
+	if !exists {
+		http.Error(w, "Unknown ingest source", http.StatusNotFound)
+		return
+	}
+
+	if !ingestSecretMatches(r, mapping.Secret) {
+		http.Error(w, "Invalid ingest token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var payload any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	items := []any{payload}
+	if mapping.ItemsField != "" {
+		value, _ := lookupField(payload, mapping.ItemsField)
+		list, ok := value.([]any)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Payload field %q is not a list", mapping.ItemsField), http.StatusBadRequest)
+			return
+		}
+		items = list
+	}
+
+	jobs := []map[string]string{}
+	rejected := []string{}
+	skipped := 0
+	for _, item := range items {
+		req, ok := mapping.buildRequest(item)
+		if !ok {
+			skipped++
+			continue
+		}
+		link := req.URL
+		req.Owner = requestOwner(r, "ingest:"+source)
+		req.Trace = traceFromRequest(r)
+		if err := prepareRequest(&req); err != nil {
+			if errors.Is(err, errPolicyDenied) {
+				slog.InfoContext(r.Context(), "Ingest skipped item", "source", source, "url", link, "reason", err)
+				skipped++
+				continue
+			}
+			slog.InfoContext(r.Context(), "Ingest rejected item", "source", source, "url", link, "reason", err)
+			rejected = append(rejected, fmt.Sprintf("%s: %v", link, err))
+			continue
+		}
+		job := startDownload(req)
+		jobs = append(jobs, map[string]string{
+			"job_id": job.ID,
+			"url":    job.URL,
+		})
+	}
+
+	slog.InfoContext(r.Context(), "Ingested items", "source", source, "jobs", len(jobs), "rejected", len(rejected), "skipped", skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"source":   source,
+		"jobs":     jobs,
+		"rejected": rejected,
+		"skipped":  skipped,
+	})
+}
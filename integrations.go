@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Time an integration test may take
+const integrationTestTimeout = 15 * time.Second
+
+// integration is an outside service the wrapper sends jobs' results or
+// events to. test checks its configuration by talking to it, returning a
+// short description of what it reached.
+type integration struct {
+	name       string
+	configured func() bool
+	test       func() (string, error)
+}
+
+var integrations = []integration{
+	{"webhooks", func() bool { return cfg.WebhookURL != "" || len(webhookStore.List()) > 0 }, testWebhooks},
+	{"hooks", func() bool { return slices.ContainsFunc(hooks, func(h Hook) bool { return h.URL != "" }) }, testHooks},
+	{"telegram", func() bool { return telegram != nil }, testTelegram},
+	{"email", func() bool { return cfg.SMTPAddr != "" }, testEmail},
+	{"discord", func() bool { return cfg.DiscordPublicKey != "" }, testDiscord},
+	{"ntfy", func() bool { return len(ntfyTopics()) > 0 }, testNtfy},
+	{"nats", func() bool { return eventStream != nil }, testNATS},
+	{"kafka", func() bool { return kafkaSink != nil }, testKafka},
+	{"postgres_mirror", func() bool { return postgresMirror != nil }, testPostgresMirror},
+	{"plex", func() bool { return cfg.PlexURL != "" }, testPlex},
+	{"jellyfin", func() bool { return cfg.JellyfinURL != "" }, testJellyfin},
+}
+
+// IntegrationStatus is how an integration has been doing: "ok" when the
+// last attempt to use it succeeded, "failing" when it failed and "unknown"
+// before it was used
+type IntegrationStatus struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// IntegrationTest is the result of POST /integrations/{name}/test
+type IntegrationTest struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// IntegrationHealth tracks the outcome of the latest calls to each
+// integration, in memory
+type IntegrationHealth struct {
+	mu       sync.Mutex
+	statuses map[string]*IntegrationStatus
+}
+
+var integrationHealth = &IntegrationHealth{statuses: map[string]*IntegrationStatus{}}
+
+// record notes the outcome of a call to the named integration
+func (h *IntegrationHealth) record(name string, err error) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, exists := h.statuses[name]
+	if !exists {
+		status = &IntegrationStatus{Name: name}
+		h.statuses[name] = status
+	}
+	if err != nil {
+		status.Status = "failing"
+		status.LastFailure = &now
+		status.LastError = err.Error()
+		return
+	}
+	status.Status = "ok"
+	status.LastSuccess = &now
+}
+
+func (h *IntegrationHealth) get(name string) IntegrationStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if status, exists := h.statuses[name]; exists {
+		return *status
+	}
+	return IntegrationStatus{Name: name, Status: "unknown"}
+}
+
+func findIntegration(name string) (integration, bool) {
+	for _, in := range integrations {
+		if in.name == name && in.configured() {
+			return in, true
+		}
+	}
+	return integration{}, false
+}
+
+// testWebhooks posts an integration.test event to WEBHOOK_URL and every
+// registered webhook endpoint
+func testWebhooks() (string, error) {
+	ev := WebhookEvent{Event: "integration.test", Time: time.Now()}
+	id := uuid.New().String()
+	encode := func(format string) ([]byte, error) {
+		if format == "cloudevents" {
+			return json.Marshal(ev.cloudEvent(id, TraceContext{}))
+		}
+		return json.Marshal(ev)
+	}
+
+	var failed []string
+	sent := 0
+	post := func(url, format, secret string) {
+		sent++
+		body, err := encode(format)
+		if err == nil {
+			header := http.Header{}
+			header.Set("X-Webhook-Event", ev.Event)
+			header.Set("X-Webhook-Delivery", id)
+			if format == "cloudevents" {
+				header.Set("Content-Type", "application/cloudevents+json")
+			}
+			if secret != "" {
+				header.Set("X-Webhook-Signature", signPayload(secret, body))
+			}
+			err = postBody(url, body, header, TraceContext{})
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", url, err))
+		}
+	}
+	if cfg.WebhookURL != "" {
+		post(cfg.WebhookURL, cfg.WebhookFormat, "")
+	}
+	for _, wh := range webhookStore.List() {
+		post(wh.URL, wh.Format, wh.secret)
+	}
+
+	if len(failed) > 0 {
+		return "", fmt.Errorf("%d of %d endpoint(s) failed: %s", len(failed), sent, strings.Join(failed, "; "))
+	}
+	return fmt.Sprintf("delivered to %d endpoint(s)", sent), nil
+}
+
+// testHooks calls every HTTP hook with an integration.test event and an
+// empty job, which hooks can tell apart from finished jobs by the event
+func testHooks() (string, error) {
+	payload := HookPayload{Event: "integration.test", Time: time.Now(), Files: []string{}, Job: &DownloadStatus{}}
+	var failed []string
+	called := 0
+	for _, hook := range hooks {
+		if hook.URL == "" {
+			continue
+		}
+		called++
+		payload.Hook = hook.Name
+		if err := hook.test(payload); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", hook.Name, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return "", fmt.Errorf("%d of %d hook(s) failed: %s", len(failed), called, strings.Join(failed, "; "))
+	}
+	return fmt.Sprintf("called %d hook(s)", called), nil
+}
+
+func (h Hook) test(payload HookPayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTestTimeout)
+	defer cancel()
+	req, err := h.request(ctx, payload)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func testTelegram() (string, error) {
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := telegram.call("getMe", map[string]any{}, &me); err != nil {
+		return "", err
+	}
+	return "bot @" + me.Username, nil
+}
+
+func testEmail() (string, error) {
+	c, err := dialSMTP()
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if err := c.Quit(); err != nil {
+		return "", err
+	}
+	return "connected to " + cfg.SMTPAddr, nil
+}
+
+func testDiscord() (string, error) {
+	if cfg.DiscordBotToken == "" {
+		return "interactions only; set DISCORD_BOT_TOKEN to test the bot", nil
+	}
+	url := fmt.Sprintf("%s/applications/%s/commands", discordAPI, cfg.DiscordApplicationID)
+	if err := discordRequest(http.MethodGet, url, "Bot "+cfg.DiscordBotToken, nil, TraceContext{}); err != nil {
+		return "", err
+	}
+	return "bot token accepted", nil
+}
+
+// ntfyTopics returns the distinct ntfy topic URLs of the routing rules
+func ntfyTopics() []string {
+	var topics []string
+	for _, rule := range routingRules {
+		for _, n := range rule.Notify {
+			if n.Type == "ntfy" && !slices.Contains(topics, n.URL) {
+				topics = append(topics, n.URL)
+			}
+		}
+	}
+	return topics
+}
+
+// testNtfy publishes a test message to every ntfy topic of the routing
+// rules
+func testNtfy() (string, error) {
+	var failed []string
+	topics := ntfyTopics()
+	for _, topicURL := range topics {
+		server, topic, _ := ntfyTopic(topicURL)
+		body, err := json.Marshal(map[string]any{"topic": topic, "title": "Apple Music download", "message": "Integration test"})
+		if err == nil {
+			err = postBody(server, body, nil, TraceContext{})
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", topic, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return "", fmt.Errorf("%d of %d topic(s) failed: %s", len(failed), len(topics), strings.Join(failed, "; "))
+	}
+	return fmt.Sprintf("published to %d topic(s)", len(topics)), nil
+}
+
+func testNATS() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTestTimeout)
+	defer cancel()
+	if cfg.NATSStream != "" {
+		if _, err := eventStream.js.Stream(ctx, cfg.NATSStream); err != nil {
+			return "", err
+		}
+		return "stream " + cfg.NATSStream + " found", nil
+	}
+	if _, err := eventStream.js.AccountInfo(ctx); err != nil {
+		return "", err
+	}
+	return "JetStream available", nil
+}
+
+// testKafka looks up the topic's partitions, without creating it if the
+// brokers auto-create topics
+func testKafka() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTestTimeout)
+	defer cancel()
+
+	topic := kmsg.NewMetadataRequestTopic()
+	topic.Topic = kmsg.StringPtr(cfg.KafkaTopic)
+	req := kmsg.NewPtrMetadataRequest()
+	req.Topics = append(req.Topics, topic)
+	req.AllowAutoTopicCreation = false
+	resp, err := req.RequestWith(ctx, kafkaSink.client)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Topics) != 1 {
+		return "", fmt.Errorf("no metadata for topic %s", cfg.KafkaTopic)
+	}
+	if err := kerr.ErrorForCode(resp.Topics[0].ErrorCode); err != nil {
+		return "", fmt.Errorf("metadata for topic %s failed: %w", cfg.KafkaTopic, err)
+	}
+	return fmt.Sprintf("topic %s has %d partition(s)", cfg.KafkaTopic, len(resp.Topics[0].Partitions)), nil
+}
+
+func testPostgresMirror() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTestTimeout)
+	defer cancel()
+	if err := postgresMirror.db.PingContext(ctx); err != nil {
+		return "", err
+	}
+	return "connected", nil
+}
+
+// handleIntegrationsStatus serves GET /integrations/status, how each
+// configured integration has been doing
+func handleIntegrationsStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := []IntegrationStatus{}
+	for _, in := range integrations {
+		if in.configured() {
+			statuses = append(statuses, integrationHealth.get(in.name))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"integrations": statuses,
+		"count":        len(statuses),
+	})
+}
+
+// handleIntegrationTest serves POST /integrations/{name}/test, which checks
+// an integration's configuration by talking to it
+func handleIntegrationTest(w http.ResponseWriter, r *http.Request) {
+	name, resource, _ := strings.Cut(r.URL.Path[len("/integrations/"):], "/")
+	if resource != "test" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	in, exists := findIntegration(name)
+	if !exists {
+		http.Error(w, "Integration not found or not configured", http.StatusNotFound)
+		return
+	}
+
+	start := time.Now()
+	type outcome struct {
+		detail string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		detail, err := in.test()
+		done <- outcome{detail, err}
+	}()
+	var result outcome
+	select {
+	case result = <-done:
+	case <-time.After(integrationTestTimeout):
+		result.err = errors.New("timed out")
+	}
+	integrationHealth.record(in.name, result.err)
+
+	test := IntegrationTest{Name: in.name, OK: result.err == nil, Detail: result.detail, Duration: time.Since(start).Round(time.Millisecond).String()}
+	if result.err != nil {
+		test.Error = result.err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(test)
+}
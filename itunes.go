@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The public iTunes Search API allows roughly 20 requests per minute
+const itunesSearchInterval = 3 * time.Second
+
+var (
+	itunesMu       sync.Mutex
+	itunesLastCall time.Time
+)
+
+type itunesSong struct {
+	TrackID        int64  `json:"trackId"`
+	TrackName      string `json:"trackName"`
+	ArtistName     string `json:"artistName"`
+	CollectionName string `json:"collectionName"`
+	TrackViewURL   string `json:"trackViewUrl"`
+}
+
+// AppleMusicURL returns the track URL without iTunes affiliate parameters
+func (s itunesSong) AppleMusicURL() string {
+	u, err := url.Parse(s.TrackViewURL)
+	if err != nil {
+		return s.TrackViewURL
+	}
+	query := u.Query()
+	u.RawQuery = url.Values{"i": query["i"]}.Encode()
+	return u.String()
+}
+
+// searchITunesSongs queries the iTunes Search API, throttled to stay under
+// its rate limit
+func searchITunesSongs(term, country string, limit int) ([]itunesSong, error) {
+	itunesMu.Lock()
+	if wait := itunesSearchInterval - time.Since(itunesLastCall); wait > 0 {
+		time.Sleep(wait)
+	}
+	itunesLastCall = time.Now()
+	itunesMu.Unlock()
+
+	params := url.Values{
+		"term":    {term},
+		"entity":  {"song"},
+		"media":   {"music"},
+		"country": {country},
+		"limit":   {fmt.Sprint(limit)},
+	}
+	resp, err := httpClient.Get("https://itunes.apple.com/search?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("itunes search returned %s", resp.Status)
+	}
+
+	var result struct {
+		Results []itunesSong `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// normalizeTitle lowercases s and drops punctuation and bracketed suffixes
+// such as "(Remastered)" so titles from different services compare equal
+func normalizeTitle(s string) string {
+	for _, sep := range []string{" (", " [", " - "} {
+		if i := strings.Index(s, sep); i > 0 {
+			s = s[:i]
+		}
+	}
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// matchSong searches for artist/title and returns the candidates that match
+// both names after normalization, along with all raw results
+func matchSong(artist, title, country string) (matches []itunesSong, candidates []itunesSong, err error) {
+	candidates, err = searchITunesSongs(artist+" "+title, country, 10)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wantArtist, wantTitle := normalizeTitle(artist), normalizeTitle(title)
+	for _, song := range candidates {
+		if normalizeTitle(song.TrackName) == wantTitle && strings.Contains(normalizeTitle(song.ArtistName), wantArtist) {
+			matches = append(matches, song)
+		}
+	}
+	return matches, candidates, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// EventStream publishes events to NATS JetStream subjects named after the
+// event, e.g. amdl.job.completed
+type EventStream struct {
+	js jetstream.JetStream
+
+	// Events still waiting for an acknowledgement
+	inFlight atomic.Int64
+}
+
+// eventStream is nil unless NATS_URL is set
+var eventStream *EventStream
+
+// connectEventStream connects to NATS and, when NATS_STREAM is set, creates
+// or updates a stream capturing every subject under the prefix
+func connectEventStream() error {
+	opts := []nats.Option{
+		nats.Name("apple-music-dl-http-wrapper"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("Disconnected from NATS", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", nc.ConnectedUrl())
+		}),
+	}
+	if cfg.NATSCredentials != "" {
+		opts = append(opts, nats.UserCredentials(cfg.NATSCredentials))
+	}
+
+	nc, err := nats.Connect(cfg.NATSURL, opts...)
+	if err != nil {
+		return err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NATSStream != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     cfg.NATSStream,
+			Subjects: []string{cfg.NATSSubjectPrefix + ".>"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	eventStream = &EventStream{js: js}
+	slog.Info("Publishing events to NATS", "subjects", cfg.NATSSubjectPrefix+".*")
+	return nil
+}
+
+// publish sends the event in the background without blocking the caller
+func (es *EventStream) publish(ev WebhookEvent, id string, trace TraceContext) {
+	es.inFlight.Add(1)
+	go func() {
+		defer es.inFlight.Add(-1)
+		es.send(ev, id, trace)
+	}()
+}
+
+// Settled reports whether every published event has been acknowledged or
+// has failed
+func (es *EventStream) Settled() bool {
+	return es.inFlight.Load() == 0
+}
+
+// send sends the event and waits for the stream's acknowledgement. The
+// event ID is the message ID, so JetStream drops duplicates.
+func (es *EventStream) send(ev WebhookEvent, id string, trace TraceContext) {
+	var payload any = ev
+	if cfg.NATSFormat == "cloudevents" {
+		payload = ev.cloudEvent(id, trace)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode event", "event", ev.Event, "error", err)
+		return
+	}
+
+	msg := nats.NewMsg(cfg.NATSSubjectPrefix + "." + ev.Event)
+	msg.Data = data
+	if cfg.NATSFormat == "cloudevents" {
+		msg.Header.Set("Content-Type", "application/cloudevents+json")
+	} else {
+		msg.Header.Set("Content-Type", "application/json")
+	}
+	trace.apply(http.Header(msg.Header))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = es.js.PublishMsg(ctx, msg, jetstream.WithMsgID(id))
+	integrationHealth.record("nats", err)
+	if err != nil {
+		metrics.natsPublishFailures.Add(1)
+		slog.Error("Failed to publish event to NATS", "event", ev.Event, "error", err)
+	}
+}
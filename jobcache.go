@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Jobs evicted from memory are archived as jobs/<id>.json in the state
+// directory, from where Snapshot still finds them. With a job store they're
+// read back from the store instead.
+
+func archivePath(id string) string {
+	return filepath.Join("jobs", id+".json")
+}
+
+func archiveJob(job DownloadStatus) error {
+	if jobStore != nil {
+		return nil
+	}
+	return saveState(archivePath(job.ID), job)
+}
+
+func loadArchivedJob(id string) (DownloadStatus, bool) {
+	if jobStore != nil {
+		storeWriter.flush()
+		job, exists, err := jobStore.LoadJob(id)
+		if err != nil {
+			slog.Error("Failed to load stored job", "job_id", id, "error", err)
+		}
+		return job, exists
+	}
+
+	// Job IDs are UUIDs; anything else can't be an archived job
+	if cfg.StateDir == "" || id == "" || filepath.Base(id) != id {
+		return DownloadStatus{}, false
+	}
+
+	var job DownloadStatus
+	if err := loadState(archivePath(id), &job); err != nil {
+		slog.Error("Failed to load archived job", "job_id", id, "error", err)
+		return DownloadStatus{}, false
+	}
+	return job, job.ID != ""
+}
+
+// memorySize roughly estimates the memory a job holds
+func (job *DownloadStatus) memorySize() int {
+	size := 512 + len(job.URL) + len(job.Error) + len(job.OutputDir)
+	if job.Progress != nil {
+		size += 96 + len(job.Progress.Line)
+	}
+	for _, line := range slices.Concat(job.Logs, job.StderrTail) {
+		size += len(line) + 16
+	}
+	for _, event := range job.Events {
+		size += 96 + len(event.Message)
+	}
+	for _, artifact := range append(job.Artifacts, job.Extras...) {
+		size += 48 + len(artifact.Path) + len(artifact.SHA256)
+	}
+	if job.Verification != nil {
+		for _, check := range job.Verification.Checks {
+			size += 64 + len(check.Error)
+			for _, problem := range check.Problems {
+				size += 16 + len(problem)
+			}
+		}
+	}
+	for _, track := range job.Tracks {
+		size += 80 + len(track.Title) + len(track.Path)
+	}
+	if job.Request != nil {
+		size += 256 + len(job.Request.URL)
+	}
+	size += 40 * len(job.Retries)
+	return size
+}
+
+// touch records that a job was read, for least-recently-used eviction
+func (jm *JobManager) touch(id string) {
+	jm.accessMu.Lock()
+	jm.accessed[id] = time.Now()
+	jm.accessMu.Unlock()
+}
+
+// enforceBudget evicts the least recently used terminal jobs while more of
+// them are kept in memory than JOB_CACHE_MAX_JOBS allows or they take more
+// than JOB_CACHE_MAX_MB. Evicted jobs are archived first, so they stay
+// available through Snapshot. Without a state directory or job store there's
+// nowhere to archive them, and all jobs stay in memory.
+func (jm *JobManager) enforceBudget() {
+	maxJobs, maxBytes := cfg.JobCacheMaxJobs, cfg.JobCacheMaxMB<<20
+	if maxJobs <= 0 && maxBytes <= 0 {
+		return
+	}
+	if cfg.StateDir == "" && jobStore == nil {
+		return
+	}
+
+	type candidate struct {
+		job      DownloadStatus
+		size     int
+		accessed time.Time
+	}
+
+	jm.mu.RLock()
+	var terminal []candidate
+	total := 0
+	for _, job := range jm.jobs {
+		if job.EndedAt == nil {
+			continue
+		}
+		c := candidate{job: job.clone(), size: job.memorySize(), accessed: *job.EndedAt}
+		terminal = append(terminal, c)
+		total += c.size
+	}
+	jm.mu.RUnlock()
+
+	jm.accessMu.Lock()
+	for i := range terminal {
+		if accessed, ok := jm.accessed[terminal[i].job.ID]; ok && accessed.After(terminal[i].accessed) {
+			terminal[i].accessed = accessed
+		}
+	}
+	jm.accessMu.Unlock()
+
+	sort.Slice(terminal, func(i, j int) bool { return terminal[i].accessed.Before(terminal[j].accessed) })
+
+	var evicted []string
+	count := len(terminal)
+	for _, c := range terminal {
+		if (maxJobs <= 0 || count <= maxJobs) && (maxBytes <= 0 || total <= maxBytes) {
+			break
+		}
+		if err := archiveJob(c.job); err != nil {
+			slog.Error("Failed to archive job, keeping it in memory", "job_id", c.job.ID, "error", err)
+			continue
+		}
+		evicted = append(evicted, c.job.ID)
+		count--
+		total -= c.size
+	}
+	if len(evicted) == 0 {
+		return
+	}
+
+	jm.mu.Lock()
+	for _, id := range evicted {
+		delete(jm.jobs, id)
+	}
+	jm.version.Add(1)
+	jm.mu.Unlock()
+
+	jm.accessMu.Lock()
+	for _, id := range evicted {
+		delete(jm.accessed, id)
+	}
+	jm.accessMu.Unlock()
+
+	if jobStore != nil {
+		slog.Info("Evicted finished jobs from memory", "jobs", len(evicted), "path", cfg.JobDatabase)
+	} else {
+		slog.Info("Archived finished jobs", "jobs", len(evicted), "path", filepath.Join(cfg.StateDir, "jobs"))
+	}
+}
+
+// JobListCache keeps the encoded /jobs response until the job set changes,
+// so frequent polling doesn't re-encode every job. Only the latest query is
+// kept, which is what pollers repeat.
+type JobListCache struct {
+	mu      sync.Mutex
+	version uint64
+	key     string
+	body    []byte
+}
+
+var jobListCache = &JobListCache{}
+
+// get returns the encoded job list for q and the job set version it reflects
+func (c *JobListCache) get(q jobListQuery) ([]byte, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := q.key()
+	if c.body != nil && c.key == key && c.version == jobManager.version.Load() {
+		return c.body, c.version
+	}
+
+	jobs, version := jobManager.SnapshotAllVersion()
+	page, total := q.apply(jobs)
+	var buf bytes.Buffer
+	writeJobList(&buf, page, total, q.view)
+	c.body, c.version, c.key = buf.Bytes(), version, key
+	return c.body, c.version
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Changes returned by a single GET /jobs/changes request
+const maxJobChangesLimit = 1000
+
+// JobChange is a state transition of a job: "created", "status",
+// "archived", "unarchived" or "deleted"
+type JobChange struct {
+	Seq    uint64          `json:"seq"`
+	Time   time.Time       `json:"time"`
+	JobID  string          `json:"job_id"`
+	Type   string          `json:"type"`
+	Status string          `json:"status,omitempty"`
+	Job    *DownloadStatus `json:"job,omitempty"` // as of the change, without logs
+}
+
+// JobChangeLog numbers job state changes so mirrors can sync incrementally.
+// Sequence numbers only increase, also across restarts: they continue from
+// the job store, or start from the clock without one, so a client can't
+// mistake a new run's changes for ones it has seen. The newest
+// JOB_CHANGES_RETAIN changes are kept.
+type JobChangeLog struct {
+	mu      sync.Mutex
+	changes []JobChange // oldest first
+	seq     uint64      // of the latest change
+}
+
+var jobChanges = &JobChangeLog{}
+
+// load picks up where the job store's changes left off
+func (c *JobChangeLog) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if jobStore != nil {
+		changes, err := jobStore.LoadChanges(cfg.JobChangesRetain)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			c.changes = changes
+			c.seq = changes[len(changes)-1].Seq
+			return nil
+		}
+	}
+	c.seq = uint64(time.Now().UnixMilli()) * 1000
+	return nil
+}
+
+// record adds a change of job; callers may hold the job manager lock
+func (c *JobChangeLog) record(changeType string, job *DownloadStatus) {
+	snapshot := job.clone()
+	snapshot.Logs = nil
+	c.add(JobChange{JobID: job.ID, Type: changeType, Status: job.Status, Job: &snapshot})
+}
+
+func (c *JobChangeLog) recordDeleted(id string) {
+	c.add(JobChange{JobID: id, Type: "deleted"})
+}
+
+func (c *JobChangeLog) add(change JobChange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	change.Seq = c.seq
+	change.Time = time.Now()
+	c.changes = append(c.changes, change)
+	if over := len(c.changes) - cfg.JobChangesRetain; over > 0 {
+		c.changes = append(c.changes[:0:0], c.changes[over:]...)
+	}
+
+	if postgresMirror != nil {
+		postgresMirror.enqueue(change)
+	}
+	if jobStore != nil {
+		storeWriter.appendChange(change)
+		if change.Seq%100 == 0 && change.Seq > uint64(cfg.JobChangesRetain) {
+			storeWriter.pruneChanges(change.Seq - uint64(cfg.JobChangesRetain))
+		}
+	}
+}
+
+// oldest returns the sequence number of the oldest change kept, or the one
+// the next change will get
+func (c *JobChangeLog) oldest() uint64 {
+	if len(c.changes) > 0 {
+		return c.changes[0].Seq
+	}
+	return c.seq + 1
+}
+
+// latest returns the sequence number of the latest change
+func (c *JobChangeLog) latest() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// start is the sequence number to read every change kept after
+func (c *JobChangeLog) start() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.oldest() - 1
+}
+
+// since returns up to limit changes after seq, the latest sequence number
+// and whether more changes follow. ok is false when changes after seq were
+// dropped before they could be read.
+func (c *JobChangeLog) since(seq uint64, limit int) (changes []JobChange, latest uint64, more, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldest := c.oldest()
+	if seq+1 < oldest {
+		return nil, c.seq, false, false
+	}
+
+	// Sequence numbers are consecutive within the kept changes
+	start := min(int(seq+1-oldest), len(c.changes))
+	end := min(start+limit, len(c.changes))
+	return append([]JobChange{}, c.changes[start:end]...), c.seq, end < len(c.changes), true
+}
+
+// handleJobChanges serves GET /jobs/changes?since_seq=N, the job state
+// changes after sequence number N. Without since_seq every change kept is
+// returned.
+func handleJobChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	since := jobChanges.start()
+	if value := query.Get("since_seq"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "since_seq must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	limit := maxJobChangesLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxJobChangesLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxJobChangesLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	changes, latest, more, ok := jobChanges.since(since, limit)
+	if !ok {
+		http.Error(w, "Changes since since_seq are no longer available; resync from GET /jobs", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"changes":    changes,
+		"latest_seq": latest,
+		"has_more":   more,
+	})
+}
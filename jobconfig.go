@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stagingDirName is the hidden folder under DOWNLOADS_DIR holding a folder
+// per running job, which the downloader saves into. That keeps the files of
+// jobs running alongside each other apart until they are published.
+const stagingDirName = ".jobs"
+
+func jobStagingDir(jobID string) string {
+	return filepath.Join(cfg.DownloadsDir, stagingDirName, jobID)
+}
+
+// downloaderOverrides returns the apple-music-dl config.yaml settings a
+// request changes
+func downloaderOverrides(req DownloadRequest) map[string]any {
+	overrides := map[string]any{}
+	profile := resolveOutputProfile(req)
+	profile.Artwork.apply(overrides)
+	if profile.MetadataLanguage != "" {
+		overrides["language"] = profile.MetadataLanguage
+	}
+	return overrides
+}
+
+// stageSaveFolders points the downloader's save folders that lie under
+// DOWNLOADS_DIR at the same folders under the job's staging directory.
+// Relative folders are taken relative to the downloader config.
+func stageSaveFolders(jobID string, config map[string]any) {
+	root, err := filepath.Abs(cfg.DownloadsDir)
+	if err != nil {
+		return
+	}
+	for key, value := range config {
+		folder, ok := value.(string)
+		if !ok || folder == "" || !strings.HasSuffix(key, "-save-folder") {
+			continue
+		}
+		if !filepath.IsAbs(folder) {
+			folder = filepath.Join(filepath.Dir(cfg.DownloaderConfig), folder)
+		}
+		rel, err := filepath.Rel(root, folder)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		config[key] = filepath.Join(root, stagingDirName, jobID, rel)
+	}
+}
+
+// prepareWorkDir creates a directory for running apple-music-dl with a copy
+// of its config.yaml carrying the request's overrides and saving into the
+// job's staging directory. The downloader reads its config from the working
+// directory, so the other files next to the original config are linked in
+// as well. It returns a function removing both directories.
+func prepareWorkDir(jobID string, req DownloadRequest) (string, func(), error) {
+	overrides := downloaderOverrides(req)
+
+	data, err := os.ReadFile(cfg.DownloaderConfig)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read downloader config: %w", err)
+	}
+	config := map[string]any{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", nil, fmt.Errorf("failed to parse downloader config: %w", err)
+	}
+	for key, value := range overrides {
+		config[key] = value
+	}
+	stageSaveFolders(jobID, config)
+
+	dir, err := os.MkdirTemp("", "amdl-"+jobID+"-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(jobStagingDir(jobID))
+	}
+
+	base := filepath.Dir(cfg.DownloaderConfig)
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(cfg.DownloaderConfig) {
+			continue
+		}
+		src, dst := filepath.Join(base, entry.Name()), filepath.Join(dir, entry.Name())
+		if err := os.Symlink(src, dst); err != nil {
+			// Windows only allows symlinks in developer mode or with admin
+			// rights; files can be hard-linked instead
+			if entry.IsDir() || os.Link(src, dst) != nil {
+				cleanup()
+				return "", nil, err
+			}
+		}
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), out, 0o600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if len(overrides) > 0 {
+		jobManager.AppendLog(jobID, fmt.Sprintf("Downloader config overrides: %v", overrides))
+	}
+	return dir, cleanup, nil
+}
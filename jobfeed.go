@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events buffered per live subscriber; a subscriber that falls further
+// behind is dropped rather than slowing jobs down
+const jobFeedBuffer = 256
+
+// JobFeedEvent is a change to a job as it happens: "created", "status",
+// "progress", "log" or "finished"
+type JobFeedEvent struct {
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	JobID    string          `json:"job_id"`
+	Status   string          `json:"status,omitempty"`
+	Progress *JobProgress    `json:"progress,omitempty"`
+	Line     string          `json:"line,omitempty"`
+	Job      *DownloadStatus `json:"job,omitempty"` // without logs
+}
+
+// JobFeed fans job changes out to live subscribers such as WebSocket
+// clients. Publishing never blocks.
+type JobFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan JobFeedEvent]struct{}
+	count       atomic.Int32
+}
+
+var jobFeed = &JobFeed{subscribers: map[chan JobFeedEvent]struct{}{}}
+
+// subscribe returns a channel of events, closed if the subscriber falls
+// behind
+func (f *JobFeed) subscribe() chan JobFeedEvent {
+	ch := make(chan JobFeedEvent, jobFeedBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[ch] = struct{}{}
+	f.count.Add(1)
+	return ch
+}
+
+func (f *JobFeed) unsubscribe(ch chan JobFeedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subscribers[ch]; ok {
+		delete(f.subscribers, ch)
+		f.count.Add(-1)
+		close(ch)
+	}
+}
+
+// active reports whether anyone is subscribed, so events aren't built for
+// nobody
+func (f *JobFeed) active() bool {
+	return f.count.Load() > 0
+}
+
+func (f *JobFeed) publish(ev JobFeedEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			delete(f.subscribers, ch)
+			f.count.Add(-1)
+			close(ch)
+		}
+	}
+}
+
+// publishJob sends an event carrying a snapshot of the job
+func (f *JobFeed) publishJob(eventType string, job *DownloadStatus) {
+	snapshot := job.clone()
+	snapshot.Logs = nil
+	f.publish(JobFeedEvent{Type: eventType, JobID: job.ID, Status: job.Status, Job: &snapshot})
+}
+
+// progressChanged reports whether the progress figures differ, ignoring
+// the output line
+func progressChanged(a, b *JobProgress) bool {
+	if a == nil || b == nil {
+		return a != b
+	}
+	x, y := *a, *b
+	x.Line, y.Line = "", ""
+	return x != y
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// JobFiles is returned by GET /jobs/{id}/files
+type JobFiles struct {
+	JobID     string     `json:"job_id"`
+	OutputDir string     `json:"output_dir,omitempty"`
+	Files     []Artifact `json:"files"`
+}
+
+// outputDir returns the deepest directory containing all of the files,
+// relative to DOWNLOADS_DIR and slash-separated like artifact paths
+func outputDir(artifacts []Artifact) string {
+	if len(artifacts) == 0 {
+		return ""
+	}
+	dir := path.Dir(artifacts[0].Path)
+	for _, artifact := range artifacts[1:] {
+		for dir != "." && !strings.HasPrefix(artifact.Path, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// jobOutputPath returns the absolute directory containing all of a job's
+// files, or DOWNLOADS_DIR when they have none in common
+func jobOutputPath(job DownloadStatus) string {
+	if job.OutputDir == "" {
+		return cfg.DownloadsDir
+	}
+	return filepath.Join(cfg.DownloadsDir, filepath.FromSlash(job.OutputDir))
+}
+
+// handleJobFiles serves /jobs/{id}/files, listing the files a job
+// produced, and /jobs/{id}/files/{path}, downloading one of them
+func handleJobFiles(w http.ResponseWriter, r *http.Request, jobID, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	files := append(append([]Artifact{}, job.Artifacts...), job.Extras...)
+
+	if name == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JobFiles{JobID: job.ID, OutputDir: job.OutputDir, Files: files})
+		return
+	}
+
+	// Only files in the job's manifest are served, so a name can't reach
+	// anything else under DOWNLOADS_DIR or outside it
+	var artifact *Artifact
+	for i := range files {
+		if files[i].Path == name {
+			artifact = &files[i]
+			break
+		}
+	}
+	if artifact == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	fullPath, err := resolveArtifactPath(artifact.Path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(artifact.Path)}))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// resolveArtifactPath returns the location of an artifact, making sure it
+// resolves inside DOWNLOADS_DIR even when the manifest or a symlink says
+// otherwise
+func resolveArtifactPath(rel string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("%s is outside of the downloads directory", rel)
+	}
+	root, err := filepath.EvalSymlinks(cfg.DownloadsDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	if inside, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(inside) {
+		return "", fmt.Errorf("%s is outside of the downloads directory", rel)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest page of GET /jobs; without ?limit= every matching job is listed
+const maxJobListLimit = 1000
+
+// jobSortKeys compare jobs for ?sort=; a "-" prefix reverses the order
+var jobSortKeys = map[string]func(a, b *DownloadStatus) int{
+	"started_at": func(a, b *DownloadStatus) int { return a.StartedAt.Compare(b.StartedAt) },
+	"ended_at": func(a, b *DownloadStatus) int {
+		// Unfinished jobs sort after finished ones
+		switch {
+		case a.EndedAt == nil && b.EndedAt == nil:
+			return 0
+		case a.EndedAt == nil:
+			return 1
+		case b.EndedAt == nil:
+			return -1
+		}
+		return a.EndedAt.Compare(*b.EndedAt)
+	},
+	"status": func(a, b *DownloadStatus) int { return cmp.Compare(a.Status, b.Status) },
+	"priority": func(a, b *DownloadStatus) int {
+		return cmp.Compare(priorityLevels[a.Priority], priorityLevels[b.Priority])
+	},
+}
+
+// jobListQuery is the filter, order and page of a GET /jobs request
+type jobListQuery struct {
+	statuses    []string
+	since       time.Time
+	sort        string
+	limit       int
+	offset      int
+	includeLogs bool
+
+	// "" hides archived jobs, "include" lists them too and "only" lists
+	// nothing else
+	archived string
+
+	// Fields of each job to include
+	view jobView
+}
+
+// parseJobListQuery reads ?status= (comma-separated), ?since= (a time or an
+// age such as "24h" or "7d"), ?sort= (default "-started_at", newest first),
+// ?limit=, ?offset=, ?include=logs, ?archived=include or only, and ?fields=
+// or ?compact=true. Selecting the logs field includes them.
+func parseJobListQuery(query url.Values) (jobListQuery, error) {
+	q := jobListQuery{
+		statuses: splitList(query.Get("status")),
+		sort:     "-started_at",
+	}
+
+	if since := query.Get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			q.since = t
+		} else if age, err := parseAge(since); err == nil {
+			q.since = time.Now().Add(-age)
+		} else {
+			return q, errors.New("since must be an RFC 3339 time or an age such as 24h or 7d")
+		}
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		if _, ok := jobSortKeys[strings.TrimPrefix(sort, "-")]; !ok {
+			return q, errors.New("sort must be started_at, ended_at, status or priority, optionally prefixed with -")
+		}
+		q.sort = sort
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxJobListLimit)
+		}
+		q.limit = n
+	}
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return q, errors.New("offset must be a non-negative integer")
+		}
+		q.offset = n
+	}
+
+	switch q.archived = query.Get("archived"); q.archived {
+	case "", "include", "only":
+	default:
+		return q, errors.New("archived must be include or only")
+	}
+
+	for _, include := range splitList(query.Get("include")) {
+		if include != "logs" {
+			return q, fmt.Errorf("unknown include %q", include)
+		}
+		q.includeLogs = true
+	}
+
+	view, err := parseJobView(query)
+	if err != nil {
+		return q, err
+	}
+	q.view = view
+	if view.fields != nil && view.includes("logs") {
+		q.includeLogs = true
+	}
+	return q, nil
+}
+
+// key identifies the query's response for caching
+func (q jobListQuery) key() string {
+	return fmt.Sprintf("%v|%d|%s|%d|%d|%t|%s|%s", q.statuses, q.since.Unix(), q.sort, q.limit, q.offset, q.includeLogs, q.archived, q.view.key())
+}
+
+// apply filters and orders jobs, returning the requested page and the
+// number of jobs matching the filters
+func (q jobListQuery) apply(jobs []DownloadStatus) ([]DownloadStatus, int) {
+	jobs = slices.DeleteFunc(jobs, func(job DownloadStatus) bool {
+		if (q.archived == "" && job.Archived) || (q.archived == "only" && !job.Archived) {
+			return true
+		}
+		if len(q.statuses) > 0 && !slices.Contains(q.statuses, job.Status) {
+			return true
+		}
+		return !q.since.IsZero() && job.StartedAt.Before(q.since)
+	})
+
+	compare := jobSortKeys[strings.TrimPrefix(q.sort, "-")]
+	descending := strings.HasPrefix(q.sort, "-")
+	slices.SortStableFunc(jobs, func(a, b DownloadStatus) int {
+		c := compare(&a, &b)
+		if c == 0 {
+			// Keep pages stable between requests
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		if descending {
+			return -c
+		}
+		return c
+	})
+
+	total := len(jobs)
+	end := total
+	if q.limit > 0 {
+		end = min(q.offset+q.limit, total)
+	}
+	page := jobs[min(q.offset, total):end]
+	if !q.includeLogs {
+		for i := range page {
+			page[i].Logs = nil
+		}
+	}
+	return page, total
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// JobStore persists jobs so history survives restarts. The job manager keeps
+// working from memory and queues every change for the store, which
+// jobWriter writes in batches.
+type JobStore interface {
+	// LoadJobs returns every stored job with its most recent log lines
+	LoadJobs() ([]DownloadStatus, error)
+
+	// LoadJob returns a stored job, e.g. one evicted from memory
+	LoadJob(id string) (DownloadStatus, bool, error)
+
+	// FinishedJobs lists the ID, status, end time and archived flag of
+	// every finished job
+	FinishedJobs() ([]finishedJob, error)
+
+	// DeleteJobs removes jobs with their log lines
+	DeleteJobs(ids []string) error
+
+	// WriteBatch writes queued changes in one transaction
+	WriteBatch(batch jobBatch) error
+
+	// LoadChanges returns the latest limit job state changes recorded for
+	// GET /jobs/changes, oldest first
+	LoadChanges(limit int) ([]JobChange, error)
+
+	Close() error
+}
+
+// jobBatch is what the job manager queued for the store since the last
+// write. Log lines are written first, then changes, then jobs.
+type jobBatch struct {
+	// Latest version of each changed job; their Logs are ignored
+	jobs map[string]DownloadStatus
+
+	logs    []jobLogLine
+	changes []JobChange
+
+	// Changes up to and including this sequence number are deleted
+	pruneChanges uint64
+}
+
+type jobLogLine struct {
+	jobID, line string
+}
+
+func (b jobBatch) empty() bool {
+	return len(b.jobs) == 0 && len(b.logs) == 0 && len(b.changes) == 0 && b.pruneChanges == 0
+}
+
+// jobWriteInterval is how long the writer waits after a write, so that the
+// changes made meanwhile go out together
+const jobWriteInterval = 100 * time.Millisecond
+
+// jobWriter queues writes to the job store, so that jobs are updated and
+// log lines appended without waiting on the database while the job manager
+// holds its lock
+type jobWriter struct {
+	mu      sync.Mutex
+	pending jobBatch
+	wake    chan struct{}
+
+	// Held while a batch is written, so that flush returns only once
+	// everything queued before it is stored
+	writeMu sync.Mutex
+}
+
+var storeWriter = &jobWriter{wake: make(chan struct{}, 1)}
+
+func (w *jobWriter) queue(fn func(batch *jobBatch)) {
+	w.mu.Lock()
+	if w.pending.jobs == nil {
+		w.pending.jobs = map[string]DownloadStatus{}
+	}
+	fn(&w.pending)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *jobWriter) saveJob(job DownloadStatus) {
+	job.Logs = nil
+	w.queue(func(batch *jobBatch) { batch.jobs[job.ID] = job })
+}
+
+func (w *jobWriter) appendLog(id, line string) {
+	w.queue(func(batch *jobBatch) { batch.logs = append(batch.logs, jobLogLine{id, line}) })
+}
+
+func (w *jobWriter) appendChange(change JobChange) {
+	w.queue(func(batch *jobBatch) { batch.changes = append(batch.changes, change) })
+}
+
+func (w *jobWriter) pruneChanges(seq uint64) {
+	w.queue(func(batch *jobBatch) { batch.pruneChanges = max(batch.pruneChanges, seq) })
+}
+
+func (w *jobWriter) run() {
+	for range w.wake {
+		w.flush()
+		time.Sleep(jobWriteInterval)
+	}
+}
+
+// flush writes everything queued so far. Reads of jobs that may have left
+// memory, and deletes, flush first.
+func (w *jobWriter) flush() {
+	if jobStore == nil {
+		return
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = jobBatch{}
+	w.mu.Unlock()
+
+	if batch.empty() {
+		return
+	}
+	if err := jobStore.WriteBatch(batch); err != nil {
+		slog.Error("Failed to write jobs", "jobs", len(batch.jobs), "log_lines", len(batch.logs), "changes", len(batch.changes), "error", err)
+	}
+}
+
+// jobStore is nil when jobs are kept in memory only
+var jobStore JobStore
+
+func openJobStore() error {
+	if cfg.JobDatabase == "" {
+		return nil
+	}
+	store, err := openSQLiteJobStore(cfg.JobDatabase)
+	if err != nil {
+		return err
+	}
+	jobStore = store
+	go storeWriter.run()
+	return nil
+}
+
+// persist queues the job for the store; callers hold jm.mu
+func (jm *JobManager) persist(job *DownloadStatus) {
+	if jobStore == nil {
+		return
+	}
+	storeWriter.saveJob(job.clone())
+}
+
+// restore loads stored jobs into memory. Jobs that were queued or running
+// when the wrapper stopped can't be resumed and are marked interrupted.
+func (jm *JobManager) restore() error {
+	if jobStore == nil {
+		return nil
+	}
+
+	jobs, err := jobStore.LoadJobs()
+	if err != nil {
+		return err
+	}
+
+	jm.mu.Lock()
+	interrupted := 0
+	for i := range jobs {
+		job := &jobs[i]
+		if job.EndedAt == nil {
+			now := time.Now()
+			job.Events = append(job.Events, JobEvent{Time: now, Type: "interrupted", Message: "The wrapper restarted"})
+			job.Status = "interrupted"
+			job.Error = "Interrupted by a restart"
+			job.EndedAt = &now
+			job.Duration = now.Sub(job.StartedAt).String()
+			jm.persist(job)
+			jobChanges.record("status", job)
+			interrupted++
+		}
+		jm.jobs[job.ID] = job
+	}
+	jm.version.Add(1)
+	jm.mu.Unlock()
+
+	slog.Info("Restored jobs", "jobs", len(jobs), "path", cfg.JobDatabase, "interrupted", interrupted)
+	jm.enforceBudget()
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id         TEXT PRIMARY KEY,
+	status     TEXT NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	data       TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS job_logs (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id TEXT NOT NULL,
+	line   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS job_logs_job_id ON job_logs (job_id, id);
+CREATE TABLE IF NOT EXISTS job_changes (
+	seq  INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+`
+
+// sqliteJobStore keeps each job as a JSON document next to its log lines
+type sqliteJobStore struct {
+	db *sql.DB
+}
+
+func openSQLiteJobStore(path string) (*sqliteJobStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; sharing one connection avoids lock
+	// contention between the job manager's writes
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+	return &sqliteJobStore{db: db}, nil
+}
+
+func (s *sqliteJobStore) LoadJobs() ([]DownloadStatus, error) {
+	rows, err := s.db.Query(`SELECT data FROM jobs ORDER BY started_at`)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []DownloadStatus
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var job DownloadStatus
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range jobs {
+		if jobs[i].Logs, err = s.logs(jobs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+func (s *sqliteJobStore) LoadJob(id string) (DownloadStatus, bool, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM jobs WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DownloadStatus{}, false, nil
+	}
+	if err != nil {
+		return DownloadStatus{}, false, err
+	}
+
+	var job DownloadStatus
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return DownloadStatus{}, false, err
+	}
+	job.Logs, err = s.logs(id)
+	return job, err == nil, err
+}
+
+// logs returns the job's most recent log lines, oldest first
+func (s *sqliteJobStore) logs(id string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT line FROM job_logs WHERE job_id = ? ORDER BY id DESC LIMIT ?`, id, cfg.JobLogLines)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []string{}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	slices.Reverse(lines)
+	return lines, rows.Err()
+}
+
+func (s *sqliteJobStore) WriteBatch(batch jobBatch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, log := range batch.logs {
+		if _, err := tx.Exec(`INSERT INTO job_logs (job_id, line) VALUES (?, ?)`, log.jobID, log.line); err != nil {
+			return err
+		}
+	}
+	for _, change := range batch.changes {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO job_changes (seq, data) VALUES (?, ?)`, int64(change.Seq), string(data)); err != nil {
+			return err
+		}
+	}
+	for _, job := range batch.jobs {
+		if err := saveJob(tx, job); err != nil {
+			return fmt.Errorf("job %s: %w", job.ID, err)
+		}
+	}
+	if batch.pruneChanges > 0 {
+		if _, err := tx.Exec(`DELETE FROM job_changes WHERE seq <= ?`, int64(batch.pruneChanges)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// saveJob inserts or replaces a job
+func saveJob(tx *sql.Tx, job DownloadStatus) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO jobs (id, status, started_at, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, data = excluded.data`,
+		job.ID, job.Status, job.StartedAt, string(data))
+	if err != nil || job.EndedAt == nil {
+		return err
+	}
+
+	// Finished jobs won't log any more; drop lines beyond those kept
+	_, err = tx.Exec(`DELETE FROM job_logs WHERE job_id = ? AND id NOT IN
+		(SELECT id FROM job_logs WHERE job_id = ? ORDER BY id DESC LIMIT ?)`,
+		job.ID, job.ID, cfg.JobLogLines)
+	return err
+}
+
+func (s *sqliteJobStore) FinishedJobs() ([]finishedJob, error) {
+	rows, err := s.db.Query(`SELECT id, status, json_extract(data, '$.ended_at'), coalesce(json_extract(data, '$.archived'), 0) FROM jobs
+		WHERE json_extract(data, '$.ended_at') IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []finishedJob
+	for rows.Next() {
+		var job finishedJob
+		var endedAt string
+		if err := rows.Scan(&job.ID, &job.Status, &endedAt, &job.Archived); err != nil {
+			return nil, err
+		}
+		if job.EndedAt, err = time.Parse(time.RFC3339Nano, endedAt); err != nil {
+			return nil, fmt.Errorf("job %s: %w", job.ID, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *sqliteJobStore) DeleteJobs(ids []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM job_logs WHERE job_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM jobs WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteJobStore) LoadChanges(limit int) ([]JobChange, error) {
+	rows, err := s.db.Query(`SELECT data FROM (SELECT seq, data FROM job_changes ORDER BY seq DESC LIMIT ?) ORDER BY seq`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []JobChange
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var change JobChange
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqliteJobStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Events waiting to be produced; further events are dropped and counted as
+// failures while Kafka is unreachable for long
+const kafkaQueueSize = 1000
+
+// Attempts per event before it's counted as a delivery failure
+const kafkaMaxAttempts = 5
+
+// KafkaSink produces events to a Kafka topic, keyed by job or batch ID so a
+// job's events stay in order on one partition. Records are partitioned with
+// Kafka's murmur2 hash, produced uncompressed and acknowledged by all
+// in-sync replicas.
+type KafkaSink struct {
+	client *kgo.Client
+
+	// Messages buffered or being produced
+	inFlight atomic.Int64
+}
+
+// kafkaSink is nil unless KAFKA_BROKERS is set
+var kafkaSink *KafkaSink
+
+func newKafkaSink() (*KafkaSink, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.KafkaBrokers...),
+		kgo.ClientID("apple-music-dl-http-wrapper"),
+		kgo.DefaultProduceTopic(cfg.KafkaTopic),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		kgo.MaxBufferedRecords(kafkaQueueSize),
+		kgo.RecordRetries(kafkaMaxAttempts),
+	}
+	if cfg.KafkaTLS {
+		opts = append(opts, kgo.DialTLSConfig(outboundTLSConfig()))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaSink{client: client}, nil
+}
+
+// publish queues the event without blocking the caller
+func (ks *KafkaSink) publish(ev WebhookEvent, id string, trace TraceContext) {
+	var payload any = ev
+	contentType := "application/json"
+	if cfg.KafkaFormat == "cloudevents" {
+		payload = ev.cloudEvent(id, trace)
+		contentType = "application/cloudevents+json"
+	}
+	value, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode event", "event", ev.Event, "error", err)
+		return
+	}
+
+	headers := []kgo.RecordHeader{
+		{Key: "event", Value: []byte(ev.Event)},
+		{Key: "event_id", Value: []byte(id)},
+		{Key: "content-type", Value: []byte(contentType)},
+	}
+	if trace.TraceParent != "" {
+		headers = append(headers, kgo.RecordHeader{Key: "traceparent", Value: []byte(trace.TraceParent)})
+	}
+	if trace.RequestID != "" {
+		headers = append(headers, kgo.RecordHeader{Key: "request_id", Value: []byte(trace.RequestID)})
+	}
+
+	record := &kgo.Record{Value: value, Headers: headers, Timestamp: ev.Time}
+	if key := ev.subject(); key != "" {
+		record.Key = []byte(key)
+	}
+	ks.inFlight.Add(1)
+	ks.client.TryProduce(context.Background(), record, func(_ *kgo.Record, err error) {
+		defer ks.inFlight.Add(-1)
+		if errors.Is(err, kgo.ErrMaxBuffered) {
+			metrics.kafkaFailures.Add(1)
+			slog.Warn("Kafka queue full, dropped event", "event", ev.Event)
+			return
+		}
+		integrationHealth.record("kafka", err)
+		if err != nil {
+			metrics.kafkaFailures.Add(1)
+			slog.Error("Failed to produce event to Kafka", "event", ev.Event, "error", err)
+			return
+		}
+		metrics.kafkaDelivered.Add(1)
+	})
+}
+
+// Settled reports whether every queued message has been produced or has
+// failed
+func (ks *KafkaSink) Settled() bool {
+	return ks.inFlight.Load() == 0
+}
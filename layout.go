@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// layoutPlaceholder matches "{album}" or, for numbers, "{track:02}" with a
+// zero-padded width
+var layoutPlaceholder = regexp.MustCompile(`\{([a-z_]+)(?::(0[1-9]))?\}`)
+
+// Tags usable in directory and file name templates
+var layoutFields = map[string]bool{
+	"artist": true, "album_artist": true, "album": true, "year": true,
+	"title": true, "track": true, "disc": true, "genre": true,
+}
+
+func validateLayoutTemplate(tmpl string) error {
+	for _, m := range layoutPlaceholder.FindAllStringSubmatch(tmpl, -1) {
+		if !layoutFields[m[1]] {
+			return fmt.Errorf("unknown placeholder {%s}", m[1])
+		}
+		if m[2] != "" && m[1] != "track" && m[1] != "disc" {
+			return fmt.Errorf("{%s} can't be padded", m[1])
+		}
+	}
+	if strings.ContainsAny(layoutPlaceholder.ReplaceAllString(tmpl, ""), "{}") {
+		return errors.New("unbalanced braces")
+	}
+	return nil
+}
+
+// validateOutputDir checks a directory files are moved to, relative to
+// DOWNLOADS_DIR
+func validateOutputDir(dir string) error {
+	if dir != "" && !filepath.IsLocal(filepath.FromSlash(dir)) {
+		return errors.New("output_dir must be a relative path inside DOWNLOADS_DIR")
+	}
+	return nil
+}
+
+// renderLayout fills a template from an audio file's tags. Tags that are
+// missing render empty, path components left empty are dropped, and the
+// rest are sanitized by the given profile, "windows" when unset.
+func renderLayout(tmpl string, tags map[string]string, sanitize string) string {
+	values := map[string]string{
+		"artist":       tags["artist"],
+		"album_artist": cmp.Or(tags["album_artist"], tags["artist"]),
+		"album":        tags["album"],
+		"title":        tags["title"],
+		"genre":        tags["genre"],
+		"year":         strings.TrimSpace(tags["date"]),
+	}
+	if len(values["year"]) > 4 {
+		values["year"] = values["year"][:4]
+	}
+	numbers := map[string]int{"track": tagNumber(tags["track"]), "disc": tagNumber(tags["disc"])}
+
+	rendered := layoutPlaceholder.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		m := layoutPlaceholder.FindStringSubmatch(placeholder)
+		if n, isNumber := numbers[m[1]]; isNumber {
+			if n == 0 {
+				return ""
+			}
+			width, _ := strconv.Atoi(m[2])
+			return fmt.Sprintf("%0*d", width, n)
+		}
+		// A tag can't add directories
+		return strings.NewReplacer("/", "_", `\`, "_").Replace(values[m[1]])
+	})
+
+	var parts []string
+	for _, part := range strings.Split(rendered, "/") {
+		if part = strings.TrimSpace(part); part != "" && part != "." && part != ".." {
+			parts = append(parts, sanitizeName(part, cmp.Or(sanitize, "windows")))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// layoutFiles moves the job's files under outputDir and into the layout of
+// the profile's directory and file name templates, returning their new
+// paths. Audio files are placed by their own tags; other files follow the
+// audio files of their directory, and lyrics named after an audio file are
+// renamed with it. Existing files are replaced when overwrite is set;
+// otherwise they're kept and left out of the returned paths. On failure the
+// files moved so far are returned at their new paths, and the others where
+// they were.
+func layoutFiles(jobID string, files []string, outputDir string, profile OutputProfile, overwrite bool) ([]string, error) {
+	dirs := map[string]string{}  // source directory -> target directory
+	stems := map[string]string{} // source path without extension -> target
+	targets := map[string]string{}
+
+	for _, file := range files {
+		if artifactKind(file) != "audio" {
+			continue
+		}
+		rel, err := filepath.Rel(cfg.DownloadsDir, file)
+		if err != nil {
+			return files, err
+		}
+		rel = filepath.ToSlash(rel)
+		dir, name := path.Dir(rel), path.Base(rel)
+		ext := path.Ext(name)
+
+		if profile.DirTemplate != "" || profile.FileTemplate != "" {
+			tags, err := readTags(file)
+			if err != nil {
+				return files, err
+			}
+			if profile.DirTemplate != "" {
+				if rendered := renderLayout(profile.DirTemplate, tags, profile.Sanitize); rendered != "" {
+					dir = rendered
+				}
+			}
+			if profile.FileTemplate != "" {
+				if rendered := renderLayout(profile.FileTemplate, tags, profile.Sanitize); rendered != "" {
+					name = rendered + ext
+				}
+			}
+		}
+
+		target := path.Join(outputDir, dir, name)
+		targets[file] = target
+		if _, seen := dirs[filepath.Dir(file)]; !seen {
+			dirs[filepath.Dir(file)] = path.Dir(target)
+		}
+		stems[strings.TrimSuffix(file, filepath.Ext(file))] = strings.TrimSuffix(target, ext)
+	}
+
+	moved := make([]string, 0, len(files))
+	var counts moveCounts
+	defer func() { counts.log(jobID) }()
+	for i, file := range files {
+		target, ok := targets[file]
+		if !ok {
+			rel, err := filepath.Rel(cfg.DownloadsDir, file)
+			if err != nil {
+				return append(moved, files[i:]...), err
+			}
+			target = path.Join(outputDir, filepath.ToSlash(rel))
+			if stem, ok := stems[strings.TrimSuffix(file, filepath.Ext(file))]; ok {
+				target = stem + filepath.Ext(file)
+			} else if dir, ok := dirs[filepath.Dir(file)]; ok {
+				target = path.Join(dir, filepath.Base(file))
+			}
+		}
+
+		full := filepath.Join(cfg.DownloadsDir, filepath.FromSlash(target))
+		result, err := moveFile(file, full, overwrite)
+		if err != nil {
+			return append(moved, files[i:]...), err
+		}
+		counts.add(result)
+		if result != moveKept {
+			moved = append(moved, full)
+		}
+	}
+
+	jobManager.AppendLog(jobID, fmt.Sprintf("Moved %d file(s) into the output layout", len(moved)))
+	return moved, nil
+}
+
+// laysOut reports whether a job's files are moved into another layout
+func (p OutputProfile) laysOut(outputDir string) bool {
+	return outputDir != "" || p.DirTemplate != "" || p.FileTemplate != ""
+}
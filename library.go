@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time a media server may take to answer a refresh
+const libraryRefreshTimeout = 30 * time.Second
+
+// LibraryRefresh is the outcome of asking a media server to scan the files
+// of a completed job. Status is "ok" or "failed".
+type LibraryRefresh struct {
+	Server  string    `json:"server"`
+	Path    string    `json:"path"`
+	Library string    `json:"library,omitempty"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// mediaServer is a media server the wrapper refreshes once a job completes.
+// refresh scans path and returns the name of the library containing it.
+// pathMap translates paths of the wrapper into the server's.
+type mediaServer struct {
+	name       string
+	configured func() bool
+	pathMap    func() []string
+	refresh    func(ctx context.Context, path string) (string, error)
+}
+
+var mediaServers = []mediaServer{
+	{"plex", func() bool { return cfg.PlexURL != "" }, func() []string { return cfg.PlexPathMap }, refreshPlex},
+	{"jellyfin", func() bool { return cfg.JellyfinURL != "" }, func() []string { return cfg.JellyfinPathMap }, refreshJellyfin},
+}
+
+// serverPath translates a path of the wrapper into a media server's, using
+// the first matching "from=to" entry of its path map
+func serverPath(path string, pathMap []string) string {
+	for _, mapping := range pathMap {
+		from, to, ok := strings.Cut(mapping, "=")
+		if !ok {
+			continue
+		}
+		from = strings.TrimRight(from, "/")
+		if path == from || strings.HasPrefix(path, from+"/") {
+			return strings.TrimRight(to, "/") + path[len(from):]
+		}
+	}
+	return path
+}
+
+// refreshLibraries asks each configured media server to scan the output of
+// a completed job, and records the outcome on the job. A failed refresh
+// adds a library_refresh_failed event without failing the job.
+func refreshLibraries(jobID string) {
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists || len(job.Artifacts) == 0 {
+		return
+	}
+	var refreshes []LibraryRefresh
+	for _, server := range mediaServers {
+		if !server.configured() {
+			continue
+		}
+		path := serverPath(jobOutputPath(job), server.pathMap())
+		ctx, cancel := context.WithTimeout(context.Background(), libraryRefreshTimeout)
+		library, err := server.refresh(ctx, path)
+		cancel()
+		integrationHealth.record(server.name, err)
+
+		refresh := LibraryRefresh{Server: server.name, Path: path, Library: library, Status: "ok", Time: time.Now()}
+		if err != nil {
+			refresh.Status, refresh.Error = "failed", err.Error()
+			jobManager.AddEvent(jobID, JobEvent{Type: "library_refresh_failed", Message: fmt.Sprintf("%s refresh failed: %v", server.name, err)})
+			jobManager.AppendLog(jobID, fmt.Sprintf("Refreshing %s failed: %v", server.name, err))
+			slog.Warn("Library refresh failed", "job_id", jobID, "server", server.name, "error", err)
+		} else {
+			jobManager.AppendLog(jobID, fmt.Sprintf("Refreshed %s library %s for %s", server.name, library, path))
+		}
+		refreshes = append(refreshes, refresh)
+	}
+	if len(refreshes) > 0 {
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.LibraryRefresh = refreshes
+		})
+	}
+}
+
+// mediaLibrary is a library of a media server and the folders it covers
+type mediaLibrary struct {
+	name      string
+	id        string
+	locations []string
+}
+
+// libraryContaining returns the library with the longest location
+// containing path
+func libraryContaining(libraries []mediaLibrary, path string) (mediaLibrary, error) {
+	var found mediaLibrary
+	longest := -1
+	for _, library := range libraries {
+		for _, location := range library.locations {
+			location = strings.TrimRight(location, "/")
+			if (path == location || strings.HasPrefix(path, location+"/")) && len(location) > longest {
+				found, longest = library, len(location)
+			}
+		}
+	}
+	if longest < 0 {
+		return mediaLibrary{}, fmt.Errorf("no library contains %s", path)
+	}
+	return found, nil
+}
+
+// mediaServerRequest calls a media server's API, decoding its JSON
+// response into out unless out is nil
+func mediaServerRequest(ctx context.Context, method, endpoint string, header http.Header, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("token rejected")
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type plexSection struct {
+	Key      string `json:"key"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Location []struct {
+		Path string `json:"path"`
+	} `json:"Location"`
+}
+
+func plexHeader() http.Header {
+	header := http.Header{}
+	header.Set("X-Plex-Token", cfg.PlexToken)
+	return header
+}
+
+func plexSections(ctx context.Context) ([]plexSection, error) {
+	var sections struct {
+		MediaContainer struct {
+			Directory []plexSection `json:"Directory"`
+		} `json:"MediaContainer"`
+	}
+	endpoint := strings.TrimRight(cfg.PlexURL, "/") + "/library/sections"
+	if err := mediaServerRequest(ctx, http.MethodGet, endpoint, plexHeader(), nil, &sections); err != nil {
+		return nil, err
+	}
+	return sections.MediaContainer.Directory, nil
+}
+
+// refreshPlex starts a partial scan of path in the Plex library section
+// containing it, or in PLEX_SECTION
+func refreshPlex(ctx context.Context, path string) (string, error) {
+	sections, err := plexSections(ctx)
+	if err != nil {
+		return "", err
+	}
+	var libraries []mediaLibrary
+	for _, section := range sections {
+		if cfg.PlexSection != "" && section.Key != cfg.PlexSection {
+			continue
+		}
+		library := mediaLibrary{name: section.Title, id: section.Key}
+		for _, location := range section.Location {
+			library.locations = append(library.locations, location.Path)
+		}
+		libraries = append(libraries, library)
+	}
+	section, err := libraryContaining(libraries, path)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("%s/library/sections/%s/refresh?path=%s", strings.TrimRight(cfg.PlexURL, "/"), url.PathEscape(section.id), url.QueryEscape(path))
+	if err := mediaServerRequest(ctx, http.MethodGet, endpoint, plexHeader(), nil, nil); err != nil {
+		return "", err
+	}
+	return section.name, nil
+}
+
+type jellyfinLibrary struct {
+	Name      string   `json:"Name"`
+	ItemID    string   `json:"ItemId"`
+	Locations []string `json:"Locations"`
+}
+
+func jellyfinHeader() http.Header {
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("MediaBrowser Token=%q", cfg.JellyfinAPIKey))
+	return header
+}
+
+func jellyfinLibraries(ctx context.Context) ([]jellyfinLibrary, error) {
+	var libraries []jellyfinLibrary
+	endpoint := strings.TrimRight(cfg.JellyfinURL, "/") + "/Library/VirtualFolders"
+	if err := mediaServerRequest(ctx, http.MethodGet, endpoint, jellyfinHeader(), nil, &libraries); err != nil {
+		return nil, err
+	}
+	return libraries, nil
+}
+
+// refreshJellyfin reports path as created, which has Jellyfin scan it in
+// the library containing it. Jellyfin ignores paths outside its libraries,
+// so those are reported as failures here.
+func refreshJellyfin(ctx context.Context, path string) (string, error) {
+	libraries, err := jellyfinLibraries(ctx)
+	if err != nil {
+		return "", err
+	}
+	var candidates []mediaLibrary
+	for _, library := range libraries {
+		candidates = append(candidates, mediaLibrary{name: library.Name, id: library.ItemID, locations: library.Locations})
+	}
+	library, err := libraryContaining(candidates, path)
+	if err != nil {
+		return "", err
+	}
+
+	body := map[string]any{"Updates": []map[string]string{{"Path": path, "UpdateType": "Created"}}}
+	endpoint := strings.TrimRight(cfg.JellyfinURL, "/") + "/Library/Media/Updated"
+	if err := mediaServerRequest(ctx, http.MethodPost, endpoint, jellyfinHeader(), body, nil); err != nil {
+		return "", err
+	}
+	return library.name, nil
+}
+
+func testPlex() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTestTimeout)
+	defer cancel()
+	sections, err := plexSections(ctx)
+	if err != nil {
+		return "", err
+	}
+	var music []string
+	for _, section := range sections {
+		if section.Type == "artist" {
+			music = append(music, section.Title)
+		}
+	}
+	return fmt.Sprintf("%d music section(s): %s", len(music), strings.Join(music, ", ")), nil
+}
+
+func testJellyfin() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTestTimeout)
+	defer cancel()
+	libraries, err := jellyfinLibraries(ctx)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, library := range libraries {
+		names = append(names, library.Name)
+	}
+	return fmt.Sprintf("%d virtual folder(s): %s", len(names), strings.Join(names, ", ")), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+)
+
+// inheritLocale as DOWNLOADER_LOCALE runs the downloader in the wrapper's
+// own locale
+const inheritLocale = "inherit"
+
+// downloaderEnv returns the environment the downloader runs with. Its output
+// is parsed, so unless DOWNLOADER_LOCALE is "inherit" every locale variable
+// is replaced to get the same messages whatever the host's LANG.
+func downloaderEnv(extra ...string) []string {
+	env := os.Environ()
+	if cfg.DownloaderLocale != inheritLocale {
+		env = slices.DeleteFunc(env, func(entry string) bool {
+			name, _, _ := strings.Cut(entry, "=")
+			return name == "LANG" || name == "LANGUAGE" || strings.HasPrefix(name, "LC_")
+		})
+		env = append(env, "LANG="+cfg.DownloaderLocale, "LC_ALL="+cfg.DownloaderLocale)
+	}
+	return append(env, extra...)
+}
+
+// downloaderLanguage returns the language of the downloader's messages, such
+// as "de" for de_DE.UTF-8, used to pick locale-specific output patterns.
+// The C and POSIX locales are reported as "c".
+func downloaderLanguage() string {
+	locale := cfg.DownloaderLocale
+	if locale == inheritLocale {
+		locale = "C"
+		for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			if value := os.Getenv(name); value != "" {
+				locale = value
+				break
+			}
+		}
+	}
+	language, _, _ := strings.Cut(locale, ".")
+	language, _, _ = strings.Cut(language, "_")
+	language, _, _ = strings.Cut(language, "@")
+	if language == "POSIX" {
+		language = "C"
+	}
+	return strings.ToLower(language)
+}
@@ -5,46 +5,241 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type DownloadRequest struct {
-	URL     string `json:"url"`
-	Format  string `json:"format,omitempty"`
-	Song    bool   `json:"song,omitempty"`
-	Debug   bool   `json:"debug,omitempty"`
-	Timeout int    `json:"timeout,omitempty"` // timeout in seconds, default 3600 (1 hour)
+	URL     string     `json:"url"`
+	Format  FormatList `json:"format,omitempty"`
+	Song    bool       `json:"song,omitempty"`
+	Debug   bool       `json:"debug,omitempty"`
+	Timeout int        `json:"timeout,omitempty"` // timeout in seconds, DEFAULT_TIMEOUT when 0
+
+	// Seconds an attempt may go without printing anything before it's
+	// considered stuck, DEFAULT_IDLE_TIMEOUT when 0
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+
+	// Quality caps passed to the downloader for the format being fetched:
+	// the highest ALAC sample rate in Hz, the highest Atmos bitrate in kbps
+	// and the AAC variant; see validateQuality
+	AlacMax  int    `json:"alac_max,omitempty"`
+	AtmosMax int    `json:"atmos_max,omitempty"`
+	AACType  string `json:"aac_type,omitempty"`
+
+	// Output profile, notification channel (see parseNotifyChannel) and
+	// overwrite policy for files that already exist, "skip" (default) or
+	// "overwrite"; unset values come from the owner's preferences
+	OutputProfile string `json:"output_profile,omitempty"`
+	Notify        string `json:"notify,omitempty"`
+	Overwrite     string `json:"overwrite,omitempty"`
+
+	// Directory under DOWNLOADS_DIR the job's files are moved to
+	OutputDir string `json:"output_dir,omitempty"`
+
+	// Queue priority: "high", "normal" (default) or "low"
+	Priority string `json:"priority,omitempty"`
+
+	// Overrides for the configured retry policy
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// Album tracks to download or skip; see TrackList
+	IncludeTracks TrackList `json:"include_tracks,omitempty"`
+	ExcludeTracks TrackList `json:"exclude_tracks,omitempty"`
+
+	// Only download the album or playlist tracks earlier syncs haven't; see
+	// SyncManifest
+	Sync bool `json:"sync,omitempty"`
+
+	// Start the download later: once at ScheduleAt, or whenever Cron
+	// matches (not before ScheduleAt, when both are set); see Schedule
+	ScheduleAt *time.Time `json:"schedule_at,omitempty"`
+	Cron       string     `json:"cron,omitempty"`
+
+	// Per-request overrides for the output profile's tagging, artwork,
+	// extras and verification options
+	Tagging *TaggingOptions `json:"tagging,omitempty"`
+	Artwork *ArtworkOptions `json:"artwork,omitempty"`
+	Extras  *ExtrasOptions  `json:"extras,omitempty"`
+	Verify  *VerifyPolicy   `json:"verify,omitempty"`
+
+	// Language for tags and file names, e.g. "ja" for Japanese titles or
+	// "en-US" for English transliterations
+	MetadataLanguage string `json:"metadata_language,omitempty"`
+
+	// Album edition preference such as "deluxe,standard", or "ask" to get
+	// the alternatives back when the album has other versions
+	Edition string `json:"edition,omitempty"`
+
+	// URL posted the job's result once it finishes
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// Labels such as {"requester": "kids"}, used to route notifications
+	Labels Labels `json:"labels,omitempty"`
+
+	// Collection the job, or the batch of URLs, is attached to
+	Collection string `json:"collection,omitempty"`
+
+	// Template the request's unset options are taken from; see applyTemplate
+	Template string `json:"template,omitempty"`
+
+	// Several URLs downloaded with the same options, as one job each under
+	// a batch, with optional digests of the batch's progress; see
+	// handleDownloadBatch
+	URLs   []string      `json:"urls,omitempty"`
+	Digest *DigestConfig `json:"digest,omitempty"`
+
+	// Set by importers that group the jobs they create
+	BatchID string `json:"-"`
+
+	// Who submitted the request, used to share the queue fairly
+	Owner string `json:"-"`
+
+	// Name of the API key the request was made with, matched by policies
+	APIKey string `json:"-"`
+
+	// Policy rules that changed the request; see applyPolicies
+	Policies []string `json:"-"`
+
+	// Trace of the request that created the job
+	Trace TraceContext `json:"-"`
+
+	// Job this one retries, set by handleRetryJob
+	RetryOf string `json:"-"`
 }
 
 type DownloadStatus struct {
-	ID        string     `json:"id"`
-	URL       string     `json:"url"`
-	Status    string     `json:"status"`
-	Progress  string     `json:"progress,omitempty"`
-	Error     string     `json:"error,omitempty"`
-	StartedAt time.Time  `json:"started_at"`
-	EndedAt   *time.Time `json:"ended_at,omitempty"`
-	Logs      []string   `json:"logs,omitempty"`
-	Duration  string     `json:"duration,omitempty"`
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Status    string       `json:"status"`
+	Progress  *JobProgress `json:"progress,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	ErrorCode string       `json:"error_code,omitempty"`
+	StartedAt time.Time    `json:"started_at"`
+	EndedAt   *time.Time   `json:"ended_at,omitempty"`
+	Logs      []string     `json:"logs,omitempty"`
+	Duration  string       `json:"duration,omitempty"`
+	BatchID   string       `json:"batch_id,omitempty"`
+	Priority  string       `json:"priority,omitempty"`
+	Owner     string       `json:"owner,omitempty"`
+	Events    []JobEvent   `json:"events,omitempty"`
+
+	// Format that was actually downloaded after any fallbacks
+	FormatObtained string `json:"format_obtained,omitempty"`
+
+	// What the URL links to: album, song, playlist, artist or music-video
+	ContentType string `json:"content_type,omitempty"`
+
+	// URL posted the job's result once it finishes
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// End of the downloader's stderr when it failed; see DownloadError
+	// for the error codes
+	StderrTail []string `json:"stderr_tail,omitempty"`
+
+	// Labels the job was submitted with
+	Labels Labels `json:"labels,omitempty"`
+
+	// Trace headers forwarded to outbound calls made for the job
+	Trace TraceContext `json:"trace"`
+
+	// Files the job produced; booklets, videos and motion artwork are
+	// listed under Extras. OutputDir is the directory containing all of
+	// them, relative to DOWNLOADS_DIR.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+	Extras    []Artifact `json:"extras,omitempty"`
+	OutputDir string     `json:"output_dir,omitempty"`
+
+	// Audio files of a completed job with their tags, for notifications
+	Tracks []Track `json:"tracks,omitempty"`
+
+	// Tracks a sync job skipped and downloaded
+	Sync *SyncResult `json:"sync,omitempty"`
+
+	// Checks the job's files went through once they were downloaded
+	Verification *VerificationReport `json:"verification,omitempty"`
+
+	// Media servers asked to scan the job's files once it completed
+	LibraryRefresh []LibraryRefresh `json:"library_refresh,omitempty"`
+
+	// Where the current download stands in its retry policy
+	Retry *RetryState `json:"retry,omitempty"`
+
+	// Request the job was started with, after preferences were applied,
+	// so it can be retried as it was
+	Request *DownloadRequest `json:"request,omitempty"`
+
+	// Retry lineage: the job this one retries, and the jobs retrying it
+	RetryOf string   `json:"retry_of,omitempty"`
+	Retries []string `json:"retries,omitempty"`
+
+	// Policy rules that changed the request when it was submitted
+	Policies []string `json:"policies,omitempty"`
+
+	// Archived jobs are left out of GET /jobs but kept for statistics and
+	// audit until they're purged
+	Archived   bool       `json:"archived,omitempty"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// JobEvent is an entry in a job's timeline
+type JobEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Attempt  int       `json:"attempt,omitempty"`
+	Code     string    `json:"code,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+// clone copies the job so it can be read without holding the manager lock
+func (job *DownloadStatus) clone() DownloadStatus {
+	snapshot := *job
+	snapshot.Logs = append([]string(nil), job.Logs...)
+	snapshot.Events = append([]JobEvent(nil), job.Events...)
+	return snapshot
 }
 
 type JobManager struct {
-	mu   sync.RWMutex
-	jobs map[string]*DownloadStatus
+	mu          sync.RWMutex
+	jobs        map[string]*DownloadStatus
+	finishHooks []func(DownloadStatus)
+
+	// When jobs were last read, for evicting finished jobs from memory
+	accessMu sync.Mutex
+	accessed map[string]time.Time
+
+	// Incremented on every change to the jobs, under mu
+	version atomic.Uint64
+
+	// Finish hooks still running
+	hooksRunning sync.WaitGroup
+
+	// Downloader processes of running jobs, by job ID
+	procMu sync.Mutex
+	procs  map[string]*jobProcess
 }
 
 func NewJobManager() *JobManager {
 	return &JobManager{
-		jobs: make(map[string]*DownloadStatus),
+		jobs:     make(map[string]*DownloadStatus),
+		accessed: make(map[string]time.Time),
+		procs:    make(map[string]*jobProcess),
 	}
 }
 
@@ -56,37 +251,137 @@ func (jm *JobManager) CreateJob(url string) *DownloadStatus {
 	job := &DownloadStatus{
 		ID:        id,
 		URL:       url,
-		Status:    "pending",
+		Status:    "queued",
 		StartedAt: time.Now(),
 		Logs:      []string{},
 	}
 	jm.jobs[id] = job
+	jm.version.Add(1)
+	jm.persist(job)
 	return job
 }
 
-func (jm *JobManager) GetJob(id string) (*DownloadStatus, bool) {
+// Snapshot returns a copy of the job that is safe to read while it runs.
+// Jobs evicted from memory are read from the archive.
+func (jm *JobManager) Snapshot(id string) (DownloadStatus, bool) {
 	jm.mu.RLock()
-	defer jm.mu.RUnlock()
 	job, exists := jm.jobs[id]
-	return job, exists
+	if !exists {
+		jm.mu.RUnlock()
+		return loadArchivedJob(id)
+	}
+	snapshot := job.clone()
+	jm.mu.RUnlock()
+
+	jm.touch(id)
+	return snapshot, true
+}
+
+// SnapshotAll returns copies of every job
+func (jm *JobManager) SnapshotAll() []DownloadStatus {
+	jobs, _ := jm.SnapshotAllVersion()
+	return jobs
 }
 
-func (jm *JobManager) GetAllJobs() []*DownloadStatus {
+// SnapshotAllVersion returns copies of every job and the version of the job
+// set they were taken at
+func (jm *JobManager) SnapshotAllVersion() ([]DownloadStatus, uint64) {
 	jm.mu.RLock()
 	defer jm.mu.RUnlock()
 
-	jobs := make([]*DownloadStatus, 0, len(jm.jobs))
+	jobs := make([]DownloadStatus, 0, len(jm.jobs))
 	for _, job := range jm.jobs {
-		jobs = append(jobs, job)
+		jobs = append(jobs, job.clone())
 	}
-	return jobs
+	return jobs, jm.version.Load()
+}
+
+// FindByURL returns a snapshot of the most recent job for url that hasn't
+// failed, expired or been cancelled
+func (jm *JobManager) FindByURL(url string) (*DownloadStatus, bool) {
+	jm.mu.RLock()
+	defer jm.mu.RUnlock()
+
+	var found *DownloadStatus
+	for _, job := range jm.jobs {
+		if job.URL != url || job.Status == "failed" || job.Status == "cancelled" || job.Status == "expired" || job.Status == "interrupted" {
+			continue
+		}
+		if found == nil || job.StartedAt.After(found.StartedAt) {
+			found = job
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+
+	snapshot := found.clone()
+	return &snapshot, true
+}
+
+// OnFinish registers fn to be called once for every job that reaches a
+// terminal state
+func (jm *JobManager) OnFinish(fn func(DownloadStatus)) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.finishHooks = append(jm.finishHooks, fn)
 }
 
 func (jm *JobManager) UpdateJob(id string, updater func(*DownloadStatus)) {
+	jm.mu.Lock()
+	job, exists := jm.jobs[id]
+	if !exists {
+		jm.mu.Unlock()
+		return
+	}
+
+	wasFinished, wasStatus := job.EndedAt != nil, job.Status
+	updater(job)
+	finished := !wasFinished && job.EndedAt != nil
+	jm.version.Add(1)
+	jm.persist(job)
+
+	if job.Status != wasStatus {
+		jobChanges.record("status", job)
+	}
+	if jobFeed.active() {
+		switch {
+		case finished:
+			jobFeed.publishJob("finished", job)
+		case job.Status != wasStatus:
+			jobFeed.publish(JobFeedEvent{Type: "status", JobID: id, Status: job.Status})
+		}
+	}
+
+	var snapshot DownloadStatus
+	if finished {
+		snapshot = job.clone()
+	}
+	hooks := jm.finishHooks
+	jm.mu.Unlock()
+
+	if finished {
+		jm.hooksRunning.Add(len(hooks))
+		for _, hook := range hooks {
+			go func() {
+				defer jm.hooksRunning.Done()
+				hook(snapshot)
+			}()
+		}
+		jm.enforceBudget()
+	}
+}
+
+func (jm *JobManager) AddEvent(id string, event JobEvent) {
 	jm.mu.Lock()
 	defer jm.mu.Unlock()
 	if job, exists := jm.jobs[id]; exists {
-		updater(job)
+		if event.Time.IsZero() {
+			event.Time = time.Now()
+		}
+		job.Events = append(job.Events, event)
+		jm.version.Add(1)
+		jm.persist(job)
 	}
 }
 
@@ -99,28 +394,325 @@ func (jm *JobManager) AppendLog(id string, logLine string) {
 			return
 		}
 
+		previous := job.Progress
 		job.Logs = append(job.Logs, logLine)
-		job.Progress = logLine
+		job.Progress = job.Progress.update(logLine)
+		jm.version.Add(1)
+
+		if jobFeed.active() {
+			jobFeed.publish(JobFeedEvent{Type: "log", JobID: id, Line: logLine})
+			if progressChanged(previous, job.Progress) {
+				jobFeed.publish(JobFeedEvent{Type: "progress", JobID: id, Progress: job.Progress})
+			}
+		}
 
-		// Keep only last 100 log lines to prevent memory issues
-		if len(job.Logs) > 100 {
-			job.Logs = job.Logs[len(job.Logs)-100:]
+		// Keep only the last lines to prevent memory issues
+		if len(job.Logs) > cfg.JobLogLines {
+			job.Logs = job.Logs[len(job.Logs)-cfg.JobLogLines:]
+		}
+
+		if jobStore != nil {
+			storeWriter.appendLog(id, logLine)
 		}
 	}
 }
 
 var jobManager = NewJobManager()
 
+var cfg *Config
+
+// httpClient is shared by all outbound integrations
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
 func main() {
+	flag.Parse()
+
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+	if err := configureLogging(os.Stderr); err != nil {
+		fatal("Failed to configure logging", "error", err)
+	}
+	scheduler = NewScheduler(cfg.MaxConcurrentDownloads, cfg.QueueTTL, cfg.PriorityAging, cfg.FairShareWeights,
+		NewStagingBudget(cfg.StagingBudgetMB, cfg.StagingCheckInterval))
+	if cfg.PatternsFile != "" {
+		if err := loadPatterns(cfg.PatternsFile); err != nil {
+			fatal("Failed to load output patterns", "error", err)
+		}
+	}
+
+	if flag.Arg(0) == "healthcheck" {
+		os.Exit(runHealthcheck(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "audit-verify" {
+		os.Exit(runAuditVerify(flag.Args()[1:]))
+	}
+	if *replayFile != "" {
+		os.Exit(runReplay(*replayFile))
+	}
+
+	switch {
+	case *installServiceFlag:
+		if err := installService(); err != nil {
+			fatal("Failed to install service", "error", err)
+		}
+		return
+	case *uninstallServiceFlag:
+		if err := uninstallService(); err != nil {
+			fatal("Failed to remove service", "error", err)
+		}
+		return
+	}
+	startServiceHandler()
+
+	if err := configureHTTPClient(); err != nil {
+		fatal("Failed to configure outbound HTTP", "error", err)
+	}
+	if cfg.AuditLog != "" {
+		var err error
+		if auditLog, err = openAuditLog(); err != nil {
+			fatal("Failed to open the audit log", "error", err)
+		}
+	}
+
+	// A one-off run keeps its job to itself rather than sharing the history
+	// of a server that may be running
+	if !*onceMode {
+		if err := openJobStore(); err != nil {
+			fatal("Failed to open job database", "error", err)
+		}
+		if err := jobChanges.load(); err != nil {
+			fatal("Failed to load job changes", "error", err)
+		}
+		if err := jobManager.restore(); err != nil {
+			fatal("Failed to restore jobs", "error", err)
+		}
+		// Left behind by jobs that were running when the server stopped
+		os.RemoveAll(filepath.Join(cfg.DownloadsDir, stagingDirName))
+		if cfg.PostgresMirrorURL != "" {
+			if err := connectPostgresMirror(); err != nil {
+				fatal("Failed to connect to the PostgreSQL mirror", "error", err)
+			}
+			postgresMirror.backfill()
+			go postgresMirror.run()
+		}
+		if cfg.JobRetention > 0 || cfg.JobRetentionMaxJobs > 0 {
+			go jobManager.runRetention()
+		}
+	}
+
+	jobManager.OnFinish(batchManager.jobFinished)
+	jobManager.OnFinish(jobFinishedWebhook)
+	jobManager.OnFinish(jobFinishedCallback)
+	jobManager.OnFinish(jobFinishedNotify)
+
+	deps, err := parseDependencies(cfg.StartupWait)
+	if err != nil {
+		fatal("Invalid STARTUP_WAIT", "error", err)
+	}
+	// Jobs stay queued until the dependencies are up, while the API
+	// already accepts them
+	if len(deps) > 0 {
+		setStartupCheck(HealthCheck{Status: "fail", Error: "waiting for dependencies"})
+	}
+	go func() {
+		waitForDependencies(deps)
+		if scheduler.budget != nil {
+			go scheduler.budget.run()
+		}
+		scheduler.run()
+	}()
+
+	if err := loadIngestMappings(cfg.IngestMappingsFile); err != nil {
+		fatal("Failed to load ingest mappings", "error", err)
+	}
+	if err := loadOutputProfiles(cfg.OutputProfilesFile); err != nil {
+		fatal("Failed to load output profiles", "error", err)
+	}
+	if cfg.TelegramBotToken != "" {
+		telegram = newTelegramBot(cfg.TelegramBotToken, cfg.TelegramAllowedChats)
+	}
+	if err := loadPolicyRules(cfg.PolicyRulesFile); err != nil {
+		fatal("Failed to load policy rules", "error", err)
+	}
+	if err := loadRoutingRules(cfg.RoutingRulesFile, cfg.RoutingRules); err != nil {
+		fatal("Failed to load routing rules", "error", err)
+	}
+	if err := loadHooks(cfg.HooksFile); err != nil {
+		fatal("Failed to load hooks", "error", err)
+	}
+	for _, server := range mediaServers {
+		for _, mapping := range server.pathMap() {
+			if from, _, ok := strings.Cut(mapping, "="); !ok || from == "" {
+				fatal("Path map entries must be from=to", "variable", strings.ToUpper(server.name)+"_PATH_MAP", "entry", mapping)
+			}
+		}
+	}
+	if err := preferenceStore.load(); err != nil {
+		fatal("Failed to load preferences", "error", err)
+	}
+	if err := accountStore.load(); err != nil {
+		fatal("Failed to load account", "error", err)
+	}
+	if !slices.Contains(languages, cfg.DefaultLanguage) {
+		fatal("DEFAULT_LANGUAGE must be one of "+strings.Join(languages, ", "), "language", cfg.DefaultLanguage)
+	}
+	if !slices.Contains(eventFormats, cfg.WebhookFormat) {
+		fatal("WEBHOOK_FORMAT must be json or cloudevents")
+	}
+	if err := cfg.Verify.validate(); err != nil {
+		fatal("Invalid VERIFY_* settings", "error", err)
+	}
+	if cfg.NATSURL != "" {
+		if !slices.Contains(eventFormats, cfg.NATSFormat) {
+			fatal("NATS_FORMAT must be json or cloudevents")
+		}
+		if err := connectEventStream(); err != nil {
+			fatal("Failed to connect to NATS", "error", err)
+		}
+	}
+	if len(cfg.KafkaBrokers) > 0 {
+		if !slices.Contains(eventFormats, cfg.KafkaFormat) {
+			fatal("KAFKA_FORMAT must be json or cloudevents")
+		}
+		sink, err := newKafkaSink()
+		if err != nil {
+			fatal("Failed to create the Kafka producer", "error", err)
+		}
+		kafkaSink = sink
+	}
+	if err := webhookStore.load(); err != nil {
+		fatal("Failed to load webhooks", "error", err)
+	}
+	if err := collectionStore.load(); err != nil {
+		fatal("Failed to load collections", "error", err)
+	}
+	if err := templateStore.load(); err != nil {
+		fatal("Failed to load templates", "error", err)
+	}
+	if err := syncManifest.load(); err != nil {
+		fatal("Failed to load the sync manifest", "error", err)
+	}
+	if err := artistWatches.load(); err != nil {
+		fatal("Failed to load artist watches", "error", err)
+	}
+	if err := scheduleStore.load(); err != nil {
+		fatal("Failed to load schedules", "error", err)
+	}
+	if err := deliveryQueue.load(); err != nil {
+		fatal("Failed to load webhook deliveries", "error", err)
+	}
+	go deliveryQueue.run()
+	go artistWatches.run()
+	go scheduleStore.run()
+
+	if *onceMode {
+		os.Exit(runOnce(flag.Args()))
+	}
+
+	if err := loadAPIKeys(); err != nil {
+		fatal("Failed to load API keys", "error", err)
+	}
+	if patternsLoader != nil && cfg.PatternsReloadInterval > 0 {
+		go patternsLoader.watch(cfg.PatternsReloadInterval)
+	}
+
 	http.HandleFunc("/download", handleDownload)
 	http.HandleFunc("/status/", handleStatus)
 	http.HandleFunc("/jobs", handleListJobs)
+	http.HandleFunc("/jobs/", handleJob)
+	http.HandleFunc("/queue/plan", handleQueuePlan)
+	http.HandleFunc("/queue/retries", handleQueueRetries)
+	http.HandleFunc("/collections", handleCollections)
+	http.HandleFunc("/templates", handleTemplates)
+	http.HandleFunc("/templates/", handleTemplate)
+	http.HandleFunc("/collections/", handleCollection)
+	http.HandleFunc("/watch", handleArtistWatches)
+	http.HandleFunc("/watch/", handleArtistWatch)
+	http.HandleFunc("/schedules", handleSchedules)
+	http.HandleFunc("/schedules/", handleSchedule)
+	http.HandleFunc("/exports/", handleExportFile)
 	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/check", handleCheck)
+	http.HandleFunc("/preview", handlePreview)
 	http.HandleFunc("/cancel/", handleCancel)
+	http.HandleFunc("/ingest/webhook/", handleIngestWebhook)
+	http.HandleFunc("/quick", handleQuick)
+	http.HandleFunc("/ext/submit", handleExtSubmit)
+	http.HandleFunc("/me/preferences", handlePreferences)
+	http.HandleFunc("/batches/", handleBatchStatus)
+	http.HandleFunc("/import/loved", handleImportLoved)
+	http.HandleFunc("/import/", handleImportStatus)
+	http.HandleFunc("/migrate/spotify", handleMigrateSpotify)
+	http.HandleFunc("/migrate/spotify/", handleMigrationReport)
+	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("/openapi.json", handleOpenAPI)
+	if cfg.DocsUI {
+		http.HandleFunc("/docs", handleDocs)
+	}
+
+	if cfg.DiscordPublicKey != "" {
+		if err := setupDiscord(); err != nil {
+			fatal("Failed to set up Discord integration", "error", err)
+		}
+		http.HandleFunc("/discord/interactions", handleDiscordInteraction)
+	}
+
+	if telegram != nil {
+		jobManager.OnFinish(telegram.jobFinished)
+		go telegram.run()
+	}
+
+	if cfg.IMAPAddr != "" {
+		if cfg.SMTPAddr == "" {
+			fatal("SMTP_ADDR is required to reply to mailed-in requests")
+		}
+		watcher := newEmailWatcher()
+		jobManager.OnFinish(watcher.jobFinished)
+		go watcher.run()
+	}
+
+	if cfg.WatchDir != "" {
+		watcher := newFolderWatcher(cfg.WatchDir)
+		jobManager.OnFinish(watcher.jobFinished)
+		go watcher.run()
+	}
+
+	// Admin endpoints get their own listener when configured, e.g. bound to
+	// localhost, and are served with the API otherwise
+	admin := http.DefaultServeMux
+	if cfg.AdminListenAddr != "" {
+		admin = http.NewServeMux()
+		admin.HandleFunc("/health", handleHealth)
+		admin.HandleFunc("/readyz", handleReadyz)
+	}
+	admin.HandleFunc("/metrics", handleMetrics)
+	admin.HandleFunc("/webhooks", handleWebhooks)
+	admin.HandleFunc("/webhooks/", handleWebhook)
+	admin.HandleFunc("/admin/webhooks/deliveries", handleWebhookDeliveries)
+	admin.HandleFunc("/admin/webhooks/deliveries/", handleWebhookDelivery)
+	admin.HandleFunc("/integrations/status", handleIntegrationsStatus)
+	admin.HandleFunc("/integrations/", handleIntegrationTest)
+	admin.HandleFunc("/audit/export", handleAuditExport)
+	admin.HandleFunc("/admin/credentials", handleCredentials)
+	admin.HandleFunc("/admin/credentials/assist", handleCredentialsAssist)
+	admin.HandleFunc("/auth-assist/", handleAuthAssist)
+	admin.HandleFunc("/admin/account", handleAccount)
+	if cfg.AdminListenAddr != "" {
+		serve("admin", &http.Server{Addr: cfg.AdminListenAddr, Handler: requestID(accessLog(problemErrors(requireAPIKey(admin))))})
+	}
 
-	port := ":8080"
-	log.Printf("Starting API server on %s", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	if len(cfg.ListenAddrs) == 0 {
+		fatal("LISTEN_ADDR must list at least one address")
+	}
+	api := requestID(accessLog(problemErrors(requireAPIKey(http.DefaultServeMux))))
+	for _, addr := range cfg.ListenAddrs {
+		serve("API", &http.Server{Addr: addr, Handler: api})
+	}
+
+	waitForSignal()
 }
 
 func handleDownload(w http.ResponseWriter, r *http.Request) {
@@ -129,33 +721,275 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
 	var req DownloadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if req.Template != "" {
+		if err := applyTemplate(&req, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	req.Owner = requestOwner(r, "anonymous")
+	req.APIKey = apiKeyName(r)
 
-	if req.URL == "" {
-		http.Error(w, "URL is required", http.StatusBadRequest)
+	if len(req.URLs) > 0 {
+		handleDownloadBatch(w, r, req)
 		return
 	}
 
-	// Default timeout to 1 hour
-	if req.Timeout == 0 {
-		req.Timeout = 3600
+	if err := prepareRequest(&req); err != nil {
+		writeSubmitError(w, err)
+		return
 	}
 
-	// Create job
-	job := jobManager.CreateJob(req.URL)
+	if req.scheduled() {
+		if err := req.validateSchedule(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := scheduleStore.Create(req)
+		if err != nil {
+			writeScheduleError(w, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Scheduled download", "schedule_id", s.ID, "url", req.URL, "next_run_at", s.NextRunAt)
+		auditLog.recordRequest(r, AuditEntry{Action: "schedule.created", Actor: req.Owner, URL: req.URL, Detail: map[string]string{"schedule_id": s.ID}})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"schedule_id": s.ID,
+			"status":      "scheduled",
+			"next_run_at": s.NextRunAt,
+		})
+		return
+	}
 
-	// Start download in background
-	go executeDownload(job.ID, req)
+	editions, err := resolveEdition(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Edition lookup failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	if editions != nil {
+		writeProblem(w, r, http.StatusConflict, "Album has multiple editions", map[string]any{"editions": editions})
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	req.Trace = traceFromRequest(r)
+	job := startDownload(req)
+
+	response := map[string]string{
 		"job_id": job.ID,
 		"status": "started",
+	}
+	if warning := storefrontWarning(req.URL); warning != "" {
+		response["warning"] = warning
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// validate checks a download request, returning an error message fit for
+// the client
+func (req *DownloadRequest) validate() error {
+	if req.URL == "" {
+		return errors.New("URL is required")
+	}
+	normalized, _, err := normalizeAppleMusicURL(req.URL)
+	if err != nil {
+		return err
+	}
+	req.URL = normalized
+	return req.validateOptions()
+}
+
+// validationStatus is the status code for a request validate rejected:
+// 422 for links that can't be downloaded, 400 otherwise
+func validationStatus(err error) int {
+	var linkErr *LinkError
+	if errors.As(err, &linkErr) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// prepareRequest readies a submitted request for startDownload: it
+// normalizes the URL, applies the submission policies and validates the
+// result. Every entry point goes through it, so none skips a check.
+func prepareRequest(req *DownloadRequest) error {
+	req.URL = strings.TrimSpace(req.URL)
+	if req.URL == "" {
+		return errors.New("URL is required")
+	}
+	normalized, _, err := normalizeAppleMusicURL(req.URL)
+	if err != nil {
+		return err
+	}
+	req.URL = normalized
+	if err := applyPolicies(req); err != nil {
+		return err
+	}
+	return req.validate()
+}
+
+// validateOptions checks everything about a download request but its URL,
+// which templates don't have
+func (req *DownloadRequest) validateOptions() error {
+	if req.Timeout < 0 || req.IdleTimeout < 0 {
+		return errors.New("timeout and idle_timeout must not be negative")
+	}
+
+	if _, ok := priorityLevels[req.Priority]; !ok {
+		return errors.New("Priority must be high, normal or low")
+	}
+
+	if err := req.Format.validate(); err != nil {
+		return errors.New("Format must be alac, atmos or aac")
+	}
+
+	if err := req.validateQuality(); err != nil {
+		return err
+	}
+
+	if !slices.Contains(overwritePolicy, req.Overwrite) {
+		return errors.New("Overwrite must be skip or overwrite")
+	}
+	if _, err := parseNotifyChannel(req.Notify); err != nil {
+		return err
+	}
+
+	if !outputProfileExists(req.OutputProfile) {
+		return errors.New("Unknown output profile")
+	}
+	if err := validateOutputDir(req.OutputDir); err != nil {
+		return err
+	}
+	if req.Tagging != nil {
+		if err := req.Tagging.validate(); err != nil {
+			return fmt.Errorf("Invalid tagging options: %w", err)
+		}
+	}
+	if req.Artwork != nil {
+		if err := req.Artwork.validate(); err != nil {
+			return fmt.Errorf("Invalid artwork options: %w", err)
+		}
+	}
+	if req.Verify != nil {
+		if err := req.Verify.validate(); err != nil {
+			return fmt.Errorf("Invalid verify options: %w", err)
+		}
+	}
+
+	if err := validateLanguage(req.MetadataLanguage); err != nil {
+		return fmt.Errorf("Invalid metadata_language: %w", err)
+	}
+
+	if err := req.IncludeTracks.validate(); err != nil {
+		return fmt.Errorf("Invalid include_tracks: %w", err)
+	}
+	if err := req.ExcludeTracks.validate(); err != nil {
+		return fmt.Errorf("Invalid exclude_tracks: %w", err)
+	}
+	if req.Sync && req.Song {
+		return errors.New("sync is not supported for single songs")
+	}
+
+	if req.CallbackURL != "" {
+		if !isHTTPURL(req.CallbackURL) {
+			return errors.New("callback_url must be an http or https URL")
+		}
+		if err := checkCallbackURL(req.CallbackURL); err != nil {
+			return err
+		}
+	}
+	if err := req.Labels.validate(); err != nil {
+		return fmt.Errorf("Invalid labels: %w", err)
+	}
+	if _, exists := collectionStore.Get(req.Collection); req.Collection != "" && !exists {
+		return errors.New("Unknown collection")
+	}
+	return nil
+}
+
+// requestOwner identifies who submitted r, falling back to a name for the
+// submission channel
+func requestOwner(r *http.Request, fallback string) string {
+	if user := strings.TrimSpace(r.Header.Get(cfg.UserHeader)); user != "" {
+		return user
+	}
+	return fallback
+}
+
+// startDownload creates a job for req and runs it in the background
+func startDownload(req DownloadRequest) *DownloadStatus {
+	if req.Timeout == 0 {
+		req.Timeout = int(cfg.DefaultTimeout.Seconds())
+	}
+	if req.IdleTimeout == 0 {
+		req.IdleTimeout = int(cfg.DefaultIdleTimeout.Seconds())
+	}
+
+	if req.Priority == "" {
+		req.Priority = "normal"
+	}
+	if req.Owner == "" {
+		req.Owner = "anonymous"
+	}
+	if req.Trace.TraceParent == "" {
+		req.Trace = newTrace()
+	}
+	applyPreferences(&req)
+
+	// Create job
+	job := jobManager.CreateJob(req.URL)
+	jobManager.UpdateJob(job.ID, func(job *DownloadStatus) {
+		job.BatchID = req.BatchID
+		job.Priority = req.Priority
+		job.Owner = req.Owner
+		job.Trace = req.Trace
+		job.CallbackURL = req.CallbackURL
+		job.Labels = req.Labels
+		job.Request = &req
+		job.RetryOf = req.RetryOf
+		job.Policies = req.Policies
+		if link, err := parseAppleMusicURL(req.URL); err == nil {
+			job.ContentType = link.ContentType()
+		}
 	})
+	if req.BatchID != "" {
+		batchManager.AddJob(req.BatchID, job.ID)
+	} else if req.Collection != "" {
+		if _, err := collectionStore.Attach(req.Collection, collectionMembers{JobIDs: []string{job.ID}}); err != nil {
+			slog.Error("Failed to attach to collection", "job_id", job.ID, "collection_id", req.Collection, "error", err)
+		}
+	}
+
+	if snapshot, exists := jobManager.Snapshot(job.ID); exists {
+		jobChanges.record("created", &snapshot)
+		if jobFeed.active() {
+			jobFeed.publishJob("created", &snapshot)
+		}
+	}
+
+	if warning := storefrontWarning(req.URL); warning != "" {
+		jobManager.AddEvent(job.ID, JobEvent{Type: "storefront_mismatch", Message: warning})
+		jobManager.AppendLog(job.ID, "Warning: "+warning)
+	}
+
+	auditLog.record(AuditEntry{Action: "job.created", Actor: req.Owner, APIKey: req.APIKey, JobID: job.ID, URL: req.URL, Detail: jobAuditDetail(req), RequestID: req.Trace.RequestID})
+	slog.Info("Job created", "job_id", job.ID, "request_id", req.Trace.RequestID, "url", req.URL, "owner", req.Owner)
+
+	// Queue download to run in the background
+	scheduler.Enqueue(job.ID, req)
+
+	return job
 }
 
 // Custom split function that handles both \n and \r
@@ -179,26 +1013,114 @@ func scanLinesOrCarriageReturn(data []byte, atEOF bool) (advance int, token []by
 	return 0, nil, nil
 }
 
-// Read output with proper handling of \r (carriage return) for progress updates
-func readOutput(reader io.Reader, jobID string, prefix string) {
+// Lines buffered between an output reader and the job store; regular lines
+// arriving while the buffer is full are dropped and counted in metrics
+const outputBufferSize = 256
+
+// pendingLine holds the latest progress line not yet written to the job
+// store, so rapid progress updates coalesce instead of queueing up
+type pendingLine struct {
+	mu      sync.Mutex
+	line    string
+	pending bool
+}
+
+// set stores line and reports whether it replaced an unwritten one
+func (p *pendingLine) set(line string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	replaced := p.pending
+	p.line, p.pending = line, true
+	return replaced
+}
+
+func (p *pendingLine) take() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line, ok := p.line, p.pending
+	p.pending = false
+	return line, ok
+}
+
+// Read output with proper handling of \r (carriage return) for progress updates.
+// onLine, if set, is called with every non-empty line, including ones that
+// are coalesced or dropped before reaching the job log.
+func readOutput(reader io.Reader, jobID string, prefix string, onLine func(string)) {
 	scanner := bufio.NewScanner(reader)
 	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 
-	// Use custom split function that handles both \n and \r
-	scanner.Split(scanLinesOrCarriageReturn)
+	// Use custom split function that handles both \n and \r, remembering
+	// whether the line ended with \r, which marks a progress update
+	progressLine := false
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := scanLinesOrCarriageReturn(data, atEOF)
+		progressLine = token != nil && advance > len(token) && data[len(token)] == '\r'
+		return advance, token, err
+	})
+
+	lines := make(chan string, outputBufferSize)
+	var progress pendingLine
+	wake := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		store := func(line string) {
+			slog.Info("Downloader output", "job_id", jobID, "stream", strings.ToLower(prefix), "line", line)
+			jobManager.AppendLog(jobID, line)
+		}
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					if line, ok := progress.take(); ok {
+						store(line)
+					}
+					return
+				}
+				store(line)
+			case <-wake:
+				if line, ok := progress.take(); ok {
+					store(line)
+				}
+			}
+		}
+	}()
 
 	for scanner.Scan() {
-		line := scanner.Text()
-		trimmed := strings.TrimSpace(line)
+		trimmed := strings.TrimSpace(scanner.Text())
+		if trimmed == "" {
+			continue
+		}
+
+		metrics.outputLines.Add(1)
+		if onLine != nil {
+			onLine(trimmed)
+		}
 
-		if trimmed != "" {
-			log.Printf("[Job %s] %s: %s", jobID, prefix, trimmed)
-			jobManager.AppendLog(jobID, trimmed)
+		if progressLine {
+			if progress.set(trimmed) {
+				metrics.progressCoalesced.Add(1)
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		select {
+		case lines <- trimmed:
+		default:
+			metrics.outputLinesDropped.Add(1)
 		}
 	}
 
+	close(lines)
+	<-done
+
 	if err := scanner.Err(); err != nil {
-		log.Printf("[Job %s] Scanner error (%s): %v", jobID, prefix, err)
+		slog.Warn("Failed to read downloader output", "job_id", jobID, "stream", strings.ToLower(prefix), "error", err)
 		jobManager.AppendLog(jobID, fmt.Sprintf("Scanner error: %v", err))
 	}
 }
@@ -212,19 +1134,128 @@ func executeDownload(jobID string, req DownloadRequest) {
 	})
 	jobManager.AppendLog(jobID, fmt.Sprintf("Starting download at %s", startTime.Format(time.RFC3339)))
 
+	targets, err := downloadTargets(jobID, req)
+	if err != nil {
+		finishJobWithError(jobID, err, startTime)
+		return
+	}
+	if len(targets) == 0 {
+		// A sync that found nothing new
+		duration := time.Since(startTime)
+		now := time.Now()
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.Status = "completed"
+			job.EndedAt = &now
+			job.Duration = duration.String()
+			job.Progress = job.Progress.complete()
+		})
+		jobManager.AppendLog(jobID, "Nothing new to download")
+		slog.Info("Sync found nothing new to download", "job_id", jobID)
+		return
+	}
+
+	workDir, cleanup, err := prepareWorkDir(jobID, req)
+	if err != nil {
+		finishJobWithError(jobID, err, startTime)
+		return
+	}
+	defer cleanup()
+
+	var obtained []string
+	synced := map[string]string{} // format by song ID
+	for _, target := range targets {
+		format, err := downloadWithFallback(jobID, target, workDir)
+
+		if jobCancelled(jobID) {
+			return
+		}
+		if err != nil {
+			finishJobWithError(jobID, err, startTime)
+			return
+		}
+		if !slices.Contains(obtained, format) {
+			obtained = append(obtained, format)
+		}
+		if id := songID(target.URL); req.Sync && id != "" {
+			synced[id] = format
+		}
+	}
+
+	downloadExtras(jobID, req, workDir)
+	if jobCancelled(jobID) {
+		return
+	}
+
+	postProcess(jobID, req)
+	recordTracks(jobID, obtained)
+	writeChapters(jobID, req)
+	if report := verifyJob(jobID, req); report != nil && report.Status == "fail" {
+		finishJobWithError(jobID, &DownloadError{Code: "verification_failed", Err: fmt.Errorf("verification failed: %s", report.summary("fail"))}, startTime)
+		return
+	}
+	if req.Sync {
+		syncManifest.record(jobID, req, synced)
+	}
+	runHooks(jobID, strings.Join(obtained, ","))
+	refreshLibraries(jobID)
+	if jobCancelled(jobID) {
+		return
+	}
+
+	duration := time.Since(startTime)
+	now := time.Now()
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		job.Status = "completed"
+		job.EndedAt = &now
+		job.Duration = duration.String()
+		job.FormatObtained = strings.Join(obtained, ",")
+		job.Progress = job.Progress.complete()
+	})
+	jobManager.AppendLog(jobID, "Download completed successfully!")
+	slog.Info("Job completed", "job_id", jobID, "status", "completed", "duration", duration.Seconds())
+}
+
+// downloadWithFallback downloads req in the first of its formats that is
+// available and returns that format. dir is the downloader's working
+// directory, or "" to inherit ours.
+func downloadWithFallback(jobID string, req DownloadRequest, dir string) (string, error) {
+	formats := req.Format
+	if len(formats) == 0 {
+		formats = FormatList{"alac"}
+	}
+	policy := cfg.Retry.merge(req.Retry)
+
+	for i, format := range formats {
+		args := buildArgs(jobID, req, format)
+		unavailable, err := runWithRetries(jobID, args, dir, req, policy)
+
+		// Fall back to the next format if this variant doesn't exist
+		if unavailable && i < len(formats)-1 && !jobCancelled(jobID) {
+			jobManager.AddEvent(jobID, JobEvent{
+				Type:    "format_fallback",
+				Message: fmt.Sprintf("%s is not available, falling back to %s", format, formats[i+1]),
+			})
+			jobManager.AppendLog(jobID, fmt.Sprintf("Format %s is not available, falling back to %s", format, formats[i+1]))
+			slog.Info("Format not available, falling back", "job_id", jobID, "format", format, "fallback", formats[i+1])
+			continue
+		}
+		return format, err
+	}
+	return "", nil
+}
+
+// buildArgs returns the apple-music-dl arguments for downloading req in format
+func buildArgs(jobID string, req DownloadRequest, format string) []string {
 	// Build command
 	args := []string{}
 
 	// Add format flags
-	switch req.Format {
-	case "atmos":
-		args = append(args, "--atmos")
-		jobManager.AppendLog(jobID, "Format: Dolby Atmos")
-	case "aac":
-		args = append(args, "--aac")
-		jobManager.AppendLog(jobID, "Format: AAC")
-	default:
-		jobManager.AppendLog(jobID, "Format: ALAC (default)")
+	flags, name := formatFlags(format)
+	args = append(args, flags...)
+	jobManager.AppendLog(jobID, fmt.Sprintf("Format: %s", name))
+	if quality := qualityFlags(req, format); quality != nil {
+		args = append(args, quality...)
+		jobManager.AppendLog(jobID, fmt.Sprintf("Quality: %s", strings.Join(quality, " ")))
 	}
 
 	// Add song flag
@@ -242,102 +1273,240 @@ func executeDownload(jobID string, req DownloadRequest) {
 	// Add URL
 	args = append(args, req.URL)
 
-	cmdStr := fmt.Sprintf("/usr/local/bin/apple-music-dl %v", args)
+	cmdStr := fmt.Sprintf("%s %v", cfg.DownloaderPath, args)
 	jobManager.AppendLog(jobID, fmt.Sprintf("Command: %s", cmdStr))
 
+	return args
+}
+
+// runWithRetries runs apple-music-dl until it succeeds or the retry policy
+// gives up. It reports whether the downloader said the requested format is
+// unavailable, which is never retried.
+func runWithRetries(jobID string, args []string, dir string, req DownloadRequest, policy RetryPolicy) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		jobManager.AddEvent(jobID, JobEvent{Type: "attempt_started", Attempt: attempt})
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.Retry = job.Retry.next(attempt, policy.MaxAttempts, nil)
+		})
+
+		code, unavailable, err := runAttempt(jobID, args, dir, time.Duration(req.Timeout)*time.Second, time.Duration(req.IdleTimeout)*time.Second)
+		attemptDuration := time.Since(attemptStart)
+
+		if err == nil {
+			jobManager.AddEvent(jobID, JobEvent{Type: "attempt_succeeded", Attempt: attempt, Duration: attemptDuration.String()})
+			return unavailable, nil
+		}
+
+		// The process was stopped by cancelJob, which records the event
+		if jobCancelled(jobID) {
+			return unavailable, err
+		}
+
+		if unavailable {
+			code = "format_unavailable"
+		}
+		jobManager.AddEvent(jobID, JobEvent{
+			Type:     "attempt_failed",
+			Attempt:  attempt,
+			Code:     code,
+			Message:  err.Error(),
+			Duration: attemptDuration.String(),
+		})
+
+		if unavailable || attempt >= policy.MaxAttempts || !policy.retryable(code) {
+			return unavailable, err
+		}
+
+		delay := policy.delay(attempt)
+		nextAttemptAt := time.Now().Add(delay)
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.Retry = job.Retry.next(attempt+1, policy.MaxAttempts, &nextAttemptAt)
+			job.Retry.LastCode, job.Retry.LastError = code, err.Error()
+		})
+		jobManager.AddEvent(jobID, JobEvent{
+			Type:    "retry_scheduled",
+			Attempt: attempt + 1,
+			Message: fmt.Sprintf("Retrying in %v", delay),
+		})
+		jobManager.AppendLog(jobID, fmt.Sprintf("Attempt %d failed (%s), retrying in %v", attempt, code, delay))
+		slog.Warn("Attempt failed, retrying", "job_id", jobID, "attempt", attempt, "code", code, "delay", delay.Seconds())
+		time.Sleep(delay)
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.Retry.NextAttemptAt = nil
+		})
+
+		if jobCancelled(jobID) {
+			return false, err
+		}
+	}
+}
+
+// runAttempt runs apple-music-dl once and returns an error code describing
+// why it failed, e.g. "timeout", "exit_1", "transient" when the output
+// reported a token or network error or "stalled" when there was no output
+// for idleTimeout, and whether the output reported that the requested
+// format is unavailable. A failed attempt's error is a *DownloadError.
+func runAttempt(jobID string, args []string, dir string, timeout, idleTimeout time.Duration) (string, bool, error) {
+	attemptStart := time.Now()
+
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	// Execute command with context
-	cmd := exec.CommandContext(ctx, "/usr/local/bin/apple-music-dl", args...)
+	cmd := exec.CommandContext(ctx, cfg.DownloaderPath, args...)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcess(cmd) }
+	var traceEnv []string
+	if job, exists := jobManager.Snapshot(jobID); exists {
+		traceEnv = job.Trace.env()
+	}
+	cmd.Env = downloaderEnv(traceEnv...)
 
 	// Capture stdout and stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		finishJobWithError(jobID, fmt.Errorf("failed to create stdout pipe: %w", err), startTime)
-		return
+		return "start_failed", false, &DownloadError{Code: "start_failed", Err: fmt.Errorf("failed to create stdout pipe: %w", err)}
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		finishJobWithError(jobID, fmt.Errorf("failed to create stderr pipe: %w", err), startTime)
-		return
+		return "start_failed", false, &DownloadError{Code: "start_failed", Err: fmt.Errorf("failed to create stderr pipe: %w", err)}
 	}
 
 	// Start command
 	if err := cmd.Start(); err != nil {
-		finishJobWithError(jobID, fmt.Errorf("failed to start command: %w", err), startTime)
-		return
+		return "start_failed", false, &DownloadError{Code: "start_failed", Err: fmt.Errorf("failed to start command: %w", err)}
 	}
 
 	jobManager.AppendLog(jobID, fmt.Sprintf("Process started (PID: %d)", cmd.Process.Pid))
 
+	var stdoutReader, stderrReader io.Reader = stdout, stderr
+	if cfg.RecordOutputDir != "" {
+		recorder, err := newOutputRecorder(jobID, args)
+		if err != nil {
+			slog.Error("Failed to record output", "job_id", jobID, "error", err)
+		} else {
+			stdoutReader = io.TeeReader(stdout, recorder.stream("stdout"))
+			stderrReader = io.TeeReader(stderr, recorder.stream("stderr"))
+			defer func() { recorder.close(cmd.ProcessState.ExitCode()) }()
+		}
+	}
+
+	if err := attachProcess(cmd); err != nil {
+		slog.Error("Failed to track child processes", "job_id", jobID, "error", err)
+	}
+	defer releaseProcess(cmd)
+
+	proc := jobManager.trackProcess(jobID, cmd)
+	defer jobManager.untrackProcess(jobID, proc)
+	// The job may have been cancelled while the process was starting
+	if jobCancelled(jobID) {
+		jobManager.stopProcess(jobID)
+	}
+
+	// A downloader that hangs without printing anything is stopped long
+	// before the overall timeout
+	var stalled atomic.Bool
+	var idle *time.Timer
+	if idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() {
+			stalled.Store(true)
+			cancel()
+		})
+		defer idle.Stop()
+	}
+
+	var unavailable, transient atomic.Bool
+	var failure failureOutput
+	onLine := func(line string) {
+		if idle != nil {
+			idle.Reset(idleTimeout)
+		}
+		patterns := currentPatterns()
+		if patterns.FormatUnavailable.MatchString(line) {
+			unavailable.Store(true)
+		}
+		if patterns.Transient.MatchString(line) {
+			transient.Store(true)
+		}
+		failure.line(patterns, line)
+	}
+
 	// Read output in goroutines
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		readOutput(stdout, jobID, "STDOUT")
+		readOutput(stdoutReader, jobID, "STDOUT", onLine)
 	}()
 
 	go func() {
 		defer wg.Done()
-		readOutput(stderr, jobID, "STDERR")
+		readOutput(stderrReader, jobID, "STDERR", func(line string) {
+			onLine(line)
+			failure.stderrLine(line)
+		})
 	}()
 
-	// Monitor progress
-	done := make(chan error, 1)
-	go func() {
-		wg.Wait()
-		done <- cmd.Wait()
-	}()
+	wg.Wait()
+	err = cmd.Wait()
 
-	// Wait for completion or timeout
-	select {
-	case err := <-done:
-		duration := time.Since(startTime)
-		now := time.Now()
+	if stalled.Load() && err != nil {
+		return "stalled", unavailable.Load(), failure.error("stalled", fmt.Errorf("Download stalled: no output for %v", idleTimeout))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "timeout", unavailable.Load(), failure.error("timeout", fmt.Errorf("Download timed out after %v", time.Since(attemptStart)))
+	}
+	if err != nil && unavailable.Load() {
+		return "format_unavailable", true, failure.error("format_unavailable", err)
+	}
 
-		if ctx.Err() == context.DeadlineExceeded {
-			jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
-				job.Status = "failed"
-				job.Error = fmt.Sprintf("Download timed out after %v", duration)
-				job.EndedAt = &now
-				job.Duration = duration.String()
-			})
-			log.Printf("[Job %s] Timed out after %v", jobID, duration)
-		} else if err != nil {
-			jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
-				job.Status = "failed"
-				job.Error = err.Error()
-				job.EndedAt = &now
-				job.Duration = duration.String()
-			})
-			log.Printf("[Job %s] Failed after %v: %v", jobID, duration, err)
-		} else {
-			jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
-				job.Status = "completed"
-				job.EndedAt = &now
-				job.Duration = duration.String()
-			})
-			jobManager.AppendLog(jobID, "Download completed successfully!")
-			log.Printf("[Job %s] Completed successfully in %v", jobID, duration)
+	fallback := "downloader_failed"
+	if transient.Load() {
+		fallback = "network"
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if transient.Load() {
+			return "transient", unavailable.Load(), failure.classified(fallback, err)
 		}
+		return fmt.Sprintf("exit_%d", exitErr.ExitCode()), unavailable.Load(), failure.classified(fallback, err)
+	}
+	if err != nil {
+		return "unknown", unavailable.Load(), failure.classified(fallback, err)
 	}
+	return "", unavailable.Load(), nil
+}
+
+// jobCancelled reports whether the job was cancelled, or interrupted by a
+// shutdown, while it ran
+func jobCancelled(jobID string) bool {
+	job, exists := jobManager.Snapshot(jobID)
+	return !exists || job.Status == "cancelled" || job.Status == "interrupted"
 }
 
 func finishJobWithError(jobID string, err error, startTime time.Time) {
 	now := time.Now()
 	duration := time.Since(startTime)
+	code := "internal"
+	var stderrTail []string
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		code, stderrTail = downloadErr.Code, downloadErr.StderrTail
+	}
 	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
 		job.Status = "failed"
 		job.Error = err.Error()
+		job.ErrorCode = code
+		job.StderrTail = stderrTail
 		job.EndedAt = &now
 		job.Duration = duration.String()
 	})
-	log.Printf("[Job %s] Failed: %v", jobID, err)
+	slog.Warn("Job failed", "job_id", jobID, "status", "failed", "code", code, "duration", duration.Seconds(), "error", err)
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -352,29 +1521,108 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, exists := jobManager.GetJob(jobID)
+	view, err := parseJobView(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, exists := jobManager.Snapshot(jobID)
 	if !exists {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
+	body, err := view.project(&job)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode job: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(job)
+	json.NewEncoder(w).Encode(body)
+}
+
+// handleJob routes requests for a single job under /jobs/{id}/
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	jobID, rest, _ := strings.Cut(r.URL.Path[len("/jobs/"):], "/")
+	if jobID == "" {
+		http.Error(w, "Job ID is required", http.StatusBadRequest)
+		return
+	}
+	if jobID == "archive" && rest == "" {
+		handleArchiveJobs(w, r)
+		return
+	}
+	if jobID == "changes" && rest == "" {
+		handleJobChanges(w, r)
+		return
+	}
+
+	switch resource, name, _ := strings.Cut(rest, "/"); resource {
+	case "files":
+		handleJobFiles(w, r, jobID, name)
+	case "retry":
+		handleRetryJob(w, r, jobID)
+	case "archive", "unarchive":
+		handleArchiveJob(w, r, jobID, resource == "archive")
+	case "priority":
+		handleJobPriority(w, r, jobID)
+	default:
+		http.NotFound(w, r)
+	}
 }
 
 func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		handlePurgeJobs(w, r)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	jobs := jobManager.GetAllJobs()
+	q, err := parseJobListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, version := jobListCache.get(q)
+	etag := fmt.Sprintf(`"jobs-%d-%08x"`, version, crc32.ChecksumIEEE([]byte(q.key())))
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"jobs":  jobs,
-		"count": len(jobs),
-	})
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// writeJobList streams {"count": n, "total": n, "jobs": [...]} one job at a
+// time, so large histories aren't marshaled into a single buffer first. total
+// counts the jobs matching the filters across all pages, and view
+// selects the fields of each job.
+func writeJobList(w io.Writer, jobs []DownloadStatus, total int, view jobView) error {
+	bw := bufio.NewWriterSize(w, 32*1024)
+	enc := json.NewEncoder(bw)
+
+	fmt.Fprintf(bw, `{"count":%d,"total":%d,"jobs":[`, len(jobs), total)
+	for i := range jobs {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		job, err := view.project(&jobs[i])
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(job); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
 }
 
 func handleCancel(w http.ResponseWriter, r *http.Request) {
@@ -389,35 +1637,136 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, exists := jobManager.GetJob(jobID)
-	if !exists {
-		http.Error(w, "Job not found", http.StatusNotFound)
+	// The reason is optional, in the body or the query string
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if body.Reason == "" {
+		body.Reason = r.URL.Query().Get("reason")
+	}
 
-	if job.Status != "running" {
+	switch err := cancelJob(jobID, body.Reason); {
+	case errors.Is(err, errJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errJobNotRunning):
 		http.Error(w, "Job is not running", http.StatusBadRequest)
 		return
 	}
+	auditLog.recordRequest(r, AuditEntry{Action: "job.cancelled", JobID: jobID, Detail: reasonDetail(body.Reason)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "cancelled",
+	})
+}
+
+var (
+	errJobNotFound   = errors.New("job not found")
+	errJobNotRunning = errors.New("job is not running")
+)
+
+// cancelJob cancels a queued or running job, recording reason if given. The
+// downloader of a running job is asked to exit with SIGTERM and killed if
+// it's still running after CANCEL_GRACE_PERIOD.
+func cancelJob(jobID, reason string) error {
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		return errJobNotFound
+	}
+
+	switch {
+	case job.Status == "queued" && scheduler.Remove(jobID):
+	case job.Status == "running":
+	default:
+		return errJobNotRunning
+	}
+
+	message := "Cancelled by user"
+	if reason = strings.TrimSpace(reason); reason != "" {
+		message += ": " + reason
+	}
 
-	// Note: This is a simplified cancel - in production you'd want to track
-	// the actual process and kill it
 	now := time.Now()
+	cancelled := false
 	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		// The job may have finished in the meantime
+		if job.EndedAt != nil {
+			return
+		}
+		cancelled = true
 		job.Status = "cancelled"
-		job.Error = "Cancelled by user"
+		job.Error = message
 		job.EndedAt = &now
 	})
+	if !cancelled {
+		return errJobNotRunning
+	}
+	jobManager.AddEvent(jobID, JobEvent{Type: "cancelled", Message: reason})
+	jobManager.AppendLog(jobID, message)
+	slog.Info("Job cancelled", "job_id", jobID, "status", "cancelled", "reason", message)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "cancelled",
-	})
+	jobManager.stopProcess(jobID)
+	return nil
+}
+
+// jobProcess is the downloader process of a running job
+type jobProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{} // closed once the process has been waited for
+}
+
+func (jm *JobManager) trackProcess(jobID string, cmd *exec.Cmd) *jobProcess {
+	proc := &jobProcess{cmd: cmd, done: make(chan struct{})}
+	jm.procMu.Lock()
+	defer jm.procMu.Unlock()
+	jm.procs[jobID] = proc
+	return proc
+}
+
+// untrackProcess is called once proc has exited
+func (jm *JobManager) untrackProcess(jobID string, proc *jobProcess) {
+	jm.procMu.Lock()
+	defer jm.procMu.Unlock()
+	if jm.procs[jobID] == proc {
+		delete(jm.procs, jobID)
+	}
+	close(proc.done)
+}
+
+// stopProcess sends SIGTERM to the downloader of a job and SIGKILL once the
+// grace period has passed
+func (jm *JobManager) stopProcess(jobID string) {
+	jm.procMu.Lock()
+	proc, exists := jm.procs[jobID]
+	jm.procMu.Unlock()
+	if !exists {
+		return
+	}
+
+	if err := terminateProcess(proc.cmd); err != nil {
+		slog.Error("Failed to terminate process", "job_id", jobID, "error", err)
+	}
+	go func() {
+		select {
+		case <-proc.done:
+		case <-time.After(cfg.CancelGracePeriod):
+			jm.AppendLog(jobID, fmt.Sprintf("Process did not exit within %v, killing it", cfg.CancelGracePeriod))
+			if err := killProcess(proc.cmd); err != nil {
+				slog.Error("Failed to kill process", "job_id", jobID, "error", err)
+			}
+		}
+	}()
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"status": "healthy",
+		"status":           "healthy",
+		"patterns_version": currentPatterns().Version,
 	})
 }
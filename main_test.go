@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Size of the job history the /jobs benchmarks run against
+const benchmarkJobs = 20000
+
+// benchmarkJobManager fills the job manager with finished jobs shaped like
+// real album downloads
+func benchmarkJobManager(b *testing.B) {
+	b.Helper()
+	cfg = &Config{}
+	jobManager = NewJobManager()
+	jobListCache = &JobListCache{}
+
+	start := time.Now().Add(-benchmarkJobs * time.Minute)
+	for i := range benchmarkJobs {
+		started := start.Add(time.Duration(i) * time.Minute)
+		ended := started.Add(3 * time.Minute)
+		job := &DownloadStatus{
+			ID:             fmt.Sprintf("job-%05d", i),
+			URL:            fmt.Sprintf("https://music.apple.com/us/album/album-%d/%d", i, 1000000000+i),
+			Status:         "completed",
+			StartedAt:      started,
+			EndedAt:        &ended,
+			Duration:       "3m0s",
+			Priority:       "normal",
+			Owner:          "anonymous",
+			ContentType:    "album",
+			FormatObtained: "alac",
+			Logs:           []string{"Track 1 of 12: Song (ALAC)", "Download completed"},
+			Events: []JobEvent{
+				{Time: started, Type: "queued"},
+				{Time: started, Type: "started", Attempt: 1},
+				{Time: ended, Type: "completed", Duration: "3m0s"},
+			},
+		}
+		for n := range 12 {
+			job.Tracks = append(job.Tracks, Track{
+				Number:   n + 1,
+				Title:    fmt.Sprintf("Song %d", n+1),
+				Duration: 214.5,
+				Format:   "alac",
+				Path:     fmt.Sprintf("ALAC/Artist/Album %d/%02d Song %d.m4a", i, n+1, n+1),
+			})
+		}
+		jobManager.jobs[job.ID] = job
+	}
+	jobManager.version.Add(1)
+}
+
+func BenchmarkSnapshotAll(b *testing.B) {
+	benchmarkJobManager(b)
+	b.ResetTimer()
+	for range b.N {
+		jobManager.SnapshotAllVersion()
+	}
+}
+
+func BenchmarkWriteJobList(b *testing.B) {
+	benchmarkJobManager(b)
+	jobs := jobManager.SnapshotAll()
+	for _, query := range []string{"", "compact=true", "fields=id,status,url"} {
+		values, _ := url.ParseQuery(query)
+		view, err := parseJobView(values)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("view=%q", query), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				if err := writeJobList(io.Discard, jobs, len(jobs), view); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkListJobs(b *testing.B) {
+	benchmarkJobManager(b)
+	for _, bench := range []struct {
+		name    string
+		changed bool // a job changed since the previous request
+	}{
+		{"cached", false},
+		{"changed", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				if bench.changed {
+					jobManager.version.Add(1)
+				}
+				w := httptest.NewRecorder()
+				handleListJobs(w, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// Metrics are process-wide counters exposed in the Prometheus text format
+type Metrics struct {
+	// Downloader output lines read, dropped because the job store fell
+	// behind, and progress updates replaced by newer ones before being stored
+	outputLines        atomic.Int64
+	outputLinesDropped atomic.Int64
+	progressCoalesced  atomic.Int64
+
+	// Webhook deliveries that ran out of attempts
+	webhooksDead atomic.Int64
+
+	// Events NATS JetStream didn't acknowledge
+	natsPublishFailures atomic.Int64
+
+	// Events produced to Kafka, and events given up on
+	kafkaDelivered atomic.Int64
+	kafkaFailures  atomic.Int64
+}
+
+var metrics = &Metrics{}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int{}
+	for _, job := range jobManager.SnapshotAll() {
+		counts[job.Status]++
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP amdl_jobs Jobs by status.")
+	fmt.Fprintln(w, "# TYPE amdl_jobs gauge")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "amdl_jobs{status=%q} %d\n", status, counts[status])
+	}
+
+	fmt.Fprintln(w, "# HELP amdl_output_lines_total Downloader output lines read.")
+	fmt.Fprintln(w, "# TYPE amdl_output_lines_total counter")
+	fmt.Fprintf(w, "amdl_output_lines_total %d\n", metrics.outputLines.Load())
+
+	fmt.Fprintln(w, "# HELP amdl_output_lines_dropped_total Downloader output lines dropped because the job log fell behind.")
+	fmt.Fprintln(w, "# TYPE amdl_output_lines_dropped_total counter")
+	fmt.Fprintf(w, "amdl_output_lines_dropped_total %d\n", metrics.outputLinesDropped.Load())
+
+	fmt.Fprintln(w, "# HELP amdl_progress_updates_coalesced_total Progress updates replaced by a newer one before being stored.")
+	fmt.Fprintln(w, "# TYPE amdl_progress_updates_coalesced_total counter")
+	fmt.Fprintf(w, "amdl_progress_updates_coalesced_total %d\n", metrics.progressCoalesced.Load())
+
+	fmt.Fprintln(w, "# HELP amdl_webhook_deliveries Webhook deliveries by status.")
+	fmt.Fprintln(w, "# TYPE amdl_webhook_deliveries gauge")
+	for _, status := range []string{"pending", "delivered", "dead"} {
+		fmt.Fprintf(w, "amdl_webhook_deliveries{status=%q} %d\n", status, len(deliveryQueue.List(status)))
+	}
+
+	fmt.Fprintln(w, "# HELP amdl_webhook_dead_letters_total Webhook deliveries dead-lettered after running out of attempts.")
+	fmt.Fprintln(w, "# TYPE amdl_webhook_dead_letters_total counter")
+	fmt.Fprintf(w, "amdl_webhook_dead_letters_total %d\n", metrics.webhooksDead.Load())
+
+	fmt.Fprintln(w, "# HELP amdl_nats_publish_failures_total Events that failed to publish to NATS JetStream.")
+	fmt.Fprintln(w, "# TYPE amdl_nats_publish_failures_total counter")
+	fmt.Fprintf(w, "amdl_nats_publish_failures_total %d\n", metrics.natsPublishFailures.Load())
+
+	fmt.Fprintln(w, "# HELP amdl_kafka_messages_total Events produced to Kafka.")
+	fmt.Fprintln(w, "# TYPE amdl_kafka_messages_total counter")
+	fmt.Fprintf(w, "amdl_kafka_messages_total %d\n", metrics.kafkaDelivered.Load())
+
+	fmt.Fprintln(w, "# HELP amdl_kafka_delivery_failures_total Events that couldn't be produced to Kafka.")
+	fmt.Fprintln(w, "# TYPE amdl_kafka_delivery_failures_total counter")
+	fmt.Fprintf(w, "amdl_kafka_delivery_failures_total %d\n", metrics.kafkaFailures.Load())
+
+	if budget := scheduler.budget; budget != nil {
+		fmt.Fprintln(w, "# HELP amdl_staging_bytes Disk space taken by the output of running jobs.")
+		fmt.Fprintln(w, "# TYPE amdl_staging_bytes gauge")
+		fmt.Fprintf(w, "amdl_staging_bytes %d\n", budget.used.Load())
+
+		fmt.Fprintln(w, "# HELP amdl_staging_budget_bytes Staging usage above which queued jobs are deferred.")
+		fmt.Fprintln(w, "# TYPE amdl_staging_budget_bytes gauge")
+		fmt.Fprintf(w, "amdl_staging_budget_bytes %d\n", budget.limit)
+	}
+}
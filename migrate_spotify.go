@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type SpotifyMigrationRequest struct {
+	PlaylistURL  string     `json:"playlist_url"`
+	ClientID     string     `json:"client_id,omitempty"`
+	ClientSecret string     `json:"client_secret,omitempty"`
+	Format       FormatList `json:"format,omitempty"`
+	Storefront   string     `json:"storefront,omitempty"`
+	DryRun       bool       `json:"dry_run,omitempty"`
+
+	Digest *DigestConfig `json:"digest,omitempty"`
+
+	Owner  string       `json:"-"`
+	APIKey string       `json:"-"`
+	Trace  TraceContext `json:"-"`
+}
+
+type spotifyTrack struct {
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+	Album  string `json:"album"`
+	ISRC   string `json:"isrc,omitempty"`
+}
+
+// MigrationEntry is one playlist track and how it was resolved
+type MigrationEntry struct {
+	spotifyTrack
+	Result        string   `json:"result"` // matched, ambiguous or unmatched
+	URL           string   `json:"url,omitempty"`
+	Candidates    []string `json:"candidates,omitempty"`
+	JobID         string   `json:"job_id,omitempty"`
+	ExistingJobID string   `json:"existing_job_id,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type MigrationReport struct {
+	ID          string           `json:"id"`
+	PlaylistURL string           `json:"playlist_url"`
+	DryRun      bool             `json:"dry_run"`
+	Status      string           `json:"status"`
+	Error       string           `json:"error,omitempty"`
+	BatchID     string           `json:"batch_id,omitempty"`
+	Total       int              `json:"total"`
+	Counts      map[string]int   `json:"counts"`
+	Entries     []MigrationEntry `json:"entries"`
+	StartedAt   time.Time        `json:"started_at"`
+	FinishedAt  *time.Time       `json:"finished_at,omitempty"`
+}
+
+var (
+	migrationsMu sync.RWMutex
+	migrations   = map[string]*MigrationReport{}
+)
+
+func updateMigration(id string, updater func(*MigrationReport)) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if report, exists := migrations[id]; exists {
+		updater(report)
+	}
+}
+
+// spotifyPlaylistID extracts the playlist ID from an open.spotify.com URL or
+// a spotify:playlist:<id> URI
+func spotifyPlaylistID(playlistURL string) (string, error) {
+	if id, ok := strings.CutPrefix(playlistURL, "spotify:playlist:"); ok {
+		return id, nil
+	}
+	u, err := url.Parse(playlistURL)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "playlist" {
+			return parts[i+1], nil
+		}
+	}
+	return "", errors.New("not a Spotify playlist URL")
+}
+
+func handleMigrateSpotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SpotifyMigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	playlistID, err := spotifyPlaylistID(req.PlaylistURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid playlist_url: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.ClientID == "" {
+		req.ClientID, req.ClientSecret = cfg.SpotifyClientID, cfg.SpotifyClientSecret
+	}
+	if req.ClientID == "" || req.ClientSecret == "" {
+		http.Error(w, "Spotify client_id and client_secret are required", http.StatusBadRequest)
+		return
+	}
+	if req.Storefront == "" {
+		req.Storefront = cfg.Storefront
+	}
+	req.Owner = requestOwner(r, "migrate:spotify")
+	req.APIKey = apiKeyName(r)
+	req.Trace = traceFromRequest(r)
+
+	report := &MigrationReport{
+		ID:          uuid.New().String(),
+		PlaylistURL: req.PlaylistURL,
+		DryRun:      req.DryRun,
+		Status:      "running",
+		Counts:      map[string]int{},
+		Entries:     []MigrationEntry{},
+		StartedAt:   time.Now(),
+	}
+	migrationsMu.Lock()
+	migrations[report.ID] = report
+	migrationsMu.Unlock()
+
+	go runSpotifyMigration(report.ID, playlistID, req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"migration_id": report.ID,
+		"status":       "started",
+	})
+}
+
+// handleMigrationReport serves GET /migrate/spotify/{id}, or the report as CSV
+// with ?format=csv
+func handleMigrationReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	migrationID := r.URL.Path[len("/migrate/spotify/"):]
+	if migrationID == "" {
+		http.Error(w, "Migration ID is required", http.StatusBadRequest)
+		return
+	}
+
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	report, exists := migrations[migrationID]
+	if !exists {
+		http.Error(w, "Migration not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"migration-%s.csv\"", report.ID))
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"result", "artist", "title", "album", "isrc", "apple_music_url", "job_id", "candidates", "error"})
+	for _, entry := range report.Entries {
+		jobID := entry.JobID
+		if jobID == "" {
+			jobID = entry.ExistingJobID
+		}
+		writer.Write([]string{
+			entry.Result, entry.Artist, entry.Title, entry.Album, entry.ISRC,
+			entry.URL, jobID, strings.Join(entry.Candidates, " "), entry.Error,
+		})
+	}
+	writer.Flush()
+}
+
+func runSpotifyMigration(migrationID, playlistID string, req SpotifyMigrationRequest) {
+	tracks, err := fetchSpotifyPlaylist(playlistID, req.ClientID, req.ClientSecret)
+	if err != nil {
+		now := time.Now()
+		updateMigration(migrationID, func(report *MigrationReport) {
+			report.Status = "failed"
+			report.Error = err.Error()
+			report.FinishedAt = &now
+		})
+		slog.Error("Failed to read Spotify playlist", "migration_id", migrationID, "error", err)
+		return
+	}
+
+	var batchID string
+	if !req.DryRun {
+		batchID = batchManager.CreateBatch("migrate:spotify", req.Digest, req.Trace).ID
+	}
+	updateMigration(migrationID, func(report *MigrationReport) {
+		report.Total = len(tracks)
+		report.BatchID = batchID
+	})
+	slog.Info("Resolving tracks", "migration_id", migrationID, "tracks", len(tracks))
+
+	for _, track := range tracks {
+		entry := resolveSpotifyTrack(track, req.Storefront)
+
+		if entry.Result == "matched" {
+			if existing, exists := jobManager.FindByURL(entry.URL); exists {
+				entry.ExistingJobID = existing.ID
+			} else if !req.DryRun {
+				single := DownloadRequest{
+					URL:     entry.URL,
+					Format:  req.Format,
+					Song:    true,
+					BatchID: batchID,
+					Owner:   req.Owner,
+					APIKey:  req.APIKey,
+					Trace:   req.Trace,
+				}
+				if err := prepareRequest(&single); err != nil {
+					entry.Error = err.Error()
+				} else {
+					entry.JobID = startDownload(single).ID
+				}
+			}
+		}
+
+		updateMigration(migrationID, func(report *MigrationReport) {
+			report.Entries = append(report.Entries, entry)
+			report.Counts[entry.Result]++
+		})
+	}
+
+	if batchID != "" {
+		batchManager.Seal(batchID)
+	}
+
+	now := time.Now()
+	updateMigration(migrationID, func(report *MigrationReport) {
+		report.Status = "completed"
+		report.FinishedAt = &now
+	})
+	slog.Info("Migration finished", "migration_id", migrationID)
+}
+
+// resolveSpotifyTrack matches a track by artist and title, using the album
+// name to break ties between multiple matching releases
+func resolveSpotifyTrack(track spotifyTrack, storefront string) MigrationEntry {
+	entry := MigrationEntry{spotifyTrack: track}
+
+	matches, _, err := matchSong(track.Artist, track.Title, storefront)
+	if err != nil {
+		entry.Result = "unmatched"
+		entry.Error = err.Error()
+		return entry
+	}
+
+	if len(matches) > 1 {
+		var sameAlbum []itunesSong
+		for _, song := range matches {
+			if normalizeTitle(song.CollectionName) == normalizeTitle(track.Album) {
+				sameAlbum = append(sameAlbum, song)
+			}
+		}
+		if len(sameAlbum) > 0 {
+			matches = sameAlbum[:1]
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		entry.Result = "unmatched"
+	case 1:
+		entry.Result = "matched"
+		entry.URL = matches[0].AppleMusicURL()
+	default:
+		entry.Result = "ambiguous"
+		for _, song := range matches {
+			entry.Candidates = append(entry.Candidates, song.AppleMusicURL())
+		}
+	}
+	return entry
+}
+
+func spotifyToken(clientID, clientSecret string) (string, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, "https://accounts.spotify.com/api/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(clientID, clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode Spotify token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("spotify authentication failed: %s", result.ErrorDescription)
+	}
+	return result.AccessToken, nil
+}
+
+func fetchSpotifyPlaylist(playlistID, clientID, clientSecret string) ([]spotifyTrack, error) {
+	token, err := spotifyToken(clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := "items(track(name,artists(name),album(name),external_ids(isrc))),next"
+	next := fmt.Sprintf("https://api.spotify.com/v1/playlists/%s/tracks?limit=100&fields=%s", url.PathEscape(playlistID), url.QueryEscape(fields))
+
+	var tracks []spotifyTrack
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Next  string `json:"next"`
+			Items []struct {
+				Track *struct {
+					Name    string `json:"name"`
+					Artists []struct {
+						Name string `json:"name"`
+					} `json:"artists"`
+					Album struct {
+						Name string `json:"name"`
+					} `json:"album"`
+					ExternalIDs struct {
+						ISRC string `json:"isrc"`
+					} `json:"external_ids"`
+				} `json:"track"`
+			} `json:"items"`
+		}
+		status := resp.StatusCode
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("spotify returned %d for playlist %s", status, playlistID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode Spotify playlist: %w", err)
+		}
+
+		for _, item := range page.Items {
+			// Local files and removed tracks come back without track data
+			if item.Track == nil || len(item.Track.Artists) == 0 {
+				continue
+			}
+			tracks = append(tracks, spotifyTrack{
+				Artist: item.Track.Artists[0].Name,
+				Title:  item.Track.Name,
+				Album:  item.Track.Album.Name,
+				ISRC:   item.Track.ExternalIDs.ISRC,
+			})
+		}
+		next = page.Next
+	}
+	return tracks, nil
+}
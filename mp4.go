@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Just enough of the MP4 box structure to read and rewrite the gapless info
+// of downloaded tracks: the audio track's sample entry, edit list and
+// length, and the iTunes items of moov/udta/meta/ilst.
+
+// mp4Box is a box read from a byte slice; body aliases the slice
+type mp4Box struct {
+	typ  string
+	body []byte
+}
+
+// mp4Children splits a box's payload into the boxes it contains
+func mp4Children(payload []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(payload) > 0 {
+		if len(payload) < 8 {
+			return nil, errors.New("truncated box header")
+		}
+		size, header := uint64(binary.BigEndian.Uint32(payload)), 8
+		switch size {
+		case 0:
+			size = uint64(len(payload))
+		case 1:
+			if len(payload) < 16 {
+				return nil, errors.New("truncated box header")
+			}
+			size, header = binary.BigEndian.Uint64(payload[8:]), 16
+		}
+		if size < uint64(header) || size > uint64(len(payload)) {
+			return nil, fmt.Errorf("invalid size of %q box", payload[4:8])
+		}
+		boxes = append(boxes, mp4Box{typ: string(payload[4:8]), body: payload[header:size]})
+		payload = payload[size:]
+	}
+	return boxes, nil
+}
+
+// mp4Child returns the body of the first child of payload at path, or nil
+func mp4Child(payload []byte, path ...string) []byte {
+	for _, typ := range path {
+		boxes, err := mp4Children(payload)
+		if err != nil {
+			return nil
+		}
+		payload = nil
+		for _, box := range boxes {
+			if box.typ == typ {
+				payload = box.body
+				if typ == "meta" {
+					payload = payload[metaPrefix(payload):]
+				}
+				break
+			}
+		}
+		if payload == nil {
+			return nil
+		}
+	}
+	return payload
+}
+
+// metaPrefix is the length of the version and flags of a meta box, which
+// QuickTime files leave out
+func metaPrefix(body []byte) int {
+	if len(body) >= 8 && string(body[4:8]) == "hdlr" {
+		return 0
+	}
+	return min(4, len(body))
+}
+
+func mp4Encode(typ string, body ...[]byte) []byte {
+	payload := bytes.Join(body, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(box, typ...), payload...)
+}
+
+// withMP4Child returns payload with the body of its first typ child
+// replaced by update's result, appending the child when there's none, in
+// which case update gets nil
+func withMP4Child(payload []byte, typ string, update func([]byte) ([]byte, error)) ([]byte, error) {
+	boxes, err := mp4Children(payload)
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	found := false
+	for _, box := range boxes {
+		if box.typ == typ && !found {
+			body, err := update(box.body)
+			if err != nil {
+				return nil, err
+			}
+			out, found = append(out, mp4Encode(typ, body)), true
+			continue
+		}
+		out = append(out, mp4Encode(box.typ, box.body))
+	}
+	if !found {
+		body, err := update(nil)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, mp4Encode(typ, body))
+	}
+	return bytes.Join(out, nil), nil
+}
+
+// mp4Span is where a top-level box lies in a file
+type mp4Span struct {
+	typ         string
+	offset, end int64
+	header      int64
+}
+
+func mp4TopLevel(f *os.File) ([]mp4Span, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var spans []mp4Span
+	header := make([]byte, 16)
+	for offset := int64(0); offset < info.Size(); {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return nil, fmt.Errorf("truncated box header at %d", offset)
+		}
+		span := mp4Span{typ: string(header[4:8]), offset: offset, header: 8}
+		switch size := int64(binary.BigEndian.Uint32(header)); size {
+		case 0:
+			span.end = info.Size()
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, fmt.Errorf("truncated box header at %d", offset)
+			}
+			span.end, span.header = offset+int64(binary.BigEndian.Uint64(header[8:])), 16
+		default:
+			span.end = offset + size
+		}
+		if span.end < offset+span.header || span.end > info.Size() {
+			return nil, fmt.Errorf("invalid size of %q box at %d", span.typ, offset)
+		}
+		spans = append(spans, span)
+		offset = span.end
+	}
+	return spans, nil
+}
+
+// mp4File is the moov box of an MP4 file, read into memory
+type mp4File struct {
+	moov       []byte // body
+	span       mp4Span
+	fragmented bool
+}
+
+func readMP4(path string) (*mp4File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	spans, err := mp4TopLevel(f)
+	if err != nil {
+		return nil, err
+	}
+	file := &mp4File{}
+	for _, span := range spans {
+		switch span.typ {
+		case "moov":
+			file.span = span
+		case "moof":
+			file.fragmented = true
+		}
+	}
+	if file.span.typ == "" {
+		return nil, errors.New("no moov box")
+	}
+	file.moov = make([]byte, file.span.end-file.span.offset-file.span.header)
+	if _, err := f.ReadAt(file.moov, file.span.offset+file.span.header); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// audioTrack returns the body of the first sound track's trak box
+func (m *mp4File) audioTrack() []byte {
+	boxes, _ := mp4Children(m.moov)
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+		// Version and flags, pre_defined, then the handler type
+		if hdlr := mp4Child(box.body, "mdia", "hdlr"); len(hdlr) >= 12 && string(hdlr[8:12]) == "soun" {
+			return box.body
+		}
+	}
+	return nil
+}
+
+// iTunesItem returns the value of the freeform com.apple.iTunes item name,
+// or ""
+func (m *mp4File) iTunesItem(name string) string {
+	boxes, _ := mp4Children(mp4Child(m.moov, "udta", "meta", "ilst"))
+	for _, box := range boxes {
+		if box.typ != "----" {
+			continue
+		}
+		// mean and name have a version and flags, data a type and locale
+		item := mp4Child(box.body, "name")
+		data := mp4Child(box.body, "data")
+		if len(item) >= 4 && string(item[4:]) == name && len(data) >= 8 {
+			return string(data[8:])
+		}
+	}
+	return ""
+}
+
+// ilstItem is an item of moov/udta/meta/ilst: a standard one such as
+// "\xa9mvn" with its data type (1 for UTF-8 text, 21 for a big-endian
+// integer), or a freeform com.apple.iTunes item when typ is "----"
+type ilstItem struct {
+	typ      string
+	name     string // of a freeform item
+	dataType byte
+	value    []byte
+}
+
+func textItem(typ, value string) ilstItem {
+	return ilstItem{typ: typ, dataType: 1, value: []byte(value)}
+}
+
+// integerItem encodes value in size bytes
+func integerItem(typ string, value, size int) ilstItem {
+	data := binary.BigEndian.AppendUint32(nil, uint32(value))
+	return ilstItem{typ: typ, dataType: 21, value: data[4-size:]}
+}
+
+func (item ilstItem) encode() []byte {
+	data := mp4Encode("data", []byte{0, 0, 0, item.dataType, 0, 0, 0, 0}, item.value)
+	if item.typ != "----" {
+		return mp4Encode(item.typ, data)
+	}
+	return mp4Encode("----",
+		mp4Encode("mean", make([]byte, 4), []byte("com.apple.iTunes")),
+		mp4Encode("name", make([]byte, 4), []byte(item.name)),
+		data,
+	)
+}
+
+// matches reports whether box is an earlier value of the item
+func (item ilstItem) matches(box mp4Box) bool {
+	if box.typ != item.typ {
+		return false
+	}
+	if item.typ != "----" {
+		return true
+	}
+	name := mp4Child(box.body, "name")
+	return len(name) >= 4 && string(name[4:]) == item.name
+}
+
+// item returns the data of the first standard item typ, without its type
+// and locale, or nil
+func (m *mp4File) item(typ string) []byte {
+	data := mp4Child(m.moov, "udta", "meta", "ilst", typ, "data")
+	if len(data) < 8 {
+		return nil
+	}
+	return data[8:]
+}
+
+// bigEndianUint decodes an integer item of up to 8 bytes
+func bigEndianUint(data []byte) uint64 {
+	var n uint64
+	for _, b := range data {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// setITunesItem writes the freeform com.apple.iTunes item name into the
+// file, replacing the item if it exists
+func (m *mp4File) setITunesItem(path, name, value string) error {
+	return m.setItems(path, ilstItem{typ: "----", name: name, dataType: 1, value: []byte(value)})
+}
+
+// setItems writes the items into the file, replacing those that exist.
+// Chunk offsets are moved along when moov grows in front of the media data.
+func (m *mp4File) setItems(path string, items ...ilstItem) error {
+	if m.fragmented {
+		return errors.New("fragmented MP4 files aren't supported")
+	}
+
+	moov, err := withMP4Child(m.moov, "udta", func(udta []byte) ([]byte, error) {
+		return withMP4Child(udta, "meta", func(meta []byte) ([]byte, error) {
+			if meta == nil {
+				// Version and flags, and the handler of iTunes metadata
+				meta = append(make([]byte, 4), mp4Encode("hdlr", make([]byte, 8), []byte("mdirappl"), make([]byte, 9))...)
+			}
+			prefix := metaPrefix(meta)
+			children, err := withMP4Child(meta[prefix:], "ilst", func(ilst []byte) ([]byte, error) {
+				return withILSTItems(ilst, items)
+			})
+			return append(bytes.Clone(meta[:prefix]), children...), err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	newMoov := mp4Encode("moov", moov)
+	if delta := int64(len(newMoov)) - (m.span.end - m.span.offset); delta != 0 {
+		if err := shiftChunkOffsets(newMoov[8:], m.span.end, delta); err != nil {
+			return err
+		}
+	}
+	return replaceMP4Span(path, m.span, newMoov)
+}
+
+// withILSTItems returns ilst with each item replacing its first earlier
+// value, or appended when there's none
+func withILSTItems(ilst []byte, items []ilstItem) ([]byte, error) {
+	boxes, err := mp4Children(ilst)
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	replaced := make([]bool, len(items))
+	for _, box := range boxes {
+		i := slices.IndexFunc(items, func(item ilstItem) bool { return item.matches(box) })
+		if i >= 0 && !replaced[i] {
+			out, replaced[i] = append(out, items[i].encode()), true
+			continue
+		}
+		out = append(out, mp4Encode(box.typ, box.body))
+	}
+	for i, item := range items {
+		if !replaced[i] {
+			out = append(out, item.encode())
+		}
+	}
+	return bytes.Join(out, nil), nil
+}
+
+// shiftChunkOffsets moves the chunk offsets at or after from by delta
+func shiftChunkOffsets(moov []byte, from, delta int64) error {
+	boxes, err := mp4Children(moov)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+		stbl, err := mp4Children(mp4Child(box.body, "mdia", "minf", "stbl"))
+		if err != nil {
+			return err
+		}
+		for _, table := range stbl {
+			width := map[string]int{"stco": 4, "co64": 8}[table.typ]
+			if width == 0 || len(table.body) < 8 {
+				continue
+			}
+			count := int(binary.BigEndian.Uint32(table.body[4:]))
+			entries := table.body[8:]
+			if len(entries) < count*width {
+				return fmt.Errorf("truncated %s box", table.typ)
+			}
+			for i := range count {
+				entry := entries[i*width:]
+				if width == 4 {
+					offset := int64(binary.BigEndian.Uint32(entry))
+					if offset < from {
+						continue
+					}
+					if offset+delta > math.MaxUint32 {
+						return errors.New("chunk offsets would overflow")
+					}
+					binary.BigEndian.PutUint32(entry, uint32(offset+delta))
+				} else if offset := int64(binary.BigEndian.Uint64(entry)); offset >= from {
+					binary.BigEndian.PutUint64(entry, uint64(offset+delta))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// replaceMP4Span rewrites the file with the box at span replaced by box
+func replaceMP4Span(path string, span mp4Span, box []byte) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := filepath.Join(filepath.Dir(path), ".mp4-"+filepath.Base(path))
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, 0, span.offset))
+	if err == nil {
+		_, err = dst.Write(box)
+	}
+	if err == nil {
+		_, err = io.Copy(dst, io.NewSectionReader(src, span.end, math.MaxInt64-span.end))
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// A silent AAC-LC frame and an ALAC frame of digital silence, repeated to
+// fill each chunk
+var (
+	aacSilence  = []byte{0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c}
+	alacSilence = []byte{0x20, 0x00, 0x00, 0x00, 0x13, 0x00, 0x00, 0x00}
+)
+
+type mp4Fixture struct {
+	codec     string // "mp4a" or "alac"
+	co64      bool   // 64-bit chunk offsets
+	moovFirst bool   // moov before mdat, as iTunes and the downloader write it
+	udta      bool   // with an existing udta/meta/ilst holding iTunSMPB
+}
+
+const (
+	fixtureChunks    = 3
+	fixtureChunkSize = 48
+)
+
+// chunk returns the media data of chunk i, different for every chunk so a
+// misplaced offset is noticed
+func (f mp4Fixture) chunk(i int) []byte {
+	frame := aacSilence
+	if f.codec == "alac" {
+		frame = alacSilence
+	}
+	data := bytes.Repeat(frame, fixtureChunkSize/len(frame)+1)[:fixtureChunkSize]
+	data[len(data)-1] = byte(i)
+	return data
+}
+
+func fullBox(typ string, version byte, body ...[]byte) []byte {
+	return mp4Encode(typ, append([][]byte{{version, 0, 0, 0}}, body...)...)
+}
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// moov builds the movie box with chunk offsets relative to mdatData, the
+// offset of the media data in the file
+func (f mp4Fixture) moov(mdatData int64) []byte {
+	var offsets []byte
+	for i := range fixtureChunks {
+		offset := mdatData + int64(i*fixtureChunkSize)
+		if f.co64 {
+			offsets = append(offsets, u64(uint64(offset))...)
+		} else {
+			offsets = append(offsets, u32(uint32(offset))...)
+		}
+	}
+	chunkOffsets := fullBox("stco", 0, u32(fixtureChunks), offsets)
+	if f.co64 {
+		chunkOffsets = fullBox("co64", 0, u32(fixtureChunks), offsets)
+	}
+
+	// Reserved, data reference index, version, revision, vendor, channels,
+	// sample size, compression ID, packet size and sample rate
+	entry := append(make([]byte, 6), 0, 1)
+	entry = append(entry, make([]byte, 8)...)
+	entry = append(entry, 0, 2, 0, 16, 0, 0, 0, 0)
+	entry = append(entry, u32(44100<<16)...)
+	if f.codec == "alac" {
+		entry = append(entry, fullBox("alac", 0, make([]byte, 24))...)
+	} else {
+		entry = append(entry, fullBox("esds", 0, []byte{0x03, 0x19, 0x00, 0x00, 0x00, 0x04, 0x11, 0x40, 0x15}, make([]byte, 13), []byte{0x05, 0x02, 0x12, 0x10, 0x06, 0x01, 0x02})...)
+	}
+
+	stbl := mp4Encode("stbl",
+		fullBox("stsd", 0, u32(1), mp4Encode(f.codec, entry)),
+		fullBox("stts", 0, u32(1), u32(fixtureChunks), u32(1024)),
+		fullBox("stsc", 0, u32(1), u32(1), u32(1), u32(1)),
+		fullBox("stsz", 0, u32(fixtureChunkSize), u32(fixtureChunks)),
+		chunkOffsets,
+	)
+	trak := mp4Encode("trak",
+		fullBox("tkhd", 0, make([]byte, 80)),
+		mp4Encode("mdia",
+			fullBox("mdhd", 0, u32(0), u32(0), u32(44100), u32(fixtureChunks*1024), make([]byte, 4)),
+			fullBox("hdlr", 0, u32(0), []byte("soun"), make([]byte, 13)),
+			mp4Encode("minf", stbl),
+		),
+	)
+	boxes := [][]byte{fullBox("mvhd", 0, u32(0), u32(0), u32(44100), u32(fixtureChunks*1024), make([]byte, 80)), trak}
+	if f.udta {
+		item := mp4Encode("----",
+			fullBox("mean", 0, []byte("com.apple.iTunes")),
+			fullBox("name", 0, []byte("iTunSMPB")),
+			mp4Encode("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(" 00000000 00000840 00000000 0000000000000000")),
+		)
+		title := mp4Encode("\xa9nam", mp4Encode("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte("Song")))
+		boxes = append(boxes, mp4Encode("udta", fullBox("meta", 0,
+			fullBox("hdlr", 0, u32(0), []byte("mdirappl"), make([]byte, 9)),
+			mp4Encode("ilst", title, item),
+		)))
+	}
+	return mp4Encode("moov", boxes...)
+}
+
+// write saves the fixture and returns its path
+func (f mp4Fixture) write(t *testing.T) string {
+	t.Helper()
+	ftyp := mp4Encode("ftyp", []byte("M4A "), u32(0), []byte("M4A mp42isom"))
+	var media []byte
+	for i := range fixtureChunks {
+		media = append(media, f.chunk(i)...)
+	}
+	mdat := mp4Encode("mdat", media)
+
+	var file []byte
+	if f.moovFirst {
+		// The moov box's size doesn't depend on the offsets it holds
+		moovSize := int64(len(f.moov(0)))
+		file = slices.Concat(ftyp, f.moov(int64(len(ftyp))+moovSize+8), mdat)
+	} else {
+		file = slices.Concat(ftyp, mdat, f.moov(int64(len(ftyp))+8))
+	}
+
+	path := filepath.Join(t.TempDir(), "track.m4a")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkChunks reads the chunk offsets of the file's audio track and checks
+// that they still point at the fixture's media data
+func checkChunks(t *testing.T, path string, f mp4Fixture) {
+	t.Helper()
+	file, err := readMP4(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stbl := mp4Child(file.audioTrack(), "mdia", "minf", "stbl")
+	table, width := mp4Child(stbl, "stco"), 4
+	if f.co64 {
+		table, width = mp4Child(stbl, "co64"), 8
+	}
+	if table == nil {
+		t.Fatal("no chunk offset table")
+	}
+	if count := binary.BigEndian.Uint32(table[4:]); count != fixtureChunks {
+		t.Fatalf("got %d chunk offsets, want %d", count, fixtureChunks)
+	}
+	for i := range fixtureChunks {
+		entry := table[8+i*width:]
+		offset := int64(binary.BigEndian.Uint32(entry))
+		if width == 8 {
+			offset = int64(binary.BigEndian.Uint64(entry))
+		}
+		if offset+fixtureChunkSize > int64(len(data)) {
+			t.Fatalf("chunk %d at %d is past the end of the file", i, offset)
+		}
+		if got := data[offset : offset+fixtureChunkSize]; !bytes.Equal(got, f.chunk(i)) {
+			t.Errorf("chunk %d at %d doesn't hold its media data", i, offset)
+		}
+	}
+}
+
+func TestSetITunesItem(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture mp4Fixture
+	}{
+		{"aac moov first without udta", mp4Fixture{codec: "mp4a", moovFirst: true}},
+		{"aac moov first with udta", mp4Fixture{codec: "mp4a", moovFirst: true, udta: true}},
+		{"aac moov last", mp4Fixture{codec: "mp4a", udta: true}},
+		{"alac co64 moov first without udta", mp4Fixture{codec: "alac", co64: true, moovFirst: true}},
+		{"alac co64 moov first with udta", mp4Fixture{codec: "alac", co64: true, moovFirst: true, udta: true}},
+		{"alac co64 moov last without udta", mp4Fixture{codec: "alac", co64: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.fixture.write(t)
+			checkChunks(t, path, tt.fixture)
+
+			// Longer and then shorter than the item written before, so the
+			// offsets move both ways
+			for _, value := range []string{
+				" 00000000 00000840 000001C4 00000000000A2A3C 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000",
+				" 00000000 00000840 0000004C 0000000000000BB4",
+			} {
+				file, err := readMP4(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := file.setITunesItem(path, "iTunSMPB", value); err != nil {
+					t.Fatal(err)
+				}
+
+				file, err = readMP4(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := file.iTunesItem("iTunSMPB"); got != value {
+					t.Errorf("iTunSMPB = %q, want %q", got, value)
+				}
+				items, _ := mp4Children(mp4Child(file.moov, "udta", "meta", "ilst"))
+				freeform := 0
+				for _, item := range items {
+					if item.typ == "----" {
+						freeform++
+					}
+				}
+				if freeform != 1 {
+					t.Errorf("got %d freeform items, want 1", freeform)
+				}
+				if tt.fixture.udta && mp4Child(file.moov, "udta", "meta", "ilst", "\xa9nam") == nil {
+					t.Error("other items were dropped")
+				}
+				if readGapless(file).codec != tt.fixture.codec {
+					t.Errorf("sample entry changed")
+				}
+				checkChunks(t, path, tt.fixture)
+			}
+		})
+	}
+}
+
+func TestSetITunesItemFragmented(t *testing.T) {
+	f := mp4Fixture{codec: "mp4a", moovFirst: true}
+	path := f.write(t)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, mp4Encode("moof", fullBox("mfhd", 0, u32(1)))...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := readMP4(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.setITunesItem(path, "iTunSMPB", " 00000000"); err == nil {
+		t.Error("fragmented file was rewritten")
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, append(data, mp4Encode("moof", fullBox("mfhd", 0, u32(1)))...)) {
+		t.Error("fragmented file changed")
+	}
+}
+
+func TestSetItems(t *testing.T) {
+	f := mp4Fixture{codec: "alac", moovFirst: true, udta: true}
+	path := f.write(t)
+
+	for _, number := range []int{2, 3} {
+		file, err := readMP4(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.setItems(path, textItem("\xa9mvn", "Allegro"), integerItem("\xa9mvi", number, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := readMP4(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(file.item("\xa9mvn")); got != "Allegro" {
+		t.Errorf("\xa9mvn = %q, want %q", got, "Allegro")
+	}
+	if got := bigEndianUint(file.item("\xa9mvi")); got != 3 {
+		t.Errorf("\xa9mvi = %d, want 3", got)
+	}
+	if file.iTunesItem("iTunSMPB") == "" {
+		t.Error("freeform item was dropped")
+	}
+	items, _ := mp4Children(mp4Child(file.moov, "udta", "meta", "ilst"))
+	if len(items) != 4 {
+		t.Errorf("got %d items, want 4", len(items))
+	}
+	checkChunks(t, path, f)
+}
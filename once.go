@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	onceMode   = flag.Bool("once", false, "run a single download and exit instead of serving the API")
+	onceFormat = flag.String("format", "", "with --once: format or comma-separated preference list, e.g. atmos,alac")
+	onceSong   = flag.Bool("song", false, "with --once: download a single song")
+	onceDebug  = flag.Bool("debug", false, "with --once: run the downloader in debug mode")
+)
+
+// How long --once waits for webhooks and event sinks after the job finishes
+const onceFlushTimeout = 30 * time.Second
+
+// runOnce runs one download through the full pipeline, as for POST
+// /download, prints the finished job as JSON and returns the exit code. The
+// URL is taken from the arguments, or read from stdin as a URL or a JSON
+// download request when the argument is missing or "-".
+func runOnce(args []string) int {
+	req, err := onceRequest(args)
+	if err != nil {
+		slog.Warn("Invalid request", "error", err)
+		return 2
+	}
+	req.Owner = "cli"
+	if err := prepareRequest(&req); err != nil {
+		if errors.Is(err, errPolicyDenied) {
+			slog.Warn("Request denied", "error", err)
+		} else {
+			slog.Warn("Invalid request", "error", err)
+		}
+		return 2
+	}
+
+	editions, err := resolveEdition(&req)
+	if err != nil {
+		slog.Warn("Edition lookup failed", "error", err)
+		return 1
+	}
+	if editions != nil {
+		slog.Info("Album has multiple editions; pass the URL of one of them")
+		for _, edition := range editions {
+			slog.Info("Edition", "name", edition.Name, "edition", edition.Edition, "url", edition.URL)
+		}
+		return 2
+	}
+
+	finished := make(chan DownloadStatus, 1)
+	var jobID string
+	ready := make(chan struct{})
+	jobManager.OnFinish(func(job DownloadStatus) {
+		<-ready
+		if job.ID == jobID {
+			finished <- job
+		}
+	})
+
+	jobID = startDownload(req).ID
+	close(ready)
+	slog.Info("Job started", "job_id", jobID, "url", req.URL)
+
+	job := <-finished
+	flushEvents(onceFlushTimeout)
+
+	job.Logs = nil
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(job)
+
+	if job.Status != "completed" {
+		return 1
+	}
+	return 0
+}
+
+func onceRequest(args []string) (DownloadRequest, error) {
+	req := DownloadRequest{
+		Song:  *onceSong,
+		Debug: *onceDebug,
+	}
+	if *onceFormat != "" {
+		req.Format = splitList(*onceFormat)
+	}
+
+	switch {
+	case len(args) > 1:
+		return req, errors.New("expected a single URL")
+	case len(args) == 1 && args[0] != "-":
+		req.URL = args[0]
+		return req, nil
+	}
+
+	data, err := io.ReadAll(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return req, err
+	}
+	input := strings.TrimSpace(string(data))
+	if strings.HasPrefix(input, "{") {
+		if err := json.Unmarshal([]byte(input), &req); err != nil {
+			return req, err
+		}
+		return req, nil
+	}
+	if strings.ContainsAny(input, " \t\n") {
+		return req, fmt.Errorf("expected a single URL on stdin")
+	}
+	req.URL = input
+	return req, nil
+}
+
+// flushEvents waits for finish hooks to run and for the events they
+// published to be sent, so they aren't lost when the process exits.
+// Webhook deliveries that fail stay in the queue for the next run.
+func flushEvents(timeout time.Duration) {
+	hooksDone := make(chan struct{})
+	go func() {
+		jobManager.hooksRunning.Wait()
+		close(hooksDone)
+	}()
+
+	deadline := time.After(timeout)
+	select {
+	case <-hooksDone:
+	case <-deadline:
+		slog.Info("Timed out waiting for notifications")
+		return
+	}
+
+	deliveryQueue.notify()
+	for {
+		settled := deliveryQueue.Settled() &&
+			(eventStream == nil || eventStream.Settled()) &&
+			(kafkaSink == nil || kafkaSink.Settled())
+		if settled {
+			return
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			slog.Info("Timed out waiting for notifications")
+			return
+		}
+	}
+}
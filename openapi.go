@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// apiOperation describes an endpoint for the OpenAPI document. Request and
+// response are values of the JSON body types, or schemas written out as
+// maps for bodies that aren't a named type.
+type apiOperation struct {
+	method   string
+	path     string // with {parameters}
+	summary  string
+	query    []apiParam
+	request  any
+	response any
+	status   int    // of a successful response, 200 if unset
+	produces string // content type of a response that isn't JSON
+	public   bool   // doesn't need an API key
+	admin    bool   // served on ADMIN_LISTEN_ADDR when that's set
+}
+
+type apiParam struct {
+	name        string
+	description string
+}
+
+// object is the schema of a JSON object with the given properties
+func object(properties map[string]any) map[string]any {
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func arrayOf(items any) map[string]any {
+	return map[string]any{"type": "array", "items": items}
+}
+
+var (
+	stringSchema  = map[string]any{"type": "string"}
+	integerSchema = map[string]any{"type": "integer"}
+	booleanSchema = map[string]any{"type": "boolean"}
+
+	startedResponse = object(map[string]any{"job_id": stringSchema, "status": stringSchema})
+)
+
+var apiOperations = []apiOperation{
+	{method: "POST", path: "/download", summary: "Start a download, a batch when urls is given, or schedule one with schedule_at or cron", request: DownloadRequest{},
+		response: map[string]any{"oneOf": []any{object(map[string]any{"job_id": stringSchema, "status": stringSchema, "warning": stringSchema}), object(map[string]any{
+			"batch_id": stringSchema,
+			"status":   stringSchema,
+			"jobs":     arrayOf(object(map[string]any{"url": stringSchema, "job_id": stringSchema})),
+		}), object(map[string]any{
+			"schedule_id": stringSchema,
+			"status":      stringSchema,
+			"next_run_at": stringSchema,
+		})}}},
+	{method: "GET", path: "/schedules", summary: "List scheduled downloads", response: object(map[string]any{"schedules": arrayOf(Schedule{}), "count": integerSchema})},
+	{method: "GET", path: "/schedules/{schedule_id}", summary: "Get a scheduled download", response: Schedule{}},
+	{method: "DELETE", path: "/schedules/{schedule_id}", summary: "Delete a scheduled download", status: http.StatusNoContent},
+	{method: "POST", path: "/schedules/{schedule_id}/pause", summary: "Pause a scheduled download", response: Schedule{}},
+	{method: "POST", path: "/schedules/{schedule_id}/resume", summary: "Resume a paused scheduled download", response: Schedule{}},
+	{method: "GET", path: "/status/{job_id}", summary: "Get a job", query: jobViewParams, response: DownloadStatus{}},
+	{method: "GET", path: "/jobs", summary: "List jobs", query: []apiParam{
+		{"status", "Comma-separated statuses"},
+		{"since", "RFC 3339 time, or an age such as 24h or 7d"},
+		{"sort", "started_at, ended_at, status or priority, prefixed with - for descending order"},
+		{"limit", "Page size, up to 1000"},
+		{"offset", "Matching jobs to skip"},
+		{"include", "logs to include log lines"},
+		{"archived", "include or only"},
+		jobViewParams[0], jobViewParams[1],
+	}, response: object(map[string]any{"count": integerSchema, "total": integerSchema, "jobs": arrayOf(DownloadStatus{})})},
+	{method: "DELETE", path: "/jobs", summary: "Purge finished jobs", query: finishedJobParams,
+		response: object(map[string]any{"deleted": integerSchema, "job_ids": arrayOf(stringSchema)})},
+	{method: "POST", path: "/jobs/archive", summary: "Archive finished jobs", query: finishedJobParams,
+		response: object(map[string]any{"archived": integerSchema, "job_ids": arrayOf(stringSchema)})},
+	{method: "GET", path: "/jobs/changes", summary: "List job state changes after a sequence number", query: []apiParam{
+		{"since_seq", "Sequence number of the last change seen"},
+		{"limit", "Changes to return, up to 1000"},
+	}, response: object(map[string]any{"changes": arrayOf(JobChange{}), "latest_seq": integerSchema, "has_more": booleanSchema})},
+	{method: "POST", path: "/jobs/{job_id}/archive", summary: "Archive a finished job", response: DownloadStatus{}},
+	{method: "POST", path: "/jobs/{job_id}/unarchive", summary: "Unarchive a job", response: DownloadStatus{}},
+	{method: "POST", path: "/jobs/{job_id}/priority", summary: "Change a queued job's priority or move it to the front of the queue",
+		request: object(map[string]any{"priority": stringSchema, "front": booleanSchema}), response: DownloadStatus{}},
+	{method: "POST", path: "/jobs/{job_id}/retry", summary: "Retry a failed job",
+		response: object(map[string]any{"job_id": stringSchema, "retry_of": stringSchema, "status": stringSchema})},
+	{method: "GET", path: "/jobs/{job_id}/files", summary: "List a job's files", response: JobFiles{}},
+	{method: "GET", path: "/jobs/{job_id}/files/{path}", summary: "Download a file of a job", produces: "application/octet-stream"},
+	{method: "POST", path: "/cancel/{job_id}", summary: "Cancel a queued or running job", query: []apiParam{{"reason", "Recorded with the cancellation"}},
+		request: object(map[string]any{"reason": stringSchema}), response: object(map[string]any{"status": stringSchema})},
+	{method: "GET", path: "/queue/retries", summary: "List running jobs waiting to retry their download",
+		response: object(map[string]any{"retries": arrayOf(ScheduledRetry{}), "count": integerSchema})},
+	{method: "GET", path: "/queue/plan", summary: "Estimate when queued jobs start and finish", query: []apiParam{
+		{"max_concurrent", "Download slots to plan with"},
+		{"estimate", "Duration of a job, such as 15m"},
+	}, response: QueuePlan{}},
+	{method: "GET", path: "/ws", summary: "Receive job events and submit or cancel jobs over a WebSocket", query: []apiParam{
+		{"events", "Comma-separated event types: created, status, progress, log, finished"},
+		{"job_id", "Comma-separated job IDs to receive events for"},
+		{"access_token", "API key, for browsers that can't send headers"},
+	}, status: http.StatusSwitchingProtocols},
+	{method: "GET", path: "/check", summary: "Check which formats a release is available in", query: []apiParam{
+		{"url", "Apple Music URL"},
+		{"storefront", "Storefront to check"},
+	}, response: CheckResult{}},
+	{method: "GET", path: "/preview", summary: "Preview what a link points at before downloading it", query: []apiParam{
+		{"url", "Apple Music URL"},
+		{"storefront", "Storefront to look the content up in"},
+		{"language", "Language of names, such as en-GB"},
+	}, response: Preview{}},
+	{method: "GET", path: "/batches/{batch_id}", summary: "Get a batch",
+		response: object(map[string]any{"batch": Batch{}, "counts": map[string]any{"type": "object", "additionalProperties": integerSchema}, "total": integerSchema, "finished": integerSchema})},
+	{method: "GET", path: "/collections", summary: "List collections",
+		response: object(map[string]any{"collections": arrayOf(CollectionStatus{}), "count": integerSchema})},
+	{method: "POST", path: "/collections", summary: "Create a collection", request: collectionInput{}, response: Collection{}, status: http.StatusCreated},
+	{method: "GET", path: "/collections/{collection_id}", summary: "Get a collection with its jobs",
+		response: object(map[string]any{"collection": CollectionStatus{}, "jobs": arrayOf(DownloadStatus{})})},
+	{method: "DELETE", path: "/collections/{collection_id}", summary: "Delete a collection", status: http.StatusNoContent},
+	{method: "POST", path: "/collections/{collection_id}/attach", summary: "Add jobs and batches to a collection", request: collectionMembers{}, response: CollectionStatus{}},
+	{method: "POST", path: "/collections/{collection_id}/detach", summary: "Remove jobs and batches from a collection", request: collectionMembers{}, response: CollectionStatus{}},
+	{method: "GET", path: "/collections/{collection_id}/manifest", summary: "List a collection's files",
+		response: object(map[string]any{"collection_id": stringSchema, "name": stringSchema, "files": arrayOf(CollectionFile{})})},
+	{method: "GET", path: "/collections/{collection_id}/playlist", summary: "Download an M3U8 playlist of a collection", produces: "audio/x-mpegurl"},
+	{method: "GET", path: "/collections/{collection_id}/export", summary: "Export a collection as a ZIP archive, or signed links with mode=urls", query: []apiParam{
+		{"mode", "zip or urls"},
+		{"transcode", "mp3 or flac"},
+	}, produces: "application/zip"},
+	{method: "GET", path: "/watch", summary: "List artist watches", response: object(map[string]any{"watches": arrayOf(ArtistWatch{}), "count": integerSchema})},
+	{method: "POST", path: "/watch", summary: "Watch an artist for new releases", request: artistWatchInput{}, response: ArtistWatch{}, status: http.StatusCreated},
+	{method: "GET", path: "/watch/{watch_id}", summary: "Get an artist watch", response: ArtistWatch{}},
+	{method: "DELETE", path: "/watch/{watch_id}", summary: "Delete an artist watch", status: http.StatusNoContent},
+	{method: "POST", path: "/watch/{watch_id}/check", summary: "Check an artist for new releases now", response: ArtistWatch{}},
+	{method: "GET", path: "/templates", summary: "List templates", response: object(map[string]any{"templates": arrayOf(Template{}), "count": integerSchema})},
+	{method: "POST", path: "/templates", summary: "Create a template", request: Template{}, response: Template{}, status: http.StatusCreated},
+	{method: "GET", path: "/templates/{name}", summary: "Get a template", response: Template{}},
+	{method: "PUT", path: "/templates/{name}", summary: "Create or replace a template", request: Template{}, response: Template{}},
+	{method: "DELETE", path: "/templates/{name}", summary: "Delete a template", status: http.StatusNoContent},
+	{method: "GET", path: "/me/preferences", summary: "Get the user's preferences",
+		response: object(map[string]any{"user": stringSchema, "preferences": Preferences{}})},
+	{method: "PUT", path: "/me/preferences", summary: "Replace the user's preferences", request: Preferences{},
+		response: object(map[string]any{"user": stringSchema, "preferences": Preferences{}})},
+	{method: "DELETE", path: "/me/preferences", summary: "Reset the user's preferences",
+		response: object(map[string]any{"user": stringSchema, "preferences": Preferences{}})},
+	{method: "POST", path: "/import/loved", summary: "Import loved tracks from Last.fm or ListenBrainz", request: LovedImportRequest{},
+		response: object(map[string]any{"import_id": stringSchema, "status": stringSchema})},
+	{method: "GET", path: "/import/{import_id}", summary: "Get an import's report", response: ImportReport{}},
+	{method: "POST", path: "/migrate/spotify", summary: "Migrate a Spotify playlist", request: SpotifyMigrationRequest{},
+		response: object(map[string]any{"migration_id": stringSchema, "status": stringSchema})},
+	{method: "GET", path: "/migrate/spotify/{migration_id}", summary: "Get a migration's report", response: MigrationReport{}},
+	{method: "GET", path: "/quick", summary: "Start a download with a single GET request", public: true, query: []apiParam{
+		{"token", "QUICK_TOKEN"},
+		{"url", "Apple Music URL"},
+		{"format", "Comma-separated formats"},
+		{"song", "true for a single song"},
+		{"output", "html for a confirmation page"},
+	}, response: startedResponse},
+	{method: "POST", path: "/ext/submit", summary: "Submit a download from the browser extension", public: true, request: DownloadRequest{},
+		response: object(map[string]any{"id": stringSchema, "status": stringSchema, "duplicate": booleanSchema})},
+	{method: "POST", path: "/ingest/webhook/{source}", summary: "Start a download from another service's webhook", public: true,
+		request: map[string]any{"type": "object"}, response: object(map[string]any{
+			"source":  stringSchema,
+			"jobs":    arrayOf(object(map[string]any{"job_id": stringSchema, "url": stringSchema})),
+			"skipped": integerSchema,
+		})},
+	{method: "GET", path: "/exports/{path}", summary: "Download an exported file through a signed link", public: true, query: []apiParam{
+		{"expires", "Expiry as a Unix time"},
+		{"sig", "Signature"},
+		{"transcode", "mp3 or flac"},
+	}, produces: "application/octet-stream"},
+	{method: "GET", path: "/health", summary: "Liveness", public: true,
+		response: object(map[string]any{"status": stringSchema, "patterns_version": stringSchema})},
+	{method: "GET", path: "/readyz", summary: "Readiness", public: true, response: Readiness{}},
+	{method: "GET", path: "/metrics", summary: "Prometheus metrics", admin: true, produces: "text/plain"},
+	{method: "GET", path: "/webhooks", summary: "List webhook endpoints", admin: true,
+		response: object(map[string]any{"webhooks": arrayOf(Webhook{}), "count": integerSchema})},
+	{method: "POST", path: "/webhooks", summary: "Register a webhook endpoint", admin: true, request: webhookInput{}, response: Webhook{}, status: http.StatusCreated},
+	{method: "GET", path: "/webhooks/{webhook_id}", summary: "Get a webhook endpoint", admin: true, response: Webhook{}},
+	{method: "PUT", path: "/webhooks/{webhook_id}", summary: "Replace a webhook endpoint", admin: true, request: webhookInput{}, response: Webhook{}},
+	{method: "DELETE", path: "/webhooks/{webhook_id}", summary: "Delete a webhook endpoint", admin: true, status: http.StatusNoContent},
+	{method: "GET", path: "/admin/webhooks/deliveries", summary: "List webhook deliveries", admin: true, query: []apiParam{{"status", "Delivery status"}},
+		response: object(map[string]any{"deliveries": arrayOf(Delivery{}), "count": integerSchema})},
+	{method: "GET", path: "/admin/webhooks/deliveries/{delivery_id}", summary: "Get a webhook delivery", admin: true, response: Delivery{}},
+	{method: "GET", path: "/integrations/status", summary: "Report how each configured integration has been doing", admin: true,
+		response: object(map[string]any{"integrations": arrayOf(IntegrationStatus{}), "count": integerSchema})},
+	{method: "POST", path: "/integrations/{name}/test", summary: "Test an integration's configuration", admin: true, response: IntegrationTest{}},
+	{method: "GET", path: "/audit/export", summary: "Export audit log entries as JSONL with a signed trailer", admin: true, query: []apiParam{
+		{"since_seq", "Export the entries after this sequence number"},
+		{"limit", "Maximum number of entries (default 1000, max 10000)"},
+	}, produces: "application/x-ndjson"},
+	{method: "GET", path: "/admin/credentials", summary: "Check the downloader's Apple Music credentials", admin: true, response: CredentialsReport{}},
+	{method: "POST", path: "/admin/credentials", summary: "Upload cookies.txt, exported cookie JSON or tokens, check and save them", admin: true,
+		query:   []apiParam{{"force", "true to save credentials Apple Music rejected"}},
+		request: object(map[string]any{"media_user_token": stringSchema, "authorization_token": stringSchema, "storefront": stringSchema}), response: CredentialsReport{}},
+	{method: "POST", path: "/admin/credentials/assist", summary: "Create a short-lived page for pasting Apple Music tokens", admin: true,
+		response: object(map[string]any{"url": stringSchema, "expires_at": stringSchema}), status: http.StatusCreated},
+	{method: "GET", path: "/auth-assist/{token}", summary: "Show the token capture instructions and form", public: true, admin: true, produces: "text/html"},
+	{method: "POST", path: "/auth-assist/{token}", summary: "Verify pasted tokens and save them", public: true, admin: true,
+		request: object(map[string]any{"media_user_token": stringSchema, "developer_token": stringSchema}), response: CredentialsReport{}},
+	{method: "GET", path: "/admin/account", summary: "Show the storefront and subscription of the credentials' account", admin: true,
+		query: []apiParam{{"refresh", "true to look the account up again"}}, response: AccountReport{}},
+}
+
+var jobViewParams = []apiParam{
+	{"fields", "Comma-separated fields of each job to return"},
+	{"compact", "true to leave out logs, events, files and other metadata"},
+}
+
+var finishedJobParams = []apiParam{
+	{"status", "Comma-separated finished statuses"},
+	{"older_than", "How long ago the jobs ended, such as 36h or 7d"},
+	{"archived", "true for archived jobs only"},
+}
+
+// Schemas of types whose JSON form isn't what reflection finds
+var customSchemas = map[reflect.Type]map[string]any{
+	reflect.TypeFor[time.Time]():       {"type": "string", "format": "date-time"},
+	reflect.TypeFor[json.RawMessage](): {},
+	reflect.TypeFor[FormatList](): {
+		"description": "A format, or formats in order of preference",
+		"oneOf":       []any{stringSchema, arrayOf(stringSchema)},
+	},
+	reflect.TypeFor[TrackList](): arrayOf(map[string]any{"oneOf": []any{stringSchema, integerSchema}}),
+}
+
+// schemaGenerator derives JSON schemas from Go types the way encoding/json
+// encodes them, collecting named structs as components
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	if schema, ok := customSchemas[t]; ok {
+		return schema
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return stringSchema
+	case reflect.Bool:
+		return booleanSchema
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return integerSchema
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return arrayOf(g.schema(t.Elem()))
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := componentName(t)
+		if _, exists := g.components[name]; !exists {
+			// Reserved first, so types referring to themselves end
+			g.components[name] = nil
+			g.components[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		// Embedded structs without a name have their fields inlined
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := g.structSchema(field.Type)
+			for key, value := range embedded["properties"].(map[string]any) {
+				properties[key] = value
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+	}
+	return object(properties)
+}
+
+// componentName exports the names of unexported types, e.g. collectionInput
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func (g *schemaGenerator) body(v any) map[string]any {
+	if schema, ok := v.(map[string]any); ok {
+		return g.resolve(schema).(map[string]any)
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+// resolve replaces the Go values inside a schema written as a map with
+// their schemas
+func (g *schemaGenerator) resolve(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		resolved := make(map[string]any, len(v))
+		for key, value := range v {
+			resolved[key] = g.resolve(value)
+		}
+		return resolved
+	case []any:
+		resolved := make([]any, len(v))
+		for i, value := range v {
+			resolved[i] = g.resolve(value)
+		}
+		return resolved
+	case string, bool, int, float64, nil:
+		return v
+	default:
+		return g.schema(reflect.TypeOf(v))
+	}
+}
+
+var pathParameter = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// openAPIDocument builds the OpenAPI 3 description of the API once
+var openAPIDocument = sync.OnceValue(func() []byte {
+	g := &schemaGenerator{components: map[string]any{}}
+	paths := map[string]map[string]any{}
+
+	for _, op := range apiOperations {
+		var parameters []any
+		for _, m := range pathParameter.FindAllStringSubmatch(op.path, -1) {
+			parameters = append(parameters, map[string]any{"name": m[1], "in": "path", "required": true, "schema": stringSchema})
+		}
+		for _, param := range op.query {
+			parameters = append(parameters, map[string]any{"name": param.name, "in": "query", "description": param.description, "schema": stringSchema})
+		}
+
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case op.response != nil:
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": g.body(op.response)}}
+		case op.produces != "":
+			success["content"] = map[string]any{op.produces: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+		}
+
+		operation := map[string]any{
+			"summary":     op.summary,
+			"operationId": operationID(op),
+			"responses": map[string]any{
+				fmt.Sprint(status): success,
+				"default": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"application/problem+json": map[string]any{"schema": g.body(Problem{})}},
+				},
+			},
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if op.request != nil {
+			operation["requestBody"] = map[string]any{
+				"content": map[string]any{"application/json": map[string]any{"schema": g.body(op.request)}},
+			}
+		}
+		if op.public {
+			operation["security"] = []any{}
+		}
+		if op.admin {
+			operation["tags"] = []string{"admin"}
+		}
+
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	data, err := json.MarshalIndent(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "apple-music-dl HTTP wrapper",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"apiKey": []string{}}, map[string]any{"bearer": []string{}}},
+	}, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return data
+})
+
+// operationID names an operation for generated clients, e.g.
+// "getJobsJobIdFiles" for GET /jobs/{job_id}/files
+func operationID(op apiOperation) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(op.method))
+	for _, word := range strings.FieldsFunc(op.path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		sb.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return sb.String()
+}
+
+// handleOpenAPI serves the OpenAPI document at /openapi.json
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument())
+}
+
+// docsPage loads Swagger UI from a CDN, so it needs no assets of its own
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>apple-music-dl HTTP wrapper API</title>
+<link rel="stylesheet" href="{{.}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.}}/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`))
+
+// handleDocs serves Swagger UI at /docs when DOCS_UI is enabled
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	docsPage.Execute(w, strings.TrimSuffix(cfg.DocsUIAssets, "/"))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	normalizationForms = map[string]norm.Form{"nfc": norm.NFC, "nfd": norm.NFD, "nfkc": norm.NFKC, "nfkd": norm.NFKD}
+
+	// "romanized" renames files to their transliterated names, "both" keeps
+	// the localized names and links the files into a romanized layout too
+	transliterationModes = []string{"", "romanized", "both"}
+)
+
+// organizePaths returns the path a file should have under the profile and,
+// for the "both" transliteration mode, the romanized path to link it at
+func organizePaths(rel string, profile OutputProfile) (string, string) {
+	if form, ok := normalizationForms[profile.Normalize]; ok {
+		rel = form.String(rel)
+	}
+
+	localized := sanitizePath(rel, profile.Sanitize)
+	romanized := sanitizePath(transliterate(rel), profile.Sanitize)
+
+	switch profile.Transliterate {
+	case "romanized":
+		return romanized, ""
+	case "both":
+		if romanized != localized {
+			return localized, romanized
+		}
+	}
+	return localized, ""
+}
+
+// organizeFiles renames the job's files under DOWNLOADS_DIR according to
+// the profile's normalization, transliteration and sanitization options and
+// returns their new paths. Existing files are replaced when overwrite is
+// set; otherwise they're kept and left out of the returned paths.
+func organizeFiles(jobID string, files []string, profile OutputProfile, overwrite bool) ([]string, error) {
+	renamed := make([]string, 0, len(files))
+	links := 0
+	var counts moveCounts
+	defer func() { counts.log(jobID) }()
+	for _, path := range files {
+		rel, err := filepath.Rel(cfg.DownloadsDir, path)
+		if err != nil {
+			return nil, err
+		}
+
+		targetRel, linkRel := organizePaths(rel, profile)
+		target := filepath.Join(cfg.DownloadsDir, targetRel)
+		result, err := moveFile(path, target, overwrite)
+		if err != nil {
+			return nil, err
+		}
+		counts.add(result)
+		if result == moveKept {
+			continue
+		}
+		renamed = append(renamed, target)
+
+		if linkRel != "" {
+			link := filepath.Join(cfg.DownloadsDir, linkRel)
+			if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+				return nil, err
+			}
+			os.Remove(link)
+			if err := os.Link(target, link); err != nil {
+				return nil, fmt.Errorf("failed to link %s: %w", linkRel, err)
+			}
+			links++
+		}
+	}
+
+	if links > 0 {
+		jobManager.AppendLog(jobID, fmt.Sprintf("Linked %d file(s) into the romanized layout", links))
+	}
+	return renamed, nil
+}
+
+// What moveFile did about a file already at its target
+type moveResult int
+
+const (
+	moveDone     moveResult = iota // nothing was there
+	moveReplaced                   // the file there was replaced
+	moveKept                       // what was there was kept, and the moved file removed
+)
+
+// moveFile renames path to target, creating directories as needed and
+// removing directories left empty. A file already at target is replaced
+// when overwrite is set and kept otherwise, as is a directory.
+func moveFile(path, target string, overwrite bool) (moveResult, error) {
+	if target == path {
+		return moveDone, nil
+	}
+	result := moveDone
+	if info, err := os.Stat(target); err == nil {
+		if !overwrite || info.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return moveDone, err
+			}
+			removeEmptyDirs(filepath.Dir(path))
+			return moveKept, nil
+		}
+		if err := os.Remove(target); err != nil {
+			return moveDone, err
+		}
+		result = moveReplaced
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return moveDone, err
+	}
+	if err := os.Rename(path, target); err != nil {
+		return moveDone, err
+	}
+	removeEmptyDirs(filepath.Dir(path))
+	return result, nil
+}
+
+// moveCounts counts the existing files a job's moves kept and replaced
+type moveCounts struct {
+	kept, replaced int
+}
+
+func (c *moveCounts) add(result moveResult) {
+	switch result {
+	case moveKept:
+		c.kept++
+	case moveReplaced:
+		c.replaced++
+	}
+}
+
+// log reports the counts in the job's log
+func (c moveCounts) log(jobID string) {
+	if c.kept > 0 {
+		jobManager.AppendLog(jobID, fmt.Sprintf("Kept %d existing file(s)", c.kept))
+	}
+	if c.replaced > 0 {
+		jobManager.AppendLog(jobID, fmt.Sprintf("Replaced %d existing file(s)", c.replaced))
+	}
+}
+
+// removeEmptyDirs removes dir and its empty parents up to DOWNLOADS_DIR
+func removeEmptyDirs(dir string) {
+	for dir != cfg.DownloadsDir && strings.HasPrefix(dir, cfg.DownloadsDir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (p OutputProfile) validateOrganize() error {
+	if !slices.Contains(sanitizeProfiles, p.Sanitize) {
+		return fmt.Errorf("sanitize must be windows, fat or ascii")
+	}
+	if _, ok := normalizationForms[p.Normalize]; !ok && p.Normalize != "" {
+		return fmt.Errorf("normalize must be nfc, nfd, nfkc or nfkd")
+	}
+	if !slices.Contains(transliterationModes, p.Transliterate) {
+		return fmt.Errorf("transliterate must be romanized or both")
+	}
+	return nil
+}
+
+func (p OutputProfile) organizes() bool {
+	return p.Sanitize != "" || p.Normalize != "" || p.Transliterate != ""
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// builtinPatternsVersion identifies the patterns compiled into the wrapper
+const builtinPatternsVersion = "builtin-3"
+
+// OutputPatterns are the regular expressions the downloader's output is
+// parsed with. They can be replaced from PATTERNS_FILE when a new
+// apple-music-dl release changes its output, without a new wrapper.
+type OutputPatterns struct {
+	Version string
+
+	// "Track 3 of 12", with the current and total track numbers as groups
+	Track *regexp.Regexp
+
+	// Progress bars like
+	// "Downloading...  45% |████      | (12/27 MB, 3.2 MB/s) [4s:5s]",
+	// with the percentage, speed and remaining time as the first group
+	Percent *regexp.Regexp
+	Speed   *regexp.Regexp
+	ETA     *regexp.Regexp
+
+	// Output reporting that the requested audio variant doesn't exist for
+	// the release
+	FormatUnavailable *regexp.Regexp
+
+	// Output reporting a failure that may go away on its own, such as an
+	// expired token or a network error; failed attempts that printed it
+	// get the "transient" failure code
+	Transient *regexp.Regexp
+
+	// Output reporting why a download failed, which gives the failed job
+	// its error_code; see classify
+	InvalidToken       *regexp.Regexp
+	RegionMismatch     *regexp.Regexp
+	NotFound           *regexp.Regexp
+	WrapperUnreachable *regexp.Regexp
+	DiskFull           *regexp.Regexp
+}
+
+var builtinPatterns = &OutputPatterns{
+	Version:           builtinPatternsVersion,
+	Track:             regexp.MustCompile(`(?i)\btrack (\d+) of (\d+)\b`),
+	Percent:           regexp.MustCompile(`(\d{1,3}(?:\.\d+)?)\s?%`),
+	Speed:             regexp.MustCompile(`(\d+(?:\.\d+)?\s?[kKMGT]?i?B/s)`),
+	ETA:               regexp.MustCompile(`\[[\dhms.]+:([\dhms.]+)\]`),
+	FormatUnavailable: regexp.MustCompile(`(?i)\b(atmos|alac|lossless|aac|audio traits?)\b.*\b(not available|unavailable|not found)\b|\b(not available|unavailable)\b.*\b(atmos|alac|lossless|aac)\b`),
+	Transient:         regexp.MustCompile(`(?i)\btoken\b.*\b(expired|invalid|failed)\b|connection (reset|refused)|i/o timeout|no such host|tls handshake timeout|temporary failure|too many requests|unexpected eof|\b(status|http)( code)?:? (429|502|503|504)\b`),
+
+	InvalidToken:       regexp.MustCompile(`(?i)\btoken\b.*\b(expired|invalid|unauthori[sz]ed)\b|\b(status|http)( code)?:? 401\b`),
+	RegionMismatch:     regexp.MustCompile(`(?i)not available in (your|this|the) (country|region|storefront)|\b(storefront|region)\b.*\b(mismatch|does ?n[o']t match|restricted)\b`),
+	NotFound:           regexp.MustCompile(`(?i)\b(album|playlist|song|track|station|artist|music video|resource)\b.*\bnot found\b|\b(status|http)( code)?:? 404\b`),
+	WrapperUnreachable: regexp.MustCompile(`(?i)(127\.0\.0\.1|localhost|\bwrapper\b|:(10020|20020)\b).*\b(connection refused|no route to host|i/o timeout|unreachable|not running)\b`),
+	DiskFull:           regexp.MustCompile(`(?i)no space left on device|\bdisk (is )?full\b|disk quota exceeded`),
+}
+
+var outputPatterns atomic.Pointer[OutputPatterns]
+
+func init() {
+	outputPatterns.Store(builtinPatterns)
+}
+
+// classify returns the error code of a line of output reporting why a
+// download failed, or "" for other lines. The most specific causes are
+// checked first, e.g. a refused connection to the wrapper before the token
+// it would have handed out.
+func (patterns *OutputPatterns) classify(line string) string {
+	for _, class := range []struct {
+		code    string
+		pattern *regexp.Regexp
+	}{
+		{"disk_full", patterns.DiskFull},
+		{"wrapper_unreachable", patterns.WrapperUnreachable},
+		{"invalid_token", patterns.InvalidToken},
+		{"region_mismatch", patterns.RegionMismatch},
+		{"not_found", patterns.NotFound},
+	} {
+		if class.pattern.MatchString(line) {
+			return class.code
+		}
+	}
+	return ""
+}
+
+// currentPatterns returns the patterns in effect; a reload replaces them as
+// a whole, so callers should use one value for each line
+func currentPatterns() *OutputPatterns {
+	return outputPatterns.Load()
+}
+
+// patternsFile is the JSON form of PATTERNS_FILE. Patterns left out keep
+// their built-in value; Locales override them for the language the
+// downloader runs in, e.g. "de" when DOWNLOADER_LOCALE is de_DE.UTF-8.
+type patternsFile struct {
+	Version string `json:"version"`
+	patternSources
+	Locales map[string]patternSources `json:"locales"`
+}
+
+type patternSources struct {
+	Track             string `json:"track"`
+	Percent           string `json:"percent"`
+	Speed             string `json:"speed"`
+	ETA               string `json:"eta"`
+	FormatUnavailable string `json:"format_unavailable"`
+	Transient         string `json:"transient"`
+
+	InvalidToken       string `json:"invalid_token"`
+	RegionMismatch     string `json:"region_mismatch"`
+	NotFound           string `json:"not_found"`
+	WrapperUnreachable string `json:"wrapper_unreachable"`
+	DiskFull           string `json:"disk_full"`
+}
+
+func parsePatterns(data []byte) (*OutputPatterns, error) {
+	var file patternsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Version == "" {
+		return nil, fmt.Errorf("version is required")
+	}
+
+	patterns := *builtinPatterns
+	patterns.Version = file.Version
+	if err := patterns.apply(file.patternSources); err != nil {
+		return nil, err
+	}
+	for language, sources := range file.Locales {
+		// Invalid patterns are reported whichever language is in use
+		var scratch OutputPatterns
+		if err := scratch.apply(sources); err != nil {
+			return nil, fmt.Errorf("locales.%s.%w", language, err)
+		}
+	}
+	if sources, ok := file.Locales[downloaderLanguage()]; ok {
+		patterns.apply(sources)
+	}
+	return &patterns, nil
+}
+
+// apply compiles the patterns set in sources over the current ones
+func (patterns *OutputPatterns) apply(sources patternSources) error {
+	for _, p := range []struct {
+		name   string
+		source string
+		groups int
+		target **regexp.Regexp
+	}{
+		{"track", sources.Track, 2, &patterns.Track},
+		{"percent", sources.Percent, 1, &patterns.Percent},
+		{"speed", sources.Speed, 1, &patterns.Speed},
+		{"eta", sources.ETA, 1, &patterns.ETA},
+		{"format_unavailable", sources.FormatUnavailable, 0, &patterns.FormatUnavailable},
+		{"transient", sources.Transient, 0, &patterns.Transient},
+		{"invalid_token", sources.InvalidToken, 0, &patterns.InvalidToken},
+		{"region_mismatch", sources.RegionMismatch, 0, &patterns.RegionMismatch},
+		{"not_found", sources.NotFound, 0, &patterns.NotFound},
+		{"wrapper_unreachable", sources.WrapperUnreachable, 0, &patterns.WrapperUnreachable},
+		{"disk_full", sources.DiskFull, 0, &patterns.DiskFull},
+	} {
+		if p.source == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.source)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+		if re.NumSubexp() < p.groups {
+			return fmt.Errorf("%s: needs %d capturing group(s)", p.name, p.groups)
+		}
+		*p.target = re
+	}
+	return nil
+}
+
+// PatternsLoader keeps the patterns in effect in sync with PATTERNS_FILE,
+// reloading it when it changes. A file that fails to load leaves the
+// previous patterns in place.
+type PatternsLoader struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	err     error
+}
+
+var patternsLoader *PatternsLoader
+
+func loadPatterns(path string) error {
+	patternsLoader = &PatternsLoader{path: path}
+	return patternsLoader.load()
+}
+
+func (pl *PatternsLoader) load() error {
+	info, err := os.Stat(pl.path)
+	if err != nil {
+		return pl.setErr(err)
+	}
+	// A file that failed to load is only reported again once it changes
+	pl.mu.Lock()
+	unchanged := info.ModTime().Equal(pl.modTime)
+	pl.modTime = info.ModTime()
+	pl.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(pl.path)
+	if err != nil {
+		return pl.setErr(err)
+	}
+	patterns, err := parsePatterns(data)
+	if err != nil {
+		return pl.setErr(fmt.Errorf("%s: %w", pl.path, err))
+	}
+
+	pl.setErr(nil)
+	if previous := outputPatterns.Swap(patterns); previous.Version != patterns.Version {
+		slog.Info("Using output patterns", "version", patterns.Version, "path", pl.path)
+	}
+	return nil
+}
+
+func (pl *PatternsLoader) setErr(err error) error {
+	pl.mu.Lock()
+	pl.err = err
+	pl.mu.Unlock()
+	return err
+}
+
+// watch reloads the file every interval
+func (pl *PatternsLoader) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := pl.load(); err != nil {
+			slog.Error("Failed to reload output patterns", "version", currentPatterns().Version, "error", err)
+		}
+	}
+}
+
+// check reports a file that failed to reload as degraded, since output is
+// still parsed with the previous patterns
+func (pl *PatternsLoader) check() HealthCheck {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.err != nil {
+		return HealthCheck{Status: "degraded", Error: pl.err.Error()}
+	}
+	return HealthCheck{Status: "ok"}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const postgresMirrorSchema = `
+CREATE TABLE IF NOT EXISTS amdl_jobs (
+	id               TEXT PRIMARY KEY,
+	url              TEXT NOT NULL,
+	status           TEXT NOT NULL,
+	owner            TEXT NOT NULL DEFAULT '',
+	priority         TEXT NOT NULL DEFAULT '',
+	batch_id         TEXT NOT NULL DEFAULT '',
+	error            TEXT NOT NULL DEFAULT '',
+	error_code       TEXT NOT NULL DEFAULT '',
+	format_obtained  TEXT NOT NULL DEFAULT '',
+	output_dir       TEXT NOT NULL DEFAULT '',
+	archived         BOOLEAN NOT NULL DEFAULT false,
+	started_at       TIMESTAMPTZ NOT NULL,
+	ended_at         TIMESTAMPTZ,
+	duration_seconds DOUBLE PRECISION,
+	labels           JSONB,
+	data             JSONB NOT NULL,
+	seq              BIGINT NOT NULL,
+	mirrored_at      TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS amdl_jobs_started_at ON amdl_jobs (started_at);
+CREATE TABLE IF NOT EXISTS amdl_tracks (
+	job_id           TEXT NOT NULL REFERENCES amdl_jobs (id) ON DELETE CASCADE,
+	path             TEXT NOT NULL,
+	disc             INTEGER,
+	number           INTEGER,
+	title            TEXT NOT NULL,
+	duration_seconds DOUBLE PRECISION,
+	format           TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (job_id, path)
+);
+`
+
+// Delay before changes that failed to apply are tried again
+const postgresMirrorRetryDelay = 30 * time.Second
+
+// PostgresMirror keeps copies of the job and track tables in PostgreSQL for
+// reporting tools. It follows the job changes feed: each job's latest state
+// is upserted, and purged jobs are deleted. Pending changes are coalesced
+// per job, so an unreachable database delays the mirror but never blocks
+// jobs or loses their final state.
+type PostgresMirror struct {
+	db   *sql.DB
+	wake chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]JobChange // by job ID
+
+	// Set while the last attempt to apply changes failed
+	failing atomic.Bool
+}
+
+// postgresMirror is nil unless POSTGRES_MIRROR_URL is set
+var postgresMirror *PostgresMirror
+
+func connectPostgresMirror() error {
+	db, err := sql.Open("postgres", cfg.PostgresMirrorURL)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(postgresMirrorSchema); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+	postgresMirror = &PostgresMirror{
+		db:      db,
+		wake:    make(chan struct{}, 1),
+		pending: map[string]JobChange{},
+	}
+	return nil
+}
+
+// backfill queues every job in memory, so the mirror catches up with
+// changes made while it wasn't running
+func (m *PostgresMirror) backfill() {
+	seq := jobChanges.latest()
+	for _, job := range jobManager.SnapshotAll() {
+		job.Logs = nil
+		m.enqueue(JobChange{Seq: seq, JobID: job.ID, Type: "status", Status: job.Status, Job: &job})
+	}
+}
+
+func (m *PostgresMirror) enqueue(change JobChange) {
+	m.mu.Lock()
+	if queued, ok := m.pending[change.JobID]; !ok || queued.Seq <= change.Seq {
+		m.pending[change.JobID] = change
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+func (m *PostgresMirror) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *PostgresMirror) run() {
+	for range m.wake {
+		m.mu.Lock()
+		changes := make([]JobChange, 0, len(m.pending))
+		for _, change := range m.pending {
+			changes = append(changes, change)
+		}
+		clear(m.pending)
+		m.mu.Unlock()
+		slices.SortFunc(changes, func(a, b JobChange) int { return cmp.Compare(a.Seq, b.Seq) })
+
+		for i, change := range changes {
+			err := m.apply(change)
+			integrationHealth.record("postgres_mirror", err)
+			if err != nil {
+				slog.Warn("Failed to mirror job, retrying", "component", "postgres_mirror", "job_id", change.JobID, "delay", postgresMirrorRetryDelay.Seconds(), "error", err)
+				m.failing.Store(true)
+				for _, unapplied := range changes[i:] {
+					m.requeue(unapplied)
+				}
+				time.AfterFunc(postgresMirrorRetryDelay, m.notify)
+				break
+			}
+			m.failing.Store(false)
+		}
+	}
+}
+
+// requeue puts back a change that wasn't applied, unless a newer one for
+// the job has arrived since
+func (m *PostgresMirror) requeue(change JobChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if queued, ok := m.pending[change.JobID]; !ok || queued.Seq < change.Seq {
+		m.pending[change.JobID] = change
+	}
+}
+
+// apply upserts or deletes the job a change is about, with its tracks
+func (m *PostgresMirror) apply(change JobChange) error {
+	if change.Type == "deleted" || change.Job == nil {
+		_, err := m.db.Exec(`DELETE FROM amdl_jobs WHERE id = $1`, change.JobID)
+		return err
+	}
+
+	job := change.Job
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	// JSONB is sent as text, as lib/pq would send []byte as bytea
+	var labels *string
+	if len(job.Labels) > 0 {
+		encoded, err := json.Marshal(job.Labels)
+		if err != nil {
+			return err
+		}
+		text := string(encoded)
+		labels = &text
+	}
+	var duration *float64
+	if d, err := time.ParseDuration(job.Duration); err == nil {
+		seconds := d.Seconds()
+		duration = &seconds
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A change that's older than what's mirrored, e.g. from a backfill
+	// racing a live change, leaves the row alone
+	result, err := tx.Exec(`INSERT INTO amdl_jobs (id, url, status, owner, priority, batch_id, error, error_code,
+			format_obtained, output_dir, archived, started_at, ended_at, duration_seconds, labels, data, seq, mirrored_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, now())
+		ON CONFLICT (id) DO UPDATE SET url = excluded.url, status = excluded.status, owner = excluded.owner,
+			priority = excluded.priority, batch_id = excluded.batch_id, error = excluded.error,
+			error_code = excluded.error_code, format_obtained = excluded.format_obtained,
+			output_dir = excluded.output_dir, archived = excluded.archived, started_at = excluded.started_at,
+			ended_at = excluded.ended_at, duration_seconds = excluded.duration_seconds, labels = excluded.labels,
+			data = excluded.data, seq = excluded.seq, mirrored_at = excluded.mirrored_at
+		WHERE amdl_jobs.seq <= excluded.seq`,
+		job.ID, job.URL, job.Status, job.Owner, job.Priority, job.BatchID, job.Error, job.ErrorCode,
+		job.FormatObtained, job.OutputDir, job.Archived, job.StartedAt, job.EndedAt, duration, labels, string(data),
+		int64(change.Seq))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM amdl_tracks WHERE job_id = $1`, job.ID); err != nil {
+		return err
+	}
+	for _, track := range job.Tracks {
+		_, err := tx.Exec(`INSERT INTO amdl_tracks (job_id, path, disc, number, title, duration_seconds, format)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING`,
+			job.ID, track.Path, track.Disc, track.Number, track.Title, track.Duration, track.Format)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *PostgresMirror) check() HealthCheck {
+	if m.failing.Load() {
+		return HealthCheck{Status: "degraded", Error: "failing to write to PostgreSQL"}
+	}
+	return HealthCheck{Status: "ok"}
+}
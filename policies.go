@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+)
+
+// PolicyRule changes or rejects the download requests matching it when
+// they're submitted, e.g. to use a template for playlists or to keep Atmos
+// downloads to some API keys. A rule matches a request that meets Match and
+// doesn't meet Unless.
+type PolicyRule struct {
+	Name   string       `json:"name"`
+	Match  PolicyMatch  `json:"match"`
+	Unless *PolicyMatch `json:"unless,omitempty"`
+
+	// Request options applied over the request's own, in the form of a
+	// download request without a URL. A template they name fills the
+	// options still unset afterwards.
+	Set json.RawMessage `json:"set,omitempty"`
+
+	// Rejects matching requests with this message
+	Deny string `json:"deny,omitempty"`
+}
+
+// PolicyMatch lists the conditions a request has to meet; each one left
+// empty is met by any request
+type PolicyMatch struct {
+	URLTypes    []string `json:"url_type,omitempty"`   // album, song, playlist, ...
+	Storefronts []string `json:"storefront,omitempty"` // e.g. "jp"
+	Formats     []string `json:"format,omitempty"`     // any requested format
+	Owners      []string `json:"owner,omitempty"`      // patterns such as "telegram:*"
+	APIKeys     []string `json:"api_key,omitempty"`    // names of API keys
+	Labels      Labels   `json:"labels,omitempty"`     // "*" accepts any value
+}
+
+// errPolicyDenied is returned for requests a policy rejects
+var errPolicyDenied = errors.New("Denied by policy")
+
+var policyRules []PolicyRule
+
+// loadPolicyRules reads the JSON list of rules at POLICY_RULES_FILE
+func loadPolicyRules(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rules []PolicyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	names := map[string]bool{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule #%d: name is required", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule %s: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+		if (len(rule.Set) == 0) == (rule.Deny == "") {
+			return fmt.Errorf("rule %s: either set or deny is required", rule.Name)
+		}
+		if len(rule.Set) > 0 {
+			var req DownloadRequest
+			if err := json.Unmarshal(rule.Set, &req); err != nil {
+				return fmt.Errorf("rule %s: invalid set: %w", rule.Name, err)
+			}
+			if req.URL != "" || len(req.URLs) > 0 {
+				return fmt.Errorf("rule %s: set must not include url or urls", rule.Name)
+			}
+			if err := req.validateOptions(); err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+		}
+	}
+
+	policyRules = rules
+	slog.Info("Loaded policy rules", "rules", len(rules), "path", path)
+	return nil
+}
+
+// matches reports whether req meets every condition of m
+func (m PolicyMatch) matches(req *DownloadRequest) bool {
+	if len(m.URLTypes) > 0 || len(m.Storefronts) > 0 {
+		parsed, err := parseAppleMusicURL(req.URL)
+		if err != nil {
+			return false
+		}
+		if len(m.URLTypes) > 0 && !slices.Contains(m.URLTypes, parsed.Type) {
+			return false
+		}
+		if len(m.Storefronts) > 0 && !slices.Contains(m.Storefronts, parsed.Storefront) {
+			return false
+		}
+	}
+	if len(m.Formats) > 0 {
+		formats := req.Format
+		if len(formats) == 0 {
+			formats = FormatList{"alac"}
+		}
+		if !slices.ContainsFunc(formats, func(format string) bool { return slices.Contains(m.Formats, format) }) {
+			return false
+		}
+	}
+	if len(m.Owners) > 0 && !slices.ContainsFunc(m.Owners, func(pattern string) bool {
+		matched, _ := path.Match(pattern, req.Owner)
+		return matched
+	}) {
+		return false
+	}
+	if len(m.APIKeys) > 0 && !slices.Contains(m.APIKeys, req.APIKey) {
+		return false
+	}
+	for key, want := range m.Labels {
+		value, ok := req.Labels[key]
+		if !ok || (want != "*" && value != want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule PolicyRule) matches(req *DownloadRequest) bool {
+	return rule.Match.matches(req) && (rule.Unless == nil || !rule.Unless.matches(req))
+}
+
+// applyPolicies runs the policy rules on a submitted request in order,
+// recording the names of those that matched in req.Policies. A rule that
+// denies the request stops it with errPolicyDenied; the owner and API key
+// have to be set beforehand.
+func applyPolicies(req *DownloadRequest) error {
+	template := req.Template
+	for _, rule := range policyRules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Deny != "" {
+			slog.Info("Policy denied a request", "policy", rule.Name, "url", req.URL, "owner", req.Owner)
+			return fmt.Errorf("%w %s: %s", errPolicyDenied, rule.Name, rule.Deny)
+		}
+		if err := json.Unmarshal(rule.Set, req); err != nil {
+			return fmt.Errorf("policy %s: %w", rule.Name, err)
+		}
+		req.Policies = append(req.Policies, rule.Name)
+	}
+
+	// A template named by a policy is applied like one named by the request
+	if req.Template != template {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		return applyTemplate(req, body)
+	}
+	return nil
+}
+
+// writeSubmitError answers a request prepareRequest rejected: 403 when a
+// policy denied it, and otherwise as validationStatus has it
+func writeSubmitError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPolicyDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), validationStatus(err))
+}
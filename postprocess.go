@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Artifact is a file produced by a job, recorded in its manifest
+type Artifact struct {
+	Path string `json:"path"` // relative to DOWNLOADS_DIR
+	Kind string `json:"kind"`
+	Size int64  `json:"size"`
+
+	// Audio stream of audio files, when ffprobe could read it
+	Audio *AudioQuality `json:"audio,omitempty"`
+
+	// Gapless info of AAC files
+	Gapless *GaplessInfo `json:"gapless,omitempty"`
+
+	// Recorded by the checksums check of verification
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+var artifactKinds = map[string]string{
+	".m4a":  "audio",
+	".mp4":  "video",
+	".m4v":  "video",
+	".jpg":  "artwork",
+	".jpeg": "artwork",
+	".png":  "artwork",
+	".lrc":  "lyrics",
+	".ttml": "lyrics",
+	".pdf":  "booklet",
+	".cue":  "cue_sheet",
+}
+
+func artifactKind(path string) string {
+	if isMotionArtwork(path) {
+		return "motion_artwork"
+	}
+	if strings.HasSuffix(strings.ToLower(path), chaptersSuffix) {
+		return "chapters"
+	}
+	if kind, ok := artifactKinds[strings.ToLower(filepath.Ext(path))]; ok {
+		return kind
+	}
+	return "other"
+}
+
+// publishOutput moves the files the job saved into its staging directory
+// to the same places under DOWNLOADS_DIR and returns their new paths. Files
+// that already exist there are replaced with overwrite, and otherwise kept,
+// like the downloader does, and left out of the list. Hidden files and
+// directories are skipped.
+func publishOutput(jobID string, overwrite bool) ([]string, error) {
+	stage := jobStagingDir(jobID)
+	var files []string
+	var counts moveCounts
+	err := filepath.WalkDir(stage, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == stage && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != stage {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(stage, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(cfg.DownloadsDir, rel)
+		result, err := moveFile(path, target, overwrite)
+		if err != nil {
+			return err
+		}
+		counts.add(result)
+		if result != moveKept {
+			files = append(files, target)
+		}
+		return nil
+	})
+	counts.log(jobID)
+	return files, err
+}
+
+// postProcess publishes the files a job produced, runs the output
+// profile's steps on them and records them in the job's manifest. Failures
+// are reported in the job's log and events without failing the download.
+func postProcess(jobID string, req DownloadRequest) {
+	if _, err := os.Stat(cfg.DownloadsDir); err != nil {
+		return
+	}
+
+	files, err := publishOutput(jobID, req.Overwrite == "overwrite")
+	if err != nil {
+		postProcessWarning(jobID, fmt.Errorf("failed to move output files: %w", err))
+	}
+
+	profile := resolveOutputProfile(req)
+	if profile.Artwork.Mode == "embed" && profile.Artwork.RemoveCoverFiles {
+		files = removeCoverFiles(files)
+	}
+	if profile.Extras.RemoveBooklets && !profile.Extras.Booklet {
+		files = removeBooklets(files)
+	}
+
+	var audio []string
+	for _, path := range files {
+		if artifactKind(path) == "audio" {
+			audio = append(audio, path)
+		}
+	}
+
+	if (profile.Tagging.enabled() || len(profile.TagRules) > 0) && len(audio) > 0 {
+		if err := tagFiles(jobID, req, profile, audio); err != nil {
+			postProcessWarning(jobID, fmt.Errorf("tagging failed: %w", err))
+		} else {
+			jobManager.AppendLog(jobID, fmt.Sprintf("Tagged %d file(s)", len(audio)))
+		}
+	}
+
+	if profile.laysOut(req.OutputDir) {
+		moved, err := layoutFiles(jobID, files, req.OutputDir, profile, req.Overwrite == "overwrite")
+		if err != nil {
+			postProcessWarning(jobID, fmt.Errorf("moving files failed: %w", err))
+		}
+		files = moved
+	}
+
+	if profile.organizes() {
+		renamed, err := organizeFiles(jobID, files, profile, req.Overwrite == "overwrite")
+		if err != nil {
+			postProcessWarning(jobID, fmt.Errorf("renaming files failed: %w", err))
+		} else {
+			files = renamed
+		}
+	}
+
+	gapless := checkGapless(jobID, files, profile.RepairGapless)
+	recordArtifacts(jobID, files, gapless)
+
+	if profile.Artwork.Motion && !slices.ContainsFunc(files, isMotionArtwork) {
+		jobManager.AddEvent(jobID, JobEvent{Type: "motion_artwork_unavailable", Message: "No motion artwork was saved for this release"})
+	}
+	if profile.Extras.Booklet && !slices.ContainsFunc(files, func(path string) bool { return artifactKind(path) == "booklet" }) {
+		jobManager.AddEvent(jobID, JobEvent{Type: "booklet_unavailable", Message: "No digital booklet was saved for this release"})
+	}
+}
+
+func postProcessWarning(jobID string, err error) {
+	jobManager.AddEvent(jobID, JobEvent{Type: "postprocess_warning", Message: err.Error()})
+	jobManager.AppendLog(jobID, fmt.Sprintf("Post-processing: %v", err))
+	slog.Warn("Post-processing warning", "job_id", jobID, "error", err)
+}
+
+// recordArtifacts lists the files in the job's manifest, keeping booklets,
+// videos and motion artwork separately under extras
+func recordArtifacts(jobID string, files []string, gapless map[string]*GaplessInfo) {
+	var artifacts, extras []Artifact
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(cfg.DownloadsDir, path)
+		if err != nil {
+			rel = path
+		}
+		artifact := Artifact{Path: filepath.ToSlash(rel), Kind: artifactKind(path), Size: info.Size(), Gapless: gapless[path]}
+		if extraKinds[artifact.Kind] {
+			extras = append(extras, artifact)
+		} else {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		job.Artifacts = artifacts
+		job.Extras = extras
+		job.OutputDir = outputDir(append(append([]Artifact{}, artifacts...), extras...))
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stageDownload writes the files a download of the album saved into the
+// job's staging directory
+func stageDownload(t *testing.T, jobID, content string) {
+	t.Helper()
+	jobManager.jobs[jobID] = &DownloadStatus{ID: jobID, Status: "running"}
+	for name, data := range map[string]string{
+		"Artist/Album/01 Song.m4a": content,
+		"Artist/Album/cover.jpg":   content,
+	} {
+		path := filepath.Join(jobStagingDir(jobID), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPostProcessRedownloadIntoLayout(t *testing.T) {
+	tests := []struct {
+		overwrite string
+		want      string
+		artifacts int // of the second download
+	}{
+		{"", "first", 0},
+		{"skip", "first", 0},
+		{"overwrite", "second", 2},
+	}
+	for _, tt := range tests {
+		t.Run("overwrite="+tt.overwrite, func(t *testing.T) {
+			cfg = &Config{DownloadsDir: t.TempDir()}
+			jobManager = NewJobManager()
+
+			for i, content := range []string{"first", "second"} {
+				jobID := []string{"job-1", "job-2"}[i]
+				stageDownload(t, jobID, content)
+				postProcess(jobID, DownloadRequest{OutputDir: "Library", Overwrite: tt.overwrite})
+
+				for _, event := range jobManager.jobs[jobID].Events {
+					if event.Type == "postprocess_warning" {
+						t.Errorf("%s: %s", jobID, event.Message)
+					}
+				}
+			}
+
+			for _, name := range []string{"01 Song.m4a", "cover.jpg"} {
+				data, err := os.ReadFile(filepath.Join(cfg.DownloadsDir, "Library", "Artist", "Album", name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != tt.want {
+					t.Errorf("%s holds %q, want %q", name, data, tt.want)
+				}
+			}
+			// Nothing is left behind in the layout the downloader saved in
+			if _, err := os.Stat(filepath.Join(cfg.DownloadsDir, "Artist")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("files left outside the output directory: %v", err)
+			}
+
+			if got := len(jobManager.jobs["job-2"].Artifacts); got != tt.artifacts {
+				t.Errorf("second download has %d artifacts, want %d", got, tt.artifacts)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const preferencesFile = "preferences.json"
+
+// Preferences are a user's defaults, applied to requests that leave the
+// corresponding fields empty
+type Preferences struct {
+	Format        string `json:"format,omitempty"`
+	OutputProfile string `json:"output_profile,omitempty"`
+	Notify        string `json:"notify,omitempty"`
+	Overwrite     string `json:"overwrite,omitempty"`
+}
+
+var (
+	validFormats    = []string{"", "alac", "atmos", "aac"}
+	overwritePolicy = []string{"", "skip", "overwrite"}
+)
+
+func (p Preferences) validate() error {
+	if !slices.Contains(validFormats, p.Format) {
+		return fmt.Errorf("format must be alac, atmos or aac")
+	}
+	if !slices.Contains(overwritePolicy, p.Overwrite) {
+		return fmt.Errorf("overwrite must be skip or overwrite")
+	}
+	if _, err := parseNotifyChannel(p.Notify); err != nil {
+		return err
+	}
+	if !outputProfileExists(p.OutputProfile) {
+		return fmt.Errorf("unknown output profile %q", p.OutputProfile)
+	}
+	return nil
+}
+
+type PreferenceStore struct {
+	mu    sync.RWMutex
+	users map[string]Preferences
+}
+
+var preferenceStore = &PreferenceStore{users: map[string]Preferences{}}
+
+func (ps *PreferenceStore) load() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return loadState(preferencesFile, &ps.users)
+}
+
+func (ps *PreferenceStore) Get(user string) Preferences {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.users[user]
+}
+
+func (ps *PreferenceStore) Set(user string, prefs Preferences) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if prefs == (Preferences{}) {
+		delete(ps.users, user)
+	} else {
+		ps.users[user] = prefs
+	}
+	return saveState(preferencesFile, ps.users)
+}
+
+// parseNotifyChannel parses a notification channel, "<type>:<target>" with
+// the type of a routing notifier: "telegram:<chat id>", "email:<address>",
+// "discord:<url>", "ntfy:<url>" or "webhook:<webhook id or url>". An empty
+// channel is no channel. As clients pick it, URLs are checked like
+// callback URLs and mail only goes to NOTIFY_EMAIL_RECIPIENTS.
+func parseNotifyChannel(channel string) (*RouteNotifier, error) {
+	if channel == "" {
+		return nil, nil
+	}
+	typ, target, ok := strings.Cut(channel, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("notify must be <type>:<target>, e.g. telegram:<chat id>")
+	}
+	n := RouteNotifier{Type: typ, restricted: true}
+	switch typ {
+	case "telegram":
+		chatID, err := strconv.ParseInt(target, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("notify: invalid chat id %q", target)
+		}
+		n.ChatID = chatID
+	case "email":
+		n.To = target
+	case "webhook":
+		if isHTTPURL(target) {
+			n.URL = target
+		} else {
+			n.WebhookID = target
+		}
+	default:
+		n.URL = target
+	}
+	if err := n.validate(); err != nil {
+		return nil, fmt.Errorf("notify: %w", err)
+	}
+	if n.URL != "" {
+		if err := checkClientURL("notify", n.URL); err != nil {
+			return nil, err
+		}
+	}
+	if n.To != "" && !emailAddressListed(cfg.NotifyEmailRecipients, strings.ToLower(n.To)) {
+		return nil, fmt.Errorf("notify: %s isn't in NOTIFY_EMAIL_RECIPIENTS", n.To)
+	}
+	return &n, nil
+}
+
+// jobFinishedNotify sends the summary of a finished job to the
+// notification channel it was requested with
+func jobFinishedNotify(job DownloadStatus) {
+	if job.Request == nil || job.Request.Notify == "" {
+		return
+	}
+	n, err := parseNotifyChannel(job.Request.Notify)
+	if err != nil {
+		slog.Warn("Invalid notification channel", "job_id", job.ID, "notify", job.Request.Notify, "error", err)
+		return
+	}
+	job.Logs = nil
+	ev := WebhookEvent{Event: "job." + job.Status, Time: time.Now(), Job: &job}
+	id := uuid.New().String()
+	n.send(ev, func(format string) any {
+		if format == "cloudevents" {
+			return ev.cloudEvent(id, job.Trace)
+		}
+		return ev
+	}, job.Trace)
+}
+
+// applyPreferences fills unset request options from the owner's preferences
+func applyPreferences(req *DownloadRequest) {
+	prefs := preferenceStore.Get(req.Owner)
+	if len(req.Format) == 0 && prefs.Format != "" {
+		req.Format = FormatList{prefs.Format}
+	}
+	if req.OutputProfile == "" {
+		req.OutputProfile = prefs.OutputProfile
+	}
+	if req.Notify == "" {
+		req.Notify = prefs.Notify
+	}
+	if req.Overwrite == "" {
+		req.Overwrite = prefs.Overwrite
+	}
+}
+
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	user := requestOwner(r, "anonymous")
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var prefs Preferences
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := prefs.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := preferenceStore.Set(user, prefs); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save preferences", "user", user, "error", err)
+			http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		if err := preferenceStore.Set(user, Preferences{}); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save preferences", "user", user, "error", err)
+			http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"user":        user,
+		"preferences": preferenceStore.Get(user),
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Size of the cover art linked from previews, in pixels
+const previewArtworkSize = "600"
+
+// PreviewTrack is a track of previewed content. Formats is empty for tracks
+// that can't be streamed in the storefront.
+type PreviewTrack struct {
+	ID         string   `json:"id"`
+	Disc       int      `json:"disc,omitempty"`
+	Number     int      `json:"number,omitempty"`
+	Name       string   `json:"name"`
+	Artist     string   `json:"artist,omitempty"`
+	DurationMS int64    `json:"duration_ms"`
+	Explicit   bool     `json:"explicit,omitempty"`
+	Video      bool     `json:"video,omitempty"`
+	Formats    []string `json:"formats"`
+}
+
+// PreviewAlbum is a release of a previewed artist
+type PreviewAlbum struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ReleaseDate string `json:"release_date,omitempty"`
+	TrackCount  int    `json:"track_count"`
+	URL         string `json:"url"`
+}
+
+// Preview describes content returned by GET /preview, for a confirmation
+// before it's downloaded. Track counts, durations and formats cover the
+// tracks that can be downloaded; artists list their releases instead.
+type Preview struct {
+	URL           string         `json:"url"`
+	ContentType   string         `json:"content_type"`
+	ID            string         `json:"id"`
+	Storefront    string         `json:"storefront"`
+	Name          string         `json:"name"`
+	Artist        string         `json:"artist,omitempty"`
+	Album         string         `json:"album,omitempty"`
+	ReleaseDate   string         `json:"release_date,omitempty"`
+	ContentRating string         `json:"content_rating,omitempty"`
+	ArtworkURL    string         `json:"artwork_url,omitempty"`
+	TrackCount    int            `json:"track_count"`
+	DurationMS    int64          `json:"duration_ms"`
+	Duration      string         `json:"duration,omitempty"`
+	Formats       []string       `json:"formats"`
+	HiRes         bool           `json:"hi_res"`
+	Tracks        []PreviewTrack `json:"tracks,omitempty"`
+	Albums        []PreviewAlbum `json:"albums,omitempty"`
+}
+
+// artworkURL fills in the size of a catalog artwork URL template
+func artworkURL(template string) string {
+	return strings.NewReplacer("{w}", previewArtworkSize, "{h}", previewArtworkSize).Replace(template)
+}
+
+func previewContent(link AppleMusicURL, rawURL, storefront, language string) (*Preview, error) {
+	resource, err := appleMusic.Resource(storefront, link.Type, link.ID, language)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := resource.Attributes
+	preview := &Preview{
+		URL:           rawURL,
+		ContentType:   link.ContentType(),
+		ID:            link.ID,
+		Storefront:    storefront,
+		Name:          attrs.Name,
+		Artist:        cmp.Or(attrs.ArtistName, attrs.CuratorName),
+		ReleaseDate:   attrs.ReleaseDate,
+		ContentRating: attrs.ContentRating,
+		ArtworkURL:    artworkURL(attrs.Artwork.URL),
+		Formats:       []string{},
+	}
+
+	if link.Type == "artist" {
+		albums, err := appleMusic.ArtistAlbums(storefront, link.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			preview.TrackCount += album.Attributes.TrackCount
+			preview.Albums = append(preview.Albums, PreviewAlbum{
+				ID:          album.ID,
+				Name:        album.Attributes.Name,
+				ReleaseDate: album.Attributes.ReleaseDate,
+				TrackCount:  album.Attributes.TrackCount,
+				URL:         album.Attributes.URL,
+			})
+		}
+		return preview, nil
+	}
+
+	tracks := catalogTracks(resource, link.SongID)
+	if link.SongID != "" {
+		if len(tracks) == 0 {
+			return nil, errCatalogNotFound
+		}
+		song := tracks[0].Attributes
+		preview.ID, preview.Album = link.SongID, attrs.Name
+		preview.Name, preview.Artist, preview.ContentRating = song.Name, song.ArtistName, song.ContentRating
+	}
+
+	for _, track := range tracks {
+		video := track.Type == "music-videos"
+		item := PreviewTrack{
+			ID:         track.ID,
+			Disc:       track.Attributes.DiscNumber,
+			Number:     track.Attributes.TrackNumber,
+			Name:       track.Attributes.Name,
+			Artist:     track.Attributes.ArtistName,
+			DurationMS: track.Attributes.DurationInMillis,
+			Explicit:   track.Attributes.ContentRating == "explicit",
+			Video:      video,
+			Formats:    trackFormats(track),
+		}
+		preview.Tracks = append(preview.Tracks, item)
+
+		// Bonus videos come with albums as extras rather than as tracks
+		if track.Attributes.PlayParams == nil || (video && link.Type != "music-video") {
+			continue
+		}
+		preview.TrackCount++
+		preview.DurationMS += item.DurationMS
+		preview.HiRes = preview.HiRes || slices.Contains(track.Attributes.AudioTraits, "hi-res-lossless")
+		for _, format := range item.Formats {
+			if !slices.Contains(preview.Formats, format) {
+				preview.Formats = append(preview.Formats, format)
+			}
+		}
+	}
+	slices.SortFunc(preview.Formats, func(a, b string) int {
+		return slices.Index(catalogFormats, a) - slices.Index(catalogFormats, b)
+	})
+	preview.Duration = (time.Duration(preview.DurationMS) * time.Millisecond).Round(time.Second).String()
+	return preview, nil
+}
+
+// handlePreview serves GET /preview, what a link points at according to the
+// catalog, so clients can confirm before creating a job
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("url") == "" {
+		http.Error(w, "URL is required", http.StatusBadRequest)
+		return
+	}
+	rawURL, link, err := normalizeAppleMusicURL(query.Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	language := query.Get("language")
+	if err := validateLanguage(language); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid language: %v", err), http.StatusBadRequest)
+		return
+	}
+	storefront := cmp.Or(query.Get("storefront"), cfg.Storefront)
+
+	preview, err := previewContent(link, rawURL, storefront, language)
+	if errors.Is(err, errCatalogNotFound) {
+		http.Error(w, "Not found in catalog", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Preview failed", "url", rawURL, "error", err)
+		http.Error(w, fmt.Sprintf("Preview failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Problem is an RFC 7807 error response. Code is stable, for clients to
+// branch on, and Type is the same code as a URI; Detail is the message,
+// translated into the client's language.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+const problemTypePrefix = "urn:amdl:problem:"
+
+// Codes of error messages, matched by prefix in order, so details after
+// the fixed part of a message don't change its code
+var problemCodes = []struct{ prefix, code string }{
+	{"Job not found", "job_not_found"},
+	{"Batch not found", "batch_not_found"},
+	{"Collection not found", "collection_not_found"},
+	{"Delivery not found", "delivery_not_found"},
+	{"File not found", "file_not_found"},
+	{"Import not found", "import_not_found"},
+	{"Migration not found", "migration_not_found"},
+	{"Schedule not found", "schedule_not_found"},
+	{"Template not found", "template_not_found"},
+	{"Watch not found", "watch_not_found"},
+	{"Webhook not found", "webhook_not_found"},
+	{"Integration not found", "integration_not_found"},
+	{"Not found in catalog", "catalog_not_found"},
+	{"Invalid or missing API key", "invalid_api_key"},
+	{"Invalid API key", "invalid_api_key"},
+	{"API key is read-only", "read_only_api_key"},
+	{"Invalid token", "invalid_token"},
+	{"Invalid ingest token", "invalid_token"},
+	{"Invalid signature", "invalid_signature"},
+	{"Invalid request signature", "invalid_signature"},
+	{"Link expired", "link_expired"},
+	{"Denied by policy", "policy_denied"},
+	{"Quick submission is disabled", "submission_disabled"},
+	{"Extension submission is disabled", "submission_disabled"},
+	{"Unknown output profile", "unknown_output_profile"},
+	{"Job is not running", "job_not_running"},
+	{"Job is ", "job_state_conflict"},
+	{"Template already exists", "template_exists"},
+	{"Schedule already ran", "schedule_already_ran"},
+	{"Album has multiple editions", "multiple_editions"},
+}
+
+// Codes of other errors, by status
+var statusProblemCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusBadGateway:            "upstream_failed",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "upstream_timeout",
+}
+
+func problemCode(status int, message string) string {
+	for _, entry := range problemCodes {
+		if strings.HasPrefix(message, entry.prefix) {
+			return entry.code
+		}
+	}
+	if code, ok := statusProblemCodes[status]; ok {
+		return code
+	}
+	return fmt.Sprintf("http_%d", status)
+}
+
+// problemErrors turns the plain-text error responses written with
+// http.Error into problem+json, with the message translated into the
+// language the client asked for
+func problemErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&problemWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+type problemWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	status  int // of an error response
+	written bool
+}
+
+func (pw *problemWriter) WriteHeader(code int) {
+	// http.Error marks its responses with nosniff
+	h := pw.Header()
+	if code >= 400 && h.Get("X-Content-Type-Options") == "nosniff" && strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+		pw.status = code
+		h.Set("Content-Type", "application/problem+json")
+		if lang := requestLanguage(pw.r); lang != "en" {
+			h.Set("Content-Language", lang)
+		}
+	}
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *problemWriter) Write(p []byte) (int, error) {
+	if pw.status == 0 {
+		return pw.ResponseWriter.Write(p)
+	}
+	// http.Error writes the message at once; anything after it is dropped
+	if pw.written {
+		return len(p), nil
+	}
+	pw.written = true
+
+	problem := newProblem(pw.r, pw.status, strings.TrimSuffix(string(p), "\n"))
+	if err := json.NewEncoder(pw.ResponseWriter).Encode(problem); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func newProblem(r *http.Request, status int, message string) Problem {
+	code := problemCode(status, message)
+	return Problem{
+		Type:      problemTypePrefix + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    translateError(requestLanguage(r), message),
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: requestIDFrom(r.Context()),
+	}
+}
+
+// writeProblem answers with a problem carrying extension members, such as
+// the choices of a conflict, which http.Error can't
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, message string, extensions map[string]any) {
+	data, err := json.Marshal(newProblem(r, status, message))
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	// The problem's own members take precedence
+	body := maps.Clone(extensions)
+	if err := json.Unmarshal(data, &body); err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	if lang := requestLanguage(r); lang != "en" {
+		w.Header().Set("Content-Language", lang)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (pw *problemWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades through, since they check for
+// http.Hijacker directly
+func (pw *problemWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(pw.ResponseWriter).Hijack()
+}
@@ -0,0 +1,23 @@
+//go:build !unix && !windows
+
+package main
+
+import "os/exec"
+
+const defaultDownloaderPath = "apple-music-dl"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func attachProcess(cmd *exec.Cmd) error { return nil }
+
+func releaseProcess(cmd *exec.Cmd) {}
+
+// terminateProcess kills the process outright where there are no signals
+// to ask it to exit
+func terminateProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
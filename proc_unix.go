@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const defaultDownloaderPath = "/usr/local/bin/apple-music-dl"
+
+// setProcessGroup starts cmd in its own process group so signals reach any
+// helpers the downloader spawns as well
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// attachProcess is called once cmd has started; process groups need no
+// further setup
+func attachProcess(cmd *exec.Cmd) error { return nil }
+
+// releaseProcess is called once cmd has exited
+func releaseProcess(cmd *exec.Cmd) {}
+
+// terminateProcess asks the process group of cmd to exit
+func terminateProcess(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcess kills the process group of cmd
+func killProcess(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
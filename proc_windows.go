@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Looked up in PATH
+const defaultDownloaderPath = "apple-music-dl.exe"
+
+// Job objects holding the running downloaders and the processes they
+// start, by PID
+var jobObjects = struct {
+	sync.Mutex
+	handles map[int]windows.Handle
+}{handles: map[int]windows.Handle{}}
+
+// setProcessGroup starts cmd in a new console process group so it can be
+// sent CTRL_BREAK_EVENT without the wrapper receiving it too
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+// attachProcess puts the started process in a job object, so the processes
+// it starts can be killed with it. Whatever is still running in the job
+// when it's released is killed as well.
+func attachProcess(cmd *exec.Cmd) error {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return err
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+	defer windows.CloseHandle(process)
+	if err := windows.AssignProcessToJobObject(job, process); err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+
+	jobObjects.Lock()
+	defer jobObjects.Unlock()
+	jobObjects.handles[cmd.Process.Pid] = job
+	return nil
+}
+
+// releaseProcess closes the job object of cmd once it has exited
+func releaseProcess(cmd *exec.Cmd) {
+	jobObjects.Lock()
+	defer jobObjects.Unlock()
+	if job, exists := jobObjects.handles[cmd.Process.Pid]; exists {
+		windows.CloseHandle(job)
+		delete(jobObjects.handles, cmd.Process.Pid)
+	}
+}
+
+// terminateProcess asks cmd to exit with CTRL_BREAK_EVENT, which needs a
+// console shared with the wrapper; without one it's killed right away
+func terminateProcess(cmd *exec.Cmd) error {
+	if err := windows.GenerateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(cmd.Process.Pid)); err != nil {
+		return killProcess(cmd)
+	}
+	return nil
+}
+
+// killProcess terminates every process in the job object of cmd
+func killProcess(cmd *exec.Cmd) error {
+	jobObjects.Lock()
+	defer jobObjects.Unlock()
+	job, exists := jobObjects.handles[cmd.Process.Pid]
+	if !exists {
+		return cmd.Process.Kill()
+	}
+	return windows.TerminateJobObject(job, 1)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"golang.org/x/text/language"
+)
+
+// OutputProfile groups the post-download processing options selected by a
+// request's output_profile
+type OutputProfile struct {
+	Tagging TaggingOptions `json:"tagging"`
+
+	Artwork ArtworkOptions `json:"artwork"`
+	Extras  ExtrasOptions  `json:"extras"`
+
+	// Language for tags and file names, e.g. "ja" or "en-US", independent
+	// of the storefront the audio comes from
+	MetadataLanguage string `json:"metadata_language,omitempty"`
+
+	// Rewrite rules applied to every tag after tagging
+	TagRules []TagRule `json:"tag_rules,omitempty"`
+
+	// Checks run on the files once they're downloaded, on top of the
+	// VERIFY_* defaults
+	Verify VerifyPolicy `json:"verify,omitempty"`
+
+	// Write missing or inconsistent iTunSMPB tags of AAC files from their
+	// edit lists
+	RepairGapless bool `json:"repair_gapless,omitempty"`
+
+	// Filename sanitization for the target filesystem: "windows", "fat" or
+	// "ascii"
+	Sanitize string `json:"sanitize,omitempty"`
+
+	// Unicode normalization form for file names: "nfc", "nfd", "nfkc" or
+	// "nfkd"
+	Normalize string `json:"normalize,omitempty"`
+
+	// Romanize non-Latin names: "romanized" or "both"
+	Transliterate string `json:"transliterate,omitempty"`
+
+	// Layout of the files under DOWNLOADS_DIR, filled from their tags: the
+	// directory of audio files, e.g. "{album_artist}/{album} ({year})", and
+	// their names without extension, e.g. "{disc}-{track:02} {title}"
+	DirTemplate  string `json:"dir_template,omitempty"`
+	FileTemplate string `json:"file_template,omitempty"`
+}
+
+var outputProfiles = map[string]OutputProfile{}
+
+func loadOutputProfiles(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	profiles := map[string]OutputProfile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for name, profile := range profiles {
+		if err := profile.Tagging.validate(); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := profile.Artwork.validate(); err != nil {
+			return fmt.Errorf("profile %q: artwork: %w", name, err)
+		}
+		if err := profile.Verify.validate(); err != nil {
+			return fmt.Errorf("profile %q: verify: %w", name, err)
+		}
+		if err := validateLanguage(profile.MetadataLanguage); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := profile.validateOrganize(); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := validateLayoutTemplate(profile.DirTemplate); err != nil {
+			return fmt.Errorf("profile %q: dir_template: %w", name, err)
+		}
+		if err := validateLayoutTemplate(profile.FileTemplate); err != nil {
+			return fmt.Errorf("profile %q: file_template: %w", name, err)
+		}
+		for i := range profile.TagRules {
+			if err := profile.TagRules[i].compile(); err != nil {
+				return fmt.Errorf("profile %q: %w", name, err)
+			}
+		}
+	}
+
+	outputProfiles = profiles
+	slog.Info("Loaded output profiles", "profiles", len(profiles), "path", path)
+	return nil
+}
+
+func outputProfileExists(name string) bool {
+	_, exists := outputProfiles[name]
+	return name == "" || exists
+}
+
+// resolveOutputProfile returns the request's output profile with its
+// per-request overrides applied
+func resolveOutputProfile(req DownloadRequest) OutputProfile {
+	profile := outputProfiles[req.OutputProfile]
+	profile.Tagging = profile.Tagging.merge(req.Tagging)
+	profile.Artwork = profile.Artwork.merge(req.Artwork)
+	profile.Extras = profile.Extras.merge(req.Extras)
+	profile.Verify = cfg.Verify.merge(&profile.Verify).merge(req.Verify)
+	if req.MetadataLanguage != "" {
+		profile.MetadataLanguage = req.MetadataLanguage
+	}
+	return profile
+}
+
+// validateLanguage checks a BCP 47 language tag such as "en-US"
+func validateLanguage(tag string) error {
+	if tag == "" {
+		return nil
+	}
+	if _, err := language.Parse(tag); err != nil {
+		return fmt.Errorf("%q is not a language tag", tag)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JobProgress is parsed from the downloader's output
+type JobProgress struct {
+	// Estimated share of the whole job that's done, counting finished
+	// tracks when the output names them
+	Percent      float64 `json:"percent"`
+	CurrentTrack int     `json:"current_track,omitempty"`
+	TotalTracks  int     `json:"total_tracks,omitempty"`
+	TrackPercent float64 `json:"track_percent,omitempty"`
+	Speed        string  `json:"speed,omitempty"`
+	ETA          string  `json:"eta,omitempty"` // of the current track
+
+	// Last line of output
+	Line string `json:"line,omitempty"`
+}
+
+// UnmarshalJSON also accepts the bare output line stored as progress by
+// earlier versions
+func (p *JobProgress) UnmarshalJSON(data []byte) error {
+	var line string
+	if json.Unmarshal(data, &line) == nil {
+		*p = JobProgress{Line: line}
+		return nil
+	}
+	type plain JobProgress
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// update returns the progress after line was output. Snapshots share the
+// previous value, so it's never modified.
+func (p *JobProgress) update(line string) *JobProgress {
+	next := &JobProgress{}
+	if p != nil {
+		*next = *p
+	}
+	next.Line = line
+
+	patterns := currentPatterns()
+	if m := patterns.Track.FindStringSubmatch(line); m != nil {
+		current, _ := strconv.Atoi(m[1])
+		total, _ := strconv.Atoi(m[2])
+		if current != next.CurrentTrack || total != next.TotalTracks {
+			next.CurrentTrack, next.TotalTracks = current, total
+			next.TrackPercent, next.Speed, next.ETA = 0, "", ""
+		}
+	}
+	if m := patterns.Percent.FindStringSubmatch(line); m != nil {
+		if percent, err := strconv.ParseFloat(m[1], 64); err == nil && percent <= 100 {
+			next.TrackPercent = percent
+		}
+	}
+	if m := patterns.Speed.FindStringSubmatch(line); m != nil {
+		next.Speed = m[1]
+	}
+	if m := patterns.ETA.FindStringSubmatch(line); m != nil {
+		next.ETA = m[1]
+	}
+
+	next.Percent = next.TrackPercent
+	if next.TotalTracks > 0 && next.CurrentTrack > 0 && next.CurrentTrack <= next.TotalTracks {
+		done := float64(next.CurrentTrack-1) + next.TrackPercent/100
+		next.Percent = done / float64(next.TotalTracks) * 100
+	}
+	next.Percent = float64(int(next.Percent*10)) / 10
+	return next
+}
+
+// complete returns the progress of a job that has finished successfully
+func (p *JobProgress) complete() *JobProgress {
+	next := &JobProgress{}
+	if p != nil {
+		*next = *p
+	}
+	next.CurrentTrack = next.TotalTracks
+	next.Percent, next.TrackPercent = 100, 100
+	next.Speed, next.ETA = "", ""
+	return next
+}
+
+// String renders the progress for chat clients, e.g.
+// "45.8% (track 5 of 12, 3.2 MB/s, 5s left)"
+func (p *JobProgress) String() string {
+	if p == nil {
+		return ""
+	}
+	var details []string
+	if p.TotalTracks > 0 {
+		details = append(details, fmt.Sprintf("track %d of %d", p.CurrentTrack, p.TotalTracks))
+	}
+	if p.Speed != "" {
+		details = append(details, p.Speed)
+	}
+	if p.ETA != "" {
+		details = append(details, p.ETA+" left")
+	}
+	if len(details) == 0 && p.Percent == 0 {
+		return p.Line
+	}
+	s := strconv.FormatFloat(p.Percent, 'f', -1, 64) + "%"
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// configureHTTPClient applies the outbound proxy and extra CA certificates
+// to the client shared by all integrations. Without OUTBOUND_PROXY the
+// standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY variables are honored.
+func configureHTTPClient() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.OutboundProxy != "" {
+		proxy, err := url.Parse(cfg.OutboundProxy)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("invalid OUTBOUND_PROXY %q", cfg.OutboundProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if len(cfg.ExtraCACerts) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range cfg.ExtraCACerts {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read CA certificates: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", path)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	httpClient.Transport = transport
+
+	// Through a proxy, the proxy's address is the one dialed, and callback
+	// URLs are only checked when they're submitted
+	callbacks := transport.Clone()
+	proxied := cfg.OutboundProxy != "" || slices.ContainsFunc([]string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"}, func(key string) bool {
+		return os.Getenv(key) != ""
+	})
+	if !proxied {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: callbackDialControl}
+		callbacks.DialContext = dialer.DialContext
+	}
+	callbackClient.Transport = callbacks
+	return nil
+}
+
+// outboundTLSConfig returns the TLS settings of the shared client, trusting
+// EXTRA_CA_CERTS, for integrations that don't speak HTTP
+func outboundTLSConfig() *tls.Config {
+	if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		return transport.TLSClientConfig.Clone()
+	}
+	return &tls.Config{}
+}
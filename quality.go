@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lowest sample rate Apple Music sells as Hi-Res Lossless
+const hiResSampleRate = 88200
+
+// AudioQuality is the audio stream of a downloaded file as ffprobe reports
+// it. Mismatch says how it falls short of the format that was downloaded,
+// the request's caps or what the catalog offers for the track.
+type AudioQuality struct {
+	Codec      string `json:"codec"`
+	BitDepth   int    `json:"bit_depth,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"` // Hz
+	Channels   int    `json:"channels,omitempty"`
+	Bitrate    int    `json:"bitrate,omitempty"` // bits per second
+	Mismatch   string `json:"mismatch,omitempty"`
+}
+
+// Audio codecs each format is delivered in
+var formatCodecs = map[string][]string{
+	"alac":  {"alac"},
+	"aac":   {"aac"},
+	"atmos": {"eac3", "ac3", "ac4"},
+}
+
+// String renders the quality like "ALAC 24-bit/96 kHz"
+func (q AudioQuality) String() string {
+	s := cmp.Or(codecFormats[q.Codec], strings.ToUpper(q.Codec))
+	switch {
+	case q.BitDepth > 0 && q.SampleRate > 0:
+		s += fmt.Sprintf(" %d-bit/%s kHz", q.BitDepth, kilohertz(q.SampleRate))
+	case q.SampleRate > 0:
+		s += fmt.Sprintf(" %s kHz", kilohertz(q.SampleRate))
+	}
+	return s
+}
+
+// kilohertz renders a sample rate like "44.1" or "96"
+func kilohertz(rate int) string {
+	return strconv.FormatFloat(float64(rate)/1000, 'f', -1, 64)
+}
+
+// downloaderAlacMax returns the alac-max of the downloader config, the
+// cap of ALAC downloads whose request sets none, or 0 when it isn't set
+func downloaderAlacMax() int {
+	data, err := os.ReadFile(cfg.DownloaderConfig)
+	if err != nil {
+		return 0
+	}
+	var config struct {
+		AlacMax int `yaml:"alac-max"`
+	}
+	if yaml.Unmarshal(data, &config) != nil {
+		return 0
+	}
+	return config.AlacMax
+}
+
+// qualityExpectation is what a job's audio files should be
+type qualityExpectation struct {
+	codecs  []string // of the formats that were obtained
+	alacMax int      // 0 when uncapped
+
+	// Catalog tracks of the job's link, to tell Hi-Res Lossless tracks;
+	// nil when the catalog couldn't be reached
+	catalog []catalogResource
+	album   bool
+}
+
+func newQualityExpectation(req DownloadRequest, obtained []string, lookupCatalog bool) qualityExpectation {
+	expect := qualityExpectation{alacMax: req.AlacMax}
+	for _, format := range obtained {
+		expect.codecs = append(expect.codecs, formatCodecs[format]...)
+	}
+	if expect.alacMax == 0 {
+		expect.alacMax = downloaderAlacMax()
+	}
+
+	if !lookupCatalog {
+		return expect
+	}
+	catalog, album, err := jobCatalog(req)
+	if err != nil {
+		slog.Warn("Catalog lookup for quality checks failed", "url", req.URL, "error", err)
+		return expect
+	}
+	expect.catalog, expect.album = catalog, album
+	return expect
+}
+
+// jobCatalog looks up the catalog tracks of a request's link, and whether
+// it links to an album
+func jobCatalog(req DownloadRequest) ([]catalogResource, bool, error) {
+	link, err := parseAppleMusicURL(req.URL)
+	if err != nil {
+		return nil, false, err
+	}
+	resource, err := appleMusic.Resource(link.Storefront, link.Type, link.ID, "")
+	if err != nil {
+		return nil, false, err
+	}
+	return catalogTracks(resource, link.SongID), link.Type == "album", nil
+}
+
+// catalogTrack finds the catalog track of a downloaded one, by its title
+// and position, or on albums by its position alone
+func (e qualityExpectation) catalogTrack(track Track) *catalogResource {
+	disc := max(track.Disc, 1)
+	var byTitle, byPosition *catalogResource
+	for i := range e.catalog {
+		attrs := e.catalog[i].Attributes
+		sameTitle := strings.EqualFold(attrs.Name, track.Title)
+		samePosition := attrs.TrackNumber == track.Number && max(attrs.DiscNumber, 1) == disc
+		switch {
+		case sameTitle && samePosition:
+			return &e.catalog[i]
+		case sameTitle && byTitle == nil:
+			byTitle = &e.catalog[i]
+		case samePosition && byPosition == nil:
+			byPosition = &e.catalog[i]
+		}
+	}
+	if byTitle != nil {
+		return byTitle
+	}
+	if e.album {
+		return byPosition
+	}
+	return nil
+}
+
+// mismatch describes how q falls short of the expectation for track, or
+// returns ""
+func (e qualityExpectation) mismatch(track Track, q AudioQuality) string {
+	if len(e.codecs) > 0 && !slices.Contains(e.codecs, q.Codec) {
+		var names []string
+		for _, codec := range e.codecs {
+			if name := codecFormats[codec]; !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		return fmt.Sprintf("got %s, expected %s", q, strings.Join(names, " or "))
+	}
+	if q.Codec != "alac" {
+		return ""
+	}
+	if e.alacMax > 0 && q.SampleRate > e.alacMax {
+		return fmt.Sprintf("got %s, above the %s kHz cap", q, kilohertz(e.alacMax))
+	}
+
+	catalog := e.catalogTrack(track)
+	if catalog == nil || !slices.Contains(catalog.Attributes.AudioTraits, "hi-res-lossless") {
+		return ""
+	}
+	if e.alacMax == 0 || e.alacMax >= hiResSampleRate {
+		if q.BitDepth < 24 || q.SampleRate < hiResSampleRate {
+			return fmt.Sprintf("got %s, expected Hi-Res Lossless (24-bit, %s kHz or more)", q, kilohertz(hiResSampleRate))
+		}
+	} else if q.BitDepth < 24 {
+		return fmt.Sprintf("got %s, expected 24-bit", q)
+	}
+	return ""
+}
+
+// recordQuality stores the probed quality of the job's audio files, by
+// path, in its artifacts, and adds a quality_mismatch event when some
+// aren't what was expected
+func recordQuality(jobID string, tracks []Track, qualities map[string]AudioQuality, expect qualityExpectation) {
+	var mismatched []string
+	for _, track := range tracks {
+		q, ok := qualities[track.Path]
+		if !ok {
+			continue
+		}
+		if q.Mismatch = expect.mismatch(track, q); q.Mismatch != "" {
+			mismatched = append(mismatched, fmt.Sprintf("%s: %s", path.Base(track.Path), q.Mismatch))
+			jobManager.AppendLog(jobID, fmt.Sprintf("Quality mismatch: %s: %s", track.Path, q.Mismatch))
+		}
+		qualities[track.Path] = q
+	}
+
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		artifacts := slices.Clone(job.Artifacts)
+		for i, artifact := range artifacts {
+			if q, ok := qualities[artifact.Path]; ok {
+				artifacts[i].Audio = &q
+			}
+		}
+		job.Artifacts = artifacts
+	})
+	if len(mismatched) > 0 {
+		message := fmt.Sprintf("%d of %d track(s) not in the expected quality; %s", len(mismatched), len(qualities), mismatched[0])
+		jobManager.AddEvent(jobID, JobEvent{Type: "quality_mismatch", Message: message})
+		slog.Warn("Tracks not in the expected quality", "job_id", jobID, "tracks", len(mismatched), "first", mismatched[0])
+	}
+}
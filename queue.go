@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priorityLevels maps request priorities to their base scheduling score
+var priorityLevels = map[string]int{
+	"":       1,
+	"low":    0,
+	"normal": 1,
+	"high":   2,
+}
+
+type queuedJob struct {
+	jobID      string
+	req        DownloadRequest
+	enqueuedAt time.Time
+
+	// When the job was moved to the front of the queue, if it was
+	boostedAt time.Time
+}
+
+// held reports whether the job waits for a later wave of its batch
+func (q *queuedJob) held() bool {
+	return batchManager.held(q.req.BatchID, q.jobID)
+}
+
+// Scheduler runs queued downloads with a bounded number of concurrent
+// apple-music-dl processes. Slots are shared between job owners with
+// weighted fair queueing; each owner's own jobs run in priority order.
+type Scheduler struct {
+	mu            sync.Mutex
+	queue         []*queuedJob
+	running       int
+	maxConcurrent int
+	ttl           time.Duration
+	aging         time.Duration
+	wake          chan struct{}
+
+	// When each running job was started
+	started map[string]time.Time
+
+	// Cap on the disk space of running jobs' output; nil when unlimited
+	budget *StagingBudget
+
+	// Set while shutting down, when no more jobs are started
+	stopped bool
+
+	// Virtual time per owner: advanced by 1/weight for every job started,
+	// and the owner with the lowest value goes next
+	vtime   map[string]float64
+	weights map[string]float64
+}
+
+func NewScheduler(maxConcurrent int, ttl, aging time.Duration, weights map[string]float64, budget *StagingBudget) *Scheduler {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Scheduler{
+		maxConcurrent: maxConcurrent,
+		ttl:           ttl,
+		aging:         aging,
+		wake:          make(chan struct{}, 1),
+		started:       make(map[string]time.Time),
+		vtime:         make(map[string]float64),
+		weights:       weights,
+		budget:        budget,
+	}
+}
+
+var scheduler *Scheduler
+
+func (s *Scheduler) Enqueue(jobID string, req DownloadRequest) {
+	s.mu.Lock()
+	s.activate(req.Owner)
+	s.queue = append(s.queue, &queuedJob{jobID: jobID, req: req, enqueuedAt: time.Now()})
+	s.mu.Unlock()
+	s.notify()
+}
+
+// activate brings an owner that had nothing queued up to the virtual time of
+// the owners that are waiting, so an idle period doesn't turn into credit to
+// monopolize the queue. Must be called with s.mu held.
+func (s *Scheduler) activate(owner string) {
+	floor, found := 0.0, false
+	for _, queued := range s.queue {
+		if queued.req.Owner == owner {
+			return
+		}
+		if vt := s.vtime[queued.req.Owner]; !found || vt < floor {
+			floor, found = vt, true
+		}
+	}
+	if found && s.vtime[owner] < floor {
+		s.vtime[owner] = floor
+	}
+}
+
+func (s *Scheduler) weight(owner string) float64 {
+	if weight, ok := s.weights[owner]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// Reprioritize changes the priority of a job waiting in the queue, if
+// priority is set, and with front moves it ahead of every other job. It
+// reports whether the job was still waiting.
+func (s *Scheduler) Reprioritize(jobID, priority string, front bool) bool {
+	s.mu.Lock()
+	found := false
+	for i, queued := range s.queue {
+		if queued.jobID != jobID {
+			continue
+		}
+		// Replaced rather than changed, as queue plans read copies of the
+		// queue without the lock
+		updated := *queued
+		if priority != "" {
+			updated.req.Priority = priority
+		}
+		if front {
+			updated.boostedAt = time.Now()
+		}
+		s.queue[i] = &updated
+		found = true
+	}
+	s.mu.Unlock()
+	if found {
+		s.notify()
+	}
+	return found
+}
+
+// Remove drops a job that hasn't started yet. It reports whether the job
+// was still waiting in the queue.
+func (s *Scheduler) Remove(jobID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, queued := range s.queue {
+		if queued.jobID == jobID {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		s.expire()
+		s.dispatch()
+
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch starts queued jobs while there are free slots and the output
+// of running jobs fits the staging budget
+func (s *Scheduler) dispatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.stopped && s.running < s.maxConcurrent && len(s.queue) > 0 {
+		if s.budget.exceeded(len(s.queue)) && s.running > 0 {
+			return
+		}
+		next := s.pick(time.Now())
+		if next == nil {
+			return
+		}
+		s.running++
+		s.started[next.jobID] = time.Now()
+		s.budget.track(next.jobID)
+
+		go func() {
+			defer func() {
+				s.budget.untrack(next.jobID)
+				s.mu.Lock()
+				s.running--
+				delete(s.started, next.jobID)
+				s.mu.Unlock()
+				s.notify()
+			}()
+			executeDownload(next.jobID, next.req)
+		}()
+	}
+}
+
+// effectivePriority is the job's base priority plus one level for every
+// aging interval it has spent in the queue, so low-priority jobs can't be
+// starved by a steady stream of high-priority ones
+func (s *Scheduler) effectivePriority(queued *queuedJob, now time.Time) float64 {
+	priority := float64(priorityLevels[queued.req.Priority])
+	if s.aging > 0 {
+		priority += float64(now.Sub(queued.enqueuedAt)) / float64(s.aging)
+	}
+	return priority
+}
+
+// pick removes and returns the job to run next at the given time, or nil
+// when every queued job is held for a later batch wave. Boosted jobs run
+// first, the most recently boosted one first, whatever their owner or batch
+// wave. Otherwise the owner with the lowest virtual time is served (the
+// longest-waiting owner on ties), and of that owner's jobs the highest
+// effective priority runs, oldest first on ties. Must be called with s.mu
+// held.
+func (s *Scheduler) pick(now time.Time) *queuedJob {
+	best := -1
+	for i, queued := range s.queue {
+		if !queued.boostedAt.IsZero() && (best < 0 || queued.boostedAt.After(s.queue[best].boostedAt)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		best = s.pickFair(now)
+	}
+	if best < 0 {
+		return nil
+	}
+
+	next := s.queue[best]
+	owner := next.req.Owner
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	s.vtime[owner] += 1 / s.weight(owner)
+	return next
+}
+
+// pickFair returns the index of the job fair sharing and priorities choose,
+// or -1 when every queued job is held
+func (s *Scheduler) pickFair(now time.Time) int {
+	// The queue is in arrival order, so the first job seen for an owner is
+	// its longest-waiting one
+	var ready []int
+	owner := ""
+	for i, queued := range s.queue {
+		if queued.held() {
+			continue
+		}
+		if len(ready) == 0 || s.vtime[queued.req.Owner] < s.vtime[owner] {
+			owner = queued.req.Owner
+		}
+		ready = append(ready, i)
+	}
+
+	best := -1
+	for _, i := range ready {
+		queued := s.queue[i]
+		if queued.req.Owner != owner {
+			continue
+		}
+		if best < 0 || s.effectivePriority(queued, now) > s.effectivePriority(s.queue[best], now) {
+			best = i
+		}
+	}
+	return best
+}
+
+// release restarts the queue time of jobs held for a batch wave once the
+// wave begins, so they age and expire from then on
+func (s *Scheduler) release(jobIDs []string) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, queued := range s.queue {
+		if slices.Contains(jobIDs, queued.jobID) {
+			queued.enqueuedAt = now
+		}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// expire cancels jobs that have waited in the queue longer than the TTL
+func (s *Scheduler) expire() {
+	if s.ttl <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	var expired []*queuedJob
+	kept := s.queue[:0]
+	for _, queued := range s.queue {
+		if time.Since(queued.enqueuedAt) > s.ttl && !queued.held() {
+			expired = append(expired, queued)
+		} else {
+			kept = append(kept, queued)
+		}
+	}
+	s.queue = kept
+	s.mu.Unlock()
+
+	for _, queued := range expired {
+		waited := time.Since(queued.enqueuedAt).Round(time.Second)
+		now := time.Now()
+		jobManager.AddEvent(queued.jobID, JobEvent{Type: "expired", Message: fmt.Sprintf("Waited %v in queue", waited)})
+		jobManager.UpdateJob(queued.jobID, func(job *DownloadStatus) {
+			job.Status = "expired"
+			job.Error = fmt.Sprintf("Expired after waiting %v in queue", waited)
+			job.EndedAt = &now
+		})
+		slog.Info("Job expired in queue", "job_id", queued.jobID, "waited", waited.Seconds())
+	}
+}
+
+// handleJobPriority serves POST /jobs/{id}/priority for a queued job: a
+// {"priority": "high"} body changes its priority, and with "front": true,
+// or without a body, it's moved ahead of every other queued job
+func handleJobPriority(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Priority string `json:"priority"`
+		Front    *bool  `json:"front"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := priorityLevels[body.Priority]; !ok {
+		http.Error(w, "Priority must be high, normal or low", http.StatusBadRequest)
+		return
+	}
+	front := body.Priority == ""
+	if body.Front != nil {
+		front = *body.Front
+	}
+
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if job.Status != "queued" || !scheduler.Reprioritize(jobID, body.Priority, front) {
+		http.Error(w, fmt.Sprintf("Job is %s; only queued jobs can be reprioritized", job.Status), http.StatusConflict)
+		return
+	}
+
+	var changes []string
+	if body.Priority != "" {
+		changes = append(changes, "priority "+body.Priority)
+		jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+			job.Priority = body.Priority
+			if job.Request != nil {
+				req := *job.Request
+				req.Priority = body.Priority
+				job.Request = &req
+			}
+		})
+	}
+	if front {
+		changes = append(changes, "moved to the front of the queue")
+	}
+	message := strings.Join(changes, ", ")
+	jobManager.AddEvent(jobID, JobEvent{Type: "reprioritized", Message: message})
+	slog.InfoContext(r.Context(), "Job reprioritized", "job_id", jobID, "change", message)
+
+	job, _ = jobManager.Snapshot(jobID)
+	job.Logs = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
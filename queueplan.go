@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Duration assumed for a queued job before any download has completed
+const defaultJobEstimate = 10 * time.Minute
+
+// Download slots a plan can be projected for
+const maxPlannedSlots = 100
+
+// Recently completed jobs the duration of queued jobs is estimated from
+const estimateSampleSize = 20
+
+// PlannedJob is a job's place in the projected schedule
+type PlannedJob struct {
+	JobID    string    `json:"job_id"`
+	URL      string    `json:"url"`
+	Owner    string    `json:"owner,omitempty"`
+	Priority string    `json:"priority,omitempty"`
+	Position int       `json:"position,omitempty"` // start order of queued jobs
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Wait     string    `json:"wait,omitempty"` // until a queued job starts
+}
+
+// QueuePlan is the schedule GET /queue/plan projects for the running and
+// queued jobs
+type QueuePlan struct {
+	GeneratedAt   time.Time `json:"generated_at"`
+	MaxConcurrent int       `json:"max_concurrent"`
+
+	// Duration assumed for each queued job, and whether it's the median of
+	// recently completed jobs ("history"), the default or the request's
+	Estimate       string `json:"estimate"`
+	EstimateSource string `json:"estimate_source"`
+
+	Running []PlannedJob `json:"running"`
+	Queued  []PlannedJob `json:"queued"`
+
+	// Queued jobs waiting for a later wave of their batch, which aren't
+	// projected
+	Held []string `json:"held,omitempty"`
+
+	// When the last projected job ends
+	Finish *time.Time `json:"finish,omitempty"`
+}
+
+// estimateJobDuration returns the median duration of recently completed
+// jobs, or defaultJobEstimate without any
+func estimateJobDuration() (time.Duration, string) {
+	var completed []DownloadStatus
+	for _, job := range jobManager.SnapshotAll() {
+		if job.Status == "completed" && job.EndedAt != nil && job.Duration != "" {
+			completed = append(completed, job)
+		}
+	}
+	slices.SortFunc(completed, func(a, b DownloadStatus) int {
+		return b.EndedAt.Compare(*a.EndedAt)
+	})
+
+	var durations []time.Duration
+	for _, job := range completed[:min(len(completed), estimateSampleSize)] {
+		if d, err := time.ParseDuration(job.Duration); err == nil {
+			durations = append(durations, d)
+		}
+	}
+	if len(durations) == 0 {
+		return defaultJobEstimate, "default"
+	}
+	slices.Sort(durations)
+	return durations[len(durations)/2], "history"
+}
+
+// remaining estimates how long a running job still takes from its progress,
+// or from the estimate while it hasn't reported any
+func remaining(job DownloadStatus, elapsed, estimate time.Duration) time.Duration {
+	if job.Progress != nil && job.Progress.Percent > 0 && job.Progress.Percent < 100 {
+		return time.Duration(float64(elapsed) * (100 - job.Progress.Percent) / job.Progress.Percent)
+	}
+	return max(estimate-elapsed, 0)
+}
+
+// plan simulates the scheduler with maxConcurrent slots: running jobs end
+// as estimated, and queued jobs are picked for the slots they free in the
+// order the scheduler would start them. The staging budget and pauses
+// between batch waves aren't taken into account.
+func (s *Scheduler) plan(maxConcurrent int, estimate time.Duration) QueuePlan {
+	now := time.Now()
+
+	s.mu.Lock()
+	sim := &Scheduler{
+		queue:   slices.Clone(s.queue),
+		aging:   s.aging,
+		vtime:   maps.Clone(s.vtime),
+		weights: s.weights,
+	}
+	started := maps.Clone(s.started)
+	s.mu.Unlock()
+
+	plan := QueuePlan{
+		GeneratedAt:   now,
+		MaxConcurrent: maxConcurrent,
+		Estimate:      estimate.String(),
+		Running:       []PlannedJob{},
+		Queued:        []PlannedJob{},
+	}
+
+	var slots []time.Time
+	for jobID, start := range started {
+		job, exists := jobManager.Snapshot(jobID)
+		if !exists {
+			continue
+		}
+		end := now.Add(remaining(job, now.Sub(start), estimate))
+		plan.Running = append(plan.Running, PlannedJob{
+			JobID:    jobID,
+			URL:      job.URL,
+			Owner:    job.Owner,
+			Priority: job.Priority,
+			Start:    start,
+			End:      end,
+		})
+		slots = append(slots, end)
+	}
+	slices.SortFunc(plan.Running, func(a, b PlannedJob) int { return a.End.Compare(b.End) })
+	slices.SortFunc(slots, func(a, b time.Time) int { return a.Compare(b) })
+
+	// With fewer slots than running jobs, a slot only frees up once enough
+	// of them have ended
+	if len(slots) > maxConcurrent {
+		slots = slots[len(slots)-maxConcurrent:]
+	}
+	for len(slots) < maxConcurrent {
+		slots = append([]time.Time{now}, slots...)
+	}
+
+	for len(sim.queue) > 0 {
+		start := slots[0]
+		next := sim.pick(start)
+		if next == nil {
+			break
+		}
+		end := start.Add(estimate)
+		plan.Queued = append(plan.Queued, PlannedJob{
+			JobID:    next.jobID,
+			URL:      next.req.URL,
+			Owner:    next.req.Owner,
+			Priority: next.req.Priority,
+			Position: len(plan.Queued) + 1,
+			Start:    start,
+			End:      end,
+			Wait:     start.Sub(now).Round(time.Second).String(),
+		})
+
+		slots[0] = end
+		slices.SortFunc(slots, func(a, b time.Time) int { return a.Compare(b) })
+	}
+	for _, queued := range sim.queue {
+		plan.Held = append(plan.Held, queued.jobID)
+	}
+
+	for _, job := range slices.Concat(plan.Running, plan.Queued) {
+		if plan.Finish == nil || job.End.After(*plan.Finish) {
+			end := job.End
+			plan.Finish = &end
+		}
+	}
+	return plan
+}
+
+// handleQueuePlan serves GET /queue/plan. ?max_concurrent= projects the
+// queue with another number of download slots, and ?estimate= with another
+// duration per job.
+func handleQueuePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	maxConcurrent := scheduler.maxConcurrent
+	if value := query.Get("max_concurrent"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPlannedSlots {
+			http.Error(w, fmt.Sprintf("max_concurrent must be between 1 and %d", maxPlannedSlots), http.StatusBadRequest)
+			return
+		}
+		maxConcurrent = n
+	}
+
+	estimate, source := estimateJobDuration()
+	if value := query.Get("estimate"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "estimate must be a positive duration such as 15m", http.StatusBadRequest)
+			return
+		}
+		estimate, source = d, "request"
+	}
+
+	plan := scheduler.plan(maxConcurrent, estimate)
+	plan.EstimateSource = source
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
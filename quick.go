@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var quickPage = template.Must(template.New("quick").Funcs(template.FuncMap{"tr": tr}).Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{tr .Lang "Download started"}}</title>
+</head>
+<body style="font-family: -apple-system, sans-serif; margin: 2em;">
+<h3>{{tr .Lang "Download started"}}</h3>
+<p>{{.Job.URL}}</p>
+<p>{{tr .Lang "Job"}} <code>{{.Job.ID}}</code></p>
+<p><a href="/status/{{.Job.ID}}">{{tr .Lang "Check status"}}</a></p>
+</body>
+</html>
+`))
+
+func wantsHTML(r *http.Request) bool {
+	if output := r.URL.Query().Get("output"); output != "" {
+		return output == "html"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// handleQuick lets iOS Shortcuts and bookmarklets submit a download with a
+// single GET request
+func handleQuick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cfg.QuickToken == "" {
+		http.Error(w, "Quick submission is disabled", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	token := query.Get("token")
+	if token == "" {
+		token = r.Header.Get("X-API-Key")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.QuickToken)) != 1 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	req := DownloadRequest{
+		URL:    query.Get("url"),
+		Format: parseFormatList(query.Get("format")),
+		Owner:  requestOwner(r, "quick"),
+		Trace:  traceFromRequest(r),
+	}
+	req.Song, _ = strconv.ParseBool(query.Get("song"))
+	if err := prepareRequest(&req); err != nil {
+		writeSubmitError(w, err)
+		return
+	}
+
+	job := startDownload(req)
+
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		lang := requestLanguage(r)
+		w.Header().Set("Content-Language", lang)
+		quickPage.Execute(w, struct {
+			Lang string
+			Job  *DownloadStatus
+		}{lang, job})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"job_id": job.ID,
+		"status": "started",
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var replayFile = flag.String("replay", "", "feed a recorded downloader output fixture through the output parser, print the results as JSON lines and exit")
+
+// OutputRecord is one line of an output fixture: a header with the
+// downloader arguments, then the output chunks in the order they were read,
+// then the exit status
+type OutputRecord struct {
+	Time   int64    `json:"t"` // milliseconds since the process started
+	Args   []string `json:"args,omitempty"`
+	Stream string   `json:"stream,omitempty"` // stdout or stderr
+	Data   string   `json:"data,omitempty"`
+
+	// Chunks that aren't valid UTF-8 are stored base64-encoded
+	DataBase64 []byte `json:"data_base64,omitempty"`
+
+	Exit *int `json:"exit,omitempty"`
+}
+
+// outputRecorder writes the raw output of one downloader run to a fixture
+// file in RECORD_OUTPUT_DIR
+type outputRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	started time.Time
+}
+
+func newOutputRecorder(jobID string, args []string) (*outputRecorder, error) {
+	if err := os.MkdirAll(cfg.RecordOutputDir, 0o755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", jobID, time.Now().UTC().Format("20060102T150405.000"))
+	f, err := os.Create(filepath.Join(cfg.RecordOutputDir, name))
+	if err != nil {
+		return nil, err
+	}
+	r := &outputRecorder{f: f, enc: json.NewEncoder(f), started: time.Now()}
+	r.write(OutputRecord{Args: args})
+	return r, nil
+}
+
+func (r *outputRecorder) write(record OutputRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record.Time = time.Since(r.started).Milliseconds()
+	if err := r.enc.Encode(record); err != nil {
+		slog.Error("Failed to record downloader output", "path", r.f.Name(), "error", err)
+	}
+}
+
+// stream returns a writer recording everything written to it as output of
+// the named stream
+func (r *outputRecorder) stream(name string) io.Writer {
+	return recordedStream{r, name}
+}
+
+// close records the exit code, -1 when the process didn't exit normally
+func (r *outputRecorder) close(exitCode int) {
+	r.write(OutputRecord{Exit: &exitCode})
+	r.f.Close()
+}
+
+type recordedStream struct {
+	r    *outputRecorder
+	name string
+}
+
+func (s recordedStream) Write(p []byte) (int, error) {
+	record := OutputRecord{Stream: s.name}
+	if utf8.Valid(p) {
+		record.Data = string(p)
+	} else {
+		record.DataBase64 = append([]byte(nil), p...)
+	}
+	s.r.write(record)
+	return len(p), nil
+}
+
+// ReplayResult is printed for every line of replayed output
+type ReplayResult struct {
+	Stream            string       `json:"stream"`
+	Line              string       `json:"line"`
+	Progress          *JobProgress `json:"progress"`
+	FormatUnavailable bool         `json:"format_unavailable,omitempty"`
+	ErrorCode         string       `json:"error_code,omitempty"`
+}
+
+// runReplay splits a fixture's output into lines like a running job does
+// and prints what the parser makes of each, so the results can be compared
+// with a previous run when the downloader's output format changes
+func runReplay(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Error("Failed to open recording", "error", err)
+		return 1
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	var progress *JobProgress
+	pending := map[string][]byte{}
+	emit := func(stream string, line []byte) {
+		trimmed := strings.TrimSpace(string(line))
+		if trimmed == "" {
+			return
+		}
+		progress = progress.update(trimmed)
+		enc.Encode(ReplayResult{
+			Stream:            stream,
+			Line:              trimmed,
+			Progress:          progress,
+			FormatUnavailable: currentPatterns().FormatUnavailable.MatchString(trimmed),
+			ErrorCode:         currentPatterns().classify(trimmed),
+		})
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var record OutputRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			slog.Error("Invalid record", "path", path, "line", n, "error", err)
+			return 1
+		}
+		if record.Stream == "" {
+			continue
+		}
+
+		data := append(pending[record.Stream], record.Data...)
+		data = append(data, record.DataBase64...)
+		for {
+			advance, line, _ := scanLinesOrCarriageReturn(data, false)
+			if advance == 0 {
+				break
+			}
+			emit(record.Stream, line)
+			data = data[advance:]
+		}
+		pending[record.Stream] = data
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Failed to read recording", "error", err)
+		return 1
+	}
+	for _, stream := range []string{"stdout", "stderr"} {
+		emit(stream, pending[stream])
+	}
+	return 0
+}
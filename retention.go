@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// finishedStatuses are the statuses of jobs that won't change any more
+var finishedStatuses = []string{"completed", "failed", "cancelled", "expired", "interrupted"}
+
+// finishedJob identifies a finished job wherever it's kept
+type finishedJob struct {
+	ID       string
+	Status   string
+	EndedAt  time.Time
+	Archived bool
+}
+
+// finishedJobs lists the finished jobs in memory, in the job store and
+// archived in the state directory, newest first
+func (jm *JobManager) finishedJobs() ([]finishedJob, error) {
+	byID := map[string]finishedJob{}
+
+	var stored []finishedJob
+	var err error
+	if jobStore != nil {
+		storeWriter.flush()
+		stored, err = jobStore.FinishedJobs()
+	} else {
+		stored, err = evictedJobs()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range stored {
+		byID[job.ID] = job
+	}
+
+	jm.mu.RLock()
+	for id, job := range jm.jobs {
+		if job.EndedAt == nil {
+			delete(byID, id)
+			continue
+		}
+		byID[id] = finishedJob{ID: id, Status: job.Status, EndedAt: *job.EndedAt, Archived: job.Archived}
+	}
+	jm.mu.RUnlock()
+
+	jobs := make([]finishedJob, 0, len(byID))
+	for _, job := range byID {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].EndedAt.After(jobs[j].EndedAt) })
+	return jobs, nil
+}
+
+// evictedJobs lists the jobs evicted to the state directory
+func evictedJobs() ([]finishedJob, error) {
+	if cfg.StateDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(cfg.StateDir, "jobs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []finishedJob
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		var job DownloadStatus
+		if err := loadState(archivePath(id), &job); err != nil {
+			slog.Error("Failed to load archived job", "job_id", id, "error", err)
+			continue
+		}
+		if job.EndedAt != nil {
+			jobs = append(jobs, finishedJob{ID: job.ID, Status: job.Status, EndedAt: *job.EndedAt, Archived: job.Archived})
+		}
+	}
+	return jobs, nil
+}
+
+// deleteJobs removes finished jobs from memory, the job store and the
+// archive. Their downloaded files are left alone.
+func (jm *JobManager) deleteJobs(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	jm.mu.Lock()
+	for _, id := range ids {
+		if job, exists := jm.jobs[id]; exists && job.EndedAt != nil {
+			delete(jm.jobs, id)
+		}
+	}
+	jm.version.Add(1)
+	jm.mu.Unlock()
+
+	jm.accessMu.Lock()
+	for _, id := range ids {
+		delete(jm.accessed, id)
+	}
+	jm.accessMu.Unlock()
+
+	for _, id := range ids {
+		jobChanges.recordDeleted(id)
+	}
+
+	if jobStore != nil {
+		storeWriter.flush()
+		return jobStore.DeleteJobs(ids)
+	}
+	if cfg.StateDir != "" {
+		for _, id := range ids {
+			err := os.Remove(filepath.Join(cfg.StateDir, archivePath(id)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sweepJobs archives the unarchived finished jobs that ended more than
+// JOB_RETENTION ago, and the oldest beyond JOB_RETENTION_MAX_JOBS. Only
+// DELETE /jobs deletes them.
+func (jm *JobManager) sweepJobs() {
+	jobs, err := jm.finishedJobs()
+	if err != nil {
+		slog.Error("Failed to list finished jobs", "component", "retention", "error", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-cfg.JobRetention)
+	var expired []string
+	kept := 0
+	for _, job := range jobs {
+		if job.Archived {
+			continue
+		}
+		if (cfg.JobRetention > 0 && job.EndedAt.Before(cutoff)) || (cfg.JobRetentionMaxJobs > 0 && kept >= cfg.JobRetentionMaxJobs) {
+			expired = append(expired, job.ID)
+			continue
+		}
+		kept++
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	archived, err := jm.setArchived(expired, true)
+	if err != nil {
+		slog.Error("Failed to archive finished jobs", "component", "retention", "error", err)
+	}
+	if len(archived) > 0 {
+		slog.Info("Archived finished jobs", "component", "retention", "jobs", len(archived))
+	}
+}
+
+func (jm *JobManager) runRetention() {
+	for {
+		jm.sweepJobs()
+		time.Sleep(cfg.JobRetentionSweepInterval)
+	}
+}
+
+// parseAge parses a duration such as "36h", also accepting whole days
+// like "7d"
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+// finishedJobFilter selects finished jobs for bulk operations by
+// ?status= (comma-separated), ?older_than= and ?archived=true
+type finishedJobFilter struct {
+	statuses []string
+	cutoff   time.Time
+	archived bool
+}
+
+func parseFinishedJobFilter(query url.Values) (finishedJobFilter, error) {
+	f := finishedJobFilter{statuses: splitList(query.Get("status")), cutoff: time.Now()}
+	olderThan := query.Get("older_than")
+	switch archived := query.Get("archived"); archived {
+	case "", "false":
+	case "true":
+		f.archived = true
+	default:
+		return f, fmt.Errorf("Invalid archived %q; must be true or false", archived)
+	}
+	if len(f.statuses) == 0 && olderThan == "" && !f.archived {
+		return f, errors.New("A status, older_than or archived filter is required")
+	}
+	for _, status := range f.statuses {
+		if !slices.Contains(finishedStatuses, status) {
+			return f, fmt.Errorf("Invalid status %q; must be one of %s", status, strings.Join(finishedStatuses, ", "))
+		}
+	}
+	if olderThan != "" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			return f, fmt.Errorf("Invalid older_than: %v", err)
+		}
+		f.cutoff = f.cutoff.Add(-age)
+	}
+	return f, nil
+}
+
+// ids returns the IDs of the finished jobs matching the filter
+func (f finishedJobFilter) ids() ([]string, error) {
+	jobs, err := jobManager.finishedJobs()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, job := range jobs {
+		if (len(f.statuses) == 0 || slices.Contains(f.statuses, job.Status)) && job.EndedAt.Before(f.cutoff) && (!f.archived || job.Archived) {
+			ids = append(ids, job.ID)
+		}
+	}
+	return ids, nil
+}
+
+// handlePurgeJobs serves DELETE /jobs, deleting the archived jobs matching
+// ?status= (comma-separated) and ?older_than= for good
+func handlePurgeJobs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFinishedJobFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Jobs are archived before they can be deleted
+	filter.archived = true
+	ids, err := filter.ids()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := jobManager.deleteJobs(ids); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(ids) > 0 {
+		slog.InfoContext(r.Context(), "Deleted finished jobs by request", "jobs", len(ids))
+		auditLog.recordRequest(r, AuditEntry{Action: "jobs.purged", Detail: map[string]string{"count": strconv.Itoa(len(ids)), "filter": r.URL.RawQuery}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"deleted": len(ids),
+		"job_ids": ids,
+	})
+}
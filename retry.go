@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Backoff delays are capped so a large multiplier can't park a job for days
+const maxRetryDelay = time.Hour
+
+// RetryPolicy controls how failed download attempts are retried. Codes are
+// the ones recorded on attempt_failed events, e.g. "timeout", "exit_1" or
+// "start_failed"; "*" makes every failure retryable.
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"max_attempts,omitempty"`
+	BaseDelay      int      `json:"base_delay,omitempty"` // seconds
+	Multiplier     float64  `json:"multiplier,omitempty"`
+	RetryableCodes []string `json:"retryable_codes,omitempty"`
+}
+
+// merge applies the non-zero fields of override on top of the policy
+func (p RetryPolicy) merge(override *RetryPolicy) RetryPolicy {
+	if override == nil {
+		return p
+	}
+	if override.MaxAttempts > 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	if override.BaseDelay > 0 {
+		p.BaseDelay = override.BaseDelay
+	}
+	if override.Multiplier > 0 {
+		p.Multiplier = override.Multiplier
+	}
+	if override.RetryableCodes != nil {
+		p.RetryableCodes = override.RetryableCodes
+	}
+	return p
+}
+
+func (p RetryPolicy) retryable(code string) bool {
+	return slices.Contains(p.RetryableCodes, "*") || slices.Contains(p.RetryableCodes, code)
+}
+
+// delay returns how long to wait after the given failed attempt
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	seconds := float64(p.BaseDelay) * math.Pow(multiplier, float64(attempt-1))
+	delay := time.Duration(seconds * float64(time.Second))
+	if delay > maxRetryDelay || delay < 0 {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// RetryState is where a job's current download stands in its retry policy,
+// so clients can show "retrying in 4m (attempt 2/5)". Attempt is the attempt
+// running, or the one waiting for NextAttemptAt. Attempts are counted per
+// format and track the job downloads.
+type RetryState struct {
+	Attempt       int        `json:"attempt"`
+	MaxAttempts   int        `json:"max_attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastCode      string     `json:"last_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// next returns the state for the given attempt, keeping the last failure
+func (s *RetryState) next(attempt, maxAttempts int, at *time.Time) *RetryState {
+	next := &RetryState{Attempt: attempt, MaxAttempts: max(maxAttempts, 1), NextAttemptAt: at}
+	if s != nil {
+		next.LastCode, next.LastError = s.LastCode, s.LastError
+	}
+	return next
+}
+
+// ScheduledRetry is a job waiting to retry its download
+type ScheduledRetry struct {
+	JobID         string    `json:"job_id"`
+	URL           string    `json:"url"`
+	Owner         string    `json:"owner,omitempty"`
+	Attempt       int       `json:"attempt"`
+	MaxAttempts   int       `json:"max_attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	RetryIn       float64   `json:"retry_in_seconds"`
+	LastCode      string    `json:"last_code,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// handleQueueRetries serves GET /queue/retries, the running jobs waiting to
+// retry their download, soonest first
+func handleQueueRetries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	retries := []ScheduledRetry{}
+	for _, job := range jobManager.SnapshotAll() {
+		if job.Status != "running" || job.Retry == nil || job.Retry.NextAttemptAt == nil {
+			continue
+		}
+		retries = append(retries, ScheduledRetry{
+			JobID:         job.ID,
+			URL:           job.URL,
+			Owner:         job.Owner,
+			Attempt:       job.Retry.Attempt,
+			MaxAttempts:   job.Retry.MaxAttempts,
+			NextAttemptAt: *job.Retry.NextAttemptAt,
+			RetryIn:       max(job.Retry.NextAttemptAt.Sub(now).Seconds(), 0),
+			LastCode:      job.Retry.LastCode,
+			LastError:     job.Retry.LastError,
+		})
+	}
+	slices.SortFunc(retries, func(a, b ScheduledRetry) int { return a.NextAttemptAt.Compare(b.NextAttemptAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"retries": retries,
+		"count":   len(retries),
+	})
+}
+
+// retryableStatuses are the job statuses POST /jobs/{id}/retry accepts
+var retryableStatuses = []string{"failed", "cancelled", "expired", "interrupted"}
+
+// handleRetryJob serves POST /jobs/{id}/retry, starting a new job with the
+// request of a job that didn't complete. The jobs are linked through
+// retry_of and retries.
+func handleRetryJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !slices.Contains(retryableStatuses, job.Status) {
+		http.Error(w, fmt.Sprintf("Job is %s; only failed, cancelled, expired or interrupted jobs can be retried", job.Status), http.StatusConflict)
+		return
+	}
+	if job.Request == nil {
+		http.Error(w, "Job was created before requests were recorded and can't be retried", http.StatusConflict)
+		return
+	}
+
+	req := *job.Request
+	req.Owner = job.Owner
+	req.Trace = traceFromRequest(r)
+	req.RetryOf = jobID
+	retry := startDownload(req)
+
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		job.Retries = append(job.Retries, retry.ID)
+	})
+	jobManager.AddEvent(jobID, JobEvent{Type: "retried", Message: "Retried as " + retry.ID})
+	slog.InfoContext(r.Context(), "Job retried", "job_id", jobID, "retry_id", retry.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"job_id":   retry.ID,
+		"retry_of": jobID,
+		"status":   "started",
+	})
+}
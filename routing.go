@@ -0,0 +1,386 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Labels are free-form key/value pairs attached to a job by its submitter,
+// e.g. {"requester": "kids"}, used to route its events
+type Labels map[string]string
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-/]{0,62}$`)
+
+const (
+	maxLabels          = 32
+	maxLabelValueBytes = 256
+)
+
+func (l Labels) validate() error {
+	if len(l) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for key, value := range l {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label %q", key)
+		}
+		if len(value) > maxLabelValueBytes {
+			return fmt.Errorf("label %q is longer than %d bytes", key, maxLabelValueBytes)
+		}
+	}
+	return nil
+}
+
+// RoutingRule sends the events matching it to extra destinations, on top
+// of WEBHOOK_URL and the registered webhooks. A rule matches an event when
+// every label in Match has the given value on the event's job ("*" accepts
+// any value) and the event matches one of Events, if any are listed.
+type RoutingRule struct {
+	Name   string          `json:"name,omitempty"`
+	Match  Labels          `json:"match"`
+	Events []string        `json:"events,omitempty"`
+	Notify []RouteNotifier `json:"notify"`
+}
+
+// RouteNotifier is a destination of a routing rule, one of:
+//
+//   - "webhook": an event posted to URL in Format, or to the registered
+//     webhook WebhookID, through the delivery queue
+//   - "discord": the job summary posted to a Discord channel webhook URL
+//   - "telegram": the job summary sent to ChatID by the Telegram bot
+//   - "email": the job summary mailed to To through SMTP_ADDR
+//   - "ntfy": the job summary published to the ntfy topic URL with
+//     Priority, through the delivery queue
+//
+// Summaries are written in Language, or DEFAULT_LANGUAGE. Template replaces
+// the summary and Title the subject of emails and title of ntfy messages,
+// with the event's details filled into their {placeholders}.
+type RouteNotifier struct {
+	Type      string `json:"type"`
+	URL       string `json:"url,omitempty"`
+	Format    string `json:"format,omitempty"`
+	WebhookID string `json:"webhook_id,omitempty"`
+	ChatID    int64  `json:"chat_id,omitempty"`
+	To        string `json:"to,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+	Language  string `json:"language,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Template  string `json:"template,omitempty"`
+
+	// Set for the notify option of requests, whose URLs clients supply
+	restricted bool
+}
+
+// Placeholders of notification templates, besides {labels.<key>}
+var messagePlaceholders = []string{
+	"event", "summary", "job_id", "status", "url", "error", "duration",
+	"content_type", "format", "output_dir", "tracks", "batch_id",
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}\s]+\}`)
+
+func (n RouteNotifier) validate() error {
+	switch n.Type {
+	case "webhook":
+		if n.WebhookID == "" && !isHTTPURL(n.URL) {
+			return errors.New("webhook needs an http or https url or a webhook_id")
+		}
+		if n.Format != "" && n.Format != "json" && n.Format != "cloudevents" {
+			return errors.New("format must be json or cloudevents")
+		}
+	case "discord":
+		if !isHTTPURL(n.URL) {
+			return errors.New("discord needs the channel webhook url")
+		}
+	case "telegram":
+		if cfg.TelegramBotToken == "" {
+			return errors.New("telegram needs TELEGRAM_BOT_TOKEN")
+		}
+		if n.ChatID == 0 {
+			return errors.New("telegram needs a chat_id")
+		}
+	case "email":
+		if cfg.SMTPAddr == "" {
+			return errors.New("email needs SMTP_ADDR")
+		}
+		if n.To == "" {
+			return errors.New("email needs a to address")
+		}
+	case "ntfy":
+		if _, _, err := ntfyTopic(n.URL); err != nil {
+			return err
+		}
+		if n.Priority < 0 || n.Priority > 5 {
+			return errors.New("priority must be 1 to 5")
+		}
+	default:
+		return fmt.Errorf("unknown notifier type %q", n.Type)
+	}
+	if n.Language != "" && !slices.Contains(languages, n.Language) {
+		return fmt.Errorf("language must be one of %s", strings.Join(languages, ", "))
+	}
+	if n.Type == "webhook" && (n.Title != "" || n.Template != "") {
+		return errors.New("title and template don't apply to webhooks")
+	}
+	if n.Type != "ntfy" && n.Priority != 0 {
+		return errors.New("priority only applies to ntfy")
+	}
+	for _, text := range []string{n.Title, n.Template} {
+		for _, placeholder := range placeholderPattern.FindAllString(text, -1) {
+			name := placeholder[1 : len(placeholder)-1]
+			if !slices.Contains(messagePlaceholders, name) && !strings.HasPrefix(name, "labels.") {
+				return fmt.Errorf("unknown placeholder %s", placeholder)
+			}
+		}
+	}
+	return nil
+}
+
+// ntfyTopic splits an ntfy topic URL into the server's URL, which messages
+// are published to as JSON, and the topic
+func ntfyTopic(topicURL string) (server, topic string, err error) {
+	u, err := url.Parse(topicURL)
+	if err != nil || !isHTTPURL(topicURL) {
+		return "", "", errors.New("ntfy needs the topic url, e.g. https://ntfy.sh/mytopic")
+	}
+	dir, topic := path.Split(strings.TrimRight(u.Path, "/"))
+	if topic == "" {
+		return "", "", errors.New("ntfy needs the topic url, e.g. https://ntfy.sh/mytopic")
+	}
+	u.Path, u.RawQuery = dir, ""
+	return u.String(), topic, nil
+}
+
+var routingRules []RoutingRule
+
+// loadRoutingRules reads the JSON list of rules at ROUTING_RULES_FILE,
+// followed by those of ROUTING_RULES
+func loadRoutingRules(path, inline string) error {
+	var rules []RoutingRule
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	if inline != "" {
+		var more []RoutingRule
+		if err := json.Unmarshal([]byte(inline), &more); err != nil {
+			return fmt.Errorf("failed to parse ROUTING_RULES: %w", err)
+		}
+		rules = append(rules, more...)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if len(rule.Notify) == 0 {
+			return fmt.Errorf("rule %s: notify is required", name)
+		}
+		for _, pattern := range rule.Events {
+			if !validEventPattern(pattern) {
+				return fmt.Errorf("rule %s: unknown event %q", name, pattern)
+			}
+		}
+		for _, notifier := range rule.Notify {
+			if err := notifier.validate(); err != nil {
+				return fmt.Errorf("rule %s: %w", name, err)
+			}
+		}
+	}
+
+	routingRules = rules
+	slog.Info("Loaded routing rules", "rules", len(rules))
+	return nil
+}
+
+// matches reports whether the rule applies to ev. Rules with labels to
+// match only apply to job events.
+func (rule RoutingRule) matches(ev WebhookEvent) bool {
+	if len(rule.Events) > 0 {
+		subscribed := false
+		for _, pattern := range rule.Events {
+			if eventMatches(pattern, ev.Event) {
+				subscribed = true
+				break
+			}
+		}
+		if !subscribed {
+			return false
+		}
+	}
+	for key, want := range rule.Match {
+		if ev.Job == nil {
+			return false
+		}
+		value, ok := ev.Job.Labels[key]
+		if !ok || (want != "*" && value != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeEvent sends ev to the destinations of every matching rule. A
+// destination matched by several rules gets the event once. Chat and email
+// notifications are sent right away, so it's called from finish hooks
+// rather than while a job is being updated.
+func routeEvent(ev WebhookEvent, payload func(format string) any, trace TraceContext) {
+	sent := map[RouteNotifier]bool{}
+	for _, rule := range routingRules {
+		if !rule.matches(ev) {
+			continue
+		}
+		for _, notifier := range rule.Notify {
+			if sent[notifier] {
+				continue
+			}
+			sent[notifier] = true
+			notifier.send(ev, payload, trace)
+		}
+	}
+}
+
+func (n RouteNotifier) send(ev WebhookEvent, payload func(format string) any, trace TraceContext) {
+	lang := cmp.Or(n.Language, cfg.DefaultLanguage)
+	switch n.Type {
+	case "webhook":
+		if n.WebhookID != "" {
+			wh, exists := webhookStore.Get(n.WebhookID)
+			if !exists {
+				slog.Warn("Routing rule names unknown webhook", "webhook_id", n.WebhookID)
+				return
+			}
+			deliveryQueue.Enqueue(wh.URL, wh.ID, ev.Event, wh.Format, payload(wh.Format), trace)
+			return
+		}
+		n.enqueue(n.URL, "", ev.Event, n.Format, payload(n.Format), trace)
+
+	case "discord":
+		n.enqueue(n.URL, "", ev.Event, "", map[string]string{"content": n.message(lang, ev)}, trace)
+
+	case "telegram":
+		telegram.send(n.ChatID, n.message(lang, ev))
+
+	case "email":
+		if err := sendMail(n.To, n.title(lang, ev), "", n.message(lang, ev)); err != nil {
+			slog.Error("Failed to send notification", "component", "email", "event", ev.Event, "to", n.To, "error", err)
+		}
+
+	case "ntfy":
+		server, topic, _ := ntfyTopic(n.URL)
+		message := map[string]any{"topic": topic, "title": n.title(lang, ev), "message": n.message(lang, ev)}
+		if n.Priority > 0 {
+			message["priority"] = n.Priority
+		}
+		n.enqueue(server, ntfyWebhookID, ev.Event, "", message, trace)
+	}
+}
+
+// enqueue queues a delivery to a URL of the notifier, restricted to public
+// addresses when a client supplied it
+func (n RouteNotifier) enqueue(url, webhookID, event, format string, payload any, trace TraceContext) {
+	if n.restricted {
+		deliveryQueue.EnqueueRestricted(url, webhookID, event, format, payload, trace)
+		return
+	}
+	deliveryQueue.Enqueue(url, webhookID, event, format, payload, trace)
+}
+
+// message renders the notifier's template for ev, or the event summary
+func (n RouteNotifier) message(lang string, ev WebhookEvent) string {
+	if n.Template == "" {
+		return eventSummary(lang, ev)
+	}
+	return expandMessage(n.Template, lang, ev)
+}
+
+// title renders the notifier's title for ev, or the default subject
+func (n RouteNotifier) title(lang string, ev WebhookEvent) string {
+	if n.Title == "" {
+		return tr(lang, "Apple Music download: %s", ev.Event)
+	}
+	return expandMessage(n.Title, lang, ev)
+}
+
+// expandMessage fills the details of ev into the placeholders of a
+// notification template; those that don't apply to ev are left empty
+func expandMessage(text, lang string, ev WebhookEvent) string {
+	var job DownloadStatus
+	if ev.Job != nil {
+		job = *ev.Job
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if key, ok := strings.CutPrefix(name, "labels."); ok {
+			return job.Labels[key]
+		}
+		switch name {
+		case "event":
+			return ev.Event
+		case "summary":
+			return eventSummary(lang, ev)
+		case "job_id":
+			return job.ID
+		case "status":
+			return job.Status
+		case "url":
+			return job.URL
+		case "error":
+			return job.Error
+		case "duration":
+			return job.Duration
+		case "content_type":
+			return job.ContentType
+		case "format":
+			return job.FormatObtained
+		case "output_dir":
+			return job.OutputDir
+		case "tracks":
+			lines := make([]string, len(job.Tracks))
+			for i, track := range job.Tracks {
+				lines[i] = track.String()
+			}
+			return strings.Join(lines, "\n")
+		case "batch_id":
+			if ev.Batch != nil {
+				return ev.Batch.BatchID
+			}
+		}
+		return ""
+	})
+}
+
+// eventSummary renders an event as plain text in lang for chat and email
+func eventSummary(lang string, ev WebhookEvent) string {
+	switch {
+	case ev.Job != nil:
+		return jobSummary(lang, *ev.Job)
+	case ev.Batch != nil && ev.Batch.Wave > 0:
+		return tr(lang, "Batch %s wave %d of %d finished: %s; %d of %d job(s) done, next wave at %s",
+			ev.Batch.BatchID, ev.Batch.Wave, ev.Batch.Waves, formatCounts(ev.Batch.WaveCounts),
+			ev.Batch.Finished, ev.Batch.Total, ev.Batch.NextWaveAt.Format(time.Kitchen))
+	case ev.Batch != nil:
+		return tr(lang, "Batch %s finished: %d of %d job(s)", ev.Batch.BatchID, ev.Batch.Finished, ev.Batch.Total)
+	default:
+		return ev.Event
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filename sanitization profiles for the filesystems output is served from:
+//   - windows: safe on NTFS and SMB shares
+//   - fat: windows rules plus no emoji or other characters outside the BMP,
+//     which FAT-formatted players often can't display
+//   - ascii: fat rules with accents stripped and everything else non-ASCII
+//     replaced
+var sanitizeProfiles = []string{"", "windows", "fat", "ascii"}
+
+var windowsReservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Longest file name component, in bytes, kept by sanitizeName
+const maxNameBytes = 250
+
+// sanitizeName makes a single path component safe for profile
+func sanitizeName(name, profile string) string {
+	if profile == "" {
+		return name
+	}
+
+	if profile == "ascii" {
+		// Decompose accented letters so the marks can be dropped
+		name = norm.NFKD.String(name)
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == ':':
+			b.WriteString(" -")
+		case strings.ContainsRune(`<>"/\|?*`, r) || unicode.IsControl(r):
+			b.WriteRune('_')
+		case profile != "windows" && r > 0xFFFF:
+		case profile == "ascii" && unicode.Is(unicode.Mn, r):
+		case profile == "ascii" && r > unicode.MaxASCII:
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// Windows drops trailing dots and spaces
+	result := strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	if result == "" {
+		result = "_"
+	}
+
+	base := strings.ToUpper(strings.TrimSuffix(result, filepath.Ext(result)))
+	if slices.Contains(windowsReservedNames, base) {
+		result = "_" + result
+	}
+
+	return truncateName(result, maxNameBytes)
+}
+
+// truncateName shortens name to at most n bytes, keeping its extension and
+// not splitting UTF-8 sequences
+func truncateName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	ext := filepath.Ext(name)
+	stem := name[:n-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return strings.TrimRight(stem, ". ") + ext
+}
+
+// sanitizePath sanitizes every component of a path relative to DOWNLOADS_DIR
+func sanitizePath(rel, profile string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		parts[i] = sanitizeName(part, profile)
+	}
+	return filepath.Join(parts...)
+}
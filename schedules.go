@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+)
+
+const schedulesFile = "schedules.json"
+
+// How long one-off schedules are listed after they ran
+const scheduleDoneRetention = 7 * 24 * time.Hour
+
+// Schedule is a download request to start later: once at schedule_at, or
+// whenever its cron expression matches. Status is "scheduled", "paused" or,
+// for one-off schedules that ran, "done".
+type Schedule struct {
+	ID        string          `json:"id"`
+	Request   DownloadRequest `json:"request"`
+	Cron      string          `json:"cron,omitempty"`
+	Status    string          `json:"status"`
+	NextRunAt *time.Time      `json:"next_run_at,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+
+	// Runs so far, and the job started by the latest one
+	Runs      int        `json:"runs"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastJobID string     `json:"last_job_id,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	// Recorded when the schedule was created, as they aren't part of the
+	// request's JSON
+	APIKey   string   `json:"api_key,omitempty"`
+	Policies []string `json:"policies,omitempty"`
+}
+
+type ScheduleStore struct {
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+}
+
+var scheduleStore = &ScheduleStore{schedules: map[string]*Schedule{}}
+
+var (
+	errScheduleNotFound = errors.New("schedule not found")
+	errScheduleDone     = errors.New("schedule already ran")
+)
+
+// parseCron parses a standard five-field cron expression such as
+// "0 2 * * *", or a descriptor such as "@daily", in the server's time zone
+// unless it starts with CRON_TZ=
+func parseCron(spec string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression: %w", err)
+	}
+	return schedule, nil
+}
+
+// scheduled reports whether the request asks to be started later
+func (req *DownloadRequest) scheduled() bool {
+	return req.ScheduleAt != nil || req.Cron != ""
+}
+
+// validateSchedule checks schedule_at and cron
+func (req *DownloadRequest) validateSchedule() error {
+	if req.Cron != "" {
+		if _, err := parseCron(req.Cron); err != nil {
+			return err
+		}
+	} else if req.ScheduleAt != nil && !req.ScheduleAt.After(time.Now()) {
+		return errors.New("schedule_at must be in the future")
+	}
+	if req.Edition == "ask" {
+		return errors.New("edition can't be ask for scheduled downloads")
+	}
+	return nil
+}
+
+// nextRun returns when the schedule runs next after the given time, or nil
+// when a one-off schedule has run
+func (s *Schedule) nextRun(after time.Time) *time.Time {
+	if s.Cron == "" {
+		if s.Runs > 0 || s.Request.ScheduleAt == nil {
+			return nil
+		}
+		at := *s.Request.ScheduleAt
+		return &at
+	}
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return nil
+	}
+	if s.Request.ScheduleAt != nil && s.Request.ScheduleAt.After(after) {
+		after = *s.Request.ScheduleAt
+	}
+	next := spec.Next(after)
+	return &next
+}
+
+func (ss *ScheduleStore) load() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var saved []Schedule
+	if err := loadState(schedulesFile, &saved); err != nil {
+		return err
+	}
+	for _, s := range saved {
+		ss.schedules[s.ID] = &s
+	}
+	return nil
+}
+
+// save persists the schedules; callers hold ss.mu
+func (ss *ScheduleStore) save() error {
+	saved := []Schedule{}
+	for _, s := range ss.schedules {
+		saved = append(saved, *s)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	return saveState(schedulesFile, saved)
+}
+
+func (ss *ScheduleStore) List() []Schedule {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	list := []Schedule{}
+	for _, s := range ss.schedules {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (ss *ScheduleStore) Get(id string) (Schedule, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, exists := ss.schedules[id]
+	if !exists {
+		return Schedule{}, false
+	}
+	return *s, true
+}
+
+// Create schedules a validated request
+func (ss *ScheduleStore) Create(req DownloadRequest) (Schedule, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	s := &Schedule{
+		ID:        uuid.New().String(),
+		Request:   req,
+		Cron:      req.Cron,
+		Status:    "scheduled",
+		Owner:     req.Owner,
+		CreatedAt: time.Now(),
+		APIKey:    req.APIKey,
+		Policies:  req.Policies,
+	}
+	s.Request.Cron = ""
+	s.NextRunAt = s.nextRun(time.Now())
+	ss.schedules[s.ID] = s
+	return *s, ss.save()
+}
+
+func (ss *ScheduleStore) Delete(id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, exists := ss.schedules[id]; !exists {
+		return errScheduleNotFound
+	}
+	delete(ss.schedules, id)
+	return ss.save()
+}
+
+// SetPaused pauses or resumes a schedule. A resumed schedule runs at its
+// next time from now; a one-off schedule whose time passed while paused
+// runs right away.
+func (ss *ScheduleStore) SetPaused(id string, paused bool) (Schedule, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, exists := ss.schedules[id]
+	if !exists {
+		return Schedule{}, errScheduleNotFound
+	}
+	if s.Status == "done" {
+		return *s, errScheduleDone
+	}
+	if paused {
+		s.Status = "paused"
+		s.NextRunAt = nil
+	} else {
+		s.Status = "scheduled"
+		s.NextRunAt = s.nextRun(time.Now())
+	}
+	return *s, ss.save()
+}
+
+// due returns the schedules to run now, moving them to their next run, and
+// forgets one-off schedules that ran long ago
+func (ss *ScheduleStore) due(now time.Time) []Schedule {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var due []Schedule
+	changed := false
+	for id, s := range ss.schedules {
+		if s.Status == "done" && s.LastRunAt != nil && now.Sub(*s.LastRunAt) > scheduleDoneRetention {
+			delete(ss.schedules, id)
+			changed = true
+			continue
+		}
+		if s.Status != "scheduled" || s.NextRunAt == nil || s.NextRunAt.After(now) {
+			continue
+		}
+		s.Runs++
+		s.LastRunAt = &now
+		s.NextRunAt = s.nextRun(now)
+		if s.NextRunAt == nil {
+			s.Status = "done"
+		}
+		due = append(due, *s)
+		changed = true
+	}
+	if changed {
+		if err := ss.save(); err != nil {
+			slog.Error("Failed to save schedules", "error", err)
+		}
+	}
+	slices.SortFunc(due, func(a, b Schedule) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return due
+}
+
+// finished records the outcome of a schedule's run
+func (ss *ScheduleStore) finished(id, jobID string, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, exists := ss.schedules[id]
+	if !exists {
+		return
+	}
+	s.LastJobID, s.LastError = jobID, ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	if err := ss.save(); err != nil {
+		slog.Error("Failed to save schedules", "error", err)
+	}
+}
+
+// run starts the jobs of schedules as they come due
+func (ss *ScheduleStore) run() {
+	for {
+		for _, s := range ss.due(time.Now()) {
+			jobID, err := s.start()
+			if err != nil {
+				slog.Error("Failed to start scheduled download", "schedule_id", s.ID, "url", s.Request.URL, "error", err)
+			} else {
+				slog.Info("Started scheduled download", "schedule_id", s.ID, "job_id", jobID, "url", s.Request.URL)
+			}
+			ss.finished(s.ID, jobID, err)
+		}
+		time.Sleep(15 * time.Second)
+	}
+}
+
+// start runs the scheduled request as a job
+func (s Schedule) start() (string, error) {
+	req := s.Request
+	req.ScheduleAt = nil
+	req.Owner, req.APIKey, req.Policies = s.Owner, s.APIKey, s.Policies
+	editions, err := resolveEdition(&req)
+	if err != nil {
+		return "", fmt.Errorf("edition lookup failed: %w", err)
+	}
+	if editions != nil {
+		return "", errors.New("album has multiple editions")
+	}
+	return startDownload(req).ID, nil
+}
+
+func writeScheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errScheduleNotFound):
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+	case errors.Is(err, errScheduleDone):
+		http.Error(w, "Schedule already ran", http.StatusConflict)
+	default:
+		slog.Error("Failed to save schedules", "error", err)
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+	}
+}
+
+// handleSchedules serves GET /schedules, the scheduled downloads
+func handleSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	schedules := scheduleStore.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"schedules": schedules,
+		"count":     len(schedules),
+	})
+}
+
+// handleSchedule serves /schedules/{id} (GET, DELETE) and its pause and
+// resume actions
+func handleSchedule(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(r.URL.Path[len("/schedules/"):], "/")
+	if id == "" {
+		http.Error(w, "Schedule ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var s Schedule
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		var exists bool
+		if s, exists = scheduleStore.Get(id); !exists {
+			err = errScheduleNotFound
+		}
+
+	case action == "" && r.Method == http.MethodDelete:
+		if err = scheduleStore.Delete(id); err == nil {
+			auditLog.recordRequest(r, AuditEntry{Action: "schedule.deleted", Detail: map[string]string{"schedule_id": id}})
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	case (action == "pause" || action == "resume") && r.Method == http.MethodPost:
+		s, err = scheduleStore.SetPaused(id, action == "pause")
+
+	case action == "" || action == "pause" || action == "resume":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	installServiceFlag   = flag.Bool("install-service", false, "install the wrapper as a launchd agent (macOS) or Windows service and exit")
+	uninstallServiceFlag = flag.Bool("uninstall-service", false, "remove the installed launchd agent or Windows service and exit")
+)
+
+const (
+	serviceName        = "apple-music-dl-http-wrapper"
+	serviceDisplayName = "Apple Music Downloader HTTP Wrapper"
+	serviceLabel       = "io.github.tikhonp.amdl"
+)
+
+// serviceConfigFile returns the absolute path of the config file the
+// installed service is started with. The configuration, secrets included,
+// stays in that file rather than being copied into the service definition,
+// so every variable set now must come from it.
+func serviceConfigFile() (string, error) {
+	if configPath == "" {
+		return "", errors.New("--install-service needs the configuration in a config file, given with --config or CONFIG_FILE")
+	}
+	var outside []string
+	for key, value := range configEnv {
+		if fileConfig[key] != value {
+			outside = append(outside, key)
+		}
+	}
+	if len(outside) > 0 {
+		sort.Strings(outside)
+		return "", fmt.Errorf("%s set outside %s; the service only reads the config file", strings.Join(outside, ", "), configPath)
+	}
+	return filepath.Abs(configPath)
+}
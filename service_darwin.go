@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+)
+
+var launchdPlist = template.Must(template.New("plist").Funcs(template.FuncMap{
+	"xml": template.HTMLEscapeString,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .Program}}</string>
+		<string>--config</string>
+		<string>{{xml .ConfigFile}}</string>
+	</array>
+	<key>WorkingDirectory</key>
+	<string>{{xml .WorkingDirectory}}</string>
+	<key>EnvironmentVariables</key>
+	<dict>
+{{- range $key, $value := .Env}}
+		<key>{{xml $key}}</key>
+		<string>{{xml $value}}</string>
+{{- end}}
+	</dict>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>{{xml .LogFile}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogFile}}</string>
+</dict>
+</plist>
+`))
+
+func launchdPlistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", serviceLabel+".plist"), nil
+}
+
+// installService writes a launchd agent for the current user that starts
+// the wrapper with the config file at login and restarts it when it exits,
+// and loads it
+func installService() error {
+	program, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	configFile, err := serviceConfigFile()
+	if err != nil {
+		return err
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	// launchd starts agents with a minimal PATH
+	env := map[string]string{"PATH": os.Getenv("PATH")}
+	if _, set := configEnv["DOWNLOADER_PATH"]; !set {
+		if path, err := exec.LookPath(filepath.Base(cfg.DownloaderPath)); err == nil {
+			env["DOWNLOADER_PATH"] = path
+		}
+	}
+
+	var buf bytes.Buffer
+	err = launchdPlist.Execute(&buf, map[string]any{
+		"Label":            serviceLabel,
+		"Program":          program,
+		"ConfigFile":       configFile,
+		"WorkingDirectory": workDir,
+		"Env":              env,
+		"LogFile":          filepath.Join(home, "Library", "Logs", serviceName+".log"),
+	})
+	if err != nil {
+		return err
+	}
+
+	path, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	slog.Info("Wrote launchd job", "path", path)
+
+	if out, err := exec.Command("launchctl", "load", "-w", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl load: %v: %s", err, bytes.TrimSpace(out))
+	}
+	slog.Info("Loaded launchd job", "label", serviceLabel)
+	return nil
+}
+
+func uninstallService() error {
+	path, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("launchctl", "unload", "-w", path).CombinedOutput(); err != nil {
+		slog.Warn("launchctl unload failed", "output", string(bytes.TrimSpace(out)), "error", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	slog.Info("Removed launchd job", "path", path)
+	return nil
+}
+
+// startServiceHandler is only needed on Windows
+func startServiceHandler() {}
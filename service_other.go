@@ -0,0 +1,18 @@
+//go:build !darwin && !windows
+
+package main
+
+import "errors"
+
+var errServiceUnsupported = errors.New("service installation is only supported on macOS and Windows; use the Docker image or a systemd unit")
+
+func installService() error {
+	return errServiceUnsupported
+}
+
+func uninstallService() error {
+	return errServiceUnsupported
+}
+
+// startServiceHandler is only needed on Windows
+func startServiceHandler() {}
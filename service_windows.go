@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// installService registers the wrapper as a Windows service started at
+// boot with the config file, and starts it
+func installService() error {
+	program, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	configFile, err := serviceConfigFile()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, program, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "HTTP API for downloading from Apple Music with apple-music-dl",
+		StartType:   mgr.StartAutomatic,
+	}, "--config", configFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart after crashes
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		slog.Error("Failed to set recovery actions", "error", err)
+	}
+
+	slog.Info("Installed service", "service", serviceName)
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service: %w", err)
+	}
+	slog.Info("Started service", "service", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if _, err := s.Control(svc.Stop); err != nil && !errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+		slog.Error("Failed to stop service", "error", err)
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	slog.Info("Removed service", "service", serviceName)
+	return nil
+}
+
+// startServiceHandler reports to the service control manager when the
+// wrapper runs as a service, and shuts it down when the service is stopped.
+// Services have no console, so the log is written next to the executable.
+func startServiceHandler() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return
+	}
+
+	if program, err := os.Executable(); err == nil {
+		path := strings.TrimSuffix(program, filepath.Ext(program)) + ".log"
+		if f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err == nil {
+			configureLogging(f)
+		}
+	}
+
+	go func() {
+		if err := svc.Run(serviceName, windowsService{}); err != nil {
+			fatal("Service failed", "error", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			wait := cfg.ShutdownGracePeriod + cfg.CancelGracePeriod + shutdownFlushTimeout
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32(wait.Milliseconds())}
+			shutdown()
+			return false, 0
+		}
+	}
+	return false, 0
+}
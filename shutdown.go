@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time notifications about interrupted jobs get to be sent on shutdown
+const shutdownFlushTimeout = 10 * time.Second
+
+// servers are the API and admin listeners, closed on shutdown
+var servers []*http.Server
+
+// serve runs srv until it's shut down
+func serve(name string, srv *http.Server) {
+	servers = append(servers, srv)
+	go func() {
+		slog.Info("Starting server", "server", name, "addr", srv.Addr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", "server", name, "addr", srv.Addr, "error", err)
+		}
+	}()
+}
+
+// waitForSignal blocks until the wrapper is asked to stop with SIGINT or
+// SIGTERM and shuts it down
+func waitForSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("Received signal", "component", "shutdown", "signal", sig.String())
+	shutdown()
+}
+
+var shutdownOnce sync.Once
+
+// shutdown stops the wrapper gracefully. The listeners stop accepting
+// requests and no more queued jobs are started, while running downloads get
+// up to SHUTDOWN_GRACE_PERIOD to finish. Jobs still unfinished then are
+// stopped and marked interrupted, and the notifications about them are sent
+// before it returns.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := srv.Shutdown(ctx); err != nil {
+					srv.Close()
+				}
+			}()
+		}
+
+		scheduler.stop()
+		if running := scheduler.runningJobs(); running > 0 {
+			slog.Info("Waiting for running downloads", "component", "shutdown", "running", running, "grace_period", cfg.ShutdownGracePeriod.Seconds())
+			scheduler.waitIdle(ctx)
+		}
+		wg.Wait()
+
+		if interrupted := interruptJobs(); interrupted > 0 {
+			slog.Info("Interrupted unfinished jobs", "component", "shutdown", "jobs", interrupted)
+			// Give the stopped downloaders time to exit before the wrapper does
+			stopCtx, cancel := context.WithTimeout(context.Background(), cfg.CancelGracePeriod+time.Second)
+			defer cancel()
+			scheduler.waitIdle(stopCtx)
+		}
+
+		flushEvents(shutdownFlushTimeout)
+		if jobStore != nil {
+			storeWriter.flush()
+			if err := jobStore.Close(); err != nil {
+				slog.Error("Failed to close job database", "component", "shutdown", "error", err)
+			}
+		}
+		slog.Info("Done", "component", "shutdown")
+	})
+}
+
+// interruptJobs marks every queued or running job as interrupted and stops
+// the downloaders still running, returning the number of jobs
+func interruptJobs() int {
+	interrupted := 0
+	for _, job := range jobManager.SnapshotAll() {
+		if job.EndedAt != nil {
+			continue
+		}
+		scheduler.Remove(job.ID)
+
+		now := time.Now()
+		marked := false
+		jobManager.UpdateJob(job.ID, func(job *DownloadStatus) {
+			// The job may have finished in the meantime
+			if job.EndedAt != nil {
+				return
+			}
+			marked = true
+			job.Status = "interrupted"
+			job.Error = "Interrupted by a shutdown"
+			job.EndedAt = &now
+			job.Duration = now.Sub(job.StartedAt).String()
+		})
+		if !marked {
+			continue
+		}
+		jobManager.AddEvent(job.ID, JobEvent{Type: "interrupted", Message: "The wrapper shut down"})
+		jobManager.stopProcess(job.ID)
+		slog.Info("Interrupted by a shutdown", "job_id", job.ID)
+		interrupted++
+	}
+	return interrupted
+}
+
+// stop keeps the scheduler from starting any more jobs
+func (s *Scheduler) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) runningJobs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// waitIdle waits until no jobs are running or ctx is done
+func (s *Scheduler) waitIdle(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.runningJobs() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StagingBudget caps the disk space taken by the output of running jobs.
+// Their usage is sampled every interval as the size of the files written to
+// DOWNLOADS_DIR since the oldest running job started; while it's over the
+// limit, queued jobs wait for running ones to finish instead of starting.
+// The output of jobs running side by side can't be told apart, so usage is
+// tracked for all running jobs together.
+type StagingBudget struct {
+	limit    int64
+	interval time.Duration
+
+	mu      sync.Mutex
+	started map[string]time.Time
+
+	used     atomic.Int64
+	deferred atomic.Bool
+}
+
+func NewStagingBudget(limitMB int, interval time.Duration) *StagingBudget {
+	if limitMB <= 0 {
+		return nil
+	}
+	return &StagingBudget{
+		limit:    int64(limitMB) << 20,
+		interval: interval,
+		started:  make(map[string]time.Time),
+	}
+}
+
+// track counts the output of jobID against the budget from now on
+func (b *StagingBudget) track(jobID string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.started[jobID] = time.Now()
+	b.mu.Unlock()
+}
+
+// untrack stops counting jobID once it has finished. Its files are left
+// to the next sample, except when it was the last running job.
+func (b *StagingBudget) untrack(jobID string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	delete(b.started, jobID)
+	if len(b.started) == 0 {
+		b.used.Store(0)
+	}
+	b.mu.Unlock()
+}
+
+// exceeded reports whether queued jobs have to wait because in-progress
+// output is over the budget, logging when they start and stop having to
+func (b *StagingBudget) exceeded(queued int) bool {
+	if b == nil {
+		return false
+	}
+	used := b.used.Load()
+	if used < b.limit {
+		if b.deferred.Swap(false) {
+			slog.Info("In-progress output under budget; resuming queued jobs", "component", "staging", "used", used)
+		}
+		return false
+	}
+	if !b.deferred.Swap(true) {
+		slog.Info("In-progress output exceeds the budget; deferring queued jobs", "component", "staging", "used", used, "budget", b.limit, "queued", queued)
+	}
+	return true
+}
+
+// oldestStart returns when the longest-running tracked job started
+func (b *StagingBudget) oldestStart() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var oldest time.Time
+	for _, started := range b.started {
+		if oldest.IsZero() || started.Before(oldest) {
+			oldest = started
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// sample measures the usage of running jobs, waking the scheduler when
+// deferred jobs may start again
+func (b *StagingBudget) sample() {
+	since, running := b.oldestStart()
+	var used int64
+	if running {
+		var err error
+		if used, err = stagingUsage(since); err != nil {
+			slog.Error("Failed to measure in-progress output", "component", "staging", "error", err)
+			return
+		}
+	}
+	b.used.Store(used)
+
+	if used < b.limit && b.deferred.Load() {
+		scheduler.notify()
+	}
+}
+
+func (b *StagingBudget) run() {
+	for {
+		b.sample()
+		time.Sleep(b.interval)
+	}
+}
+
+// stagingUsage sums the size of the files in DOWNLOADS_DIR modified since
+// the given time, including hidden ones such as partial downloads
+func stagingUsage(since time.Time) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(cfg.DownloadsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files come and go while the downloader works
+			if path != cfg.DownloadsDir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.ModTime().Before(since) {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// formatBytes renders a size such as "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
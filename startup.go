@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dependency is something downloads need that may come up after the
+// wrapper, e.g. the decryption wrapper container
+type dependency struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// parseDependencies parses STARTUP_WAIT entries: "wrapper" for the
+// decryption wrapper named in the downloader config, "tcp:host:port",
+// "dns:hostname" and "mount:/path" for a writable directory
+func parseDependencies(entries []string) ([]dependency, error) {
+	var deps []dependency
+	for _, entry := range entries {
+		kind, target, _ := strings.Cut(entry, ":")
+		switch kind {
+		case "wrapper":
+			addr, err := decryptionWrapperAddr()
+			if err != nil {
+				return nil, fmt.Errorf("wrapper: %w", err)
+			}
+			deps = append(deps, dependency{name: "wrapper " + addr, check: tcpCheck(addr)})
+		case "tcp":
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return nil, fmt.Errorf("%s: %w", entry, err)
+			}
+			deps = append(deps, dependency{name: entry, check: tcpCheck(target)})
+		case "dns":
+			if target == "" {
+				return nil, fmt.Errorf("%s: hostname is required", entry)
+			}
+			deps = append(deps, dependency{name: entry, check: func(ctx context.Context) error {
+				_, err := net.DefaultResolver.LookupHost(ctx, target)
+				return err
+			}})
+		case "mount":
+			if target == "" {
+				return nil, fmt.Errorf("%s: path is required", entry)
+			}
+			deps = append(deps, dependency{name: entry, check: func(context.Context) error {
+				return checkWritable(target)
+			}})
+		default:
+			return nil, fmt.Errorf("unknown dependency %q", entry)
+		}
+	}
+	return deps, nil
+}
+
+// decryptionWrapperAddr reads the address of the decryption wrapper from the
+// downloader config
+func decryptionWrapperAddr() (string, error) {
+	data, err := os.ReadFile(cfg.DownloaderConfig)
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		DecryptPort string `yaml:"decrypt-m3u8-port"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", err
+	}
+	if config.DecryptPort == "" {
+		return "", errors.New("decrypt-m3u8-port is not set in the downloader config")
+	}
+	return config.DecryptPort, nil
+}
+
+func tcpCheck(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// checkWritable checks that dir exists and files can be created in it
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// startupState is reported by /readyz while dependencies are awaited
+var startupState = struct {
+	sync.Mutex
+	check HealthCheck
+}{check: HealthCheck{Status: "ok"}}
+
+func setStartupCheck(check HealthCheck) {
+	startupState.Lock()
+	defer startupState.Unlock()
+	startupState.check = check
+}
+
+func startupCheck() HealthCheck {
+	startupState.Lock()
+	defer startupState.Unlock()
+	return startupState.check
+}
+
+// waitForDependencies polls deps until they're all available or
+// STARTUP_TIMEOUT has passed, so jobs don't start and fail right after
+// boot. Dependencies still missing after the timeout make the wrapper
+// degraded, and jobs are started anyway.
+func waitForDependencies(deps []dependency) {
+	if len(deps) == 0 {
+		return
+	}
+
+	pending := deps
+	deadline := time.Now().Add(cfg.StartupTimeout)
+	lastLog := map[string]time.Time{}
+	for {
+		var waiting []dependency
+		var names []string
+		for _, dep := range pending {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := dep.check(ctx)
+			cancel()
+			if err == nil {
+				slog.Info("Dependency is available", "component", "startup", "dependency", dep.name)
+				continue
+			}
+			waiting = append(waiting, dep)
+			names = append(names, dep.name)
+			if time.Since(lastLog[dep.name]) >= 10*time.Second {
+				slog.Info("Waiting for dependency", "component", "startup", "dependency", dep.name, "error", err)
+				lastLog[dep.name] = time.Now()
+			}
+		}
+		pending = waiting
+
+		if len(pending) == 0 {
+			setStartupCheck(HealthCheck{Status: "ok"})
+			return
+		}
+		if time.Now().After(deadline) {
+			slog.Warn("Gave up waiting for dependencies; starting jobs anyway", "component", "startup", "dependencies", names, "timeout", cfg.StartupTimeout.Seconds())
+			setStartupCheck(HealthCheck{Status: "degraded", Error: "unavailable at startup: " + strings.Join(names, ", ")})
+			return
+		}
+		setStartupCheck(HealthCheck{Status: "fail", Error: "waiting for " + strings.Join(names, ", ")})
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// loadState reads a JSON document from the state directory into v. A missing
+// state directory or file leaves v untouched.
+func loadState(name string, v any) error {
+	if cfg.StateDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.StateDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// saveState atomically writes v as JSON to the state directory. It does
+// nothing when no state directory is configured.
+func saveState(name string, v any) error {
+	if cfg.StateDir == "" {
+		return nil
+	}
+
+	path := filepath.Join(cfg.StateDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
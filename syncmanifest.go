@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const syncManifestFile = "sync_manifest.json"
+
+// SyncResult is what a sync job found: of the tracks the album or playlist
+// has, how many were downloaded before and skipped, and how many were new
+type SyncResult struct {
+	Total      int `json:"total"`
+	Skipped    int `json:"skipped"`
+	Downloaded int `json:"downloaded"`
+}
+
+// SyncedSong is a song a completed sync job downloaded. Dir is the job's
+// output directory relative to DOWNLOADS_DIR, and requested is the output
+// directory the request asked for.
+type SyncedSong struct {
+	SongID    string    `json:"song_id"`
+	Format    string    `json:"format"`
+	Requested string    `json:"requested_dir,omitempty"`
+	Dir       string    `json:"dir,omitempty"`
+	JobID     string    `json:"job_id"`
+	SyncedAt  time.Time `json:"synced_at"`
+}
+
+// SyncManifest remembers the songs sync jobs downloaded, so later syncs of
+// the same album or playlist only fetch what was added since. It's kept in
+// STATE_DIR when one is configured.
+type SyncManifest struct {
+	mu    sync.Mutex
+	songs map[string][]SyncedSong // by song ID
+}
+
+var syncManifest = &SyncManifest{songs: map[string][]SyncedSong{}}
+
+func (m *SyncManifest) load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var saved []SyncedSong
+	if err := loadState(syncManifestFile, &saved); err != nil {
+		return err
+	}
+	for _, song := range saved {
+		m.songs[song.SongID] = append(m.songs[song.SongID], song)
+	}
+	return nil
+}
+
+// save persists the manifest; callers hold m.mu
+func (m *SyncManifest) save() error {
+	saved := []SyncedSong{}
+	for _, songs := range m.songs {
+		saved = append(saved, songs...)
+	}
+	slices.SortFunc(saved, func(a, b SyncedSong) int { return a.SyncedAt.Compare(b.SyncedAt) })
+	return saveState(syncManifestFile, saved)
+}
+
+// has reports whether the song was synced to the output directory req asks
+// for, in one of its formats, and its files' directory still exists
+func (m *SyncManifest) has(songID string, req DownloadRequest) bool {
+	m.mu.Lock()
+	songs := slices.Clone(m.songs[songID])
+	m.mu.Unlock()
+
+	for _, song := range songs {
+		if song.Requested != req.OutputDir {
+			continue
+		}
+		if len(req.Format) > 0 && !slices.Contains(req.Format, song.Format) {
+			continue
+		}
+		if song.Dir != "" {
+			if _, err := os.Stat(filepath.Join(cfg.DownloadsDir, filepath.FromSlash(song.Dir))); err != nil {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// record adds the songs a completed sync job downloaded, by song ID with
+// the format each was obtained in
+func (m *SyncManifest) record(jobID string, req DownloadRequest, formats map[string]string) {
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists || len(formats) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for songID, format := range formats {
+		song := SyncedSong{
+			SongID:    songID,
+			Format:    format,
+			Requested: req.OutputDir,
+			Dir:       job.OutputDir,
+			JobID:     jobID,
+			SyncedAt:  now,
+		}
+		songs := slices.DeleteFunc(m.songs[songID], func(s SyncedSong) bool {
+			return s.Requested == song.Requested && s.Format == song.Format
+		})
+		m.songs[songID] = append(songs, song)
+	}
+	if err := m.save(); err != nil {
+		slog.Error("Failed to save the sync manifest", "job_id", jobID, "error", err)
+	}
+}
+
+// syncTargets leaves out the tracks a previous sync already downloaded and
+// records the counts on the job
+func syncTargets(jobID string, req DownloadRequest, tracks []catalogResource) []catalogResource {
+	var missing []catalogResource
+	for _, track := range tracks {
+		if !syncManifest.has(track.ID, req) {
+			missing = append(missing, track)
+		}
+	}
+
+	result := SyncResult{Total: len(tracks), Skipped: len(tracks) - len(missing), Downloaded: len(missing)}
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		job.Sync = &result
+	})
+	message := fmt.Sprintf("Sync: %d of %d tracks already downloaded, %d to fetch", result.Skipped, result.Total, result.Downloaded)
+	jobManager.AddEvent(jobID, JobEvent{Type: "tracks_synced", Message: message})
+	jobManager.AppendLog(jobID, message)
+	slog.Info("Synced tracks", "job_id", jobID, "total", result.Total, "skipped", result.Skipped, "to_fetch", result.Downloaded)
+	return missing
+}
+
+// songID returns the catalog ID of the song a track link points to
+func songID(rawURL string) string {
+	link, err := parseAppleMusicURL(rawURL)
+	if err != nil {
+		return ""
+	}
+	if link.SongID != "" {
+		return link.SongID
+	}
+	if link.Type == "song" {
+		return link.ID
+	}
+	return ""
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TaggingOptions control how album artist, compilation and classical
+// work/movement tags are written after a download
+type TaggingOptions struct {
+	// Album artist written to every track; defaults to the catalog album
+	// artist when Compilation is set
+	AlbumArtist string `json:"album_artist,omitempty"`
+
+	// "auto" marks albums the catalog lists as compilations, "yes" and "no"
+	// force the flag. Compilations get "Various Artists" as album artist;
+	// other albums get the album's artist on every track so players don't
+	// split them by featured artists.
+	Compilation string `json:"compilation,omitempty"`
+
+	// Write the catalog work name to the grouping and work tags, the
+	// movement name, number and count, and the composer, as classical
+	// libraries expect
+	Classical bool `json:"classical,omitempty"`
+
+	// Use the composer as album artist for classical releases
+	ComposerAsAlbumArtist bool `json:"composer_as_album_artist,omitempty"`
+}
+
+var compilationModes = []string{"", "auto", "yes", "no"}
+
+func (t TaggingOptions) validate() error {
+	if !slices.Contains(compilationModes, t.Compilation) {
+		return fmt.Errorf("compilation must be auto, yes or no")
+	}
+	return nil
+}
+
+// merge returns t with the fields set in override replacing its own
+func (t TaggingOptions) merge(override *TaggingOptions) TaggingOptions {
+	if override == nil {
+		return t
+	}
+	if override.AlbumArtist != "" {
+		t.AlbumArtist = override.AlbumArtist
+	}
+	if override.Compilation != "" {
+		t.Compilation = override.Compilation
+	}
+	if override.Classical {
+		t.Classical = true
+	}
+	if override.ComposerAsAlbumArtist {
+		t.ComposerAsAlbumArtist = true
+	}
+	return t
+}
+
+func (t TaggingOptions) enabled() bool {
+	return t != TaggingOptions{}
+}
+
+// readTags returns the container tags of an audio file, with lowercase keys
+func readTags(path string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, cfg.FFprobePath, "-v", "quiet", "-print_format", "json", "-show_format", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe %s: %w", filepath.Base(path), err)
+	}
+
+	var probe struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe %s: %w", filepath.Base(path), err)
+	}
+
+	tags := map[string]string{}
+	for key, value := range probe.Format.Tags {
+		tags[strings.ToLower(key)] = value
+	}
+	if file, err := readMP4(path); err == nil {
+		for _, m := range movementItems {
+			if data := file.item(m.typ); data != nil {
+				if m.integer {
+					tags[m.tag] = strconv.FormatUint(bigEndianUint(data), 10)
+				} else {
+					tags[m.tag] = string(data)
+				}
+			}
+		}
+	}
+	return tags, nil
+}
+
+// Classical work and movement tags, which ffmpeg doesn't write to MP4
+// files, and their iTunes items
+var movementItems = []struct {
+	tag, typ string
+	integer  bool
+}{
+	{"work", "\xa9wrk", false},
+	{"movementname", "\xa9mvn", false},
+	{"movement", "\xa9mvi", true},
+	{"movementtotal", "\xa9mvc", true},
+}
+
+// writeTags rewrites the given tags of an audio file in place without
+// re-encoding it, keeping its gapless info. Work and movement tags are
+// written to the iTunes items directly.
+func writeTags(path string, tags map[string]string) error {
+	tags = maps.Clone(tags)
+	var items []ilstItem
+	for _, m := range movementItems {
+		value, ok := tags[m.tag]
+		if !ok {
+			continue
+		}
+		delete(tags, m.tag)
+		if !m.integer {
+			items = append(items, textItem(m.typ, value))
+		} else if n, err := strconv.Atoi(value); err == nil {
+			items = append(items, integerItem(m.typ, n, 2))
+		}
+	}
+	if err := ffmpegTags(path, tags); err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	file, err := readMP4(path)
+	if err != nil {
+		return fmt.Errorf("failed to write the movement tags of %s: %w", filepath.Base(path), err)
+	}
+	// Has players show the work and movement in place of the title
+	items = append(items, integerItem("shwm", 1, 1))
+	if err := file.setItems(path, items...); err != nil {
+		return fmt.Errorf("failed to write the movement tags of %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// ffmpegTags rewrites tags with ffmpeg, copying the streams
+func ffmpegTags(path string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var smpb string
+	if file, err := readMP4(path); err == nil {
+		smpb = file.iTunesItem("iTunSMPB")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tmp := filepath.Join(filepath.Dir(path), ".tagging-"+filepath.Base(path))
+	args := []string{"-v", "error", "-y", "-i", path, "-map", "0", "-c", "copy"}
+	for key, value := range tags {
+		args = append(args, "-metadata", key+"="+value)
+	}
+	args = append(args, tmp)
+
+	if out, err := exec.CommandContext(ctx, cfg.FFmpegPath, args...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("ffmpeg %s: %v: %s", filepath.Base(path), err, strings.TrimSpace(string(out)))
+	}
+	if err := keepITunSMPB(tmp, smpb); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to keep the gapless info of %s: %w", filepath.Base(path), err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// tagNumber parses "3" or "3/12" style track and disc tags
+func tagNumber(value string) int {
+	number, _, _ := strings.Cut(value, "/")
+	n, _ := strconv.Atoi(strings.TrimSpace(number))
+	return n
+}
+
+// albumTags computes the tags TaggingOptions require for one track. album
+// and track come from the catalog and may be nil when the lookup failed.
+func albumTags(opts TaggingOptions, album, track *catalogResource) map[string]string {
+	tags := map[string]string{}
+
+	compilation := opts.Compilation == "yes" || (opts.Compilation == "auto" && album != nil && album.Attributes.IsCompilation)
+	switch {
+	case opts.Compilation == "":
+	case compilation:
+		tags["compilation"] = "1"
+		tags["album_artist"] = "Various Artists"
+	default:
+		tags["compilation"] = "0"
+		if album != nil {
+			tags["album_artist"] = album.Attributes.ArtistName
+		}
+	}
+
+	if opts.Classical && track != nil {
+		if track.Attributes.WorkName != "" {
+			tags["grouping"] = track.Attributes.WorkName
+			tags["work"] = track.Attributes.WorkName
+		}
+		if track.Attributes.MovementName != "" {
+			tags["movementname"] = track.Attributes.MovementName
+		}
+		if track.Attributes.MovementNumber > 0 {
+			tags["movement"] = strconv.Itoa(track.Attributes.MovementNumber)
+		}
+		if track.Attributes.MovementCount > 0 {
+			tags["movementtotal"] = strconv.Itoa(track.Attributes.MovementCount)
+		}
+		if track.Attributes.ComposerName != "" {
+			tags["composer"] = track.Attributes.ComposerName
+			if opts.ComposerAsAlbumArtist {
+				tags["album_artist"] = track.Attributes.ComposerName
+			}
+		}
+	}
+
+	if opts.AlbumArtist != "" {
+		tags["album_artist"] = opts.AlbumArtist
+	}
+	return tags
+}
+
+// tagFiles applies the profile's tagging options and rewrite rules to the
+// downloaded audio files, matching them to catalog tracks by disc and track
+// number
+func tagFiles(jobID string, req DownloadRequest, profile OutputProfile, files []string) error {
+	var album *catalogResource
+	if link, err := parseAppleMusicURL(req.URL); err == nil && link.Type == "album" && profile.Tagging.enabled() {
+		album, err = appleMusic.Resource(link.Storefront, "album", link.ID, profile.MetadataLanguage)
+		if err != nil {
+			jobManager.AppendLog(jobID, fmt.Sprintf("Catalog lookup for tagging failed: %v", err))
+			album = nil
+		}
+	}
+
+	for _, path := range files {
+		current, err := readTags(path)
+		if err != nil {
+			return err
+		}
+
+		var track *catalogResource
+		if album != nil {
+			disc, number := max(tagNumber(current["disc"]), 1), tagNumber(current["track"])
+			for i, candidate := range album.Relationships.Tracks.Data {
+				if candidate.Attributes.DiscNumber == disc && candidate.Attributes.TrackNumber == number {
+					track = &album.Relationships.Tracks.Data[i]
+					break
+				}
+			}
+		}
+
+		tags := maps.Clone(current)
+		maps.Copy(tags, albumTags(profile.Tagging, album, track))
+		applyTagRules(profile.TagRules, tags)
+
+		// Only rewrite what changed
+		changed := map[string]string{}
+		for key, value := range tags {
+			if current[key] != value {
+				changed[key] = value
+			}
+		}
+		if err := writeTags(path, changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// TagRule rewrites one tag after download. Map replaces whole values,
+// Match/Replace rewrite them with a regular expression, and ExtractTo copies
+// the first capture group of Match into another tag, e.g. to move
+// "(feat. X)" out of the title.
+type TagRule struct {
+	Tag       string            `json:"tag"`
+	Map       map[string]string `json:"map,omitempty"`
+	Match     string            `json:"match,omitempty"`
+	Replace   string            `json:"replace,omitempty"`
+	ExtractTo string            `json:"extract_to,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *TagRule) compile() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag rule without tag")
+	}
+	if r.Match == "" {
+		if r.ExtractTo != "" {
+			return fmt.Errorf("tag rule for %s: extract_to requires match", r.Tag)
+		}
+		return nil
+	}
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("tag rule for %s: %w", r.Tag, err)
+	}
+	r.re = re
+	return nil
+}
+
+// applyTagRules runs the rules in order on tags, which is modified in place
+func applyTagRules(rules []TagRule, tags map[string]string) {
+	for _, rule := range rules {
+		value, exists := tags[rule.Tag]
+		if !exists {
+			continue
+		}
+
+		if mapped, ok := rule.Map[value]; ok {
+			value = mapped
+		}
+
+		if rule.re != nil {
+			if rule.ExtractTo != "" {
+				if m := rule.re.FindStringSubmatch(value); len(m) > 1 && m[1] != "" {
+					tags[rule.ExtractTo] = m[1]
+				}
+			}
+			value = rule.re.ReplaceAllString(value, rule.Replace)
+		}
+
+		tags[rule.Tag] = value
+	}
+}
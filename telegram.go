@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const telegramHelp = `Send an Apple Music link to download it, or use a command:
+/dl <url> [format] - start a download (format: alac, atmos, aac, or a fallback list like atmos,alac)
+/status [job_id] - show a job, or a summary of all jobs
+/cancel <job_id> [reason] - cancel a queued or running job
+/queue - list queued and running jobs`
+
+// How often the messages following jobs are edited with their progress;
+// the Bot API limits how often a chat's messages can be edited
+const telegramProgressInterval = 3 * time.Second
+
+type telegramBot struct {
+	token   string
+	allowed []int64
+	offset  int64
+
+	mu        sync.Mutex
+	following map[string]*telegramFollow // by job ID
+}
+
+// telegramFollow is the message the bot keeps up to date with a job it
+// started
+type telegramFollow struct {
+	chatID    int64
+	messageID int64 // of the bot's status message
+	replyTo   int64 // the message that asked for the job
+	lang      string
+
+	// Held while editing, so edits arrive in order
+	mu       sync.Mutex
+	text     string // last sent
+	finished bool
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		MessageID int64 `json:"message_id"`
+		Chat      struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		From *struct {
+			LanguageCode string `json:"language_code"`
+		} `json:"from"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// telegram is the bot when TELEGRAM_BOT_TOKEN is set, also used to send
+// routed notifications
+var telegram *telegramBot
+
+func newTelegramBot(token string, allowed []int64) *telegramBot {
+	return &telegramBot{token: token, allowed: allowed, following: map[string]*telegramFollow{}}
+}
+
+// call invokes a Bot API method and decodes its result into result
+func (b *telegramBot) call(method string, params any, result any) (err error) {
+	defer func() { integrationHealth.record("telegram", err) }()
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/%s", b.token, method)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+func (b *telegramBot) send(chatID int64, text string) {
+	if _, err := b.sendMessage(chatID, text, 0); err != nil {
+		slog.Error("Failed to send message", "component", "telegram", "chat_id", chatID, "error", err)
+	}
+}
+
+// sendMessage sends text as a reply to replyTo, unless it's 0, and returns
+// the message's ID
+func (b *telegramBot) sendMessage(chatID int64, text string, replyTo int64) (int64, error) {
+	params := map[string]any{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	}
+	if replyTo != 0 {
+		params["reply_parameters"] = map[string]any{"message_id": replyTo, "allow_sending_without_reply": true}
+	}
+	var message struct {
+		MessageID int64 `json:"message_id"`
+	}
+	err := b.call("sendMessage", params, &message)
+	return message.MessageID, err
+}
+
+func (b *telegramBot) run() {
+	if len(b.allowed) == 0 {
+		slog.Info("No allowed chats configured; all commands will be rejected", "component", "telegram")
+	}
+	slog.Info("Bot started", "component", "telegram")
+	go b.followProgress()
+
+	for {
+		var updates []telegramUpdate
+		err := b.call("getUpdates", map[string]any{
+			"offset":          b.offset,
+			"timeout":         30,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			slog.Error("Failed to fetch updates", "component", "telegram", "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, update := range updates {
+			b.offset = update.UpdateID + 1
+			if update.Message == nil || update.Message.Text == "" {
+				continue
+			}
+			lang := cfg.DefaultLanguage
+			if update.Message.From != nil && update.Message.From.LanguageCode != "" {
+				lang = supportedLanguage(update.Message.From.LanguageCode)
+			}
+			b.handleMessage(update.Message.Chat.ID, update.Message.MessageID, update.Message.Text, lang)
+		}
+	}
+}
+
+// handleMessage answers a command, or downloads the Apple Music links in
+// any other message, in lang, the sender's language
+func (b *telegramBot) handleMessage(chatID, messageID int64, text, lang string) {
+	if !slices.Contains(b.allowed, chatID) {
+		slog.Warn("Rejected message", "component", "telegram", "chat_id", chatID)
+		b.send(chatID, tr(lang, "This chat (%d) is not allowed to use this bot.", chatID))
+		return
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+
+	if !strings.HasPrefix(fields[0], "/") {
+		links := findAppleMusicLinks(text)
+		if len(links) == 0 {
+			b.send(chatID, tr(lang, "No Apple Music links were found in your message."))
+			return
+		}
+		for _, link := range links {
+			b.startJob(chatID, messageID, link, nil, lang)
+		}
+		return
+	}
+
+	// Commands in groups arrive as /cmd@botname
+	command, _, _ := strings.Cut(fields[0], "@")
+	args := fields[1:]
+
+	switch command {
+	case "/dl":
+		if len(args) == 0 {
+			b.send(chatID, tr(lang, "Usage: /dl <url> [format]"))
+			return
+		}
+		var format FormatList
+		if len(args) > 1 {
+			format = parseFormatList(args[1])
+		}
+		b.startJob(chatID, messageID, args[0], format, lang)
+
+	case "/status":
+		if len(args) == 0 {
+			b.send(chatID, jobCountsSummary(lang))
+			return
+		}
+		job, exists := jobManager.Snapshot(args[0])
+		if !exists {
+			b.send(chatID, tr(lang, "Job not found"))
+			return
+		}
+		b.send(chatID, jobSummary(lang, job))
+
+	case "/cancel":
+		if len(args) == 0 {
+			b.send(chatID, tr(lang, "Usage: /cancel <job_id> [reason]"))
+			return
+		}
+		switch err := cancelJob(args[0], strings.Join(args[1:], " ")); {
+		case errors.Is(err, errJobNotFound):
+			b.send(chatID, tr(lang, "Job not found"))
+		case errors.Is(err, errJobNotRunning):
+			b.send(chatID, tr(lang, "Job is not running"))
+		default:
+			auditLog.record(AuditEntry{Action: "job.cancelled", Actor: fmt.Sprintf("telegram:%d", chatID), JobID: args[0], Detail: reasonDetail(strings.Join(args[1:], " "))})
+			b.send(chatID, tr(lang, "Cancelled job %s", args[0]))
+		}
+
+	case "/queue":
+		b.send(chatID, queueSummary(lang))
+
+	default:
+		b.send(chatID, tr(lang, telegramHelp))
+	}
+}
+
+// startJob downloads link for a chat, answering messageID with a message
+// that follows the job's progress
+func (b *telegramBot) startJob(chatID, messageID int64, link string, format FormatList, lang string) {
+	req := DownloadRequest{URL: link, Format: format, Owner: fmt.Sprintf("telegram:%d", chatID)}
+	if err := prepareRequest(&req); err != nil {
+		b.send(chatID, err.Error())
+		return
+	}
+	job := startDownload(req)
+
+	snapshot, _ := jobManager.Snapshot(job.ID)
+	text := jobSummary(lang, snapshot)
+	statusID, err := b.sendMessage(chatID, text, messageID)
+	if err != nil {
+		slog.Error("Failed to send message", "component", "telegram", "chat_id", chatID, "error", err)
+		return
+	}
+	b.mu.Lock()
+	b.following[job.ID] = &telegramFollow{chatID: chatID, messageID: statusID, replyTo: messageID, lang: lang, text: text}
+	b.mu.Unlock()
+
+	// jobFinished has nothing to finish for a job that ended before it was
+	// followed
+	if snapshot, _ := jobManager.Snapshot(job.ID); snapshot.EndedAt != nil {
+		b.jobFinished(snapshot)
+	}
+}
+
+// followProgress edits the status messages of the jobs the bot started
+// whenever their summary changes
+func (b *telegramBot) followProgress() {
+	ticker := time.NewTicker(telegramProgressInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.mu.Lock()
+		ids := make([]string, 0, len(b.following))
+		for id := range b.following {
+			ids = append(ids, id)
+		}
+		b.mu.Unlock()
+
+		for _, id := range ids {
+			job, exists := jobManager.Snapshot(id)
+			if !exists || job.EndedAt != nil {
+				// Finished jobs are handled by jobFinished
+				continue
+			}
+			b.mu.Lock()
+			follow, following := b.following[id]
+			b.mu.Unlock()
+			if following {
+				b.edit(follow, jobSummary(follow.lang, job), false)
+			}
+		}
+	}
+}
+
+// edit updates a status message when its text has changed. Once the final
+// status has been shown, progress edits that were under way are dropped.
+func (b *telegramBot) edit(follow *telegramFollow, text string, final bool) {
+	follow.mu.Lock()
+	defer follow.mu.Unlock()
+	if follow.finished || text == follow.text {
+		follow.finished = follow.finished || final
+		return
+	}
+	follow.text, follow.finished = text, final
+
+	err := b.call("editMessageText", map[string]any{
+		"chat_id":                  follow.chatID,
+		"message_id":               follow.messageID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	}, nil)
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		slog.Error("Failed to edit message", "component", "telegram", "chat_id", follow.chatID, "error", err)
+	}
+}
+
+// jobFinished is registered with the job manager to give the final status
+// of the jobs the bot started: the status message shows it, and a new
+// message announces it, as edits don't notify
+func (b *telegramBot) jobFinished(job DownloadStatus) {
+	b.mu.Lock()
+	follow, exists := b.following[job.ID]
+	delete(b.following, job.ID)
+	b.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	b.edit(follow, jobSummary(follow.lang, job), true)
+	if _, err := b.sendMessage(follow.chatID, tr(follow.lang, "Job %s finished: %s", job.ID, job.Status), follow.replyTo); err != nil {
+		slog.Error("Failed to send message", "component", "telegram", "chat_id", follow.chatID, "error", err)
+	}
+}
+
+// jobSummary renders a short plain-text description of a job in lang for
+// chat clients
+func jobSummary(lang string, job DownloadStatus) string {
+	var sb strings.Builder
+	sb.WriteString(tr(lang, "Job %s", job.ID) + "\n")
+	fmt.Fprintf(&sb, "URL: %s\n", job.URL)
+	sb.WriteString(tr(lang, "Status: %s", job.Status))
+	if progress := job.Progress.String(); progress != "" {
+		sb.WriteString("\n" + tr(lang, "Progress: %s", progress))
+	}
+	if job.Duration != "" {
+		sb.WriteString("\n" + tr(lang, "Duration: %s", job.Duration))
+	}
+	if job.Error != "" {
+		sb.WriteString("\n" + tr(lang, "Error: %s", job.Error))
+	}
+	if len(job.Tracks) > 0 {
+		sb.WriteString("\n" + tr(lang, "Tracks:"))
+		for i, track := range job.Tracks {
+			if i == maxSummaryTracks {
+				sb.WriteString("\n" + tr(lang, "…and %d more", len(job.Tracks)-i))
+				break
+			}
+			fmt.Fprintf(&sb, "\n%s", track)
+		}
+	}
+	return sb.String()
+}
+
+// Tracks listed in a job summary; chat messages have length limits
+const maxSummaryTracks = 30
+
+func jobCountsSummary(lang string) string {
+	counts := map[string]int{}
+	for _, job := range jobManager.SnapshotAll() {
+		counts[job.Status]++
+	}
+	if len(counts) == 0 {
+		return tr(lang, "No jobs yet")
+	}
+
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	lines := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		lines = append(lines, fmt.Sprintf("%s: %d", status, counts[status]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func queueSummary(lang string) string {
+	var active []DownloadStatus
+	for _, job := range jobManager.SnapshotAll() {
+		if job.Status == "queued" || job.Status == "running" {
+			active = append(active, job)
+		}
+	}
+	if len(active) == 0 {
+		return tr(lang, "Queue is empty")
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].StartedAt.Before(active[j].StartedAt)
+	})
+
+	lines := make([]string, 0, len(active))
+	for _, job := range active {
+		lines = append(lines, fmt.Sprintf("[%s] %s\n%s", job.Status, job.ID, job.URL))
+	}
+	return strings.Join(lines, "\n\n")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const templatesFile = "templates.json"
+
+// Template is a named set of download request options, such as an
+// "archival" preset, that requests refer to instead of repeating them
+type Template struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Options in the form of a download request without a URL
+	Options json.RawMessage `json:"options"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// normalize checks the template's options and keeps only those that are
+// set, as a download request would encode them
+func (t *Template) normalize() error {
+	if t.Name == "" || strings.Contains(t.Name, "/") {
+		return errors.New("name is required and must not contain /")
+	}
+
+	var req DownloadRequest
+	if len(t.Options) > 0 {
+		if err := json.Unmarshal(t.Options, &req); err != nil {
+			return fmt.Errorf("invalid options: %v", err)
+		}
+	}
+	switch {
+	case req.URL != "" || len(req.URLs) > 0:
+		return errors.New("options must not include url or urls")
+	case req.Template != "":
+		return errors.New("options must not refer to another template")
+	}
+	if err := req.validateOptions(); err != nil {
+		return err
+	}
+
+	options, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(options, &fields)
+	delete(fields, "url")
+	t.Options, err = json.Marshal(fields)
+	return err
+}
+
+type TemplateStore struct {
+	mu        sync.RWMutex
+	templates map[string]Template
+}
+
+var templateStore = &TemplateStore{templates: map[string]Template{}}
+
+var (
+	errTemplateNotFound = errors.New("template not found")
+	errTemplateExists   = errors.New("template already exists")
+)
+
+func (ts *TemplateStore) load() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var saved []Template
+	if err := loadState(templatesFile, &saved); err != nil {
+		return err
+	}
+	for _, t := range saved {
+		ts.templates[t.Name] = t
+	}
+	return nil
+}
+
+// save persists the templates; callers hold ts.mu
+func (ts *TemplateStore) save() error {
+	return saveState(templatesFile, ts.list())
+}
+
+func (ts *TemplateStore) list() []Template {
+	list := []Template{}
+	for _, t := range ts.templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (ts *TemplateStore) List() []Template {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.list()
+}
+
+func (ts *TemplateStore) Get(name string) (Template, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	t, exists := ts.templates[name]
+	return t, exists
+}
+
+// Put saves a template, replacing the one with the same name unless create
+// is set
+func (ts *TemplateStore) Put(t Template, create bool) (Template, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	now := time.Now()
+	t.CreatedAt, t.UpdatedAt = now, now
+	if existing, exists := ts.templates[t.Name]; exists {
+		if create {
+			return Template{}, errTemplateExists
+		}
+		t.CreatedAt = existing.CreatedAt
+	}
+	ts.templates[t.Name] = t
+	return t, ts.save()
+}
+
+func (ts *TemplateStore) Delete(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, exists := ts.templates[name]; !exists {
+		return errTemplateNotFound
+	}
+	delete(ts.templates, name)
+	return ts.save()
+}
+
+// applyTemplate fills the options req leaves unset from the template it
+// names. body is the request as it was sent, decoded over the template's
+// options so that only the fields it includes take precedence; nested
+// options such as tagging are merged field by field. The owner's
+// preferences still apply to what neither sets.
+func applyTemplate(req *DownloadRequest, body []byte) error {
+	t, exists := templateStore.Get(req.Template)
+	if !exists {
+		return fmt.Errorf("Unknown template %q", req.Template)
+	}
+	var merged DownloadRequest
+	if err := json.Unmarshal(t.Options, &merged); err != nil {
+		return fmt.Errorf("Invalid template %q: %v", t.Name, err)
+	}
+	if err := json.Unmarshal(body, &merged); err != nil {
+		return fmt.Errorf("Invalid request: %v", err)
+	}
+	// Fields set by the wrapper rather than the client aren't in the body
+	merged.BatchID, merged.Owner, merged.APIKey, merged.Trace = req.BatchID, req.Owner, req.APIKey, req.Trace
+	merged.RetryOf, merged.Policies = req.RetryOf, req.Policies
+	*req = merged
+	return nil
+}
+
+// handleTemplates lists (GET) and creates (POST) templates
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		templates := templateStore.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"templates": templates,
+			"count":     len(templates),
+		})
+
+	case http.MethodPost:
+		var t Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		t.Name = strings.TrimSpace(t.Name)
+		if err := t.normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err := templateStore.Put(t, true)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTemplate serves /templates/{name}: GET, PUT to create or replace
+// it, and DELETE
+func handleTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/templates/"):]
+	if name == "" {
+		http.Error(w, "Template name is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		t, exists := templateStore.Get(name)
+		if !exists {
+			writeTemplateError(w, errTemplateNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+
+	case http.MethodPut:
+		var t Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		t.Name = name
+		if err := t.normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err := templateStore.Put(t, false)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+
+	case http.MethodDelete:
+		if err := templateStore.Delete(name); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTemplateNotFound):
+		http.Error(w, "Template not found", http.StatusNotFound)
+	case errors.Is(err, errTemplateExists):
+		http.Error(w, "Template already exists", http.StatusConflict)
+	default:
+		slog.Error("Failed to save templates", "error", err)
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+	}
+}
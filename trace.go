@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// TraceContext identifies the request a download came from, so it can be
+// followed through outbound webhooks and scripts. TraceParent is a W3C
+// Trace Context header ("00-<trace id>-<parent id>-<flags>").
+type TraceContext struct {
+	TraceParent string `json:"traceparent,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+}
+
+var traceParentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTrace starts a new trace
+func newTrace() TraceContext {
+	return TraceContext{
+		TraceParent: "00-" + randomHex(16) + "-" + randomHex(8) + "-01",
+		RequestID:   uuid.New().String(),
+	}
+}
+
+// traceFromRequest continues the caller's trace from its traceparent and
+// X-Request-ID headers, starting a new one for whatever is missing
+func traceFromRequest(r *http.Request) TraceContext {
+	trace := newTrace()
+	if parent := strings.ToLower(strings.TrimSpace(r.Header.Get("traceparent"))); traceParentPattern.MatchString(parent) {
+		trace.TraceParent = parent
+	}
+	if id := strings.TrimSpace(r.Header.Get("X-Request-ID")); id != "" && len(id) <= 128 {
+		trace.RequestID = id
+	}
+	return trace
+}
+
+// child returns a traceparent for an outbound call: the same trace with a
+// new parent span ID
+func (t TraceContext) child() string {
+	m := traceParentPattern.FindStringSubmatch(t.TraceParent)
+	if m == nil {
+		return ""
+	}
+	return "00-" + m[1] + "-" + randomHex(8) + "-" + m[3]
+}
+
+// apply sets the trace headers on an outbound request
+func (t TraceContext) apply(h http.Header) {
+	if parent := t.child(); parent != "" {
+		h.Set("traceparent", parent)
+	}
+	if t.RequestID != "" {
+		h.Set("X-Request-ID", t.RequestID)
+	}
+}
+
+// env returns the trace as environment variables for child processes
+func (t TraceContext) env() []string {
+	var env []string
+	if parent := t.child(); parent != "" {
+		env = append(env, "TRACEPARENT="+parent)
+	}
+	if t.RequestID != "" {
+		env = append(env, "REQUEST_ID="+t.RequestID)
+	}
+	return env
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Track is an audio file of a finished job, as listed in notifications
+type Track struct {
+	Disc     int     `json:"disc,omitempty"`
+	Number   int     `json:"number,omitempty"`
+	Title    string  `json:"title"`
+	Duration float64 `json:"duration,omitempty"` // seconds
+	Format   string  `json:"format,omitempty"`
+	Path     string  `json:"path"` // relative to DOWNLOADS_DIR
+}
+
+// Names of the requested formats, and of the formats audio codecs are
+// downloaded in
+var formatNames = map[string]string{
+	"alac":  "ALAC",
+	"atmos": "Dolby Atmos",
+	"aac":   "AAC",
+}
+
+var codecFormats = map[string]string{
+	"alac": "ALAC",
+	"aac":  "AAC",
+	"eac3": "Dolby Atmos",
+	"ac3":  "Dolby Atmos",
+	"ac4":  "Dolby Atmos",
+}
+
+// trackFilePattern matches names like "01 Doctor.m4a" or "1-01 Doctor.m4a"
+var trackFilePattern = regexp.MustCompile(`^(?:(\d+)-)?(\d+)[ .-]+(.+)$`)
+
+// recordTracks lists the job's audio artifacts as tracks. Tags are read
+// with ffprobe; without it, numbers and titles come from the file names and
+// the format from the one that was obtained. The audio quality ffprobe finds
+// is recorded in the artifacts.
+func recordTracks(jobID string, obtained []string) {
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		return
+	}
+
+	var tracks []Track
+	qualities := map[string]AudioQuality{}
+	alac := false
+	for _, artifact := range job.Artifacts {
+		if artifact.Kind != "audio" {
+			continue
+		}
+		track := trackFromName(artifact.Path)
+		if len(obtained) == 1 {
+			track.Format = formatNames[obtained[0]]
+		}
+		if q := probeTrack(filepath.Join(cfg.DownloadsDir, filepath.FromSlash(artifact.Path)), &track); q != nil {
+			qualities[artifact.Path] = *q
+			alac = alac || q.Codec == "alac"
+		}
+		tracks = append(tracks, track)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if tracks[i].Disc != tracks[j].Disc {
+			return tracks[i].Disc < tracks[j].Disc
+		}
+		return tracks[i].Number < tracks[j].Number
+	})
+
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		job.Tracks = tracks
+	})
+
+	if len(qualities) > 0 && job.Request != nil {
+		recordQuality(jobID, tracks, qualities, newQualityExpectation(*job.Request, obtained, alac))
+	}
+}
+
+func trackFromName(rel string) Track {
+	name := strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	track := Track{Title: name, Path: rel}
+	if m := trackFilePattern.FindStringSubmatch(name); m != nil {
+		track.Disc, _ = strconv.Atoi(m[1])
+		track.Number, _ = strconv.Atoi(m[2])
+		track.Title = m[3]
+	}
+	return track
+}
+
+// probeTrack fills in the track from the file's tags, duration and audio
+// codec and returns its audio stream, leaving the track as it is and
+// returning nil when ffprobe can't read the file
+func probeTrack(file string, track *Track) *AudioQuality {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, cfg.FFprobePath, "-v", "quiet", "-print_format", "json",
+		"-show_format", "-show_streams", "-select_streams", "a:0", file).Output()
+	if err != nil {
+		return nil
+	}
+
+	var probe struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecName        string `json:"codec_name"`
+			SampleRate       string `json:"sample_rate"`
+			Channels         int    `json:"channels"`
+			BitsPerRawSample string `json:"bits_per_raw_sample"`
+			BitsPerSample    int    `json:"bits_per_sample"`
+			BitRate          string `json:"bit_rate"`
+		} `json:"streams"`
+	}
+	if json.Unmarshal(out, &probe) != nil {
+		return nil
+	}
+
+	tags := map[string]string{}
+	for key, value := range probe.Format.Tags {
+		tags[strings.ToLower(key)] = value
+	}
+	if title := tags["title"]; title != "" {
+		track.Title = title
+	}
+	// "3/12" style numbers
+	if number, _, _ := strings.Cut(tags["track"], "/"); number != "" {
+		if n, err := strconv.Atoi(number); err == nil {
+			track.Number = n
+		}
+	}
+	if disc, _, _ := strings.Cut(tags["disc"], "/"); disc != "" {
+		if n, err := strconv.Atoi(disc); err == nil {
+			track.Disc = n
+		}
+	}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		track.Duration = duration
+	}
+	if len(probe.Streams) == 0 {
+		return nil
+	}
+
+	stream := probe.Streams[0]
+	if format, ok := codecFormats[stream.CodecName]; ok {
+		track.Format = format
+	}
+	quality := &AudioQuality{Codec: stream.CodecName, Channels: stream.Channels, BitDepth: stream.BitsPerSample}
+	quality.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+	quality.Bitrate, _ = strconv.Atoi(stream.BitRate)
+	// Lossy codecs have no bit depth
+	if bits, err := strconv.Atoi(stream.BitsPerRawSample); err == nil && bits > 0 {
+		quality.BitDepth = bits
+	}
+	return quality
+}
+
+// String renders the track for chat messages, e.g. "1. Doctor (4:12, ALAC)"
+func (t Track) String() string {
+	var sb strings.Builder
+	if t.Number > 0 {
+		if t.Disc > 1 {
+			fmt.Fprintf(&sb, "%d-", t.Disc)
+		}
+		fmt.Fprintf(&sb, "%d. ", t.Number)
+	}
+	sb.WriteString(t.Title)
+
+	var details []string
+	if t.Duration > 0 {
+		seconds := int(t.Duration + 0.5)
+		details = append(details, fmt.Sprintf("%d:%02d", seconds/60, seconds%60))
+	}
+	if t.Format != "" {
+		details = append(details, t.Format)
+	}
+	if len(details) > 0 {
+		fmt.Fprintf(&sb, " (%s)", strings.Join(details, ", "))
+	}
+	return sb.String()
+}
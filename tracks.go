@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// TrackList selects album tracks by track number ("3"), disc and track
+// number ("2:5") or catalog song ID ("1440857950"). In JSON entries can be
+// numbers or strings.
+type TrackList []string
+
+func (t *TrackList) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("track lists must be a list of track numbers or IDs")
+	}
+
+	list := make(TrackList, 0, len(raw))
+	for _, item := range raw {
+		var s string
+		if err := json.Unmarshal(item, &s); err != nil {
+			var n json.Number
+			if err := json.Unmarshal(item, &n); err != nil {
+				return fmt.Errorf("track lists must be a list of track numbers or IDs")
+			}
+			s = n.String()
+		}
+		list = append(list, strings.TrimSpace(s))
+	}
+	*t = list
+	return nil
+}
+
+// Catalog IDs are much longer than any track number
+const maxTrackNumberDigits = 4
+
+func (t TrackList) validate() error {
+	for _, entry := range t {
+		for _, part := range strings.SplitN(entry, ":", 2) {
+			if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+				return fmt.Errorf("invalid track %q", entry)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether track is selected by any entry of the list
+func (t TrackList) matches(track catalogResource) bool {
+	for _, entry := range t {
+		if disc, number, ok := strings.Cut(entry, ":"); ok {
+			if disc == strconv.Itoa(track.Attributes.DiscNumber) && number == strconv.Itoa(track.Attributes.TrackNumber) {
+				return true
+			}
+			continue
+		}
+		if len(entry) > maxTrackNumberDigits {
+			if entry == track.ID {
+				return true
+			}
+			continue
+		}
+		if entry == strconv.Itoa(track.Attributes.TrackNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTracks applies include and exclude lists to the album tracks. An
+// empty include list selects every track.
+func selectTracks(tracks []catalogResource, include, exclude TrackList) []catalogResource {
+	var selected []catalogResource
+	for _, track := range tracks {
+		if track.Type == "music-videos" {
+			continue
+		}
+		if len(include) > 0 && !include.matches(track) {
+			continue
+		}
+		if exclude.matches(track) {
+			continue
+		}
+		selected = append(selected, track)
+	}
+	return selected
+}
+
+// downloadTargets returns the single-song requests needed to download the
+// selected tracks of an album, or the tracks of an album or playlist a sync
+// hasn't downloaded yet, and req itself otherwise
+func downloadTargets(jobID string, req DownloadRequest) ([]DownloadRequest, error) {
+	selecting := len(req.IncludeTracks) > 0 || len(req.ExcludeTracks) > 0
+	if req.Song || (!selecting && !req.Sync) {
+		return []DownloadRequest{req}, nil
+	}
+
+	link, err := parseAppleMusicURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case link.Type == "playlist" && req.Sync && !selecting:
+	case link.Type != "album" && req.Sync:
+		return nil, fmt.Errorf("sync is only supported for albums and playlists")
+	case link.Type != "album":
+		return nil, fmt.Errorf("track selection is only supported for albums")
+	}
+
+	resource, err := appleMusic.Resource(link.Storefront, link.Type, link.ID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s tracks: %w", link.Type, err)
+	}
+
+	tracks := resource.Relationships.Tracks.Data
+	selected := tracks
+	if selecting {
+		selected = selectTracks(tracks, req.IncludeTracks, req.ExcludeTracks)
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("no tracks left after applying the track selection")
+		}
+
+		message := fmt.Sprintf("Selected %d of %d tracks", len(selected), len(tracks))
+		jobManager.AddEvent(jobID, JobEvent{Type: "tracks_selected", Message: message})
+		jobManager.AppendLog(jobID, message)
+		slog.Info("Selected tracks", "job_id", jobID, "selected", len(selected), "total", len(tracks))
+	}
+	if req.Sync {
+		selected = syncTargets(jobID, req, selected)
+	}
+
+	targets := make([]DownloadRequest, 0, len(selected))
+	for _, track := range selected {
+		target := req
+		target.URL = track.Attributes.URL
+		if target.URL == "" && link.Type == "album" {
+			target.URL = fmt.Sprintf("https://music.apple.com/%s/album/%s?i=%s", link.Storefront, link.ID, track.ID)
+		} else if target.URL == "" {
+			target.URL = fmt.Sprintf("https://music.apple.com/%s/song/%s", link.Storefront, track.ID)
+		}
+		target.Song = true
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Romanization tables. Cyrillic and Greek follow simplified BGN/PCGN and
+// ELOT 743, kana uses Hepburn and Hangul the Revised Romanization without
+// sound change rules. Han characters have no table and are kept as is.
+var cyrillicRomanization = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u", 'ј': "j", 'љ': "lj",
+	'њ': "nj", 'ђ': "dj", 'ћ': "c", 'џ': "dz",
+}
+
+var greekRomanization = map[rune]string{
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i",
+	'θ': "th", 'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x",
+	'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y",
+	'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+	'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o",
+	'ϊ': "i", 'ϋ': "y", 'ΐ': "i", 'ΰ': "y",
+}
+
+var kanaRomanization = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o",
+	'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'ゔ': "vu",
+}
+
+var (
+	hangulInitials = []string{"g", "kk", "n", "d", "tt", "r", "m", "b", "pp", "s", "ss", "", "j", "jj", "ch", "k", "t", "p", "h"}
+	hangulVowels   = []string{"a", "ae", "ya", "yae", "eo", "e", "yeo", "ye", "o", "wa", "wae", "oe", "yo", "u", "wo", "we", "wi", "yu", "eu", "ui", "i"}
+	hangulFinals   = []string{"", "k", "k", "k", "n", "n", "n", "t", "l", "k", "m", "l", "l", "l", "p", "l", "m", "p", "p", "t", "t", "ng", "t", "t", "k", "t", "p", "t"}
+)
+
+// katakanaToHiragana maps katakana onto the hiragana table
+func katakanaToHiragana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヴ' {
+		return r - 0x60
+	}
+	return r
+}
+
+func romanizeRune(r rune) (string, bool) {
+	if r >= 0xAC00 && r <= 0xD7A3 {
+		s := int(r - 0xAC00)
+		return hangulInitials[s/588] + hangulVowels[s%588/28] + hangulFinals[s%28], true
+	}
+
+	lower := unicode.ToLower(r)
+	for _, table := range []map[rune]string{cyrillicRomanization, greekRomanization} {
+		if latin, ok := table[lower]; ok {
+			if lower != r && latin != "" {
+				first, size := utf8.DecodeRuneInString(latin)
+				latin = string(unicode.ToUpper(first)) + latin[size:]
+			}
+			return latin, true
+		}
+	}
+	return "", false
+}
+
+// transliterate romanizes Cyrillic, Greek, Japanese kana and Hangul text
+func transliterate(s string) string {
+	runes := []rune(norm.NFC.String(s))
+	var b strings.Builder
+	doubleNext := false
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch kana := katakanaToHiragana(r); {
+		case kana == 'っ':
+			// Small tsu doubles the next consonant
+			doubleNext = true
+			continue
+		case kana == 'ー':
+			// Long vowel mark, dropped as in common English spellings
+			continue
+		case r == '・':
+			b.WriteRune(' ')
+			continue
+		case kanaRomanization[kana] != "":
+			latin := kanaRomanization[kana]
+			if i+1 < len(runes) {
+				switch next := katakanaToHiragana(runes[i+1]); next {
+				case 'ゃ', 'ゅ', 'ょ':
+					// Contracted sounds: きゃ kya, しゃ sha
+					if strings.HasSuffix(latin, "i") && len(latin) > 1 {
+						latin = strings.TrimSuffix(latin, "i")
+						if !strings.HasSuffix(latin, "sh") && !strings.HasSuffix(latin, "ch") && !strings.HasSuffix(latin, "j") {
+							latin += "y"
+						}
+						latin += kanaRomanization[next][1:]
+						i++
+					}
+				case 'ぁ', 'ぃ', 'ぅ', 'ぇ', 'ぉ':
+					// Extended katakana: ファ fa, ティ ti
+					if len(latin) > 1 {
+						latin = latin[:len(latin)-1] + kanaRomanization[next]
+						i++
+					}
+				}
+			}
+			if doubleNext {
+				if strings.HasPrefix(latin, "ch") {
+					latin = "t" + latin
+				} else if latin != "" && !strings.ContainsRune("aiueo", rune(latin[0])) {
+					latin = latin[:1] + latin
+				}
+				doubleNext = false
+			}
+			b.WriteString(latin)
+			continue
+		}
+
+		doubleNext = false
+		if latin, ok := romanizeRune(r); ok {
+			b.WriteString(latin)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// VerifyPolicy sets how each check of a finished download counts: "off"
+// (or unset) skips it, and problems it finds make the job's verification
+// report "warn" or "fail". Failed verification fails the job.
+type VerifyPolicy struct {
+	// Record the SHA-256 of every file, checking it's not empty and is
+	// the size it was listed with
+	Checksums string `json:"checksums,omitempty"`
+
+	// Decode every audio file completely with ffmpeg
+	Decode string `json:"decode,omitempty"`
+
+	// Title, artist, album and track number tags on every audio file
+	Tags string `json:"tags,omitempty"`
+
+	// Cover art embedded in every audio file or saved next to it
+	Artwork string `json:"artwork,omitempty"`
+
+	// Track durations within DurationTolerance seconds of the catalog's;
+	// a pointer so an override can set 0
+	Duration          string `json:"duration,omitempty"`
+	DurationTolerance *int   `json:"duration_tolerance,omitempty"`
+}
+
+// Results of verification checks and reports, from best to worst
+var verifyResults = []string{"pass", "warn", "fail"}
+
+var verifyLevels = []string{"", "off", "warn", "fail"}
+
+// Longest a file may take to decode
+const decodeTimeout = 10 * time.Minute
+
+func (p VerifyPolicy) validate() error {
+	for name, level := range p.levels() {
+		if !slices.Contains(verifyLevels, level) {
+			return fmt.Errorf("%s must be off, warn or fail", name)
+		}
+	}
+	if p.DurationTolerance != nil && *p.DurationTolerance < 0 {
+		return errors.New("duration_tolerance must not be negative")
+	}
+	return nil
+}
+
+// levels returns the level of each check by name
+func (p VerifyPolicy) levels() map[string]string {
+	return map[string]string{
+		"checksums": p.Checksums,
+		"decode":    p.Decode,
+		"tags":      p.Tags,
+		"artwork":   p.Artwork,
+		"duration":  p.Duration,
+	}
+}
+
+// merge applies the levels set in override on top of the policy
+func (p VerifyPolicy) merge(override *VerifyPolicy) VerifyPolicy {
+	if override == nil {
+		return p
+	}
+	p.Checksums = cmp.Or(override.Checksums, p.Checksums)
+	p.Decode = cmp.Or(override.Decode, p.Decode)
+	p.Tags = cmp.Or(override.Tags, p.Tags)
+	p.Artwork = cmp.Or(override.Artwork, p.Artwork)
+	p.Duration = cmp.Or(override.Duration, p.Duration)
+	if override.DurationTolerance != nil {
+		p.DurationTolerance = override.DurationTolerance
+	}
+	return p
+}
+
+func (p VerifyPolicy) enabled() bool {
+	for _, level := range p.levels() {
+		if level != "" && level != "off" {
+			return true
+		}
+	}
+	return false
+}
+
+// VerificationReport is the outcome of the checks a job's files went
+// through once it downloaded: the worst result among its checks
+type VerificationReport struct {
+	Status string              `json:"status"`
+	Checks []VerificationCheck `json:"checks"`
+}
+
+// VerificationCheck is the result of one check: "pass", or the level the
+// policy gives the check when it found problems, one per file. Checks that
+// couldn't be run, e.g. without the catalog, have an Error and "warn".
+type VerificationCheck struct {
+	Name     string   `json:"name"`
+	Result   string   `json:"result"`
+	Checked  int      `json:"checked"`
+	Problems []string `json:"problems,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (c VerificationCheck) String() string {
+	if c.Error != "" {
+		return fmt.Sprintf("%s: %s", c.Name, c.Error)
+	}
+	return fmt.Sprintf("%s: %d of %d file(s), e.g. %s", c.Name, len(c.Problems), c.Checked, c.Problems[0])
+}
+
+// summary describes the checks with the given result or a worse one
+func (r *VerificationReport) summary(result string) string {
+	var failed []string
+	for _, check := range r.Checks {
+		if slices.Index(verifyResults, check.Result) >= slices.Index(verifyResults, result) {
+			failed = append(failed, check.String())
+		}
+	}
+	return strings.Join(failed, "; ")
+}
+
+// verifier runs the checks of one job on its files
+type verifier struct {
+	job    DownloadStatus
+	policy VerifyPolicy
+
+	// Checksums by artifact path
+	sums map[string]string
+}
+
+// verifyJob runs the checks the request's output profile asks for on the
+// job's files and attaches the report, and the checksums, to the job.
+// Problems are reported in a verification_warning or verification_failed
+// event. Returns nil when no check is enabled.
+func verifyJob(jobID string, req DownloadRequest) *VerificationReport {
+	policy := resolveOutputProfile(req).Verify
+	if !policy.enabled() {
+		return nil
+	}
+	job, exists := jobManager.Snapshot(jobID)
+	if !exists {
+		return nil
+	}
+
+	v := &verifier{job: job, policy: policy, sums: map[string]string{}}
+	report := &VerificationReport{Status: "pass"}
+	for _, check := range []struct {
+		name, level string
+		run         func() (int, []string, error)
+	}{
+		{"checksums", policy.Checksums, v.checksums},
+		{"decode", policy.Decode, v.decode},
+		{"tags", policy.Tags, v.tags},
+		{"artwork", policy.Artwork, v.artwork},
+		{"duration", policy.Duration, v.duration},
+	} {
+		if check.level == "" || check.level == "off" {
+			continue
+		}
+		checked, problems, err := check.run()
+		result := VerificationCheck{Name: check.name, Result: "pass", Checked: checked, Problems: problems}
+		switch {
+		case err != nil:
+			result.Result, result.Error = "warn", err.Error()
+		case len(problems) > 0:
+			result.Result = check.level
+		}
+		for _, problem := range problems {
+			jobManager.AppendLog(jobID, fmt.Sprintf("Verification: %s: %s", check.name, problem))
+		}
+		if slices.Index(verifyResults, result.Result) > slices.Index(verifyResults, report.Status) {
+			report.Status = result.Result
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	jobManager.UpdateJob(jobID, func(job *DownloadStatus) {
+		job.Verification = report
+		job.Artifacts = withChecksums(job.Artifacts, v.sums)
+		job.Extras = withChecksums(job.Extras, v.sums)
+	})
+	jobManager.AppendLog(jobID, fmt.Sprintf("Verification: %s", report.Status))
+	if report.Status != "pass" {
+		event := map[string]string{"warn": "verification_warning", "fail": "verification_failed"}[report.Status]
+		jobManager.AddEvent(jobID, JobEvent{Type: event, Message: report.summary("warn")})
+		slog.Warn("Verification found problems", "job_id", jobID, "status", report.Status, "problems", report.summary("warn"))
+	}
+	return report
+}
+
+func withChecksums(artifacts []Artifact, sums map[string]string) []Artifact {
+	if len(sums) == 0 {
+		return artifacts
+	}
+	artifacts = slices.Clone(artifacts)
+	for i, artifact := range artifacts {
+		if sum, ok := sums[artifact.Path]; ok {
+			artifacts[i].SHA256 = sum
+		}
+	}
+	return artifacts
+}
+
+// audioFiles returns the paths of the job's audio files, relative to
+// DOWNLOADS_DIR
+func (v *verifier) audioFiles() []string {
+	var files []string
+	for _, artifact := range v.job.Artifacts {
+		if artifact.Kind == "audio" {
+			files = append(files, artifact.Path)
+		}
+	}
+	return files
+}
+
+func downloadPath(rel string) string {
+	return filepath.Join(cfg.DownloadsDir, filepath.FromSlash(rel))
+}
+
+func (v *verifier) checksums() (int, []string, error) {
+	artifacts := slices.Concat(v.job.Artifacts, v.job.Extras)
+	var problems []string
+	for _, artifact := range artifacts {
+		sum, size, err := fileChecksum(downloadPath(artifact.Path))
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", artifact.Path, err))
+			continue
+		case size == 0:
+			problems = append(problems, fmt.Sprintf("%s: empty", artifact.Path))
+		case size != artifact.Size:
+			problems = append(problems, fmt.Sprintf("%s: %d bytes, listed with %d", artifact.Path, size, artifact.Size))
+		}
+		v.sums[artifact.Path] = sum
+	}
+	return len(artifacts), problems, nil
+}
+
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+func (v *verifier) decode() (int, []string, error) {
+	files := v.audioFiles()
+	var problems []string
+	for _, rel := range files {
+		err := decodeAudio(downloadPath(rel))
+		if errors.Is(err, exec.ErrNotFound) {
+			return 0, nil, err
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", rel, err))
+		}
+	}
+	return len(files), problems, nil
+}
+
+// decodeAudio decodes the audio of a file without writing it anywhere,
+// failing on the first error ffmpeg reports
+func decodeAudio(file string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), decodeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, cfg.FFmpegPath, "-v", "error", "-nostdin", "-i", file, "-map", "0:a", "-f", "null", "-").CombinedOutput()
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("decoding took longer than %v", decodeTimeout)
+	case err != nil && firstLine != "":
+		return errors.New(firstLine)
+	case err != nil:
+		return err
+	case firstLine != "":
+		return errors.New(firstLine)
+	}
+	return nil
+}
+
+// Tags every audio file should have
+var requiredTags = []string{"title", "artist", "album", "track"}
+
+func (v *verifier) tags() (int, []string, error) {
+	files := v.audioFiles()
+	var problems []string
+	for _, rel := range files {
+		tags, err := readTags(downloadPath(rel))
+		if err != nil {
+			return 0, nil, err
+		}
+		var missing []string
+		for _, tag := range requiredTags {
+			if strings.TrimSpace(tags[tag]) == "" {
+				missing = append(missing, tag)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: no %s tag", rel, strings.Join(missing, ", ")))
+		}
+	}
+	return len(files), problems, nil
+}
+
+func (v *verifier) artwork() (int, []string, error) {
+	// Folders with a cover file
+	covers := map[string]bool{}
+	for _, artifact := range v.job.Artifacts {
+		if artifact.Kind == "artwork" {
+			covers[path.Dir(artifact.Path)] = true
+		}
+	}
+
+	files := v.audioFiles()
+	var problems []string
+	for _, rel := range files {
+		if covers[path.Dir(rel)] {
+			continue
+		}
+		embedded, err := hasEmbeddedArtwork(downloadPath(rel))
+		if err != nil {
+			return 0, nil, err
+		}
+		if !embedded {
+			problems = append(problems, fmt.Sprintf("%s: no cover art", rel))
+		}
+	}
+	return len(files), problems, nil
+}
+
+// hasEmbeddedArtwork reports whether an audio file has a cover image, which
+// ffprobe lists as a video stream
+func hasEmbeddedArtwork(file string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, cfg.FFprobePath, "-v", "quiet", "-select_streams", "v",
+		"-show_entries", "stream=index", "-of", "csv=p=0", file).Output()
+	if err != nil {
+		return false, fmt.Errorf("ffprobe %s: %w", filepath.Base(file), err)
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+func (v *verifier) duration() (int, []string, error) {
+	if v.job.Request == nil || len(v.job.Tracks) == 0 {
+		return 0, nil, nil
+	}
+	catalog, album, err := jobCatalog(*v.job.Request)
+	if err != nil {
+		return 0, nil, fmt.Errorf("catalog lookup failed: %w", err)
+	}
+	expect := qualityExpectation{catalog: catalog, album: album}
+	var tolerance float64
+	if v.policy.DurationTolerance != nil {
+		tolerance = float64(*v.policy.DurationTolerance)
+	}
+
+	checked := 0
+	var problems []string
+	for _, track := range v.job.Tracks {
+		entry := expect.catalogTrack(track)
+		if entry == nil || entry.Attributes.DurationInMillis <= 0 {
+			continue
+		}
+		if track.Duration <= 0 {
+			return 0, nil, errors.New("durations are read with ffprobe")
+		}
+		checked++
+		listed := float64(entry.Attributes.DurationInMillis) / 1000
+		if math.Abs(track.Duration-listed) > tolerance {
+			problems = append(problems, fmt.Sprintf("%s: %.1f s, the catalog lists %.1f s", track.Path, track.Duration, listed))
+		}
+	}
+	if checked == 0 {
+		return 0, nil, errors.New("no track matched the catalog")
+	}
+	return checked, problems, nil
+}
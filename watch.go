@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subdirectories of the watch folder; only files directly in it are picked up
+const (
+	watchProcessingDir = "processing"
+	watchDoneDir       = "done"
+)
+
+// WatchResult is written next to a processed file as <name>.result.json,
+// first when its jobs start and again once they have all finished
+type WatchResult struct {
+	File     string           `json:"file"`
+	Status   string           `json:"status"` // running or finished
+	Jobs     []DownloadStatus `json:"jobs"`
+	Rejected []string         `json:"rejected,omitempty"` // links not queued, with the reason
+	Finished *time.Time       `json:"finished_at,omitempty"`
+}
+
+// watchedFile is a dropped file whose jobs are still running
+type watchedFile struct {
+	name      string
+	jobIDs    []string
+	remaining int
+	rejected  []string
+}
+
+// FolderWatcher polls a directory for dropped .txt and .url files with Apple
+// Music links, for tools that can only write files. A file is picked up once
+// it has stopped changing, moved to processing/ while its jobs run and then
+// to done/, with results written as JSON next to it.
+type FolderWatcher struct {
+	dir string
+
+	mu      sync.Mutex
+	pending map[string]*watchedFile // by job ID
+
+	// Size and modification time of files seen in the last scan
+	seen map[string]os.FileInfo
+}
+
+func newFolderWatcher(dir string) *FolderWatcher {
+	return &FolderWatcher{
+		dir:     dir,
+		pending: map[string]*watchedFile{},
+		seen:    map[string]os.FileInfo{},
+	}
+}
+
+func (fw *FolderWatcher) run() {
+	for _, sub := range []string{watchProcessingDir, watchDoneDir} {
+		if err := os.MkdirAll(filepath.Join(fw.dir, sub), 0o755); err != nil {
+			slog.Error("Failed to create watch folder", "component", "watch", "path", sub, "error", err)
+		}
+	}
+	fw.requeueInterrupted()
+	slog.Info("Watching folder", "component", "watch", "path", fw.dir)
+
+	for {
+		fw.scan()
+		time.Sleep(cfg.WatchInterval)
+	}
+}
+
+// requeueInterrupted moves files left in processing/ by a restart back into
+// the watch folder so they're picked up again
+func (fw *FolderWatcher) requeueInterrupted() {
+	entries, err := os.ReadDir(filepath.Join(fw.dir, watchProcessingDir))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".result.json") {
+			continue
+		}
+		from := filepath.Join(fw.dir, watchProcessingDir, entry.Name())
+		if err := os.Rename(from, filepath.Join(fw.dir, entry.Name())); err != nil {
+			slog.Error("Failed to requeue file", "component", "watch", "file", entry.Name(), "error", err)
+		}
+	}
+}
+
+func (fw *FolderWatcher) scan() {
+	entries, err := os.ReadDir(fw.dir)
+	if err != nil {
+		slog.Error("Failed to read watch folder", "component", "watch", "path", fw.dir, "error", err)
+		return
+	}
+
+	current := map[string]os.FileInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || strings.HasPrefix(name, ".") || (ext != ".txt" && ext != ".url") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		current[name] = info
+
+		// Wait for a file to stop changing, e.g. while it's still syncing
+		previous, ok := fw.seen[name]
+		if !ok || previous.Size() != info.Size() || !previous.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		delete(current, name)
+		fw.process(name)
+	}
+	fw.seen = current
+}
+
+func (fw *FolderWatcher) process(name string) {
+	processing := filepath.Join(fw.dir, watchProcessingDir, name)
+	if err := os.Rename(filepath.Join(fw.dir, name), processing); err != nil {
+		slog.Error("Failed to pick up file", "component", "watch", "file", name, "error", err)
+		return
+	}
+
+	data, err := os.ReadFile(processing)
+	if err != nil {
+		slog.Error("Failed to read file", "component", "watch", "file", name, "error", err)
+		return
+	}
+
+	links := findAppleMusicLinks(string(data))
+	if len(links) == 0 {
+		slog.Info("No Apple Music links in file", "component", "watch", "file", name)
+		fw.finish(&watchedFile{name: name})
+		return
+	}
+
+	file := &watchedFile{name: name}
+	trace := newTrace()
+	fw.mu.Lock()
+	for _, link := range links {
+		req := DownloadRequest{URL: link, Owner: "watch", Trace: trace}
+		if err := prepareRequest(&req); err != nil {
+			file.rejected = append(file.rejected, fmt.Sprintf("%s: %v", link, err))
+			continue
+		}
+		job := startDownload(req)
+		file.jobIDs = append(file.jobIDs, job.ID)
+		file.remaining++
+		fw.pending[job.ID] = file
+	}
+	// Written before any job can finish the file
+	fw.writeResult(file, watchProcessingDir, nil)
+	fw.mu.Unlock()
+
+	slog.Info("Started jobs from file", "component", "watch", "file", name, "jobs", len(file.jobIDs), "rejected", len(file.rejected))
+	if len(file.jobIDs) == 0 {
+		fw.finish(file)
+	}
+}
+
+// jobFinished is registered with the job manager to complete files
+func (fw *FolderWatcher) jobFinished(job DownloadStatus) {
+	fw.mu.Lock()
+	file, exists := fw.pending[job.ID]
+	if !exists {
+		fw.mu.Unlock()
+		return
+	}
+	delete(fw.pending, job.ID)
+	file.remaining--
+	done := file.remaining == 0
+	fw.mu.Unlock()
+
+	if done {
+		fw.finish(file)
+	}
+}
+
+// finish moves the file and its result to done/
+func (fw *FolderWatcher) finish(file *watchedFile) {
+	from := filepath.Join(fw.dir, watchProcessingDir, file.name)
+	if err := os.Rename(from, filepath.Join(fw.dir, watchDoneDir, file.name)); err != nil {
+		slog.Error("Failed to move file", "component", "watch", "file", file.name, "to", watchDoneDir, "error", err)
+	}
+	os.Remove(from + ".result.json")
+
+	now := time.Now()
+	fw.writeResult(file, watchDoneDir, &now)
+}
+
+func (fw *FolderWatcher) writeResult(file *watchedFile, dir string, finished *time.Time) {
+	result := WatchResult{
+		File:     file.name,
+		Status:   "running",
+		Jobs:     []DownloadStatus{},
+		Rejected: file.rejected,
+		Finished: finished,
+	}
+	if finished != nil {
+		result.Status = "finished"
+	}
+	for _, id := range file.jobIDs {
+		if job, exists := jobManager.Snapshot(id); exists {
+			job.Logs = nil
+			result.Jobs = append(result.Jobs, job)
+		}
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return
+	}
+	path := filepath.Join(fw.dir, dir, file.name+".result.json")
+	tmp := filepath.Join(fw.dir, dir, "."+file.name+".result.json.tmp")
+	err = os.WriteFile(tmp, data, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		slog.Error("Failed to write result", "component", "watch", "file", file.name, "error", err)
+	}
+}
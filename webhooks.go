@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const webhooksFile = "webhooks.json"
+
+// webhookEvents are the events endpoints can subscribe to
+var webhookEvents = []string{
+	"job.completed",
+	"job.failed",
+	"job.cancelled",
+	"job.expired",
+	"job.interrupted",
+	"batch.wave_completed",
+	"batch.completed",
+}
+
+// Webhook is a registered endpoint receiving the events matching its filter.
+// Deliveries are signed with its secret when one is set.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	HasSecret bool      `json:"has_secret"`
+	CreatedAt time.Time `json:"created_at"`
+
+	secret string
+}
+
+// storedWebhook is the persisted form, which keeps the secret
+type storedWebhook struct {
+	Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// webhookInput is the body of POST /webhooks and PUT /webhooks/{id}
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Format string   `json:"format"`
+	Secret *string  `json:"secret"`
+}
+
+func (in webhookInput) validate() error {
+	if !isHTTPURL(in.URL) {
+		return errors.New("url must be an http or https URL")
+	}
+	if !slices.Contains(eventFormats, in.Format) {
+		return errors.New("format must be json or cloudevents")
+	}
+	for _, pattern := range in.Events {
+		if !validEventPattern(pattern) {
+			return fmt.Errorf("unknown event %q", pattern)
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validEventPattern accepts an event name, a "job.*" style prefix or "*"
+func validEventPattern(pattern string) bool {
+	for _, event := range webhookEvents {
+		if eventMatches(pattern, event) {
+			return true
+		}
+	}
+	return false
+}
+
+func eventMatches(pattern, event string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(event, prefix)
+	}
+	return pattern == event
+}
+
+// subscribed reports whether the webhook wants event; no filter means every
+// event
+func (wh Webhook) subscribed(event string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, pattern := range wh.Events {
+		if eventMatches(pattern, event) {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookStore struct {
+	mu       sync.RWMutex
+	webhooks map[string]*Webhook
+}
+
+var webhookStore = &WebhookStore{webhooks: map[string]*Webhook{}}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+func (ws *WebhookStore) load() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	var saved []storedWebhook
+	if err := loadState(webhooksFile, &saved); err != nil {
+		return err
+	}
+	for _, s := range saved {
+		wh := s.Webhook
+		wh.secret = s.Secret
+		ws.webhooks[wh.ID] = &wh
+	}
+	return nil
+}
+
+// save persists the webhooks; callers hold ws.mu
+func (ws *WebhookStore) save() error {
+	saved := []storedWebhook{}
+	for _, wh := range ws.webhooks {
+		saved = append(saved, storedWebhook{Webhook: *wh, Secret: wh.secret})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	return saveState(webhooksFile, saved)
+}
+
+func (ws *WebhookStore) List() []Webhook {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	list := []Webhook{}
+	for _, wh := range ws.webhooks {
+		list = append(list, *wh)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (ws *WebhookStore) Get(id string) (Webhook, bool) {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	wh, exists := ws.webhooks[id]
+	if !exists {
+		return Webhook{}, false
+	}
+	return *wh, true
+}
+
+func (ws *WebhookStore) Create(in webhookInput) (Webhook, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	wh := &Webhook{
+		ID:        uuid.New().String(),
+		CreatedAt: time.Now(),
+	}
+	wh.update(in)
+	ws.webhooks[wh.ID] = wh
+	return *wh, ws.save()
+}
+
+// Update replaces a webhook's URL and filter. The secret is kept unless the
+// input sets one; an empty secret removes it.
+func (ws *WebhookStore) Update(id string, in webhookInput) (Webhook, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	wh, exists := ws.webhooks[id]
+	if !exists {
+		return Webhook{}, errWebhookNotFound
+	}
+	wh.update(in)
+	return *wh, ws.save()
+}
+
+func (ws *WebhookStore) Delete(id string) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if _, exists := ws.webhooks[id]; !exists {
+		return errWebhookNotFound
+	}
+	delete(ws.webhooks, id)
+	return ws.save()
+}
+
+func (wh *Webhook) update(in webhookInput) {
+	wh.URL = in.URL
+	wh.Events = in.Events
+	wh.Format = in.Format
+	if in.Secret != nil {
+		wh.secret = *in.Secret
+	}
+	wh.HasSecret = wh.secret != ""
+}
+
+// signPayload returns the X-Webhook-Signature value for body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postJSON delivers payload to a webhook URL, treating any non-2xx response
+// as a failure. The trace headers of the originating request are forwarded.
+func postJSON(url string, payload any, trace TraceContext) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postBody(url, body, nil, trace)
+}
+
+// postBody is postJSON for an encoded body, with extra or overriding headers
+func postBody(url string, body []byte, header http.Header, trace TraceContext) error {
+	return postBodyWith(httpClient, url, body, header, trace)
+}
+
+func postBodyWith(client *http.Client, url string, body []byte, header http.Header, trace TraceContext) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "apple-music-dl-http-wrapper")
+	trace.apply(req.Header)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// handleWebhooks lists (GET) and registers (POST) webhooks
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		webhooks := webhookStore.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"webhooks": webhooks,
+			"count":    len(webhooks),
+		})
+
+	case http.MethodPost:
+		in, ok := decodeWebhookInput(w, r)
+		if !ok {
+			return
+		}
+		wh, err := webhookStore.Create(in)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save webhooks", "error", err)
+			http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(wh)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhook reads (GET), replaces (PUT) and removes (DELETE) a webhook
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len("/webhooks/"):]
+
+	var wh Webhook
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		var exists bool
+		if wh, exists = webhookStore.Get(id); !exists {
+			err = errWebhookNotFound
+		}
+
+	case http.MethodPut:
+		in, ok := decodeWebhookInput(w, r)
+		if !ok {
+			return
+		}
+		wh, err = webhookStore.Update(id, in)
+
+	case http.MethodDelete:
+		if err = webhookStore.Delete(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, errWebhookNotFound) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save webhooks", "error", err)
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wh)
+}
+
+func decodeWebhookInput(w http.ResponseWriter, r *http.Request) (webhookInput, bool) {
+	var in webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return in, false
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid webhook: %v", err), http.StatusBadRequest)
+		return in, false
+	}
+	return in, true
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket keepalive: pings are sent this often, and a connection that
+// hasn't answered within wsPongWait is closed
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+	wsMaxMessage   = 1 << 20
+)
+
+var jobFeedEventTypes = []string{"created", "status", "progress", "log", "finished"}
+
+var wsUpgrader = websocket.Upgrader{CheckOrigin: wsOriginAllowed}
+
+// wsOriginAllowed accepts clients that aren't browsers, pages served from
+// the API's own host and origins in WS_ALLOWED_ORIGINS
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(cfg.WSAllowedOrigins, "*") || slices.Contains(cfg.WSAllowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsCommand is a message from a WebSocket client: "submit" with a download
+// request, or "cancel" with a job ID. Ref is echoed in the reply.
+type wsCommand struct {
+	Type    string          `json:"type"`
+	Ref     string          `json:"ref,omitempty"`
+	Request json.RawMessage `json:"request,omitempty"`
+	JobID   string          `json:"job_id,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+}
+
+// wsReply answers a command: "submitted", "cancelled" or "error"
+type wsReply struct {
+	Type     string    `json:"type"`
+	Ref      string    `json:"ref,omitempty"`
+	JobID    string    `json:"job_id,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Editions []Edition `json:"editions,omitempty"`
+}
+
+// handleWebSocket serves GET /ws: job events are pushed as they happen,
+// optionally filtered by ?events= and ?job_id=, and jobs can be submitted
+// and cancelled over the same connection
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	eventTypes := splitList(r.URL.Query().Get("events"))
+	for _, eventType := range eventTypes {
+		if !slices.Contains(jobFeedEventTypes, eventType) {
+			http.Error(w, fmt.Sprintf("Unknown event type %q", eventType), http.StatusBadRequest)
+			return
+		}
+	}
+	jobIDs := splitList(r.URL.Query().Get("job_id"))
+	wanted := func(ev JobFeedEvent) bool {
+		return (len(eventTypes) == 0 || slices.Contains(eventTypes, ev.Type)) &&
+			(len(jobIDs) == 0 || slices.Contains(jobIDs, ev.JobID))
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the request
+		return
+	}
+	defer conn.Close()
+
+	events := jobFeed.subscribe()
+	defer jobFeed.unsubscribe(events)
+
+	replies := make(chan wsReply)
+	closed := make(chan struct{})
+	defer close(closed)
+	readDone := make(chan struct{})
+
+	key, _ := findAPIKey(r)
+	lang := requestLanguage(r)
+	go func() {
+		defer close(readDone)
+		conn.SetReadLimit(wsMaxMessage)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var reply wsReply
+			var cmd wsCommand
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				reply = wsReply{Type: "error", Error: fmt.Sprintf("Invalid command: %v", err)}
+			} else if key.ReadOnly {
+				reply = wsReply{Type: "error", Ref: cmd.Ref, Error: "API key is read-only"}
+			} else {
+				reply = runWSCommand(r, cmd)
+			}
+			if reply.Error != "" {
+				reply.Error = translateError(lang, reply.Error)
+			}
+			select {
+			case replies <- reply:
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var message any
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Client is too slow"), time.Now().Add(wsWriteWait))
+				return
+			}
+			if !wanted(ev) {
+				continue
+			}
+			message = ev
+		case reply := <-replies:
+			message = reply
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+			continue
+		case <-readDone:
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteJSON(message); err != nil {
+			return
+		}
+	}
+}
+
+// runWSCommand submits or cancels a job for a WebSocket client
+func runWSCommand(r *http.Request, cmd wsCommand) wsReply {
+	reply := wsReply{Ref: cmd.Ref}
+	fail := func(message string) wsReply {
+		reply.Type, reply.Error = "error", message
+		return reply
+	}
+
+	switch cmd.Type {
+	case "submit":
+		if len(cmd.Request) == 0 {
+			return fail("request is required")
+		}
+		var req DownloadRequest
+		if err := json.Unmarshal(cmd.Request, &req); err != nil {
+			return fail(fmt.Sprintf("Invalid request: %v", err))
+		}
+		if req.Template != "" {
+			if err := applyTemplate(&req, cmd.Request); err != nil {
+				return fail(err.Error())
+			}
+		}
+		if len(req.URLs) > 0 {
+			return fail("Batches must be submitted with POST /download")
+		}
+		if req.scheduled() {
+			return fail("Scheduled downloads must be submitted with POST /download")
+		}
+		req.Owner = requestOwner(r, "anonymous")
+		req.APIKey = apiKeyName(r)
+		if err := prepareRequest(&req); err != nil {
+			return fail(err.Error())
+		}
+		editions, err := resolveEdition(&req)
+		if err != nil {
+			return fail(fmt.Sprintf("Edition lookup failed: %v", err))
+		}
+		if editions != nil {
+			reply.Editions = editions
+			return fail("Album has multiple editions")
+		}
+
+		job := startDownload(req)
+		slog.InfoContext(r.Context(), "Job submitted over WebSocket", "job_id", job.ID, "owner", req.Owner)
+		reply.Type, reply.JobID = "submitted", job.ID
+		return reply
+
+	case "cancel":
+		if cmd.JobID == "" {
+			return fail("Job ID is required")
+		}
+		switch err := cancelJob(cmd.JobID, cmd.Reason); {
+		case errors.Is(err, errJobNotFound):
+			return fail("Job not found")
+		case errors.Is(err, errJobNotRunning):
+			return fail("Job is not running")
+		}
+		auditLog.recordRequest(r, AuditEntry{Action: "job.cancelled", JobID: cmd.JobID, Detail: reasonDetail(cmd.Reason)})
+		reply.Type, reply.JobID = "cancelled", cmd.JobID
+		return reply
+
+	default:
+		return fail("Unknown command")
+	}
+}